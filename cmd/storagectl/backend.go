@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gerladeno/media-storage-service/internal/stack"
+	"github.com/gerladeno/media-storage-service/internal/storage"
+	"github.com/gerladeno/media-storage-service/pkg/client"
+	"github.com/joho/godotenv"
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/bbolt"
+)
+
+// backend is what the file commands run against, the HTTP API or the storage itself.
+type backend interface {
+	Upload(ctx context.Context, noteUUID, name string, r io.Reader) (*client.UploadResult, error)
+	Download(ctx context.Context, noteUUID, fileID string) (io.ReadCloser, error)
+	List(ctx context.Context, q client.Query) ([]*client.File, error)
+	Delete(ctx context.Context, noteUUID, fileID string) error
+	Transfer(ctx context.Context, noteUUID, fileID, targetNoteUUID string, move bool) (*client.File, error)
+	Export(ctx context.Context, noteUUID, format string, w io.Writer) error
+	Import(ctx context.Context, noteUUID string, archive *os.File) ([]client.ImportResult, error)
+	Close() error
+}
+
+type httpBackend struct {
+	client *client.Client
+}
+
+func newHTTPBackend(apiURL, token, apiKey string) (*httpBackend, error) {
+	var opts []client.Option
+	switch {
+	case apiKey != "":
+		opts = append(opts, client.WithAPIKey(apiKey))
+	case token != "":
+		opts = append(opts, client.WithToken(token))
+	}
+	c, err := client.New(apiURL, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &httpBackend{client: c}, nil
+}
+
+func (b *httpBackend) Upload(ctx context.Context, noteUUID, name string, r io.Reader) (*client.UploadResult, error) {
+	return b.client.Upload(ctx, noteUUID, name, r)
+}
+
+func (b *httpBackend) Download(ctx context.Context, noteUUID, fileID string) (io.ReadCloser, error) {
+	return b.client.Download(ctx, noteUUID, fileID)
+}
+
+func (b *httpBackend) List(ctx context.Context, q client.Query) ([]*client.File, error) {
+	var files []*client.File
+	err := b.client.ListAll(ctx, q, func(f *client.File) error {
+		files = append(files, f)
+		return nil
+	})
+	return files, err
+}
+
+func (b *httpBackend) Delete(ctx context.Context, noteUUID, fileID string) error {
+	return b.client.Delete(ctx, noteUUID, fileID)
+}
+
+func (b *httpBackend) Transfer(ctx context.Context, noteUUID, fileID, targetNoteUUID string, move bool) (*client.File, error) {
+	if move {
+		return b.client.Move(ctx, noteUUID, fileID, targetNoteUUID)
+	}
+	return b.client.Copy(ctx, noteUUID, fileID, targetNoteUUID)
+}
+
+func (b *httpBackend) Export(ctx context.Context, noteUUID, format string, w io.Writer) error {
+	archive, err := b.client.Export(ctx, noteUUID, format)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	_, err = io.Copy(w, archive)
+	return err
+}
+
+func (b *httpBackend) Import(ctx context.Context, noteUUID string, archive *os.File) ([]client.ImportResult, error) {
+	return b.client.Import(ctx, noteUUID, archive)
+}
+
+func (b *httpBackend) Close() error {
+	return nil
+}
+
+// directBackend uses the storage and the index the service is configured with. The index
+// database is locked while the service runs, so it's meant for maintenance windows.
+// Events of the changes are queued in the outbox and delivered once the service is back.
+type directBackend struct {
+	db      *bbolt.DB
+	service *storage.Service
+	// owner is recorded on the uploaded and imported files, the API takes it from the token.
+	owner string
+}
+
+func newDirectBackend(owner string) (*directBackend, error) {
+	_ = godotenv.Load()
+	log := logrus.New()
+	log.SetOutput(os.Stderr)
+	log.SetLevel(logrus.WarnLevel)
+
+	db, err := openDB(os.Getenv("DB_PATH"))
+	if err != nil {
+		return nil, err
+	}
+	// the same stack as the service's, so the changes reach its replicas, caches and cold tier.
+	// Nothing runs the replication queue here, the replicas are written right away instead
+	files, err := stack.FromEnv(log, db, "storagectl", false)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &directBackend{db: db, service: files.Service, owner: owner}, nil
+}
+
+func openDB(path string) (*bbolt.DB, error) {
+	if path == "" {
+		path = "data/storage.db"
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create db directory. err: %w", err)
+	}
+	db, err := bbolt.Open(path, 0o600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open db %s, is the service running? err: %w", path, err)
+	}
+	return db, nil
+}
+
+func (b *directBackend) Upload(ctx context.Context, noteUUID, name string, r io.Reader) (*client.UploadResult, error) {
+	f, err := b.service.Create(ctx, noteUUID, storage.CreateFileDTO{Name: name, Owner: b.owner, Reader: r})
+	if err != nil {
+		return nil, err
+	}
+	return &client.UploadResult{ID: f.ID, Name: f.Name, Size: f.Size, Checksum: f.Checksum}, nil
+}
+
+func (b *directBackend) Download(ctx context.Context, noteUUID, fileID string) (io.ReadCloser, error) {
+	reader, _, err := b.service.OpenFile(ctx, noteUUID, fileID)
+	return reader, err
+}
+
+func (b *directBackend) List(ctx context.Context, q client.Query) ([]*client.File, error) {
+	result, err := b.service.Search(ctx, storage.SearchQuery{
+		Text:          q.Text,
+		NoteUUIDs:     q.NoteUUIDs,
+		Name:          q.Name,
+		ContentType:   q.ContentType,
+		Tags:          q.Tags,
+		MinSize:       q.MinSize,
+		MaxSize:       q.MaxSize,
+		CreatedAfter:  q.From,
+		CreatedBefore: q.To,
+	})
+	if err != nil {
+		return nil, err
+	}
+	files := make([]*client.File, 0, len(result.Files))
+	for _, e := range result.Files {
+		f := client.File(*e)
+		files = append(files, &f)
+	}
+	return files, nil
+}
+
+func (b *directBackend) Delete(ctx context.Context, noteUUID, fileID string) error {
+	return b.service.Delete(ctx, noteUUID, fileID)
+}
+
+func (b *directBackend) Transfer(ctx context.Context, noteUUID, fileID, targetNoteUUID string, move bool) (*client.File, error) {
+	transfer := b.service.Copy
+	if move {
+		transfer = b.service.Move
+	}
+	f, err := transfer(ctx, noteUUID, fileID, targetNoteUUID)
+	if err != nil {
+		return nil, err
+	}
+	return &client.File{
+		NoteUUID:    targetNoteUUID,
+		ID:          f.ID,
+		Name:        f.Name,
+		Size:        f.Size,
+		ContentType: f.ContentType,
+		Owner:       f.Owner,
+		ModifiedAt:  f.ModifiedAt,
+	}, nil
+}
+
+func (b *directBackend) Export(ctx context.Context, noteUUID, format string, w io.Writer) error {
+	if format == "" {
+		format = storage.ArchiveZip
+	}
+	archive, err := b.service.NewArchive(ctx, noteUUID, storage.ArchiveOptions{Format: format, Manifest: true})
+	if err != nil {
+		return err
+	}
+	return archive.WriteTo(ctx, w)
+}
+
+func (b *directBackend) Import(ctx context.Context, noteUUID string, archive *os.File) ([]client.ImportResult, error) {
+	info, err := archive.Stat()
+	if err != nil {
+		return nil, err
+	}
+	imported, err := b.service.ImportZip(ctx, noteUUID, b.owner, archive, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	results := make([]client.ImportResult, 0, len(imported))
+	for _, r := range imported {
+		results = append(results, client.ImportResult(r))
+	}
+	return results, nil
+}
+
+func (b *directBackend) Close() error {
+	return b.db.Close()
+}
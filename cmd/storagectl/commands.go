@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gerladeno/media-storage-service/internal/storage"
+	"github.com/gerladeno/media-storage-service/pkg/client"
+)
+
+type fileResult struct {
+	NoteUUID string `json:"note_uuid"`
+	ID       string `json:"id"`
+	Name     string `json:"name,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet(name, flag.ContinueOnError)
+}
+
+func requireNote(noteUUID string) error {
+	if noteUUID == "" {
+		return errors.New("-note is required")
+	}
+	return nil
+}
+
+func uploadCmd(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("upload")
+	noteUUID := fs.String("note", "", "note uuid")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := requireNote(*noteUUID); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("no files to upload")
+	}
+	results := make([]fileResult, 0, fs.NArg())
+	for _, path := range fs.Args() {
+		result := fileResult{NoteUUID: *noteUUID, Name: filepath.Base(path)}
+		uploaded, err := a.uploadFile(ctx, *noteUUID, path)
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			result.ID, result.Size = uploaded.ID, uploaded.Size
+		}
+		results = append(results, result)
+	}
+	return a.printFileResults(results)
+}
+
+func (a *app) uploadFile(ctx context.Context, noteUUID, path string) (*client.UploadResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return a.backend.Upload(ctx, noteUUID, filepath.Base(path), f)
+}
+
+func downloadCmd(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("download")
+	noteUUID := fs.String("note", "", "note uuid")
+	out := fs.String("out", "-", "output path, - for stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := requireNote(*noteUUID); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("exactly one file id is required")
+	}
+	reader, err := a.backend.Download(ctx, *noteUUID, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	return writeOutput(*out, func(w io.Writer) error {
+		_, err := io.Copy(w, reader)
+		return err
+	})
+}
+
+func listCmd(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("list")
+	var (
+		notes notesFlag
+		tags  = tagsFlag{}
+		q     client.Query
+	)
+	fs.Var(&notes, "note", "note uuid, repeatable")
+	fs.Var(tags, "tag", "key:value tag the files must have, repeatable")
+	fs.StringVar(&q.Text, "q", "", "text to search in the file contents")
+	fs.StringVar(&q.Name, "name", "", "name substring or glob pattern")
+	fs.StringVar(&q.ContentType, "type", "", "content type prefix")
+	fs.Int64Var(&q.MinSize, "min-size", 0, "minimum size in bytes")
+	fs.Int64Var(&q.MaxSize, "max-size", 0, "maximum size in bytes")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	q.NoteUUIDs, q.Tags = notes, tags
+	files, err := a.backend.List(ctx, q)
+	if err != nil {
+		return err
+	}
+	if files == nil {
+		files = []*client.File{}
+	}
+	rows := make([][]string, 0, len(files))
+	for _, f := range files {
+		rows = append(rows, []string{
+			f.NoteUUID, f.ID, f.Name, formatSize(f.Size), f.ContentType, f.CreatedAt.Format(time.RFC3339),
+		})
+	}
+	return a.out.print(files, []string{"NOTE", "ID", "NAME", "SIZE", "TYPE", "CREATED"}, rows)
+}
+
+func deleteCmd(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("delete")
+	noteUUID := fs.String("note", "", "note uuid")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := requireNote(*noteUUID); err != nil {
+		return err
+	}
+	results := make([]fileResult, 0, fs.NArg())
+	for _, id := range fs.Args() {
+		result := fileResult{NoteUUID: *noteUUID, ID: id}
+		if err := a.backend.Delete(ctx, *noteUUID, id); err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return a.printFileResults(results)
+}
+
+func transferCmd(move bool) command {
+	name := "copy"
+	if move {
+		name = "move"
+	}
+	return func(ctx context.Context, a *app, args []string) error {
+		fs := newFlagSet(name)
+		noteUUID := fs.String("note", "", "source note uuid")
+		target := fs.String("to", "", "target note uuid")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		if err := requireNote(*noteUUID); err != nil {
+			return err
+		}
+		if *target == "" {
+			return errors.New("-to is required")
+		}
+		results := make([]fileResult, 0, fs.NArg())
+		for _, id := range fs.Args() {
+			result := fileResult{NoteUUID: *target, ID: id}
+			f, err := a.backend.Transfer(ctx, *noteUUID, id, *target, move)
+			if err != nil {
+				result.Error = err.Error()
+			} else {
+				result.Name, result.Size = f.Name, f.Size
+			}
+			results = append(results, result)
+		}
+		return a.printFileResults(results)
+	}
+}
+
+func exportCmd(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("export")
+	noteUUID := fs.String("note", "", "note uuid")
+	format := fs.String("format", storage.ArchiveZip, "archive format, zip or tar.gz")
+	out := fs.String("out", "", "output path, - for stdout, <note>.<format> by default")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := requireNote(*noteUUID); err != nil {
+		return err
+	}
+	if *out == "" {
+		*out = *noteUUID + "." + *format
+	}
+	return writeOutput(*out, func(w io.Writer) error {
+		return a.backend.Export(ctx, *noteUUID, *format, w)
+	})
+}
+
+func importCmd(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("import")
+	noteUUID := fs.String("note", "", "note uuid")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := requireNote(*noteUUID); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("exactly one zip archive is required")
+	}
+	archive, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	imported, err := a.backend.Import(ctx, *noteUUID, archive)
+	if err != nil {
+		return err
+	}
+	results := make([]fileResult, 0, len(imported))
+	for _, r := range imported {
+		name := r.Name
+		if name == "" {
+			name = r.Entry
+		}
+		results = append(results, fileResult{NoteUUID: *noteUUID, ID: r.ID, Name: name, Size: r.Size, Error: r.Error})
+	}
+	return a.printFileResults(results)
+}
+
+func verifyCmd(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("verify")
+	var notes notesFlag
+	fs.Var(&notes, "note", "note uuid, repeatable, all notes by default")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	direct, err := a.direct("verify")
+	if err != nil {
+		return err
+	}
+	results, err := direct.service.Verify(ctx, notes)
+	if err != nil {
+		return err
+	}
+	if results == nil {
+		results = []storage.VerifyResult{}
+	}
+	failed := false
+	rows := make([][]string, 0, len(results))
+	for _, r := range results {
+		if r.Status == storage.VerifyMismatch || r.Status == storage.VerifyFailed {
+			failed = true
+		}
+		rows = append(rows, []string{r.NoteUUID, r.FileID, r.Name, r.Status, r.Error})
+	}
+	if err = a.out.print(results, []string{"NOTE", "ID", "NAME", "STATUS", "ERROR"}, rows); err != nil {
+		return err
+	}
+	if failed {
+		return errFailed
+	}
+	return nil
+}
+
+func reconcileCmd(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("reconcile")
+	var notes notesFlag
+	fs.Var(&notes, "note", "note uuid, repeatable, all notes by default")
+	dryRun := fs.Bool("dry-run", false, "only report what would change")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	direct, err := a.direct("reconcile")
+	if err != nil {
+		return err
+	}
+	results, err := direct.service.Reconcile(ctx, notes, *dryRun)
+	if err != nil {
+		return err
+	}
+	if results == nil {
+		results = []storage.ReconcileResult{}
+	}
+	failed := false
+	rows := make([][]string, 0, len(results))
+	for _, r := range results {
+		failed = failed || r.Error != ""
+		rows = append(rows, []string{r.NoteUUID, r.FileID, r.Name, r.Action, r.Error})
+	}
+	if err = a.out.print(results, []string{"NOTE", "ID", "NAME", "ACTION", "ERROR"}, rows); err != nil {
+		return err
+	}
+	if failed {
+		return errFailed
+	}
+	return nil
+}
+
+func gcCmd(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("gc")
+	dryRun := fs.Bool("dry-run", false, "only report the notes that would be released")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	direct, err := a.direct("gc")
+	if err != nil {
+		return err
+	}
+	removed, err := direct.service.GC(ctx, *dryRun)
+	if err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(removed))
+	for _, noteUUID := range removed {
+		rows = append(rows, []string{noteUUID})
+	}
+	return a.out.print(removed, []string{"RELEASED NOTE"}, rows)
+}
+
+type noteStats struct {
+	NoteUUID string `json:"note_uuid"`
+	Files    int    `json:"files"`
+	Bytes    int64  `json:"bytes"`
+}
+
+type statsReport struct {
+	Notes  []*noteStats     `json:"notes"`
+	Files  int              `json:"files"`
+	Bytes  int64            `json:"bytes"`
+	ByType map[string]int64 `json:"bytes_by_type"`
+}
+
+func statsCmd(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("stats")
+	var notes notesFlag
+	fs.Var(&notes, "note", "note uuid, repeatable, all notes by default")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	files, err := a.backend.List(ctx, client.Query{NoteUUIDs: notes})
+	if err != nil {
+		return err
+	}
+	report := statsReport{Notes: []*noteStats{}, ByType: map[string]int64{}}
+	byNote := make(map[string]*noteStats)
+	for _, f := range files {
+		ns, ok := byNote[f.NoteUUID]
+		if !ok {
+			ns = &noteStats{NoteUUID: f.NoteUUID}
+			byNote[f.NoteUUID] = ns
+			report.Notes = append(report.Notes, ns)
+		}
+		ns.Files++
+		ns.Bytes += f.Size
+		report.Files++
+		report.Bytes += f.Size
+		report.ByType[f.ContentType] += f.Size
+	}
+	sort.Slice(report.Notes, func(i, j int) bool {
+		return report.Notes[i].Bytes > report.Notes[j].Bytes
+	})
+	rows := make([][]string, 0, len(report.Notes)+1)
+	for _, ns := range report.Notes {
+		rows = append(rows, []string{ns.NoteUUID, strconv.Itoa(ns.Files), formatSize(ns.Bytes)})
+	}
+	rows = append(rows, []string{"TOTAL", strconv.Itoa(report.Files), formatSize(report.Bytes)})
+	return a.out.print(report, []string{"NOTE", "FILES", "SIZE"}, rows)
+}
+
+func (a *app) direct(name string) (*directBackend, error) {
+	direct, ok := a.backend.(*directBackend)
+	if !ok {
+		return nil, fmt.Errorf("%s runs against the backend, use -direct", name)
+	}
+	return direct, nil
+}
+
+func (a *app) printFileResults(results []fileResult) error {
+	failed := false
+	rows := make([][]string, 0, len(results))
+	for _, r := range results {
+		failed = failed || r.Error != ""
+		rows = append(rows, []string{r.NoteUUID, r.ID, r.Name, formatSize(r.Size), r.Error})
+	}
+	if err := a.out.print(results, []string{"NOTE", "ID", "NAME", "SIZE", "ERROR"}, rows); err != nil {
+		return err
+	}
+	if failed {
+		return errFailed
+	}
+	return nil
+}
+
+// writeOutput passes write a file at path, or stdout for -. A partially written file is removed.
+func writeOutput(path string, write func(io.Writer) error) error {
+	if path == "-" {
+		return write(os.Stdout)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err = write(f); err != nil {
+		_ = f.Close()
+		_ = os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,157 @@
+// Command storagectl runs day-to-day operations against the media storage service,
+// either through its HTTP API or directly against the configured backend.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+const usage = `usage: storagectl [flags] <command> [command flags] [args]
+
+commands:
+  upload     -note <uuid> <file>...            upload files to a note
+  download   -note <uuid> [-out path] <id>     download a file, to stdout by default
+  list       [-note <uuid>]... [filters]       list files
+  delete     -note <uuid> <id>...              delete files
+  copy       -note <uuid> -to <uuid> <id>...   copy files to another note
+  move       -note <uuid> -to <uuid> <id>...   move files to another note
+  export     -note <uuid> [-format zip|tar.gz] [-out path]
+  import     -note <uuid> <archive.zip>
+  verify     [-note <uuid>]...                 check stored contents against their checksums (-direct)
+  reconcile  [-note <uuid>]... [-dry-run]      bring the index in line with the storage (-direct)
+  gc         [-dry-run]                        release the storage of empty notes (-direct)
+  stats      [-note <uuid>]...                 print file counts and sizes
+
+flags:
+`
+
+// errFailed reports that a command has already printed its failures.
+var errFailed = errors.New("some operations failed")
+
+type command func(ctx context.Context, app *app, args []string) error
+
+var commands = map[string]command{
+	"upload":    uploadCmd,
+	"download":  downloadCmd,
+	"list":      listCmd,
+	"delete":    deleteCmd,
+	"copy":      transferCmd(false),
+	"move":      transferCmd(true),
+	"export":    exportCmd,
+	"import":    importCmd,
+	"verify":    verifyCmd,
+	"reconcile": reconcileCmd,
+	"gc":        gcCmd,
+	"stats":     statsCmd,
+}
+
+type app struct {
+	backend backend
+	out     *printer
+}
+
+func main() {
+	var (
+		apiURL = flag.String("api", envOr("STORAGE_API_URL", "http://localhost:3000"), "base url of the storage api")
+		token  = flag.String("token", os.Getenv("STORAGE_TOKEN"), "user access token")
+		apiKey = flag.String("api-key", os.Getenv("STORAGE_API_KEY"), "api key, used instead of the token")
+		direct = flag.Bool("direct", false, "use the backend configured by MINIO_* and DB_PATH instead of the api")
+		owner  = flag.String("owner", "", "owner of the uploaded files with -direct")
+		output = flag.String("o", "table", "output format, table or json")
+	)
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+	out, err := newPrinter(os.Stdout, *output)
+	if err != nil {
+		fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	var b backend
+	if *direct {
+		b, err = newDirectBackend(*owner)
+	} else {
+		b, err = newHTTPBackend(*apiURL, *token, *apiKey)
+	}
+	if err != nil {
+		fatal(err)
+	}
+	defer b.Close()
+	if err = cmd(ctx, &app{backend: b, out: out}, flag.Args()[1:]); err != nil {
+		b.Close()
+		switch {
+		case errors.Is(err, flag.ErrHelp):
+			os.Exit(2)
+		case errors.Is(err, errFailed):
+			os.Exit(1)
+		}
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "storagectl:", err)
+	os.Exit(1)
+}
+
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// notesFlag collects the values of a repeated -note flag.
+type notesFlag []string
+
+func (f *notesFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *notesFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// tagsFlag collects repeated key:value pairs.
+type tagsFlag map[string]string
+
+func (f tagsFlag) String() string {
+	pairs := make([]string, 0, len(f))
+	for k, v := range f {
+		pairs = append(pairs, k+":"+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f tagsFlag) Set(value string) error {
+	k, v, _ := strings.Cut(value, ":")
+	if k == "" {
+		return fmt.Errorf("invalid tag %q, expected key:value", value)
+	}
+	f[k] = v
+	return nil
+}
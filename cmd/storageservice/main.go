@@ -8,20 +8,39 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
 	"syscall"
 	"time"
 
+	"github.com/gerladeno/media-storage-service/internal/apikey"
+	"github.com/gerladeno/media-storage-service/internal/audit"
+	"github.com/gerladeno/media-storage-service/internal/auth"
+	"github.com/gerladeno/media-storage-service/internal/broker"
+	"github.com/gerladeno/media-storage-service/internal/eventsink"
+	"github.com/gerladeno/media-storage-service/internal/grpcapi"
 	"github.com/gerladeno/media-storage-service/internal/rest"
+	"github.com/gerladeno/media-storage-service/internal/share"
+	"github.com/gerladeno/media-storage-service/internal/stack"
 	"github.com/gerladeno/media-storage-service/internal/storage"
+	"github.com/gerladeno/media-storage-service/internal/webhook"
 	"github.com/gerladeno/media-storage-service/pkg/common"
+	"github.com/gerladeno/media-storage-service/pkg/metrics"
 	"github.com/joho/godotenv"
 	"github.com/sirupsen/logrus"
+	"go.etcd.io/bbolt"
+	"google.golang.org/grpc"
 )
 
-const httpPort = 3000
+const (
+	httpPort         = 3000
+	defaultGRPCPort  = 9090
+	eventHistorySize = 1024
+)
 
 //go:embed public.pub
 var publicSigningKey []byte
@@ -40,52 +59,245 @@ func main() {
 	}
 
 	var (
-		minioEndpoint  = os.Getenv("MINIO_ENDPOINT")
-		minioAccessKey = os.Getenv("MINIO_ACCESS_KEY")
-		minioSecretKey = os.Getenv("MINIO_SECRET_KEY")
-		host           = "localhost"
+		dbPath      = os.Getenv("DB_PATH")
+		natsURL     = os.Getenv("NATS_URL")
+		natsSubject = os.Getenv("NATS_SUBJECT")
+		eventsFile  = os.Getenv("EVENTS_FILE")
+		grpcPort    = defaultGRPCPort
+		host        = "localhost"
 	)
+	if port := os.Getenv("GRPC_PORT"); port != "" {
+		var err error
+		if grpcPort, err = strconv.Atoi(port); err != nil {
+			log.Panicf("invalid GRPC_PORT %q", port)
+		}
+	}
 	ctx := context.Background()
-	fileStorage, err := storage.New(log, minioEndpoint, minioAccessKey, minioSecretKey)
+	db, err := openDB(dbPath)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer db.Close()
+	keyStore, err := apikey.NewStore(log, db)
+	if err != nil {
+		log.Panic(err)
+	}
+	files, err := stack.FromEnv(log, db, host, true)
+	if err != nil {
+		log.Panic(err)
+	}
+	fileService, tiered, replicated := files.Service, files.Tiered, files.Replicated
+	integrity := metrics.NewIntegrity(host).AutoRegister()
+	fileService.SetIntegrityMetrics(integrity)
+	scrubOptions, err := scrubOptionsFromEnv()
+	if err != nil {
+		log.Panic(err)
+	}
+	scrubber := storage.NewScrubber(log, fileService, scrubOptions, integrity)
+	reapInterval, err := reapIntervalFromEnv()
+	if err != nil {
+		log.Panic(err)
+	}
+	reaper := storage.NewReaper(log, fileService, reapInterval)
+	events := broker.New(eventHistorySize)
+	fileService.AddPublisher(events)
+	webhookStore, err := webhook.NewStore(db)
+	if err != nil {
+		log.Panic(err)
+	}
+	webhooks := webhook.NewDispatcher(log, webhookStore, metrics.NewHTTPOut(host).AutoRegister())
+	outbox, err := storage.NewOutbox(log, db)
+	if err != nil {
+		log.Panic(err)
+	}
+	outbox.AddSink(webhooks)
+	if natsURL != "" {
+		if natsSubject == "" {
+			natsSubject = "media-storage"
+		}
+		natsSink, err := eventsink.NewNATS(natsURL, natsSubject)
+		if err != nil {
+			log.Panic(err)
+		}
+		outbox.AddSink(natsSink)
+	}
+	if eventsFile != "" {
+		fileSink, err := eventsink.NewFile(eventsFile)
+		if err != nil {
+			log.Panic(err)
+		}
+		outbox.AddSink(fileSink)
+	}
+	// writes a crash interrupted are left pending until the next start
+	if recovered, err := fileService.RecoverWrites(ctx); err != nil {
+		log.Errorf("failed to recover pending writes. err: %v", err)
+	} else if recovered > 0 {
+		log.Infof("finished %d writes and deletes interrupted by the last shutdown", recovered)
+	}
+	// files stored before the index existed are only searchable once indexed
+	if backfilled, err := fileService.BackfillIndex(ctx); err != nil {
+		log.Errorf("failed to backfill search index. err: %v", err)
+	} else if backfilled > 0 {
+		log.Infof("indexed %d stored files into the empty search index", backfilled)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go webhooks.Run(ctx)
+	go outbox.Run(ctx)
+	go scrubber.Run(ctx)
+	go reaper.Run(ctx)
+	if tiered != nil {
+		go tiered.Run(ctx)
+	}
+	var replication rest.Replication
+	if replicated != nil {
+		go replicated.Run(ctx)
+		replication = replicated
+	}
+	auditSink, err := auditSinkFromEnv(db.Path())
 	if err != nil {
 		log.Panic(err)
 	}
-	fileService, err := storage.NewService(log, fileStorage)
+	defer auditSink.Close()
+	auditLog := audit.NewLog(log)
+	auditLog.AddSink(auditSink)
+	shareStore, err := share.NewStore(log, db)
 	if err != nil {
 		log.Panic(err)
 	}
-	router := rest.NewRouter(log, fileService, mustGetPrivateKey(publicSigningKey), host, version)
-	if err = startServer(ctx, router, log); err != nil {
+	publicKey := mustGetPrivateKey(publicSigningKey)
+	router := rest.NewRouter(log, fileService, keyStore, webhooks, events, scrubber, replication, auditLog,
+		shareStore, publicKey, host, version)
+	grpcServer := grpcapi.NewServer(log, fileService, auth.New(keyStore, publicKey), auditLog)
+	if err = startServer(ctx, router, grpcServer, grpcPort, log); err != nil {
 		log.Panic(err)
 	}
 }
 
-func startServer(ctx context.Context, router http.Handler, log *logrus.Logger) error {
+// startServer serves the REST and the gRPC APIs until a signal or a failure of either of them
+// and then shuts both down gracefully.
+func startServer(ctx context.Context, router http.Handler, grpcServer *grpc.Server, grpcPort int, log *logrus.Logger) error {
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", grpcPort))
+	if err != nil {
+		return fmt.Errorf("failed to listen on grpc port %d. err: %w", grpcPort, err)
+	}
 	log.Infof("starting server on port %d", httpPort)
+	// there's no write timeout, the routes time out themselves and the event streams must not
 	s := &http.Server{
 		Addr:              fmt.Sprintf(":%d", httpPort),
 		ReadHeaderTimeout: 30 * time.Second,
 		ReadTimeout:       30 * time.Second,
-		WriteTimeout:      30 * time.Second,
 		Handler:           router,
 	}
-	errCh := make(chan error)
+	errCh := make(chan error, 2)
 	go func() {
-		if err := s.ListenAndServe(); err != nil && errors.Is(err, http.ErrServerClosed) {
+		if err := s.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errCh <- err
+		}
+	}()
+	go func() {
+		log.Infof("starting grpc server on port %d", grpcPort)
+		if err := grpcServer.Serve(lis); err != nil {
 			errCh <- err
 		}
 	}()
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGHUP, syscall.SIGQUIT)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM)
 	select {
-	case err := <-errCh:
-		return err
+	case err = <-errCh:
 	case <-sigCh:
 	}
 	log.Info("terminating...")
 	gfCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
-	return s.Shutdown(gfCtx)
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	if shutdownErr := s.Shutdown(gfCtx); err == nil {
+		err = shutdownErr
+	}
+	select {
+	case <-stopped:
+	case <-gfCtx.Done():
+		grpcServer.Stop()
+	}
+	return err
+}
+
+// scrubOptionsFromEnv reads SCRUB_INTERVAL (a duration), SCRUB_RATE (bytes per second)
+// and SCRUB_QUARANTINE, falling back to the defaults.
+func scrubOptionsFromEnv() (storage.ScrubOptions, error) {
+	opts := storage.DefaultScrubOptions()
+	if value := os.Getenv("SCRUB_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			return opts, fmt.Errorf("invalid SCRUB_INTERVAL %q", value)
+		}
+		opts.Interval = interval
+	}
+	if value := os.Getenv("SCRUB_RATE"); value != "" {
+		rate, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || rate < 0 {
+			return opts, fmt.Errorf("invalid SCRUB_RATE %q", value)
+		}
+		opts.Rate = rate
+	}
+	opts.Quarantine = os.Getenv("SCRUB_QUARANTINE") == "true"
+	return opts, nil
+}
+
+// auditSinkFromEnv writes the audit log to AUDIT_FILE or, unless set, to audit.log next to the db,
+// rotating it after AUDIT_MAX_BYTES and keeping AUDIT_MAX_FILES rotated files.
+func auditSinkFromEnv(dbPath string) (*audit.FileSink, error) {
+	path := os.Getenv("AUDIT_FILE")
+	if path == "" {
+		path = filepath.Join(filepath.Dir(dbPath), "audit.log")
+	}
+	var (
+		maxBytes int64
+		maxFiles int
+		err      error
+	)
+	if value := os.Getenv("AUDIT_MAX_BYTES"); value != "" {
+		if maxBytes, err = strconv.ParseInt(value, 10, 64); err != nil || maxBytes <= 0 {
+			return nil, fmt.Errorf("invalid AUDIT_MAX_BYTES %q", value)
+		}
+	}
+	if value := os.Getenv("AUDIT_MAX_FILES"); value != "" {
+		if maxFiles, err = strconv.Atoi(value); err != nil || maxFiles <= 0 {
+			return nil, fmt.Errorf("invalid AUDIT_MAX_FILES %q", value)
+		}
+	}
+	return audit.NewFileSink(path, maxBytes, maxFiles)
+}
+
+// reapIntervalFromEnv reads REAPER_INTERVAL, how often the expired files are removed.
+func reapIntervalFromEnv() (time.Duration, error) {
+	value := os.Getenv("REAPER_INTERVAL")
+	if value == "" {
+		return time.Minute, nil
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		return 0, fmt.Errorf("invalid REAPER_INTERVAL %q", value)
+	}
+	return interval, nil
+}
+
+func openDB(path string) (*bbolt.DB, error) {
+	if path == "" {
+		path = "data/storage.db"
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create db directory. err: %w", err)
+	}
+	db, err := bbolt.Open(path, 0o600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open db %s. err: %w", path, err)
+	}
+	return db, nil
 }
 
 func GetLogger(verbose bool) *logrus.Logger {
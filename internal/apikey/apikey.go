@@ -0,0 +1,243 @@
+package apikey
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/bbolt"
+)
+
+const (
+	ScopeFilesRead  = "files:read"
+	ScopeFilesWrite = "files:write"
+	ScopeAdmin      = "admin"
+
+	tokenPrefix = "msk_"
+)
+
+var keysBucket = []byte("api_keys")
+
+var ErrInvalidKey = errors.New("err invalid api key")
+
+var knownScopes = map[string]struct{}{
+	ScopeFilesRead:  {},
+	ScopeFilesWrite: {},
+	ScopeAdmin:      {},
+}
+
+type Key struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	NoteUUID  string     `json:"note_uuid,omitempty"`
+	Owner     string     `json:"owner,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+type CreateKeyDTO struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	NoteUUID  string     `json:"note_uuid"`
+	Owner     string     `json:"owner"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// HasScope reports whether the key was granted the scope. The admin scope implies all others.
+func (k *Key) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *Key) active(now time.Time) bool {
+	if k.RevokedAt != nil {
+		return false
+	}
+	return k.ExpiresAt == nil || now.Before(*k.ExpiresAt)
+}
+
+// storedKey is the persisted form of a key, the secret itself is never stored.
+type storedKey struct {
+	Key
+	Hash string `json:"hash"`
+}
+
+type Store struct {
+	log *logrus.Entry
+	db  *bbolt.DB
+}
+
+func NewStore(log *logrus.Logger, db *bbolt.DB) (*Store, error) {
+	err := db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(keysBucket)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to init api keys bucket. err: %w", err)
+	}
+	return &Store{
+		log: log.WithField("module", "apikey"),
+		db:  db,
+	}, nil
+}
+
+// Create stores a new key and returns it together with the plain token, which is shown only once.
+func (s *Store) Create(_ context.Context, dto CreateKeyDTO) (*Key, string, error) {
+	if dto.Name == "" {
+		return nil, "", apperror.BadRequestError("name is required")
+	}
+	if len(dto.Scopes) == 0 {
+		return nil, "", apperror.BadRequestError("at least one scope is required")
+	}
+	for _, scope := range dto.Scopes {
+		if _, ok := knownScopes[scope]; !ok {
+			return nil, "", apperror.BadRequestError(fmt.Sprintf("unknown scope %q", scope))
+		}
+	}
+	now := time.Now().UTC()
+	if dto.ExpiresAt != nil && !dto.ExpiresAt.After(now) {
+		return nil, "", apperror.BadRequestError("expires_at must be in the future")
+	}
+	id, err := randomString(8, hex.EncodeToString)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := randomString(32, base64.RawURLEncoding.EncodeToString)
+	if err != nil {
+		return nil, "", err
+	}
+	stored := storedKey{
+		Key: Key{
+			ID:        id,
+			Name:      dto.Name,
+			Scopes:    dto.Scopes,
+			NoteUUID:  dto.NoteUUID,
+			Owner:     dto.Owner,
+			CreatedAt: now,
+			ExpiresAt: dto.ExpiresAt,
+		},
+		Hash: hashSecret(secret),
+	}
+	if err = s.put(&stored); err != nil {
+		return nil, "", err
+	}
+	s.log.Infof("api key %s (%s) created", id, dto.Name)
+	return &stored.Key, tokenPrefix + id + "." + secret, nil
+}
+
+func (s *Store) List(_ context.Context) ([]*Key, error) {
+	keys := make([]*Key, 0)
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(keysBucket).ForEach(func(_, v []byte) error {
+			var stored storedKey
+			if err := json.Unmarshal(v, &stored); err != nil {
+				return err
+			}
+			keys = append(keys, &stored.Key)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list api keys. err: %w", err)
+	}
+	return keys, nil
+}
+
+func (s *Store) Revoke(_ context.Context, id string) error {
+	stored, err := s.get(id)
+	if err != nil {
+		return err
+	}
+	if stored.RevokedAt != nil {
+		return nil
+	}
+	now := time.Now().UTC()
+	stored.RevokedAt = &now
+	if err = s.put(stored); err != nil {
+		return err
+	}
+	s.log.Infof("api key %s revoked", id)
+	return nil
+}
+
+// Authenticate resolves a plain token to an active key.
+func (s *Store) Authenticate(_ context.Context, token string) (*Key, error) {
+	id, secret, ok := strings.Cut(strings.TrimPrefix(token, tokenPrefix), ".")
+	if !ok || id == "" || secret == "" {
+		return nil, ErrInvalidKey
+	}
+	stored, err := s.get(id)
+	switch {
+	case err == nil:
+	case errors.Is(err, apperror.ErrNotFound):
+		return nil, ErrInvalidKey
+	default:
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(stored.Hash), []byte(hashSecret(secret))) != 1 {
+		return nil, ErrInvalidKey
+	}
+	if !stored.active(time.Now()) {
+		return nil, ErrInvalidKey
+	}
+	return &stored.Key, nil
+}
+
+func (s *Store) get(id string) (*storedKey, error) {
+	var stored *storedKey
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket(keysBucket).Get([]byte(id))
+		if v == nil {
+			return apperror.ErrNotFound
+		}
+		stored = &storedKey{}
+		return json.Unmarshal(v, stored)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get api key %s. err: %w", id, err)
+	}
+	return stored, nil
+}
+
+func (s *Store) put(stored *storedKey) error {
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return fmt.Errorf("failed to marshal api key. err: %w", err)
+	}
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(keysBucket).Put([]byte(stored.ID), data)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save api key %s. err: %w", stored.ID, err)
+	}
+	return nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomString(n int, encode func([]byte) string) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate random bytes. err: %w", err)
+	}
+	return encode(b), nil
+}
@@ -0,0 +1,146 @@
+package apikey
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/bbolt"
+)
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	db, err := bbolt.Open(filepath.Join(t.TempDir(), "storage.db"), 0o600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	store, err := NewStore(log, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestCreate(t *testing.T) {
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	tests := []struct {
+		name    string
+		dto     CreateKeyDTO
+		invalid bool
+	}{
+		{name: "valid", dto: CreateKeyDTO{Name: "ci", Scopes: []string{ScopeFilesRead}, ExpiresAt: &future}},
+		{name: "no name", dto: CreateKeyDTO{Scopes: []string{ScopeFilesRead}}, invalid: true},
+		{name: "no scopes", dto: CreateKeyDTO{Name: "ci"}, invalid: true},
+		{name: "unknown scope", dto: CreateKeyDTO{Name: "ci", Scopes: []string{"files:delete"}}, invalid: true},
+		{name: "expired", dto: CreateKeyDTO{Name: "ci", Scopes: []string{ScopeAdmin}, ExpiresAt: &past}, invalid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore(t)
+			key, token, err := store.Create(context.Background(), tt.dto)
+			var appErr *apperror.AppError
+			if tt.invalid {
+				if !errors.As(err, &appErr) {
+					t.Fatalf("got %v, want a bad request", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(token, tokenPrefix+key.ID+".") {
+				t.Fatalf("token %q doesn't carry the key id %s", token, key.ID)
+			}
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	tests := []struct {
+		name string
+		// token turns the issued token into the presented one
+		token func(issued string) string
+		// prepare changes the stored key before it's presented
+		prepare func(t *testing.T, store *Store, key *Key)
+		valid   bool
+	}{
+		{name: "issued token", valid: true},
+		{name: "wrong secret", token: func(issued string) string { return issued + "x" }},
+		{name: "unknown id", token: func(issued string) string { return tokenPrefix + "0000." + strings.Split(issued, ".")[1] }},
+		{name: "no secret", token: func(issued string) string { return strings.Split(issued, ".")[0] }},
+		{name: "empty", token: func(string) string { return "" }},
+		{name: "revoked", prepare: func(t *testing.T, store *Store, key *Key) {
+			if err := store.Revoke(context.Background(), key.ID); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{name: "expired", prepare: func(t *testing.T, store *Store, key *Key) {
+			stored, err := store.get(key.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expired := time.Now().Add(-time.Minute)
+			stored.ExpiresAt = &expired
+			if err = store.put(stored); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore(t)
+			ctx := context.Background()
+			key, token, err := store.Create(ctx, CreateKeyDTO{Name: "ci", Scopes: []string{ScopeFilesRead}, NoteUUID: "note"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.prepare != nil {
+				tt.prepare(t, store, key)
+			}
+			if tt.token != nil {
+				token = tt.token(token)
+			}
+			got, err := store.Authenticate(ctx, token)
+			if !tt.valid {
+				if !errors.Is(err, ErrInvalidKey) {
+					t.Fatalf("got %v, want ErrInvalidKey", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ID != key.ID || got.NoteUUID != "note" {
+				t.Fatalf("got key %+v, want %+v", got, key)
+			}
+		})
+	}
+}
+
+func TestHasScope(t *testing.T) {
+	tests := []struct {
+		scopes []string
+		scope  string
+		want   bool
+	}{
+		{scopes: []string{ScopeFilesRead}, scope: ScopeFilesRead, want: true},
+		{scopes: []string{ScopeFilesRead}, scope: ScopeFilesWrite},
+		{scopes: []string{ScopeFilesRead}, scope: ScopeAdmin},
+		{scopes: []string{ScopeAdmin}, scope: ScopeFilesWrite, want: true},
+	}
+	for _, tt := range tests {
+		key := &Key{Scopes: tt.scopes}
+		if got := key.HasScope(tt.scope); got != tt.want {
+			t.Errorf("%v has %s: got %v, want %v", tt.scopes, tt.scope, got, tt.want)
+		}
+	}
+}
@@ -2,11 +2,24 @@ package apperror
 
 import (
 	"errors"
+	"math"
 	"net/http"
+	"strconv"
 )
 
 func HandleError(w http.ResponseWriter, err error) {
 	if err != nil {
+		var unavailable *UnavailableError
+		if errors.As(err, &unavailable) {
+			seconds := int(math.Ceil(unavailable.RetryAfter.Seconds()))
+			if seconds < 1 {
+				seconds = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write(ErrUnavailable.Marshal())
+			return
+		}
 		var appErr *AppError
 		if errors.As(err, &appErr) {
 			if errors.Is(err, ErrNotFound) {
@@ -15,12 +28,31 @@ func HandleError(w http.ResponseWriter, err error) {
 				return
 			} else if errors.Is(err, ErrAlreadyExist) {
 				w.WriteHeader(http.StatusConflict)
-				_, _ = w.Write(ErrNotFound.Marshal())
+				_, _ = w.Write(ErrAlreadyExist.Marshal())
+				return
+			} else if errors.Is(err, ErrForbidden) {
+				w.WriteHeader(http.StatusForbidden)
+				_, _ = w.Write(ErrForbidden.Marshal())
+				return
+			} else if errors.Is(err, ErrUnavailable) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				_, _ = w.Write(ErrUnavailable.Marshal())
+				return
+			} else if errors.Is(err, ErrGone) {
+				w.WriteHeader(http.StatusGone)
+				_, _ = w.Write(ErrGone.Marshal())
+				return
+			} else if errors.Is(err, ErrLocked) {
+				w.WriteHeader(http.StatusLocked)
+				_, _ = w.Write(ErrLocked.Marshal())
+				return
+			} else if errors.Is(err, ErrChecksumMismatch) {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				_, _ = w.Write(ErrChecksumMismatch.Marshal())
 				return
 			}
-			err := err.(*AppError)
 			w.WriteHeader(http.StatusBadRequest)
-			_, _ = w.Write(err.Marshal())
+			_, _ = w.Write(appErr.Marshal())
 			return
 		}
 		w.WriteHeader(418)
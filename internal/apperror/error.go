@@ -3,11 +3,20 @@ package apperror
 import (
 	"encoding/json"
 	"fmt"
+	"time"
 )
 
 var (
 	ErrNotFound     = NewAppError("not found", "FS-000010", "")
 	ErrAlreadyExist = NewAppError("already exists", "FS-000011", "")
+	ErrForbidden    = NewAppError("forbidden", "FS-000012", "")
+	// ErrChecksumMismatch means the contents don't match the checksum they were sent or stored with.
+	ErrChecksumMismatch = NewAppError("checksum mismatch", "FS-000013", "")
+	ErrUnavailable      = NewAppError("storage unavailable", "FS-000014", "")
+	// ErrGone means the file existed but has expired.
+	ErrGone = NewAppError("gone", "FS-000015", "")
+	// ErrLocked means the file is under a retention lock or legal hold and can't be deleted or overwritten.
+	ErrLocked = NewAppError("locked", "FS-000016", "")
 )
 
 type AppError struct {
@@ -40,6 +49,18 @@ func (e *AppError) Marshal() []byte {
 	return bytes
 }
 
+// UnavailableError means a dependency is temporarily down and the request may be retried later.
+type UnavailableError struct {
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *UnavailableError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *UnavailableError) Unwrap() error { return ErrUnavailable }
+
 func UnauthorizedError(message string) *AppError {
 	return NewAppError(message, "FS-000003", "")
 }
@@ -0,0 +1,125 @@
+// Package audit records who accessed or changed which file, when and with what outcome.
+package audit
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	ActionDownload = "file.download"
+	ActionList     = "file.list"
+	ActionSearch   = "file.search"
+	ActionChanges  = "file.changes"
+	ActionUpload   = "file.upload"
+	ActionUpdate   = "file.update"
+	ActionDelete   = "file.delete"
+	ActionCopy     = "file.copy"
+	ActionMove     = "file.move"
+	ActionArchive  = "note.archive"
+	ActionImport   = "note.import"
+	ActionLock     = "lock.update"
+
+	ActionShareCreate   = "share.create"
+	ActionShareList     = "share.list"
+	ActionShareRevoke   = "share.revoke"
+	ActionShareDownload = "share.download"
+)
+
+const (
+	OutcomeSuccess = "success"
+	OutcomePartial = "partial"
+	OutcomeDenied  = "denied"
+	OutcomeFailure = "failure"
+)
+
+// ErrNotQueryable is returned by Query when no sink can be searched.
+var ErrNotQueryable = errors.New("err audit log is not queryable")
+
+type Entry struct {
+	Time           time.Time `json:"time"`
+	UserID         string    `json:"user_id,omitempty"`
+	RequestID      string    `json:"request_id,omitempty"`
+	IP             string    `json:"ip,omitempty"`
+	Action         string    `json:"action"`
+	NoteUUID       string    `json:"note_uuid,omitempty"`
+	FileID         string    `json:"file_id,omitempty"`
+	TargetNoteUUID string    `json:"target_note_uuid,omitempty"`
+	ShareID        string    `json:"share_id,omitempty"`
+	Outcome        string    `json:"outcome"`
+	Status         int       `json:"status,omitempty"`
+	Error          string    `json:"error,omitempty"`
+}
+
+// Query selects entries, the empty fields match any entry.
+type Query struct {
+	UserID   string
+	NoteUUID string
+	FileID   string
+	ShareID  string
+	Action   string
+	Outcome  string
+	From     time.Time
+	To       time.Time
+	Limit    int
+}
+
+func (q Query) matches(e *Entry) bool {
+	return (q.UserID == "" || e.UserID == q.UserID) &&
+		(q.NoteUUID == "" || e.NoteUUID == q.NoteUUID) &&
+		(q.FileID == "" || e.FileID == q.FileID) &&
+		(q.ShareID == "" || e.ShareID == q.ShareID) &&
+		(q.Action == "" || e.Action == q.Action) &&
+		(q.Outcome == "" || e.Outcome == q.Outcome) &&
+		(q.From.IsZero() || !e.Time.Before(q.From)) &&
+		(q.To.IsZero() || e.Time.Before(q.To))
+}
+
+// Sink stores the entries, e.g. in a file or an external log collector.
+type Sink interface {
+	Write(ctx context.Context, e Entry) error
+}
+
+// Querier is implemented by sinks that can search the entries they stored.
+type Querier interface {
+	Query(ctx context.Context, q Query) ([]Entry, error)
+}
+
+// Log hands every entry to all its sinks.
+type Log struct {
+	log   *logrus.Entry
+	sinks []Sink
+}
+
+func NewLog(log *logrus.Logger) *Log {
+	return &Log{log: log.WithField("module", "audit")}
+}
+
+func (l *Log) AddSink(sink Sink) {
+	l.sinks = append(l.sinks, sink)
+}
+
+// Record stores an entry. A sink failing doesn't fail the audited request, it's logged instead.
+func (l *Log) Record(ctx context.Context, e Entry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	for _, sink := range l.sinks {
+		if err := sink.Write(ctx, e); err != nil {
+			l.log.Errorf("failed to write audit entry %s of request %s. err: %v", e.Action, e.RequestID, err)
+		}
+	}
+}
+
+// Query searches the first sink that can be searched, newest entries first.
+func (l *Log) Query(ctx context.Context, q Query) ([]Entry, error) {
+	for _, sink := range l.sinks {
+		if querier, ok := sink.(Querier); ok {
+			return querier.Query(ctx, q)
+		}
+	}
+	return nil, ErrNotQueryable
+}
@@ -0,0 +1,57 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+type failingSink struct{}
+
+func (failingSink) Write(context.Context, Entry) error {
+	return errors.New("collector unavailable")
+}
+
+func TestLog(t *testing.T) {
+	tests := []struct {
+		name string
+		// file adds a file sink after the failing one
+		file bool
+		err  error
+	}{
+		{name: "queryable", file: true},
+		{name: "not queryable", err: ErrNotQueryable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := logrus.New()
+			log.SetOutput(io.Discard)
+			auditLog := NewLog(log)
+			// a failing sink doesn't keep the entry from the others
+			auditLog.AddSink(failingSink{})
+			if tt.file {
+				sink, err := NewFileSink(filepath.Join(t.TempDir(), "audit.log"), 0, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer sink.Close()
+				auditLog.AddSink(sink)
+			}
+			auditLog.Record(context.Background(), Entry{UserID: "u1", Action: ActionDownload, Outcome: OutcomeSuccess})
+			found, err := auditLog.Query(context.Background(), Query{UserID: "u1"})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if tt.err != nil {
+				return
+			}
+			if len(found) != 1 || found[0].Time.IsZero() {
+				t.Fatalf("got %+v, want the entry with its time set", found)
+			}
+		})
+	}
+}
@@ -0,0 +1,279 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+const (
+	defaultMaxBytes = 100 << 20
+	defaultMaxFiles = 10
+	defaultLimit    = 100
+)
+
+// FileSink appends the entries to a JSON lines file. Once the file grows over maxBytes it's renamed
+// to path.1, the older files shift to path.2 and so on, and only maxFiles of them are kept.
+// Entries are synced to disk before Write returns, the writes that come while a sync runs
+// share the next one instead of syncing one by one under the lock.
+type FileSink struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	maxFiles int
+	file     *os.File
+	size     int64
+	// written and synced count the entries, syncing is set while a writer syncs the file
+	// without the lock and the others wait on cond for it.
+	written uint64
+	synced  uint64
+	syncing bool
+	cond    *sync.Cond
+}
+
+// NewFileSink opens the audit file at path, the zero maxBytes and maxFiles pick the defaults.
+func NewFileSink(path string, maxBytes int64, maxFiles int) (*FileSink, error) {
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxBytes
+	}
+	if maxFiles <= 0 {
+		maxFiles = defaultMaxFiles
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create audit directory. err: %w", err)
+	}
+	s := &FileSink{path: path, maxBytes: maxBytes, maxFiles: maxFiles}
+	s.cond = sync.NewCond(&s.mu)
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit file. err: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to stat audit file. err: %w", err)
+	}
+	s.file, s.size = f, info.Size()
+	return nil
+}
+
+func (s *FileSink) Write(_ context.Context, e Entry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit entry. err: %w", err)
+	}
+	data = append(data, '\n')
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		if s.file == nil {
+			return errors.New("audit file is closed")
+		}
+		if s.size == 0 || s.size+int64(len(data)) <= s.maxBytes {
+			break
+		}
+		// the file is rotated once the sync running on it is done
+		if s.syncing {
+			s.cond.Wait()
+			continue
+		}
+		if err = s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(data)
+	s.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write audit entry. err: %w", err)
+	}
+	s.written++
+	return s.sync(s.written)
+}
+
+// sync returns once the first n entries are synced, syncing the file itself unless
+// another writer already does. Called with the lock held.
+func (s *FileSink) sync(n uint64) error {
+	for s.synced < n {
+		if s.syncing {
+			s.cond.Wait()
+			continue
+		}
+		if s.file == nil {
+			return errors.New("audit file is closed")
+		}
+		s.syncing = true
+		f, written := s.file, s.written
+		s.mu.Unlock()
+		err := f.Sync()
+		s.mu.Lock()
+		s.syncing = false
+		s.cond.Broadcast()
+		if err != nil {
+			return fmt.Errorf("failed to sync audit file. err: %w", err)
+		}
+		if written > s.synced {
+			s.synced = written
+		}
+	}
+	return nil
+}
+
+// closeFile syncs and closes the file once no writer syncs it. Called with the lock held.
+func (s *FileSink) closeFile() error {
+	for s.syncing {
+		s.cond.Wait()
+	}
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Sync()
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	s.file = nil
+	if err == nil {
+		s.synced = s.written
+	}
+	return err
+}
+
+func (s *FileSink) rotate() error {
+	if err := s.closeFile(); err != nil {
+		return fmt.Errorf("failed to close audit file. err: %w", err)
+	}
+	if err := os.Remove(s.rotated(s.maxFiles)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove old audit file. err: %w", err)
+	}
+	for i := s.maxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(s.rotated(i), s.rotated(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to rotate audit file. err: %w", err)
+		}
+	}
+	if err := os.Rename(s.path, s.rotated(1)); err != nil {
+		return fmt.Errorf("failed to rotate audit file. err: %w", err)
+	}
+	return s.open()
+}
+
+func (s *FileSink) rotated(i int) string {
+	return s.path + "." + strconv.Itoa(i)
+}
+
+// Query reads the current and the rotated files and returns the latest matching entries, newest first.
+func (s *FileSink) Query(ctx context.Context, q Query) ([]Entry, error) {
+	if q.Limit <= 0 {
+		q.Limit = defaultLimit
+	}
+	readers, err := s.snapshot()
+	defer func() {
+		for _, r := range readers {
+			_ = r.Close()
+		}
+	}()
+	if err != nil {
+		return nil, err
+	}
+	found := &latest{limit: q.Limit}
+	for _, r := range readers {
+		if err = scan(ctx, r, q, found); err != nil {
+			return nil, err
+		}
+	}
+	return found.newestFirst(), nil
+}
+
+// snapshot opens the files oldest first, so they can be read without blocking writes.
+// Open files are still read in full after a rotation renames them, and the current one
+// is read up to its size at the time of the snapshot.
+func (s *FileSink) snapshot() ([]io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	readers := make([]io.ReadCloser, 0, s.maxFiles+1)
+	for i := s.maxFiles; i >= 0; i-- {
+		path := s.path
+		if i > 0 {
+			path = s.rotated(i)
+		}
+		f, err := os.Open(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return readers, fmt.Errorf("failed to open audit file. err: %w", err)
+		}
+		if i > 0 {
+			readers = append(readers, f)
+			continue
+		}
+		readers = append(readers, struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(f, s.size), f})
+	}
+	return readers, nil
+}
+
+// latest keeps the last limit entries added in a ring.
+type latest struct {
+	entries []Entry
+	next    int
+	limit   int
+}
+
+func (l *latest) add(e Entry) {
+	if len(l.entries) < l.limit {
+		l.entries = append(l.entries, e)
+		return
+	}
+	l.entries[l.next] = e
+	l.next = (l.next + 1) % l.limit
+}
+
+func (l *latest) newestFirst() []Entry {
+	entries := make([]Entry, 0, len(l.entries))
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		entries = append(entries, l.entries[(l.next+i)%len(l.entries)])
+	}
+	return entries
+}
+
+// scan adds the matching entries of a file.
+func scan(ctx context.Context, r io.Reader, q Query, found *latest) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var e Entry
+		if json.Unmarshal(scanner.Bytes(), &e) != nil || !q.matches(&e) {
+			continue
+		}
+		found.add(e)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read audit file. err: %w", err)
+	}
+	return nil
+}
+
+// Close closes the audit file, later writes fail.
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeFile()
+}
@@ -0,0 +1,226 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testStart = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+// testEntry returns the i-th entry, all of them are of the same size.
+func testEntry(i int) Entry {
+	e := Entry{
+		Time:     testStart.Add(time.Duration(i) * time.Second),
+		UserID:   fmt.Sprintf("u%d", i%2),
+		Action:   ActionUpload,
+		NoteUUID: "n1",
+		FileID:   fmt.Sprintf("f%02d", i),
+		Outcome:  OutcomeSuccess,
+		Status:   200,
+	}
+	if i%3 == 0 {
+		e.Action, e.Outcome, e.Status = ActionDelete, OutcomeFailure, 500
+	}
+	return e
+}
+
+func entrySize(t *testing.T) int64 {
+	t.Helper()
+	data, err := json.Marshal(testEntry(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int64(len(data)) + 1
+}
+
+func writeEntries(t *testing.T, sink *FileSink, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		if err := sink.Write(context.Background(), testEntry(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func fileIDs(entries []Entry) []string {
+	ids := make([]string, 0, len(entries))
+	for _, e := range entries {
+		ids = append(ids, e.FileID)
+	}
+	return ids
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	tests := []struct {
+		name     string
+		perFile  int64
+		maxFiles int
+		entries  int
+		// files is the number of entries in the current file and every rotated one
+		files []int
+	}{
+		{name: "no rotation", perFile: 4, maxFiles: 2, entries: 3, files: []int{3}},
+		{name: "rotated", perFile: 2, maxFiles: 3, entries: 5, files: []int{1, 2, 2}},
+		{name: "oldest dropped", perFile: 2, maxFiles: 2, entries: 9, files: []int{1, 2, 2}},
+		{name: "entry larger than a file", perFile: 0, maxFiles: 2, entries: 3, files: []int{1, 1, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit", "audit.log")
+			maxBytes := tt.perFile * entrySize(t)
+			if maxBytes == 0 {
+				maxBytes = 1
+			}
+			sink, err := NewFileSink(path, maxBytes, tt.maxFiles)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sink.Close()
+			writeEntries(t, sink, 0, tt.entries)
+			for i, want := range tt.files {
+				name := path
+				if i > 0 {
+					name = sink.rotated(i)
+				}
+				data, err := os.ReadFile(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := int64(len(data)) / entrySize(t); got != int64(want) {
+					t.Errorf("%s holds %d entries, want %d", filepath.Base(name), got, want)
+				}
+			}
+			if _, err = os.Stat(sink.rotated(len(tt.files))); !os.IsNotExist(err) {
+				t.Errorf("got %v, want no more than %d rotated files", err, len(tt.files)-1)
+			}
+			// the entries of the dropped files are gone, the kept ones are found newest first
+			kept := 0
+			for _, n := range tt.files {
+				kept += n
+			}
+			found, err := sink.Query(context.Background(), Query{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(found) != kept || found[0].FileID != testEntry(tt.entries-1).FileID ||
+				found[len(found)-1].FileID != testEntry(tt.entries-kept).FileID {
+				t.Fatalf("got %v, want the last %d entries newest first", fileIDs(found), kept)
+			}
+		})
+	}
+}
+
+func TestFileSinkQuery(t *testing.T) {
+	sink, err := NewFileSink(filepath.Join(t.TempDir(), "audit.log"), 4*entrySize(t), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	writeEntries(t, sink, 0, 12)
+	tests := []struct {
+		name  string
+		query Query
+		want  []string
+	}{
+		{name: "limit", query: Query{Limit: 3}, want: []string{"f11", "f10", "f09"}},
+		{name: "user", query: Query{UserID: "u1", Limit: 3}, want: []string{"f11", "f09", "f07"}},
+		{name: "failed", query: Query{Outcome: OutcomeFailure}, want: []string{"f09", "f06", "f03", "f00"}},
+		{name: "action and user", query: Query{Action: ActionDelete, UserID: "u0"}, want: []string{"f06", "f00"}},
+		{name: "file", query: Query{FileID: "f05"}, want: []string{"f05"}},
+		{
+			name:  "time range",
+			query: Query{From: testStart.Add(4 * time.Second), To: testStart.Add(7 * time.Second)},
+			want:  []string{"f06", "f05", "f04"},
+		},
+		{name: "no match", query: Query{NoteUUID: "n2"}, want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			found, err := sink.Query(context.Background(), tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fileIDs(found); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileSinkReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := NewFileSink(path, 3*entrySize(t), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeEntries(t, sink, 0, 2)
+	if err = sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = sink.Write(context.Background(), testEntry(2)); err == nil {
+		t.Fatal("wrote to a closed sink")
+	}
+	// a restart appends to the file and rotates it as if it had been open all along
+	if sink, err = NewFileSink(path, 3*entrySize(t), 5); err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	writeEntries(t, sink, 2, 4)
+	found, err := sink.Query(context.Background(), Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(fileIDs(found)); got != "[f03 f02 f01 f00]" {
+		t.Fatalf("got %s, want all 4 entries", got)
+	}
+	if _, err = os.Stat(sink.rotated(1)); err != nil {
+		t.Fatalf("got %v, want the file rotated after the restart", err)
+	}
+}
+
+func TestFileSinkConcurrentWrites(t *testing.T) {
+	sink, err := NewFileSink(filepath.Join(t.TempDir(), "audit.log"), 10*entrySize(t), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	const writers, perWriter = 8, 25
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				if err := sink.Write(context.Background(), testEntry(w*perWriter+i)); err != nil {
+					t.Error(err)
+				}
+			}
+		}(w)
+		// queries run while the files are written and rotated
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := sink.Query(context.Background(), Query{}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	found, err := sink.Query(context.Background(), Query{Limit: writers * perWriter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for _, e := range found {
+		seen[e.FileID] = true
+	}
+	if len(found) != writers*perWriter || len(seen) != writers*perWriter {
+		t.Fatalf("got %d entries, %d distinct, want %d", len(found), len(seen), writers*perWriter)
+	}
+}
@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+
+	"github.com/gerladeno/authorization-service/pkg/common"
+	"github.com/gerladeno/media-storage-service/internal/apikey"
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+	"github.com/golang-jwt/jwt"
+)
+
+// ErrUnauthorized means the caller presented no valid credentials.
+var ErrUnauthorized = errors.New("unauthorized")
+
+type Claims struct {
+	jwt.StandardClaims
+	ID    string `json:"id"`
+	Admin bool   `json:"admin,omitempty"`
+}
+
+type idType string
+
+const (
+	idKey     idType = `userID`
+	apiKeyKey idType = `apiKey`
+	adminKey  idType = `admin`
+)
+
+type KeyStore interface {
+	Authenticate(ctx context.Context, token string) (*apikey.Key, error)
+}
+
+// Authenticator resolves the caller of a request, the same way for every API.
+type Authenticator struct {
+	keys KeyStore
+	key  *rsa.PublicKey
+}
+
+func New(keys KeyStore, key *rsa.PublicKey) *Authenticator {
+	return &Authenticator{keys: keys, key: key}
+}
+
+// Bearer validates a user access token and returns ctx carrying the user id and whether the user is an admin.
+func (a *Authenticator) Bearer(ctx context.Context, accessToken string) (context.Context, error) {
+	claims, err := parseToken(accessToken, a.key)
+	var validationErr *jwt.ValidationError
+	switch {
+	case err == nil:
+	case errors.Is(err, common.ErrInvalidAccessToken), errors.As(err, &validationErr):
+		return nil, ErrUnauthorized
+	default:
+		return nil, fmt.Errorf("err parsing token: %w", err)
+	}
+	ctx = context.WithValue(ctx, idKey, claims.ID)
+	return context.WithValue(ctx, adminKey, claims.Admin), nil
+}
+
+// APIKey validates an API key and returns ctx carrying the key. The user id is the owner
+// of the key, or the key itself for keys without one.
+func (a *Authenticator) APIKey(ctx context.Context, token string) (context.Context, error) {
+	key, err := a.keys.Authenticate(ctx, token)
+	switch {
+	case err == nil:
+	case errors.Is(err, apikey.ErrInvalidKey):
+		return nil, ErrUnauthorized
+	default:
+		return nil, fmt.Errorf("err authenticating api key: %w", err)
+	}
+	id := key.Owner
+	if id == "" {
+		id = "apikey:" + key.ID
+	}
+	ctx = context.WithValue(ctx, idKey, id)
+	return context.WithValue(ctx, apiKeyKey, key), nil
+}
+
+func UserID(ctx context.Context) string {
+	id, _ := ctx.Value(idKey).(string)
+	return id
+}
+
+// RequireScope restricts API keys to the given scope. Callers authenticated with a user token pass.
+func RequireScope(ctx context.Context, scope string) error {
+	if key, ok := ctx.Value(apiKeyKey).(*apikey.Key); ok && !key.HasScope(scope) {
+		return apperror.ErrForbidden
+	}
+	return nil
+}
+
+// RequireAdmin lets through API keys with the admin scope and users whose token carries the admin claim.
+func RequireAdmin(ctx context.Context) error {
+	if key, ok := ctx.Value(apiKeyKey).(*apikey.Key); ok {
+		if key.HasScope(apikey.ScopeAdmin) {
+			return nil
+		}
+		return apperror.ErrForbidden
+	}
+	if admin, _ := ctx.Value(adminKey).(bool); admin {
+		return nil
+	}
+	return apperror.ErrForbidden
+}
+
+// CheckOwner lets through the owner of a resource and admins. Resources without an owner are left to admins.
+func CheckOwner(ctx context.Context, owner string) error {
+	if owner != "" && owner == UserID(ctx) {
+		return nil
+	}
+	return RequireAdmin(ctx)
+}
+
+// CheckNoteAccess enforces the note restriction of an API key.
+func CheckNoteAccess(ctx context.Context, noteUUID string) error {
+	key, ok := ctx.Value(apiKeyKey).(*apikey.Key)
+	if !ok || key.NoteUUID == "" || key.NoteUUID == noteUUID {
+		return nil
+	}
+	return apperror.ErrForbidden
+}
+
+// AccessScope returns the notes and the owner a listing across notes is limited to.
+// API keys keep their restrictions, admins see all files, including those without an owner,
+// and other users see their own files unless they ask for particular notes.
+func AccessScope(ctx context.Context, noteUUIDs []string) ([]string, string, error) {
+	for _, noteUUID := range noteUUIDs {
+		if err := CheckNoteAccess(ctx, noteUUID); err != nil {
+			return nil, "", err
+		}
+	}
+	key, ok := ctx.Value(apiKeyKey).(*apikey.Key)
+	switch {
+	case len(noteUUIDs) > 0:
+		return noteUUIDs, "", nil
+	case ok && key.NoteUUID != "":
+		return []string{key.NoteUUID}, "", nil
+	case ok && key.Owner == "", RequireAdmin(ctx) == nil:
+		return nil, "", nil
+	default:
+		return nil, UserID(ctx), nil
+	}
+}
+
+func parseToken(accessToken string, key *rsa.PublicKey) (*Claims, error) {
+	token, err := jwt.ParseWithClaims(accessToken, &Claims{}, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, common.ErrInvalidSigningMethod
+		}
+		return key, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
+		return claims, nil
+	}
+	return nil, common.ErrInvalidAccessToken
+}
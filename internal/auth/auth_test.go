@@ -0,0 +1,237 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gerladeno/media-storage-service/internal/apikey"
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+	"github.com/golang-jwt/jwt"
+)
+
+// keyStore knows a single token.
+type keyStore struct {
+	token string
+	key   *apikey.Key
+}
+
+func (s keyStore) Authenticate(_ context.Context, token string) (*apikey.Key, error) {
+	if token != s.token {
+		return nil, apikey.ErrInvalidKey
+	}
+	return s.key, nil
+}
+
+func signToken(t *testing.T, key *rsa.PrivateKey, method jwt.SigningMethod, claims Claims) string {
+	t.Helper()
+	var signingKey interface{} = key
+	if method == jwt.SigningMethodHS256 {
+		signingKey = []byte("secret")
+	}
+	token, err := jwt.NewWithClaims(method, claims).SignedString(signingKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestBearer(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Hour).Unix()}
+	user := Claims{StandardClaims: valid, ID: "u1"}
+	expired := Claims{StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(-time.Hour).Unix()}, ID: "u1"}
+	tests := []struct {
+		name   string
+		token  string
+		err    error
+		userID string
+		admin  bool
+	}{
+		{name: "user", token: signToken(t, key, jwt.SigningMethodRS256, user), userID: "u1"},
+		{
+			name:   "admin",
+			token:  signToken(t, key, jwt.SigningMethodRS256, Claims{StandardClaims: valid, ID: "u2", Admin: true}),
+			userID: "u2",
+			admin:  true,
+		},
+		{name: "expired", token: signToken(t, key, jwt.SigningMethodRS256, expired), err: ErrUnauthorized},
+		{name: "other key", token: signToken(t, other, jwt.SigningMethodRS256, user), err: ErrUnauthorized},
+		{name: "hmac", token: signToken(t, key, jwt.SigningMethodHS256, user), err: ErrUnauthorized},
+		{name: "garbage", token: "not.a.token", err: ErrUnauthorized},
+	}
+	authenticator := New(keyStore{}, &key.PublicKey)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, err := authenticator.Bearer(context.Background(), tt.token)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("got %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if UserID(ctx) != tt.userID {
+				t.Fatalf("user %q, want %q", UserID(ctx), tt.userID)
+			}
+			if admin := RequireAdmin(ctx) == nil; admin != tt.admin {
+				t.Fatalf("admin %v, want %v", admin, tt.admin)
+			}
+		})
+	}
+}
+
+func TestAPIKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		key    *apikey.Key
+		token  string
+		err    error
+		userID string
+	}{
+		{name: "owned key", key: &apikey.Key{ID: "k1", Owner: "u1"}, token: "msk_k1.s", userID: "u1"},
+		{name: "service key", key: &apikey.Key{ID: "k1"}, token: "msk_k1.s", userID: "apikey:k1"},
+		{name: "invalid key", key: &apikey.Key{ID: "k1"}, token: "msk_k1.x", err: ErrUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authenticator := New(keyStore{token: "msk_k1.s", key: tt.key}, nil)
+			ctx, err := authenticator.APIKey(context.Background(), tt.token)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("got %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if UserID(ctx) != tt.userID {
+				t.Fatalf("user %q, want %q", UserID(ctx), tt.userID)
+			}
+		})
+	}
+}
+
+func keyContext(key *apikey.Key) context.Context {
+	id := key.Owner
+	if id == "" {
+		id = "apikey:" + key.ID
+	}
+	ctx := context.WithValue(context.Background(), idKey, id)
+	return context.WithValue(ctx, apiKeyKey, key)
+}
+
+func userContext(id string, admin bool) context.Context {
+	ctx := context.WithValue(context.Background(), idKey, id)
+	return context.WithValue(ctx, adminKey, admin)
+}
+
+func TestAccessChecks(t *testing.T) {
+	reader := keyContext(&apikey.Key{ID: "k1", Scopes: []string{apikey.ScopeFilesRead}, NoteUUID: "n1"})
+	admin := keyContext(&apikey.Key{ID: "k2", Scopes: []string{apikey.ScopeAdmin}})
+	owned := keyContext(&apikey.Key{ID: "k3", Scopes: []string{apikey.ScopeFilesWrite}, Owner: "u1"})
+	user, adminUser := userContext("u1", false), userContext("u2", true)
+	tests := []struct {
+		name      string
+		check     func(ctx context.Context) error
+		allowed   []context.Context
+		forbidden []context.Context
+	}{
+		{
+			name:      "read scope",
+			check:     func(ctx context.Context) error { return RequireScope(ctx, apikey.ScopeFilesRead) },
+			allowed:   []context.Context{reader, admin, user},
+			forbidden: []context.Context{owned},
+		},
+		{
+			name:      "write scope",
+			check:     func(ctx context.Context) error { return RequireScope(ctx, apikey.ScopeFilesWrite) },
+			allowed:   []context.Context{admin, owned, user, adminUser},
+			forbidden: []context.Context{reader},
+		},
+		{
+			name:      "admin",
+			check:     RequireAdmin,
+			allowed:   []context.Context{admin, adminUser},
+			forbidden: []context.Context{reader, owned, user},
+		},
+		{
+			name:      "note",
+			check:     func(ctx context.Context) error { return CheckNoteAccess(ctx, "n2") },
+			allowed:   []context.Context{admin, owned, user},
+			forbidden: []context.Context{reader},
+		},
+		{
+			name:      "owner",
+			check:     func(ctx context.Context) error { return CheckOwner(ctx, "u1") },
+			allowed:   []context.Context{owned, user, admin, adminUser},
+			forbidden: []context.Context{reader},
+		},
+		{
+			name:      "no owner",
+			check:     func(ctx context.Context) error { return CheckOwner(ctx, "") },
+			allowed:   []context.Context{admin, adminUser},
+			forbidden: []context.Context{reader, owned, user},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, ctx := range tt.allowed {
+				if err := tt.check(ctx); err != nil {
+					t.Errorf("allowed caller %d: got %v", i, err)
+				}
+			}
+			for i, ctx := range tt.forbidden {
+				if err := tt.check(ctx); !errors.Is(err, apperror.ErrForbidden) {
+					t.Errorf("forbidden caller %d: got %v, want ErrForbidden", i, err)
+				}
+			}
+		})
+	}
+}
+
+func TestAccessScope(t *testing.T) {
+	tests := []struct {
+		name      string
+		ctx       context.Context
+		noteUUIDs []string
+		wantNotes []string
+		wantOwner string
+		err       error
+	}{
+		{name: "user", ctx: userContext("u1", false), wantOwner: "u1"},
+		{name: "user asking for notes", ctx: userContext("u1", false), noteUUIDs: []string{"n1"}, wantNotes: []string{"n1"}},
+		{name: "note key", ctx: keyContext(&apikey.Key{ID: "k1", NoteUUID: "n1"}), wantNotes: []string{"n1"}},
+		{name: "note key asking for another note", ctx: keyContext(&apikey.Key{ID: "k1", NoteUUID: "n1"}), noteUUIDs: []string{"n2"},
+			err: apperror.ErrForbidden},
+		{name: "service key", ctx: keyContext(&apikey.Key{ID: "k1"})},
+		{name: "owned key", ctx: keyContext(&apikey.Key{ID: "k1", Owner: "u1"}), wantOwner: "u1"},
+		{name: "admin", ctx: userContext("u1", true)},
+		{name: "admin asking for notes", ctx: userContext("u1", true), noteUUIDs: []string{"n1"}, wantNotes: []string{"n1"}},
+		{name: "owned admin key", ctx: keyContext(&apikey.Key{ID: "k1", Owner: "u1", Scopes: []string{apikey.ScopeAdmin}})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			notes, owner, err := AccessScope(tt.ctx, tt.noteUUIDs)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if len(notes) != len(tt.wantNotes) || (len(notes) > 0 && notes[0] != tt.wantNotes[0]) || owner != tt.wantOwner {
+				t.Fatalf("got notes %v owner %q, want %v %q", notes, owner, tt.wantNotes, tt.wantOwner)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package broker
+
+import (
+	"context"
+	"sync"
+
+	"github.com/gerladeno/media-storage-service/internal/storage"
+)
+
+const subscriptionBuffer = 64
+
+// Message is an event with the sequence number it got in the broker.
+type Message struct {
+	ID    uint64
+	Event storage.Event
+}
+
+// Subscription receives the messages of one note. C is closed when the subscriber
+// falls behind or unsubscribes, a resubscribe with the last received id resumes the stream.
+type Subscription struct {
+	C        <-chan Message
+	c        chan Message
+	noteUUID string
+}
+
+// Broker fans the service events out to the subscribers of each note in process.
+// It keeps the latest events so that reconnecting subscribers can catch up.
+type Broker struct {
+	mu      sync.Mutex
+	seq     uint64
+	history []Message
+	size    int
+	subs    map[string]map[*Subscription]struct{}
+}
+
+func New(historySize int) *Broker {
+	return &Broker{
+		size: historySize,
+		subs: make(map[string]map[*Subscription]struct{}),
+	}
+}
+
+// Publish never blocks: a subscriber whose buffer is full is dropped.
+func (b *Broker) Publish(_ context.Context, e storage.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	msg := Message{ID: b.seq, Event: e}
+	if len(b.history) == b.size {
+		b.history = b.history[1:]
+	}
+	b.history = append(b.history, msg)
+	for sub := range b.subs[e.NoteUUID] {
+		select {
+		case sub.c <- msg:
+		default:
+			b.remove(sub)
+		}
+	}
+}
+
+// Subscribe returns the subscription and the events of the note published after lastID.
+// complete is false if some of them have already left the history.
+func (b *Broker) Subscribe(noteUUID string, lastID uint64) (sub *Subscription, missed []Message, complete bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	complete = true
+	if lastID > 0 {
+		complete = lastID <= b.seq && (len(b.history) == 0 || b.history[0].ID <= lastID+1)
+		for _, msg := range b.history {
+			if msg.ID > lastID && msg.Event.NoteUUID == noteUUID {
+				missed = append(missed, msg)
+			}
+		}
+	}
+	c := make(chan Message, subscriptionBuffer)
+	sub = &Subscription{C: c, c: c, noteUUID: noteUUID}
+	if b.subs[noteUUID] == nil {
+		b.subs[noteUUID] = make(map[*Subscription]struct{})
+	}
+	b.subs[noteUUID][sub] = struct{}{}
+	return sub, missed, complete
+}
+
+func (b *Broker) Unsubscribe(sub *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.remove(sub)
+}
+
+func (b *Broker) remove(sub *Subscription) {
+	subs, ok := b.subs[sub.noteUUID]
+	if !ok {
+		return
+	}
+	if _, ok = subs[sub]; !ok {
+		return
+	}
+	delete(subs, sub)
+	close(sub.c)
+	if len(subs) == 0 {
+		delete(b.subs, sub.noteUUID)
+	}
+}
@@ -0,0 +1,77 @@
+package eventsink
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/gerladeno/media-storage-service/internal/storage"
+)
+
+// File appends the events to a JSON lines file. Events already in the file are skipped,
+// which makes it handy to check the outbox delivery in tests and local runs.
+type File struct {
+	mu   sync.Mutex
+	path string
+	seen map[string]struct{}
+}
+
+func NewFile(path string) (*File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create events directory. err: %w", err)
+	}
+	sink := &File{path: path, seen: make(map[string]struct{})}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return sink, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open events file. err: %w", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e storage.Event
+		if err = json.Unmarshal(scanner.Bytes(), &e); err == nil {
+			sink.seen[e.ID] = struct{}{}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read events file. err: %w", err)
+	}
+	return sink, nil
+}
+
+func (s *File) Name() string {
+	return "file"
+}
+
+func (s *File) Send(_ context.Context, e storage.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.seen[e.ID]; ok {
+		return nil
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event. err: %w", err)
+	}
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open events file. err: %w", err)
+	}
+	defer f.Close()
+	if _, err = f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write event. err: %w", err)
+	}
+	if err = f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync events file. err: %w", err)
+	}
+	s.seen[e.ID] = struct{}{}
+	return nil
+}
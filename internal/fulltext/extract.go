@@ -0,0 +1,110 @@
+package fulltext
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ledongthuc/pdf"
+	"golang.org/x/net/html"
+)
+
+// maxTextSize limits the amount of extracted text kept per file.
+const maxTextSize = 1 << 20
+
+var ErrUnsupported = errors.New("err unsupported content type")
+
+// Extract returns the plain text of text, Markdown, HTML and PDF contents.
+func Extract(name, contentType string, content []byte) (string, error) {
+	contentType = strings.ToLower(contentType)
+	ext := strings.ToLower(path.Ext(name))
+	switch {
+	case strings.HasPrefix(contentType, "application/pdf") || ext == ".pdf":
+		return extractPDF(content)
+	case strings.HasPrefix(contentType, "text/html") || strings.HasPrefix(contentType, "application/xhtml") ||
+		ext == ".html" || ext == ".htm":
+		return extractHTML(content)
+	case strings.HasPrefix(contentType, "text/") || ext == ".md" || ext == ".markdown" || ext == ".txt":
+		return extractPlain(content)
+	}
+	return "", ErrUnsupported
+}
+
+func extractPlain(content []byte) (string, error) {
+	if !utf8.Valid(content) {
+		content = bytes.ToValidUTF8(content, []byte(" "))
+	}
+	return truncate(string(content)), nil
+}
+
+func extractHTML(content []byte) (string, error) {
+	var sb strings.Builder
+	tokenizer := html.NewTokenizer(bytes.NewReader(content))
+	skip := 0
+	for sb.Len() < maxTextSize {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			if errors.Is(tokenizer.Err(), io.EOF) {
+				return truncate(sb.String()), nil
+			}
+			return "", fmt.Errorf("failed to parse html. err: %w", tokenizer.Err())
+		case html.StartTagToken:
+			if name, _ := tokenizer.TagName(); isInvisible(name) {
+				skip++
+			}
+		case html.EndTagToken:
+			if name, _ := tokenizer.TagName(); isInvisible(name) && skip > 0 {
+				skip--
+			}
+		case html.TextToken:
+			if skip == 0 {
+				sb.Write(tokenizer.Text())
+				sb.WriteByte(' ')
+			}
+		case html.SelfClosingTagToken, html.CommentToken, html.DoctypeToken:
+		}
+	}
+	return truncate(sb.String()), nil
+}
+
+func isInvisible(tag []byte) bool {
+	return string(tag) == "script" || string(tag) == "style"
+}
+
+func extractPDF(content []byte) (text string, err error) {
+	// the parser panics on some malformed documents
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("failed to parse pdf: %v", r)
+		}
+	}()
+	reader, err := pdf.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return "", fmt.Errorf("failed to open pdf. err: %w", err)
+	}
+	plain, err := reader.GetPlainText()
+	if err != nil {
+		return "", fmt.Errorf("failed to extract pdf text. err: %w", err)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(plain, maxTextSize))
+	if err != nil {
+		return "", fmt.Errorf("failed to extract pdf text. err: %w", err)
+	}
+	return extractPlain(b)
+}
+
+func truncate(text string) string {
+	if len(text) <= maxTextSize {
+		return text
+	}
+	text = text[:maxTextSize]
+	for !utf8.ValidString(text) {
+		text = text[:len(text)-1]
+	}
+	return text
+}
@@ -0,0 +1,294 @@
+package fulltext
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"html"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"go.etcd.io/bbolt"
+)
+
+const (
+	minTokenLen   = 2
+	maxTokenLen   = 64
+	snippetRadius = 60
+	maxSnippets   = 3
+)
+
+var (
+	docsBucket     = []byte("fulltext_docs")
+	postingsBucket = []byte("fulltext_postings")
+)
+
+type Hit struct {
+	NoteUUID string
+	FileID   string
+	Score    float64
+}
+
+// Index is an inverted index of extracted file texts stored next to the metadata.
+type Index struct {
+	db *bbolt.DB
+}
+
+func NewIndex(db *bbolt.DB) (*Index, error) {
+	err := db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{docsBucket, postingsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to init fulltext buckets. err: %w", err)
+	}
+	return &Index{db: db}, nil
+}
+
+func (i *Index) Put(_ context.Context, noteUUID, fileID, text string) error {
+	err := i.db.Update(func(tx *bbolt.Tx) error {
+		key := docKey(noteUUID, fileID)
+		if err := deleteDoc(tx, key); err != nil {
+			return err
+		}
+		return putDoc(tx, key, text)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to index text of file %s. err: %w", fileID, err)
+	}
+	return nil
+}
+
+func (i *Index) Delete(_ context.Context, noteUUID, fileID string) error {
+	err := i.db.Update(func(tx *bbolt.Tx) error {
+		return deleteDoc(tx, docKey(noteUUID, fileID))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to remove text of file %s from index. err: %w", fileID, err)
+	}
+	return nil
+}
+
+// Copy indexes the text already known for a file under another note.
+func (i *Index) Copy(_ context.Context, srcNoteUUID, fileID, dstNoteUUID string) error {
+	err := i.db.Update(func(tx *bbolt.Tx) error {
+		text := tx.Bucket(docsBucket).Get(docKey(srcNoteUUID, fileID))
+		if text == nil {
+			return nil
+		}
+		key := docKey(dstNoteUUID, fileID)
+		if err := deleteDoc(tx, key); err != nil {
+			return err
+		}
+		return putDoc(tx, key, string(text))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to copy text of file %s in index. err: %w", fileID, err)
+	}
+	return nil
+}
+
+// Search returns the files containing all the query terms ordered by relevance.
+func (i *Index) Search(_ context.Context, query string) ([]Hit, error) {
+	terms := uniqueTerms(query)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+	var hits []Hit
+	err := i.db.View(func(tx *bbolt.Tx) error {
+		total := float64(tx.Bucket(docsBucket).Stats().KeyN)
+		scores := make(map[string]float64)
+		for n, term := range terms {
+			postings := termPostings(tx, term)
+			idf := math.Log(1 + total/float64(len(postings)+1))
+			next := make(map[string]float64, len(postings))
+			for key, tf := range postings {
+				if _, ok := scores[key]; n == 0 || ok {
+					next[key] = scores[key] + float64(tf)*idf
+				}
+			}
+			scores = next
+		}
+		for key, score := range scores {
+			noteUUID, fileID, _ := strings.Cut(key, "\x00")
+			hits = append(hits, Hit{NoteUUID: noteUUID, FileID: fileID, Score: score})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to search text index. err: %w", err)
+	}
+	sort.Slice(hits, func(a, b int) bool {
+		return hits[a].Score > hits[b].Score
+	})
+	return hits, nil
+}
+
+// Snippets returns fragments of the file text around the query terms with the terms wrapped in <mark>.
+// Everything else in the fragments is HTML-escaped.
+func (i *Index) Snippets(_ context.Context, noteUUID, fileID, query string) ([]string, error) {
+	var text string
+	err := i.db.View(func(tx *bbolt.Tx) error {
+		text = string(tx.Bucket(docsBucket).Get(docKey(noteUUID, fileID)))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read text of file %s. err: %w", fileID, err)
+	}
+	return snippets(text, uniqueTerms(query)), nil
+}
+
+func putDoc(tx *bbolt.Tx, key []byte, text string) error {
+	if err := tx.Bucket(docsBucket).Put(key, []byte(text)); err != nil {
+		return err
+	}
+	postings := tx.Bucket(postingsBucket)
+	for term, tf := range termFrequencies(text) {
+		value := make([]byte, 4)
+		binary.BigEndian.PutUint32(value, uint32(tf))
+		if err := postings.Put(postingKey(term, key), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteDoc(tx *bbolt.Tx, key []byte) error {
+	docs := tx.Bucket(docsBucket)
+	text := docs.Get(key)
+	if text == nil {
+		return nil
+	}
+	postings := tx.Bucket(postingsBucket)
+	for term := range termFrequencies(string(text)) {
+		if err := postings.Delete(postingKey(term, key)); err != nil {
+			return err
+		}
+	}
+	return docs.Delete(key)
+}
+
+func termPostings(tx *bbolt.Tx, term string) map[string]uint32 {
+	postings := make(map[string]uint32)
+	prefix := []byte(term + "\x00")
+	c := tx.Bucket(postingsBucket).Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		postings[string(k[len(prefix):])] = binary.BigEndian.Uint32(v)
+	}
+	return postings
+}
+
+type token struct {
+	term       string
+	start, end int
+}
+
+// tokenize splits text into lowercased runs of letters and digits keeping their byte offsets.
+func tokenize(text string) []token {
+	var tokens []token
+	start := -1
+	flush := func(end int) {
+		if start < 0 {
+			return
+		}
+		term := strings.ToLower(text[start:end])
+		if n := utf8.RuneCountInString(term); n >= minTokenLen && n <= maxTokenLen {
+			tokens = append(tokens, token{term: term, start: start, end: end})
+		}
+		start = -1
+	}
+	for pos, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if start < 0 {
+				start = pos
+			}
+			continue
+		}
+		flush(pos)
+	}
+	flush(len(text))
+	return tokens
+}
+
+func termFrequencies(text string) map[string]int {
+	tf := make(map[string]int)
+	for _, t := range tokenize(text) {
+		tf[t.term]++
+	}
+	return tf
+}
+
+func uniqueTerms(query string) []string {
+	seen := make(map[string]struct{})
+	var terms []string
+	for _, t := range tokenize(query) {
+		if _, ok := seen[t.term]; !ok {
+			seen[t.term] = struct{}{}
+			terms = append(terms, t.term)
+		}
+	}
+	return terms
+}
+
+func snippets(text string, terms []string) []string {
+	wanted := make(map[string]struct{}, len(terms))
+	for _, term := range terms {
+		wanted[term] = struct{}{}
+	}
+	var matches []token
+	for _, t := range tokenize(text) {
+		if _, ok := wanted[t.term]; ok {
+			matches = append(matches, t)
+		}
+	}
+	var result []string
+	for n := 0; n < len(matches) && len(result) < maxSnippets; {
+		start := runeBoundary(text, matches[n].start-snippetRadius)
+		end := runeBoundary(text, matches[n].end+snippetRadius)
+		var sb strings.Builder
+		if start > 0 {
+			sb.WriteString("…")
+		}
+		pos := start
+		for ; n < len(matches) && matches[n].end <= end; n++ {
+			sb.WriteString(html.EscapeString(text[pos:matches[n].start]))
+			sb.WriteString("<mark>" + html.EscapeString(text[matches[n].start:matches[n].end]) + "</mark>")
+			pos = matches[n].end
+		}
+		sb.WriteString(html.EscapeString(text[pos:end]))
+		if end < len(text) {
+			sb.WriteString("…")
+		}
+		result = append(result, strings.Join(strings.Fields(sb.String()), " "))
+	}
+	return result
+}
+
+func runeBoundary(text string, pos int) int {
+	if pos <= 0 {
+		return 0
+	}
+	if pos >= len(text) {
+		return len(text)
+	}
+	for pos > 0 && !utf8.RuneStart(text[pos]) {
+		pos--
+	}
+	return pos
+}
+
+func docKey(noteUUID, fileID string) []byte {
+	return []byte(noteUUID + "\x00" + fileID)
+}
+
+func postingKey(term string, key []byte) []byte {
+	return append([]byte(term+"\x00"), key...)
+}
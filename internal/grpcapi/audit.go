@@ -0,0 +1,63 @@
+package grpcapi
+
+import (
+	"context"
+	"net"
+
+	"github.com/gerladeno/media-storage-service/internal/audit"
+	"github.com/gerladeno/media-storage-service/internal/auth"
+	"github.com/gerladeno/media-storage-service/pkg/filestoragepb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+type AuditLog interface {
+	Record(ctx context.Context, e audit.Entry)
+}
+
+// methodActions are the audited methods, the interceptors record the calls they deny.
+var methodActions = map[string]string{
+	method(filestoragepb.FileStorage_ServiceDesc, "Upload"):   audit.ActionUpload,
+	method(filestoragepb.FileStorage_ServiceDesc, "Download"): audit.ActionDownload,
+	method(filestoragepb.FileStorage_ServiceDesc, "Delete"):   audit.ActionDelete,
+}
+
+func (s *server) record(ctx context.Context, action, noteUUID, fileID string, err error) {
+	record(ctx, s.audit, action, noteUUID, fileID, err)
+}
+
+// record writes a call to the audit log like the REST API does, taking the request id
+// from the x-request-id metadata.
+func record(ctx context.Context, auditLog AuditLog, action, noteUUID, fileID string, err error) {
+	if auditLog == nil {
+		return
+	}
+	entry := audit.Entry{
+		UserID:   auth.UserID(ctx),
+		Action:   action,
+		NoteUUID: noteUUID,
+		FileID:   fileID,
+		Outcome:  audit.OutcomeSuccess,
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("x-request-id"); len(values) > 0 {
+			entry.RequestID = values[0]
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		entry.IP = p.Addr.String()
+		if host, _, splitErr := net.SplitHostPort(entry.IP); splitErr == nil {
+			entry.IP = host
+		}
+	}
+	if err != nil {
+		entry.Outcome, entry.Error = audit.OutcomeFailure, err.Error()
+		switch status.Code(err) {
+		case codes.PermissionDenied, codes.Unauthenticated:
+			entry.Outcome = audit.OutcomeDenied
+		}
+	}
+	auditLog.Record(ctx, entry)
+}
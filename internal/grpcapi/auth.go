@@ -0,0 +1,148 @@
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/gerladeno/media-storage-service/internal/apikey"
+	"github.com/gerladeno/media-storage-service/internal/auth"
+	"github.com/gerladeno/media-storage-service/pkg/filestoragepb"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+)
+
+// methodScopes are the API key scopes the methods require, like the route groups of the REST API.
+// Reflection only describes the API, so it takes the read scope.
+var methodScopes = map[string]string{
+	method(filestoragepb.FileStorage_ServiceDesc, "Upload"):                   apikey.ScopeFilesWrite,
+	method(filestoragepb.FileStorage_ServiceDesc, "Delete"):                   apikey.ScopeFilesWrite,
+	method(filestoragepb.FileStorage_ServiceDesc, "Download"):                 apikey.ScopeFilesRead,
+	method(filestoragepb.FileStorage_ServiceDesc, "List"):                     apikey.ScopeFilesRead,
+	method(filestoragepb.FileStorage_ServiceDesc, "Stat"):                     apikey.ScopeFilesRead,
+	method(reflectionpb.ServerReflection_ServiceDesc, "ServerReflectionInfo"): apikey.ScopeFilesRead,
+}
+
+// method returns the full name of a method of the service, as the interceptors get it.
+func method(service grpc.ServiceDesc, name string) string {
+	return "/" + service.ServiceName + "/" + name
+}
+
+// public reports whether a method is served without credentials, the health checks are
+// probed by load balancers and orchestrators that have none.
+func public(fullMethod string) bool {
+	return strings.HasPrefix(fullMethod, "/"+healthpb.Health_ServiceDesc.ServiceName+"/")
+}
+
+type authInterceptor struct {
+	log           *logrus.Entry
+	authenticator *auth.Authenticator
+	audit         AuditLog
+}
+
+func newAuthInterceptor(log *logrus.Logger, authenticator *auth.Authenticator, auditLog AuditLog) *authInterceptor {
+	return &authInterceptor{
+		log:           log.WithField("module", "grpc"),
+		authenticator: authenticator,
+		audit:         auditLog,
+	}
+}
+
+// fileRequest is a request naming a file, such as the one of Delete.
+type fileRequest interface {
+	GetNoteUuid() string
+	GetFileId() string
+}
+
+func (a *authInterceptor) unary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	if public(info.FullMethod) {
+		return handler(ctx, req)
+	}
+	authCtx, err := a.authenticate(ctx, info.FullMethod)
+	if err != nil {
+		var noteUUID, fileID string
+		if r, ok := req.(fileRequest); ok {
+			noteUUID, fileID = r.GetNoteUuid(), r.GetFileId()
+		}
+		a.denied(ctx, info.FullMethod, noteUUID, fileID, err)
+		return nil, err
+	}
+	return handler(authCtx, req)
+}
+
+func (a *authInterceptor) stream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	if public(info.FullMethod) {
+		return handler(srv, ss)
+	}
+	ctx, err := a.authenticate(ss.Context(), info.FullMethod)
+	if err != nil {
+		// the stream wasn't read yet, so the note and file aren't known
+		a.denied(ss.Context(), info.FullMethod, "", "", err)
+		return err
+	}
+	return handler(srv, &authenticatedStream{ServerStream: ss, ctx: ctx})
+}
+
+// authenticate reads the credentials from the x-api-key or authorization metadata.
+func (a *authInterceptor) authenticate(ctx context.Context, fullMethod string) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var err error
+	if keys := md.Get("x-api-key"); len(keys) > 0 {
+		ctx, err = a.authenticator.APIKey(ctx, keys[0])
+	} else {
+		var token string
+		if values := md.Get("authorization"); len(values) > 0 {
+			token = strings.TrimPrefix(values[0], "Bearer ")
+		}
+		if token == "" {
+			return nil, status.Error(codes.Unauthenticated, "Unauthorized")
+		}
+		ctx, err = a.authenticator.Bearer(ctx, token)
+	}
+	switch {
+	case err == nil:
+	case errors.Is(err, auth.ErrUnauthorized):
+		return nil, status.Error(codes.Unauthenticated, "Unauthorized")
+	default:
+		a.log.Warn(err)
+		return nil, status.Error(codes.Internal, "Internal server error")
+	}
+	scope, ok := methodScopes[fullMethod]
+	if !ok {
+		scope = apikey.ScopeAdmin
+	}
+	if scope == apikey.ScopeAdmin {
+		err = auth.RequireAdmin(ctx)
+	} else {
+		err = auth.RequireScope(ctx, scope)
+	}
+	if err != nil {
+		return nil, status.Error(codes.PermissionDenied, "Forbidden")
+	}
+	return ctx, nil
+}
+
+// denied records a call to an audited method that failed authentication or the scope check.
+func (a *authInterceptor) denied(ctx context.Context, fullMethod, noteUUID, fileID string, err error) {
+	if action, ok := methodActions[fullMethod]; ok {
+		record(ctx, a.audit, action, noteUUID, fileID, err)
+	}
+}
+
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,265 @@
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+	"github.com/gerladeno/media-storage-service/internal/audit"
+	"github.com/gerladeno/media-storage-service/internal/auth"
+	"github.com/gerladeno/media-storage-service/internal/storage"
+	"github.com/gerladeno/media-storage-service/pkg/filestoragepb"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	chunkSize    = 64 << 10
+	maxPageSize  = 500
+	defaultLimit = 50
+)
+
+type Service interface {
+	Create(ctx context.Context, noteUUID string, dto storage.CreateFileDTO) (*storage.File, error)
+	OpenFile(ctx context.Context, noteUUID, fileID string) (io.ReadCloser, *storage.File, error)
+	StatFile(ctx context.Context, noteUUID, fileID string) (*storage.File, error)
+	Search(ctx context.Context, q storage.SearchQuery) (*storage.SearchResult, error)
+	Delete(ctx context.Context, noteUUID, fileID string) error
+}
+
+type server struct {
+	filestoragepb.UnimplementedFileStorageServer
+	log     *logrus.Entry
+	service Service
+	audit   AuditLog
+}
+
+// NewServer returns the gRPC server of the FileStorage service authenticating calls like the REST API.
+// It serves the standard health service and server reflection too.
+func NewServer(log *logrus.Logger, service Service, authenticator *auth.Authenticator, auditLog AuditLog) *grpc.Server {
+	interceptor := newAuthInterceptor(log, authenticator, auditLog)
+	s := grpc.NewServer(
+		grpc.UnaryInterceptor(interceptor.unary),
+		grpc.StreamInterceptor(interceptor.stream),
+	)
+	filestoragepb.RegisterFileStorageServer(s, &server{
+		log:     log.WithField("module", "grpc"),
+		service: service,
+		audit:   auditLog,
+	})
+	healthpb.RegisterHealthServer(s, health.NewServer())
+	reflection.Register(s)
+	return s
+}
+
+// Upload pipes the received chunks into the service, so the contents aren't buffered here.
+func (s *server) Upload(stream filestoragepb.FileStorage_UploadServer) (err error) {
+	ctx := stream.Context()
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	header := first.GetHeader()
+	if header.GetNoteUuid() == "" || header.GetName() == "" {
+		return status.Error(codes.InvalidArgument, "the first message must be a header with note_uuid and name")
+	}
+	var fileID string
+	defer func() {
+		s.record(ctx, audit.ActionUpload, header.NoteUuid, fileID, err)
+	}()
+	if err = auth.CheckNoteAccess(ctx, header.NoteUuid); err != nil {
+		return toStatus(err)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if errors.Is(err, io.EOF) {
+				_ = pw.Close()
+				return
+			}
+			if err != nil {
+				_ = pw.CloseWithError(err)
+				return
+			}
+			if req.GetHeader() != nil {
+				_ = pw.CloseWithError(status.Error(codes.InvalidArgument, "header must be sent once"))
+				return
+			}
+			if _, err = pw.Write(req.GetChunk()); err != nil {
+				return
+			}
+		}
+	}()
+	f, err := s.service.Create(ctx, header.NoteUuid, storage.CreateFileDTO{
+		Name:   header.Name,
+		Size:   header.Size,
+		Owner:  auth.UserID(ctx),
+		Reader: pr,
+	})
+	_ = pr.Close()
+	if err != nil {
+		return toStatus(err)
+	}
+	fileID = f.ID
+	return stream.SendAndClose(fileInfo(header.NoteUuid, f))
+}
+
+func (s *server) Download(req *filestoragepb.DownloadRequest, stream filestoragepb.FileStorage_DownloadServer) (err error) {
+	ctx := stream.Context()
+	defer func() {
+		s.record(ctx, audit.ActionDownload, req.NoteUuid, req.FileId, err)
+	}()
+	if err := auth.CheckNoteAccess(ctx, req.NoteUuid); err != nil {
+		return toStatus(err)
+	}
+	rc, f, err := s.service.OpenFile(ctx, req.NoteUuid, req.FileId)
+	if err != nil {
+		return toStatus(err)
+	}
+	defer rc.Close()
+	info := &filestoragepb.DownloadResponse_Info{Info: fileInfo(req.NoteUuid, f)}
+	if err = stream.Send(&filestoragepb.DownloadResponse{Payload: info}); err != nil {
+		return err
+	}
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := rc.Read(buf)
+		if n > 0 {
+			chunk := &filestoragepb.DownloadResponse_Chunk{Chunk: buf[:n]}
+			if sendErr := stream.Send(&filestoragepb.DownloadResponse{Payload: chunk}); sendErr != nil {
+				return sendErr
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			s.log.Warnf("failed to read file %s of note %s. err: %v", req.FileId, req.NoteUuid, err)
+			return toStatus(err)
+		}
+	}
+}
+
+func (s *server) List(ctx context.Context, req *filestoragepb.ListRequest) (*filestoragepb.ListResponse, error) {
+	var noteUUIDs []string
+	if req.NoteUuid != "" {
+		noteUUIDs = []string{req.NoteUuid}
+	}
+	q := storage.SearchQuery{Limit: int(req.Limit), Offset: int(req.Offset)}
+	if q.Limit <= 0 {
+		q.Limit = defaultLimit
+	}
+	if q.Limit > maxPageSize {
+		q.Limit = maxPageSize
+	}
+	var err error
+	if q.NoteUUIDs, q.Owner, err = auth.AccessScope(ctx, noteUUIDs); err != nil {
+		return nil, toStatus(err)
+	}
+	result, err := s.service.Search(ctx, q)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	resp := &filestoragepb.ListResponse{Total: int32(result.Total)}
+	for _, e := range result.Files {
+		resp.Files = append(resp.Files, &filestoragepb.FileInfo{
+			Id:          e.ID,
+			NoteUuid:    e.NoteUUID,
+			Name:        e.Name,
+			Size:        e.Size,
+			ContentType: e.ContentType,
+			Checksum:    e.Checksum,
+			Owner:       e.Owner,
+			Description: e.Description,
+			Tags:        e.Tags,
+			ModifiedAt:  timestamp(e.ModifiedAt),
+		})
+	}
+	return resp, nil
+}
+
+func (s *server) Stat(ctx context.Context, req *filestoragepb.StatRequest) (*filestoragepb.FileInfo, error) {
+	if err := auth.CheckNoteAccess(ctx, req.NoteUuid); err != nil {
+		return nil, toStatus(err)
+	}
+	f, err := s.service.StatFile(ctx, req.NoteUuid, req.FileId)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return fileInfo(req.NoteUuid, f), nil
+}
+
+func (s *server) Delete(ctx context.Context, req *filestoragepb.DeleteRequest) (_ *filestoragepb.DeleteResponse, err error) {
+	defer func() {
+		s.record(ctx, audit.ActionDelete, req.NoteUuid, req.FileId, err)
+	}()
+	if err = auth.CheckNoteAccess(ctx, req.NoteUuid); err != nil {
+		return nil, toStatus(err)
+	}
+	if err = s.service.Delete(ctx, req.NoteUuid, req.FileId); err != nil {
+		return nil, toStatus(err)
+	}
+	return &filestoragepb.DeleteResponse{}, nil
+}
+
+func fileInfo(noteUUID string, f *storage.File) *filestoragepb.FileInfo {
+	return &filestoragepb.FileInfo{
+		Id:          f.ID,
+		NoteUuid:    noteUUID,
+		Name:        f.Name,
+		Size:        f.Size,
+		ContentType: f.ContentType,
+		Checksum:    f.Checksum,
+		Owner:       f.Owner,
+		Description: f.Description,
+		Tags:        f.Tags,
+		ModifiedAt:  timestamp(f.ModifiedAt),
+	}
+}
+
+// timestamp leaves unknown times unset instead of sending the zero time.
+func timestamp(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
+
+// toStatus maps the application errors to gRPC codes the way apperror.HandleError maps them to HTTP statuses.
+func toStatus(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	var appErr *apperror.AppError
+	switch {
+	case errors.Is(err, apperror.ErrNotFound), errors.Is(err, apperror.ErrGone):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, apperror.ErrAlreadyExist):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, apperror.ErrForbidden):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, apperror.ErrUnavailable):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, apperror.ErrChecksumMismatch):
+		return status.Error(codes.DataLoss, err.Error())
+	case errors.Is(err, apperror.ErrLocked):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case errors.As(err, &appErr):
+		return status.Error(codes.InvalidArgument, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
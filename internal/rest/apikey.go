@@ -0,0 +1,57 @@
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gerladeno/media-storage-service/internal/apikey"
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+	"github.com/gerladeno/media-storage-service/internal/auth"
+	"github.com/go-chi/chi/v5"
+)
+
+type createAPIKeyResponse struct {
+	*apikey.Key
+	Token string `json:"token"`
+}
+
+func (h *handler) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var dto apikey.CreateKeyDTO
+	if err := json.NewDecoder(r.Body).Decode(&dto); err != nil {
+		apperror.HandleError(w, apperror.BadRequestError("invalid request body"))
+		return
+	}
+	// keys act as their owner, so only admins may create keys for someone else
+	if dto.Owner != "" && dto.Owner != userID(r.Context()) {
+		if err := auth.RequireAdmin(r.Context()); err != nil {
+			apperror.HandleError(w, err)
+			return
+		}
+	}
+	key, token, err := h.keys.Create(r.Context(), dto)
+	if err != nil {
+		apperror.HandleError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, createAPIKeyResponse{Key: key, Token: token})
+}
+
+func (h *handler) listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	keys, err := h.keys.List(r.Context())
+	if err != nil {
+		apperror.HandleError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, keys)
+}
+
+func (h *handler) revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := h.keys.Revoke(r.Context(), chi.URLParam(r, "id")); err != nil {
+		apperror.HandleError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,195 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+	"github.com/gerladeno/media-storage-service/internal/audit"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+const maxAuditLimit = 1000
+
+type auditKey struct{}
+
+// auditRecord collects what a handler learns about the files of an audited request,
+// such as the ids of uploaded files, which aren't in the request.
+type auditRecord struct {
+	userID         string
+	noteUUID       string
+	targetNoteUUID string
+	shareID        string
+	files          []auditedFile
+}
+
+type auditedFile struct {
+	id  string
+	err string
+}
+
+// audited records the action of a request in the audit log with the note and file it names,
+// unless the handler reports them, and an outcome following the response status. It goes before
+// auth, so that the requests denied there are recorded too.
+func (h *handler) audited(action string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			record := &auditRecord{}
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			defer func() {
+				// an aborted response failed, whatever status it started with
+				if rvr := recover(); rvr != nil {
+					h.recordAudit(r, action, record, http.StatusInternalServerError)
+					panic(rvr)
+				}
+			}()
+			next.ServeHTTP(ww, r.WithContext(context.WithValue(r.Context(), auditKey{}, record)))
+			h.recordAudit(r, action, record, ww.Status())
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+func (h *handler) recordAudit(r *http.Request, action string, record *auditRecord, status int) {
+	if h.audit == nil {
+		return
+	}
+	if status == 0 {
+		status = http.StatusOK
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// RealIP leaves the address without a port
+		ip = r.RemoteAddr
+	}
+	entry := audit.Entry{
+		UserID:         record.userID,
+		RequestID:      middleware.GetReqID(r.Context()),
+		IP:             ip,
+		Action:         action,
+		NoteUUID:       record.noteUUID,
+		TargetNoteUUID: record.targetNoteUUID,
+		ShareID:        record.shareID,
+		Outcome:        statusOutcome(status),
+		Status:         status,
+	}
+	if entry.NoteUUID == "" {
+		entry.NoteUUID = chi.URLParam(r, "uuid")
+	}
+	if entry.NoteUUID == "" {
+		entry.NoteUUID = r.URL.Query().Get("note_uuid")
+	}
+	if entry.TargetNoteUUID == "" {
+		entry.TargetNoteUUID = r.URL.Query().Get("target_note_uuid")
+	}
+	if entry.ShareID == "" {
+		entry.ShareID = chi.URLParam(r, "shareID")
+	}
+	if len(record.files) == 0 {
+		entry.FileID = chi.URLParam(r, "id")
+		h.audit.Record(r.Context(), entry)
+		return
+	}
+	for _, f := range record.files {
+		fileEntry := entry
+		fileEntry.FileID = f.id
+		if f.err != "" {
+			fileEntry.Outcome, fileEntry.Error = audit.OutcomeFailure, f.err
+		} else if entry.Outcome == audit.OutcomePartial {
+			fileEntry.Outcome = audit.OutcomeSuccess
+		}
+		h.audit.Record(r.Context(), fileEntry)
+	}
+}
+
+func statusOutcome(status int) string {
+	switch {
+	case status == http.StatusMultiStatus:
+		return audit.OutcomePartial
+	case status < http.StatusBadRequest:
+		return audit.OutcomeSuccess
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return audit.OutcomeDenied
+	default:
+		return audit.OutcomeFailure
+	}
+}
+
+// auditUser reports the user a request was authenticated as, which the context of the
+// audit middleware doesn't have.
+func auditUser(ctx context.Context, userID string) {
+	if record, ok := ctx.Value(auditKey{}).(*auditRecord); ok {
+		record.userID = userID
+	}
+}
+
+// auditNote reports the notes of a request that names them in its body.
+func auditNote(ctx context.Context, noteUUID, targetNoteUUID string) {
+	if record, ok := ctx.Value(auditKey{}).(*auditRecord); ok {
+		record.noteUUID, record.targetNoteUUID = noteUUID, targetNoteUUID
+	}
+}
+
+// auditFile reports a file the request dealt with and the error it failed with, if any.
+func auditFile(ctx context.Context, fileID, err string) {
+	if record, ok := ctx.Value(auditKey{}).(*auditRecord); ok {
+		record.files = append(record.files, auditedFile{id: fileID, err: err})
+	}
+}
+
+// auditShare reports the share link a request created or was made with.
+func auditShare(ctx context.Context, shareID string) {
+	if record, ok := ctx.Value(auditKey{}).(*auditRecord); ok {
+		record.shareID = shareID
+	}
+}
+
+func (h *handler) listAuditEntries(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if h.audit == nil {
+		apperror.HandleError(w, apperror.ErrNotFound)
+		return
+	}
+	query := r.URL.Query()
+	q := audit.Query{
+		UserID:   query.Get("user_id"),
+		NoteUUID: query.Get("note_uuid"),
+		FileID:   query.Get("file_id"),
+		ShareID:  query.Get("share_id"),
+		Action:   query.Get("action"),
+		Outcome:  query.Get("outcome"),
+	}
+	for param, t := range map[string]*time.Time{"from": &q.From, "to": &q.To} {
+		if value := query.Get(param); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				apperror.HandleError(w, apperror.BadRequestError("invalid "+param+", expected RFC 3339 time"))
+				return
+			}
+			*t = parsed
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > maxAuditLimit {
+			apperror.HandleError(w, apperror.BadRequestError("limit must be between 1 and "+strconv.Itoa(maxAuditLimit)))
+			return
+		}
+		q.Limit = limit
+	}
+	entries, err := h.audit.Query(r.Context(), q)
+	if errors.Is(err, audit.ErrNotQueryable) {
+		writeErrResponse(w, "audit log is not queryable", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		apperror.HandleError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, JSONResponse{Data: entries, Meta: &Meta{Count: len(entries)}})
+}
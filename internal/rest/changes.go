@@ -0,0 +1,38 @@
+package rest
+
+import (
+	"net/http"
+
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+	"github.com/gerladeno/media-storage-service/internal/storage"
+)
+
+// listChanges returns the file changes after the since cursor. Clients store the returned
+// cursor and pass it on the next sync, calling again right away while has_more is set.
+func (h *handler) listChanges(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	query := r.URL.Query()
+	q := storage.ChangesQuery{Cursor: query.Get("since"), Limit: defaultPageSize}
+	limit, err := parseInt(query, "limit")
+	if err != nil {
+		apperror.HandleError(w, err)
+		return
+	}
+	if limit > 0 {
+		q.Limit = int(limit)
+	}
+	if q.Limit > maxPageSize {
+		q.Limit = maxPageSize
+	}
+	q.NoteUUIDs, q.Owner, err = accessScope(r.Context(), query["note_uuid"])
+	if err != nil {
+		apperror.HandleError(w, err)
+		return
+	}
+	changes, err := h.service.Changes(r.Context(), q)
+	if err != nil {
+		apperror.HandleError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, JSONResponse{Data: changes, Meta: &Meta{Count: len(changes.Changes)}})
+}
@@ -0,0 +1,99 @@
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+	"github.com/gerladeno/media-storage-service/internal/broker"
+	"github.com/gerladeno/media-storage-service/internal/storage"
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	sseHeartbeat = 15 * time.Second
+	sseRetry     = time.Second
+)
+
+// streamedEvents are the event types pushed to the note streams.
+var streamedEvents = map[string]bool{
+	storage.EventFileCreated: true,
+	storage.EventFileDeleted: true,
+	storage.EventFileRenamed: true,
+}
+
+// streamNoteEvents pushes the file events of a note as Server-Sent Events until the client leaves.
+// Browsers reconnect after a dropped stream with Last-Event-ID, which replays what they missed.
+// If the missed events are no longer known a reset event tells the client to reload the file list.
+func (h *handler) streamNoteEvents(w http.ResponseWriter, r *http.Request) {
+	noteUUID := chi.URLParam(r, "uuid")
+	if err := checkNoteAccess(r.Context(), noteUUID); err != nil {
+		apperror.HandleError(w, err)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		apperror.HandleError(w, fmt.Errorf("streaming is not supported"))
+		return
+	}
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	var lastID uint64
+	if lastEventID != "" {
+		var err error
+		if lastID, err = strconv.ParseUint(lastEventID, 10, 64); err != nil {
+			apperror.HandleError(w, apperror.BadRequestError("invalid Last-Event-ID"))
+			return
+		}
+	}
+	sub, missed, complete := h.events.Subscribe(noteUUID, lastID)
+	defer h.events.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	_, _ = fmt.Fprintf(w, "retry: %d\n\n", sseRetry.Milliseconds())
+	if !complete {
+		_, _ = fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+	}
+	for _, msg := range missed {
+		writeSSE(w, msg)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			_, _ = fmt.Fprint(w, ": heartbeat\n\n")
+		case msg, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			writeSSE(w, msg)
+		}
+		flusher.Flush()
+	}
+}
+
+func writeSSE(w http.ResponseWriter, msg broker.Message) {
+	e := msg.Event.AsRenamed()
+	if !streamedEvents[e.Type] {
+		return
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	_, _ = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", msg.ID, e.Type, data)
+}
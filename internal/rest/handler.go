@@ -1,28 +1,57 @@
 package rest
 
 import (
+	"context"
+	"crypto/md5" //nolint:gosec
 	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"mime/multipart"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/gerladeno/media-storage-service/internal/apperror"
+	"github.com/gerladeno/media-storage-service/internal/auth"
 	"github.com/gerladeno/media-storage-service/internal/storage"
 	"github.com/go-chi/chi/v5"
 	"github.com/sirupsen/logrus"
 )
 
 type handler struct {
-	log     *logrus.Entry
-	service Service
-	key     *rsa.PublicKey
+	log           *logrus.Entry
+	service       Service
+	keys          APIKeyStore
+	webhooks      WebhookStore
+	events        EventBroker
+	scrubber      Scrubber
+	replication   Replication
+	audit         AuditLog
+	shares        ShareStore
+	authenticator *auth.Authenticator
 }
 
-func newHandler(log *logrus.Logger, service Service, key *rsa.PublicKey) *handler {
+func newHandler(log *logrus.Logger, service Service, keys APIKeyStore, webhooks WebhookStore, events EventBroker,
+	scrubber Scrubber, replication Replication, auditLog AuditLog, shares ShareStore,
+	key *rsa.PublicKey,
+) *handler {
 	return &handler{
-		log:     log.WithField("module", "rest"),
-		service: service,
-		key:     key,
+		log:           log.WithField("module", "rest"),
+		service:       service,
+		keys:          keys,
+		webhooks:      webhooks,
+		events:        events,
+		scrubber:      scrubber,
+		replication:   replication,
+		audit:         auditLog,
+		shares:        shares,
+		authenticator: auth.New(keys, key),
 	}
 }
 
@@ -32,16 +61,29 @@ func (h *handler) getFile(w http.ResponseWriter, r *http.Request) {
 		apperror.HandleError(w, apperror.BadRequestError("note_uuid query parameter is required"))
 		return
 	}
+	if err := checkNoteAccess(r.Context(), noteUUID); err != nil {
+		apperror.HandleError(w, err)
+		return
+	}
 	fileID := chi.URLParam(r, "id")
-	f, err := h.service.GetFile(r.Context(), noteUUID, fileID)
+	reader, f, err := h.service.OpenFile(r.Context(), noteUUID, fileID)
 	if err != nil {
 		apperror.HandleError(w, err)
 		return
 	}
+	defer reader.Close()
+	if sum, err := hex.DecodeString(f.Checksum); err == nil && len(sum) == sha256.Size {
+		w.Header().Set("ETag", `"`+f.Checksum+`"`)
+		w.Header().Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(sum))
+	}
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", f.Name))
-	w.Header().Set("Content-Type", r.Header.Get("Content-Type"))
+	w.Header().Set("Content-Type", f.ContentType)
 
-	_, _ = w.Write(f.Bytes)
+	// the contents are verified while they are sent, a corrupted file is logged and counted
+	// by the service, the client can check the Digest itself
+	if _, err = io.Copy(w, reader); err != nil {
+		h.log.Warnf("failed to stream file %s of note %s. err: %v", fileID, noteUUID, err)
+	}
 }
 
 func (h *handler) getFilesByNoteUUID(w http.ResponseWriter, r *http.Request) {
@@ -51,6 +93,10 @@ func (h *handler) getFilesByNoteUUID(w http.ResponseWriter, r *http.Request) {
 		apperror.HandleError(w, apperror.BadRequestError("note_uuid query parameter is required"))
 		return
 	}
+	if err := checkNoteAccess(r.Context(), noteUUID); err != nil {
+		apperror.HandleError(w, err)
+		return
+	}
 	file, err := h.service.GetFilesByNoteUUID(r.Context(), noteUUID)
 	if err != nil {
 		apperror.HandleError(w, err)
@@ -65,35 +111,240 @@ func (h *handler) getFilesByNoteUUID(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(filesBytes)
 }
 
+func (h *handler) getNoteArchive(w http.ResponseWriter, r *http.Request) {
+	noteUUID := chi.URLParam(r, "uuid")
+	if err := checkNoteAccess(r.Context(), noteUUID); err != nil {
+		apperror.HandleError(w, err)
+		return
+	}
+	query := r.URL.Query()
+	opts := storage.ArchiveOptions{
+		Format:   query.Get("format"),
+		Manifest: query.Get("manifest") == "true",
+	}
+	if opts.Format == "" {
+		opts.Format = storage.ArchiveZip
+	}
+	for _, ids := range query["ids"] {
+		for _, id := range strings.Split(ids, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				opts.FileIDs = append(opts.FileIDs, id)
+			}
+		}
+	}
+	archive, err := h.service.NewArchive(r.Context(), noteUUID, opts)
+	if err != nil {
+		apperror.HandleError(w, err)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", archive.FileName()))
+	w.Header().Set("Content-Type", archive.ContentType())
+	w.WriteHeader(http.StatusOK)
+	if err = archive.WriteTo(r.Context(), w); err != nil {
+		h.log.Warnf("failed to stream archive of note %s. err: %v", noteUUID, err)
+		// the status is sent already, aborting the response tells the client the archive is truncated
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// uploadResult is the outcome of one uploaded file, failed files have the error and,
+// for the errors of the service, its code.
+type uploadResult struct {
+	ID       string `json:"id,omitempty"`
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Code     string `json:"code,omitempty"`
+}
+
 func (h *handler) createFile(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "form/json")
+	w.Header().Set("Content-Type", "application/json")
 	err := r.ParseMultipartForm(32 << 20)
 	if err != nil {
 		apperror.HandleError(w, err)
 		return
 	}
+	noteUUID := r.Form.Get("note_uuid")
+	if noteUUID == "" {
+		apperror.HandleError(w, apperror.BadRequestError("note_uuid is required"))
+		return
+	}
+	auditNote(r.Context(), noteUUID, "")
+	if err = checkNoteAccess(r.Context(), noteUUID); err != nil {
+		apperror.HandleError(w, err)
+		return
+	}
 	files, ok := r.MultipartForm.File["file"]
 	if !ok || len(files) == 0 {
 		apperror.HandleError(w, apperror.BadRequestError("file required"))
 		return
 	}
-	fileInfo := files[0]
-	fileReader, err := fileInfo.Open()
+	expiry, err := uploadExpiry(r.Form)
 	if err != nil {
 		apperror.HandleError(w, err)
 		return
 	}
+	results := make([]uploadResult, 0, len(files))
+	status := http.StatusCreated
+	var failed []error
+	for _, fileInfo := range files {
+		requestHeader := http.Header{}
+		if len(files) == 1 {
+			requestHeader = r.Header
+		}
+		f, err := h.uploadFile(r.Context(), noteUUID, fileInfo, requestHeader, expiry)
+		if err != nil {
+			h.log.Warnf("failed to upload file %s to note %s. err: %v", fileInfo.Filename, noteUUID, err)
+			failed = append(failed, err)
+			status = http.StatusMultiStatus
+			result := uploadResult{Name: fileInfo.Filename, Size: fileInfo.Size, Error: err.Error()}
+			var appErr *apperror.AppError
+			if errors.As(err, &appErr) {
+				result.Code = appErr.Code
+			}
+			results = append(results, result)
+			auditFile(r.Context(), "", err.Error())
+			continue
+		}
+		results = append(results, uploadResult{ID: f.ID, Name: f.Name, Size: f.Size, Checksum: f.Checksum})
+		auditFile(r.Context(), f.ID, "")
+	}
+	// 207 is for the uploads that partly succeeded, otherwise the error keeps its own status
+	if len(failed) > 0 && len(failed) == len(files) {
+		apperror.HandleError(w, failed[0])
+		return
+	}
+	writeJSON(w, status, results)
+}
+
+func (h *handler) uploadFile(ctx context.Context, noteUUID string, fileInfo *multipart.FileHeader, requestHeader http.Header,
+	expiry storage.CreateFileDTO,
+) (*storage.File, error) {
+	checksums, err := uploadChecksums(http.Header(fileInfo.Header), requestHeader)
+	if err != nil {
+		return nil, err
+	}
+	fileReader, err := fileInfo.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer fileReader.Close()
 	dto := storage.CreateFileDTO{
-		Name:   fileInfo.Filename,
-		Size:   fileInfo.Size,
-		Reader: fileReader,
+		Name:      fileInfo.Filename,
+		Size:      fileInfo.Size,
+		Owner:     userID(ctx),
+		Reader:    fileReader,
+		Checksums: checksums,
+		ExpiresAt: expiry.ExpiresAt,
+		TTL:       expiry.TTL,
 	}
-	err = h.service.Create(r.Context(), r.Form.Get("note_uuid"), dto)
+	return h.service.Create(ctx, noteUUID, dto)
+}
+
+// uploadExpiry reads the optional expires_at, an RFC 3339 time, and ttl of the uploaded files.
+func uploadExpiry(form url.Values) (storage.CreateFileDTO, error) {
+	dto := storage.CreateFileDTO{TTL: form.Get("ttl")}
+	if value := form.Get("expires_at"); value != "" {
+		expiresAt, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return dto, apperror.BadRequestError("invalid expires_at, expected RFC 3339 time")
+		}
+		dto.ExpiresAt = &expiresAt
+	}
+	return dto, nil
+}
+
+// uploadChecksums reads the checksums of an uploaded file from the headers of its part or,
+// when it's the only file, of the request. Content-MD5 is base64 encoded as in RFC 1864,
+// X-Checksum-SHA256 is either hex or base64 encoded.
+func uploadChecksums(partHeader, requestHeader http.Header) (storage.Checksums, error) {
+	header := func(key string) string {
+		if value := partHeader.Get(key); value != "" {
+			return value
+		}
+		return requestHeader.Get(key)
+	}
+	var checksums storage.Checksums
+	if value := header("Content-MD5"); value != "" {
+		sum, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(sum) != md5.Size {
+			return checksums, apperror.BadRequestError("invalid Content-MD5 header")
+		}
+		checksums.MD5 = sum
+	}
+	if value := header("X-Checksum-SHA256"); value != "" {
+		sum, err := hex.DecodeString(value)
+		if err != nil {
+			sum, err = base64.StdEncoding.DecodeString(value)
+		}
+		if err != nil || len(sum) != sha256.Size {
+			return checksums, apperror.BadRequestError("invalid X-Checksum-SHA256 header")
+		}
+		checksums.SHA256 = sum
+	}
+	return checksums, nil
+}
+
+func (h *handler) importNoteArchive(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	noteUUID := chi.URLParam(r, "uuid")
+	if err := checkNoteAccess(r.Context(), noteUUID); err != nil {
+		apperror.HandleError(w, err)
+		return
+	}
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		apperror.HandleError(w, apperror.BadRequestError("invalid multipart form"))
+		return
+	}
+	files, ok := r.MultipartForm.File["archive"]
+	if !ok || len(files) == 0 {
+		apperror.HandleError(w, apperror.BadRequestError("archive required"))
+		return
+	}
+	archive, err := files[0].Open()
+	if err != nil {
+		apperror.HandleError(w, err)
+		return
+	}
+	defer archive.Close()
+	results, err := h.service.ImportZip(r.Context(), noteUUID, userID(r.Context()), archive, files[0].Size)
 	if err != nil {
 		apperror.HandleError(w, err)
 		return
 	}
-	w.WriteHeader(http.StatusCreated)
+	status := http.StatusCreated
+	for _, result := range results {
+		auditFile(r.Context(), result.ID, result.Error)
+		if result.Error != "" {
+			status = http.StatusMultiStatus
+		}
+	}
+	writeJSON(w, status, results)
+}
+
+func (h *handler) updateFile(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	noteUUID := r.URL.Query().Get("note_uuid")
+	if noteUUID == "" {
+		apperror.HandleError(w, apperror.BadRequestError("note_uuid query parameter is required"))
+		return
+	}
+	if err := checkNoteAccess(r.Context(), noteUUID); err != nil {
+		apperror.HandleError(w, err)
+		return
+	}
+	var dto storage.UpdateFileDTO
+	if err := json.NewDecoder(r.Body).Decode(&dto); err != nil {
+		apperror.HandleError(w, apperror.BadRequestError("invalid request body"))
+		return
+	}
+	f, err := h.service.Update(r.Context(), noteUUID, chi.URLParam(r, "id"), dto)
+	if err != nil {
+		apperror.HandleError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, f)
 }
 
 func (h *handler) deleteFile(w http.ResponseWriter, r *http.Request) {
@@ -104,6 +355,10 @@ func (h *handler) deleteFile(w http.ResponseWriter, r *http.Request) {
 		apperror.HandleError(w, apperror.BadRequestError("note_uuid query parameter is required"))
 		return
 	}
+	if err := checkNoteAccess(r.Context(), noteUUID); err != nil {
+		apperror.HandleError(w, err)
+		return
+	}
 
 	err := h.service.Delete(r.Context(), noteUUID, fileID)
 	if err != nil {
@@ -5,30 +5,98 @@ import (
 	"context"
 	"crypto/rsa"
 	"encoding/json"
+	"io"
 	"net/http"
 	"time"
 
+	"github.com/gerladeno/media-storage-service/internal/apikey"
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+	"github.com/gerladeno/media-storage-service/internal/audit"
+	"github.com/gerladeno/media-storage-service/internal/broker"
+	"github.com/gerladeno/media-storage-service/internal/share"
 	"github.com/gerladeno/media-storage-service/internal/storage"
+	"github.com/gerladeno/media-storage-service/internal/webhook"
 	"github.com/gerladeno/media-storage-service/pkg/metrics"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 )
 
 type Service interface {
-	GetFile(ctx context.Context, noteUUID, fileName string) (f *storage.File, err error)
+	OpenFile(ctx context.Context, noteUUID, fileID string) (io.ReadCloser, *storage.File, error)
+	StatFile(ctx context.Context, noteUUID, fileID string) (*storage.File, error)
 	GetFilesByNoteUUID(ctx context.Context, noteUUID string) ([]*storage.File, error)
-	Create(ctx context.Context, noteUUID string, dto storage.CreateFileDTO) error
+	Create(ctx context.Context, noteUUID string, dto storage.CreateFileDTO) (*storage.File, error)
 	Delete(ctx context.Context, noteUUID, fileName string) error
+	Update(ctx context.Context, noteUUID, fileID string, dto storage.UpdateFileDTO) (*storage.File, error)
+	NewArchive(ctx context.Context, noteUUID string, opts storage.ArchiveOptions) (*storage.Archive, error)
+	ImportZip(ctx context.Context, noteUUID, owner string, r io.ReaderAt, size int64) ([]storage.ImportResult, error)
+	Copy(ctx context.Context, srcNoteUUID, fileID, dstNoteUUID string) (*storage.File, error)
+	Move(ctx context.Context, srcNoteUUID, fileID, dstNoteUUID string) (*storage.File, error)
+	Transfer(ctx context.Context, srcNoteUUID, dstNoteUUID string, fileIDs []string, move bool) []storage.TransferResult
+	Search(ctx context.Context, q storage.SearchQuery) (*storage.SearchResult, error)
+	Changes(ctx context.Context, q storage.ChangesQuery) (*storage.ChangeSet, error)
+	Lock(ctx context.Context, noteUUID, fileID string) (*storage.Lock, error)
+	SetLock(ctx context.Context, noteUUID, fileID string, dto storage.LockDTO) (*storage.Lock, error)
+	Ready(ctx context.Context) error
+}
+
+type APIKeyStore interface {
+	Create(ctx context.Context, dto apikey.CreateKeyDTO) (*apikey.Key, string, error)
+	List(ctx context.Context) ([]*apikey.Key, error)
+	Revoke(ctx context.Context, id string) error
+	Authenticate(ctx context.Context, token string) (*apikey.Key, error)
+}
+
+type WebhookStore interface {
+	Create(ctx context.Context, dto webhook.CreateSubscriptionDTO) (*webhook.Subscription, error)
+	List(ctx context.Context) ([]*webhook.Subscription, error)
+	Delete(ctx context.Context, id string) error
+	DeadLetters(ctx context.Context) ([]*webhook.DeadLetter, error)
+	Redeliver(ctx context.Context, deadLetterID uint64) error
+}
+
+type EventBroker interface {
+	Subscribe(noteUUID string, lastID uint64) (*broker.Subscription, []broker.Message, bool)
+	Unsubscribe(sub *broker.Subscription)
+}
+
+type Scrubber interface {
+	Report() *storage.ScrubReport
+	Trigger() bool
+}
+
+type Replication interface {
+	RepairReport() *storage.RepairReport
+	TriggerRepair(removeExtra bool) bool
+}
+
+type AuditLog interface {
+	Record(ctx context.Context, e audit.Entry)
+	Query(ctx context.Context, q audit.Query) ([]audit.Entry, error)
+}
+
+type ShareStore interface {
+	Create(ctx context.Context, noteUUID, fileID, createdBy string, dto share.CreateLinkDTO) (*share.Link, string, error)
+	List(ctx context.Context, noteUUID, fileID string) ([]*share.Link, error)
+	Revoke(ctx context.Context, noteUUID, fileID, id string) error
+	Resolve(ctx context.Context, token, password string) (*share.Link, error)
+	CountDownload(ctx context.Context, id string) error
 }
 
 const gitURL = "https://github.com/gerladeno/media-storage-service"
 
-func NewRouter(log *logrus.Logger, service Service, key *rsa.PublicKey, host, version string) chi.Router {
-	handler := newHandler(log, service, key)
+func NewRouter(log *logrus.Logger, service Service, keys APIKeyStore, webhooks WebhookStore, events EventBroker,
+	scrubber Scrubber, replication Replication, auditLog AuditLog, shares ShareStore, key *rsa.PublicKey,
+	host, version string,
+) chi.Router {
+	handler := newHandler(log, service, keys, webhooks, events, scrubber, replication, auditLog, shares, key)
+	// the middleware registers its collectors once, so every group shares the same one
+	promMiddleware := metrics.NewPromMiddleware(host)
 	r := chi.NewRouter()
-	r.Use(middleware.Recoverer)
+	r.Use(recoverer)
 	r.Use(cors.AllowAll().Handler)
 	r.Use(middleware.RequestID)
 	r.Use(middleware.RealIP)
@@ -37,24 +105,82 @@ func NewRouter(log *logrus.Logger, service Service, key *rsa.PublicKey, host, ve
 	r.NotFound(notFoundHandler)
 	r.Get("/ping", pingHandler)
 	r.Get("/version", versionHandler(version))
+	r.Get("/ready", handler.ready)
+	r.Handle("/metrics", promhttp.Handler())
+	// share links carry their own token, so they resolve without the auth of the API. The requests
+	// aren't logged, the token is part of the path, they are recorded in the audit log instead
 	r.Group(func(r chi.Router) {
-		r.Use(metrics.NewPromMiddleware(host))
+		r.Use(promMiddleware)
+		r.Use(middleware.Timeout(30 * time.Second))
+		r.Use(middleware.Throttle(100))
+		r.Use(handler.audited(audit.ActionShareDownload))
+		r.Get("/share/{token}", handler.downloadSharedFile)
+		r.Post("/share/{token}", handler.downloadSharedFile)
+	})
+	// streams last for as long as the client reads them, so they have neither the timeout nor the throttle
+	r.Group(func(r chi.Router) {
+		r.Use(promMiddleware)
+		r.Use(middleware.RequestLogger(&middleware.DefaultLogFormatter{Logger: log, NoColor: true}))
+		read := chi.Middlewares{handler.auth, requireScope(apikey.ScopeFilesRead)}
+		r.With(read...).Get("/public/v1/api/notes/{uuid}/events", handler.streamNoteEvents)
+		r.With(handler.audited(audit.ActionArchive)).With(read...).Get("/public/v1/api/notes/{uuid}/archive", handler.getNoteArchive)
+	})
+	r.Group(func(r chi.Router) {
+		r.Use(promMiddleware)
 		r.Use(middleware.RequestLogger(&middleware.DefaultLogFormatter{Logger: log, NoColor: true}))
 		r.Use(middleware.Timeout(30 * time.Second))
 		r.Use(middleware.Throttle(100))
-		r.Use(handler.auth)
+		// audited routes authenticate after the audit middleware, so that the requests denied
+		// by auth, requireScope or requireAdmin are recorded too
 		r.Route("/public", func(r chi.Router) {
 			r.Route("/v1", func(r chi.Router) {
-				r.Get("/api/files/{id}", handler.getFile)
-				r.Get("/api/files", handler.getFilesByNoteUUID)
-				r.Post("/api/files", handler.createFile)
-				r.Delete("/api/files/{id}", handler.deleteFile)
-				r.Group(func(r chi.Router) {
-					// protected endpoints
-				})
+				read := chi.Middlewares{handler.auth, requireScope(apikey.ScopeFilesRead)}
+				auditedRead := func(action string) chi.Router {
+					return r.With(handler.audited(action)).With(read...)
+				}
+				auditedRead(audit.ActionDownload).Get("/api/files/{id}", handler.getFile)
+				auditedRead(audit.ActionList).Get("/api/files", handler.getFilesByNoteUUID)
+				auditedRead(audit.ActionSearch).Get("/api/files/search", handler.searchFiles)
+				auditedRead(audit.ActionChanges).Get("/api/changes", handler.listChanges)
+				auditedRead(audit.ActionShareList).Get("/api/files/{id}/shares", handler.listShareLinks)
+
+				write := chi.Middlewares{handler.auth, requireScope(apikey.ScopeFilesWrite)}
+				auditedWrite := func(action string) chi.Router {
+					return r.With(handler.audited(action)).With(write...)
+				}
+				auditedWrite(audit.ActionUpload).Post("/api/files", handler.createFile)
+				auditedWrite(audit.ActionImport).Post("/api/notes/{uuid}/import", handler.importNoteArchive)
+				auditedWrite(audit.ActionUpdate).Patch("/api/files/{id}", handler.updateFile)
+				auditedWrite(audit.ActionDelete).Delete("/api/files/{id}", handler.deleteFile)
+				auditedWrite(audit.ActionCopy).Post("/api/files/{id}/copy", handler.copyFile)
+				auditedWrite(audit.ActionMove).Post("/api/files/{id}/move", handler.moveFile)
+				auditedWrite(audit.ActionCopy).Post("/api/files/copy", handler.copyFiles)
+				auditedWrite(audit.ActionMove).Post("/api/files/move", handler.moveFiles)
+				auditedWrite(audit.ActionShareCreate).Post("/api/files/{id}/shares", handler.createShareLink)
+				auditedWrite(audit.ActionShareRevoke).Delete("/api/files/{id}/shares/{shareID}", handler.revokeShareLink)
 			})
 		})
 		r.Route("/private", func(r chi.Router) {
+			r.Route("/v1", func(r chi.Router) {
+				admin := chi.Middlewares{handler.auth, requireAdmin}
+				r.With(admin...).Get("/api/keys", handler.listAPIKeys)
+				r.With(admin...).Post("/api/keys", handler.createAPIKey)
+				r.With(admin...).Delete("/api/keys/{id}", handler.revokeAPIKey)
+				r.With(admin...).Get("/api/webhooks", handler.listWebhooks)
+				r.With(admin...).Post("/api/webhooks", handler.createWebhook)
+				r.With(admin...).Delete("/api/webhooks/{id}", handler.deleteWebhook)
+				r.With(admin...).Get("/api/webhooks/dead-letters", handler.listDeadLetters)
+				r.With(admin...).Post("/api/webhooks/dead-letters/{id}/redeliver", handler.redeliverDeadLetter)
+				r.With(admin...).Get("/api/scrub", handler.getScrubReport)
+				r.With(admin...).Post("/api/scrub", handler.triggerScrub)
+				r.With(admin...).Get("/api/replication/repair", handler.getRepairReport)
+				r.With(admin...).Post("/api/replication/repair", handler.triggerRepair)
+				r.With(admin...).Get("/api/notes/{uuid}/lock", handler.getNoteLock)
+				r.With(handler.audited(audit.ActionLock)).With(admin...).Put("/api/notes/{uuid}/lock", handler.setNoteLock)
+				r.With(admin...).Get("/api/files/{id}/lock", handler.getFileLock)
+				r.With(handler.audited(audit.ActionLock)).With(admin...).Put("/api/files/{id}/lock", handler.setFileLock)
+				r.With(admin...).Get("/api/audit", handler.listAuditEntries)
+			})
 		})
 	})
 	return r
@@ -68,6 +194,16 @@ func pingHandler(w http.ResponseWriter, _ *http.Request) {
 	writeResponse(w, "pong")
 }
 
+// ready reports whether the service can serve requests, answering 503 while the storage is down.
+func (h *handler) ready(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := h.service.Ready(r.Context()); err != nil {
+		apperror.HandleError(w, err)
+		return
+	}
+	writeResponse(w, "ready")
+}
+
 func versionHandler(version string) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, _ *http.Request) {
 		writeResponse(w, version)
@@ -79,6 +215,16 @@ func writeResponse(w http.ResponseWriter, data interface{}) {
 	_ = json.NewEncoder(w).Encode(response) //nolint:errchkjson
 }
 
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	bytes, err := json.Marshal(data)
+	if err != nil {
+		apperror.HandleError(w, err)
+		return
+	}
+	w.WriteHeader(status)
+	_, _ = w.Write(bytes)
+}
+
 func writeErrResponse(w http.ResponseWriter, message string, status int) {
 	response := JSONResponse{Data: []int{}, Error: &message, Code: &status}
 	w.WriteHeader(status)
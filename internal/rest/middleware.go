@@ -2,69 +2,104 @@ package rest
 
 import (
 	"context"
-	"crypto/rsa"
 	"errors"
 	"net/http"
 	"strings"
 
-	"github.com/gerladeno/authorization-service/pkg/common"
-	"github.com/golang-jwt/jwt"
+	"github.com/gerladeno/media-storage-service/internal/auth"
+	"github.com/go-chi/chi/v5/middleware"
 )
 
-type Claims struct {
-	jwt.StandardClaims
-	ID string `json:"id"`
+// recoverer is middleware.Recoverer passing http.ErrAbortHandler on to the server, which then
+// aborts the response instead of ending it as if it was complete.
+func recoverer(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		var aborted bool
+		abortable := func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				if rvr := recover(); rvr != nil {
+					if rvr != http.ErrAbortHandler {
+						panic(rvr)
+					}
+					aborted = true
+				}
+			}()
+			next.ServeHTTP(w, r)
+		}
+		middleware.Recoverer(http.HandlerFunc(abortable)).ServeHTTP(w, r)
+		if aborted {
+			panic(http.ErrAbortHandler)
+		}
+	}
+	return http.HandlerFunc(fn)
 }
 
-type idType string
-
-const idKey idType = `userID`
-
 func (h *handler) auth(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			writeErrResponse(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-		headerParts := strings.Split(authHeader, " ")
-		if len(headerParts) != 2 {
-			writeErrResponse(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-		if headerParts[0] != "Bearer" {
-			writeErrResponse(w, "Unauthorized", http.StatusUnauthorized)
-			return
+		var (
+			ctx context.Context
+			err error
+		)
+		if token := r.Header.Get("X-API-Key"); token != "" {
+			ctx, err = h.authenticator.APIKey(r.Context(), token)
+		} else {
+			headerParts := strings.Split(r.Header.Get("Authorization"), " ")
+			if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+				writeErrResponse(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			ctx, err = h.authenticator.Bearer(r.Context(), headerParts[1])
 		}
-		id, err := parseToken(headerParts[1], h.key)
 		switch {
 		case err == nil:
-		case errors.Is(err, common.ErrInvalidAccessToken):
+		case errors.Is(err, auth.ErrUnauthorized):
 			writeErrResponse(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		default:
-			h.log.Warnf("err parsing token: %v", err)
+			h.log.Warn(err)
 			writeErrResponse(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
-		r = r.WithContext(context.WithValue(r.Context(), idKey, id))
-		next.ServeHTTP(w, r)
+		auditUser(ctx, userID(ctx))
+		next.ServeHTTP(w, r.WithContext(ctx))
 	}
 	return http.HandlerFunc(fn)
 }
 
-func parseToken(accessToken string, key *rsa.PublicKey) (string, error) {
-	token, err := jwt.ParseWithClaims(accessToken, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
-			return nil, common.ErrInvalidSigningMethod
+// requireScope restricts API keys to the given scope. Requests authenticated with a user token pass through.
+func requireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if err := auth.RequireScope(r.Context(), scope); err != nil {
+				writeErrResponse(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
 		}
-		return &key, nil
-	})
-	if err != nil {
-		return "", err
+		return http.HandlerFunc(fn)
 	}
-	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
-		return claims.ID, nil
+}
+
+// requireAdmin lets through admin API keys and users with the admin claim only.
+func requireAdmin(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if err := auth.RequireAdmin(r.Context()); err != nil {
+			writeErrResponse(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
 	}
-	return "", common.ErrInvalidAccessToken
+	return http.HandlerFunc(fn)
+}
+
+func userID(ctx context.Context) string {
+	return auth.UserID(ctx)
+}
+
+func accessScope(ctx context.Context, noteUUIDs []string) ([]string, string, error) {
+	return auth.AccessScope(ctx, noteUUIDs)
+}
+
+func checkNoteAccess(ctx context.Context, noteUUID string) error {
+	return auth.CheckNoteAccess(ctx, noteUUID)
 }
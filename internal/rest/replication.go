@@ -0,0 +1,35 @@
+package rest
+
+import (
+	"net/http"
+
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+)
+
+func (h *handler) getRepairReport(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if h.replication == nil {
+		apperror.HandleError(w, apperror.ErrNotFound)
+		return
+	}
+	report := h.replication.RepairReport()
+	if report == nil {
+		apperror.HandleError(w, apperror.ErrNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, JSONResponse{Data: report, Meta: &Meta{Count: len(report.Actions)}})
+}
+
+// triggerRepair starts a repair, with remove_extra=true it removes the replica objects the primary doesn't have.
+func (h *handler) triggerRepair(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if h.replication == nil {
+		writeErrResponse(w, "replication is not configured", http.StatusNotFound)
+		return
+	}
+	if !h.replication.TriggerRepair(r.URL.Query().Get("remove_extra") == "true") {
+		writeErrResponse(w, "repair is already in progress", http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,61 @@
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+	"github.com/gerladeno/media-storage-service/internal/storage"
+	"github.com/go-chi/chi/v5"
+)
+
+func (h *handler) getNoteLock(w http.ResponseWriter, r *http.Request) {
+	h.getLock(w, r, chi.URLParam(r, "uuid"), "")
+}
+
+func (h *handler) setNoteLock(w http.ResponseWriter, r *http.Request) {
+	h.setLock(w, r, chi.URLParam(r, "uuid"), "")
+}
+
+func (h *handler) getFileLock(w http.ResponseWriter, r *http.Request) {
+	noteUUID := r.URL.Query().Get("note_uuid")
+	if noteUUID == "" {
+		apperror.HandleError(w, apperror.BadRequestError("note_uuid query parameter is required"))
+		return
+	}
+	h.getLock(w, r, noteUUID, chi.URLParam(r, "id"))
+}
+
+func (h *handler) setFileLock(w http.ResponseWriter, r *http.Request) {
+	noteUUID := r.URL.Query().Get("note_uuid")
+	if noteUUID == "" {
+		apperror.HandleError(w, apperror.BadRequestError("note_uuid query parameter is required"))
+		return
+	}
+	h.setLock(w, r, noteUUID, chi.URLParam(r, "id"))
+}
+
+func (h *handler) getLock(w http.ResponseWriter, r *http.Request, noteUUID, fileID string) {
+	w.Header().Set("Content-Type", "application/json")
+	lock, err := h.service.Lock(r.Context(), noteUUID, fileID)
+	if err != nil {
+		apperror.HandleError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, lock)
+}
+
+func (h *handler) setLock(w http.ResponseWriter, r *http.Request, noteUUID, fileID string) {
+	w.Header().Set("Content-Type", "application/json")
+	var dto storage.LockDTO
+	if err := json.NewDecoder(r.Body).Decode(&dto); err != nil {
+		apperror.HandleError(w, apperror.BadRequestError("invalid request body"))
+		return
+	}
+	lock, err := h.service.SetLock(r.Context(), noteUUID, fileID, dto)
+	if err != nil {
+		apperror.HandleError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, lock)
+}
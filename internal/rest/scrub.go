@@ -0,0 +1,26 @@
+package rest
+
+import (
+	"net/http"
+
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+)
+
+func (h *handler) getScrubReport(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	report := h.scrubber.Report()
+	if report == nil {
+		apperror.HandleError(w, apperror.ErrNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, JSONResponse{Data: report, Meta: &Meta{Count: len(report.Findings)}})
+}
+
+func (h *handler) triggerScrub(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !h.scrubber.Trigger() {
+		writeErrResponse(w, "scrubbing is already in progress", http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
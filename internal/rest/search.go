@@ -0,0 +1,107 @@
+package rest
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+	"github.com/gerladeno/media-storage-service/internal/storage"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+func (h *handler) searchFiles(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	query := r.URL.Query()
+	q, err := parseSearchQuery(query)
+	if err != nil {
+		apperror.HandleError(w, err)
+		return
+	}
+	q.NoteUUIDs, q.Owner, err = accessScope(r.Context(), query["note_uuid"])
+	if err != nil {
+		apperror.HandleError(w, err)
+		return
+	}
+	result, err := h.service.Search(r.Context(), q)
+	if err != nil {
+		apperror.HandleError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, JSONResponse{Data: result.Files, Meta: &Meta{Count: result.Total}})
+}
+
+func parseSearchQuery(query url.Values) (storage.SearchQuery, error) {
+	q := storage.SearchQuery{
+		Text:        query.Get("q"),
+		Name:        query.Get("name"),
+		ContentType: query.Get("type"),
+		Limit:       defaultPageSize,
+	}
+	var err error
+	if q.MinSize, err = parseInt(query, "min_size"); err != nil {
+		return q, err
+	}
+	if q.MaxSize, err = parseInt(query, "max_size"); err != nil {
+		return q, err
+	}
+	limit, err := parseInt(query, "limit")
+	if err != nil {
+		return q, err
+	}
+	if limit > 0 {
+		q.Limit = int(limit)
+	}
+	if q.Limit > maxPageSize {
+		q.Limit = maxPageSize
+	}
+	offset, err := parseInt(query, "offset")
+	if err != nil {
+		return q, err
+	}
+	q.Offset = int(offset)
+	if q.CreatedAfter, err = parseTime(query, "from"); err != nil {
+		return q, err
+	}
+	if q.CreatedBefore, err = parseTime(query, "to"); err != nil {
+		return q, err
+	}
+	for _, tag := range query["tag"] {
+		if q.Tags == nil {
+			q.Tags = make(map[string]string)
+		}
+		k, v, _ := strings.Cut(tag, ":")
+		q.Tags[k] = v
+	}
+	return q, nil
+}
+
+func parseInt(query url.Values, name string) (int64, error) {
+	value := query.Get(name)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, apperror.BadRequestError(name + " must be a non-negative integer")
+	}
+	return n, nil
+}
+
+func parseTime(query url.Values, name string) (time.Time, error) {
+	value := query.Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, apperror.BadRequestError(name + " must be an RFC 3339 timestamp")
+	}
+	return t, nil
+}
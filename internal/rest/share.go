@@ -0,0 +1,173 @@
+package rest
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+	"github.com/gerladeno/media-storage-service/internal/auth"
+	"github.com/gerladeno/media-storage-service/internal/share"
+	"github.com/go-chi/chi/v5"
+)
+
+type createShareLinkResponse struct {
+	*share.Link
+	Token string `json:"token"`
+}
+
+func (h *handler) createShareLink(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	noteUUID, fileID, ok := h.sharedFile(w, r)
+	if !ok {
+		return
+	}
+	var dto share.CreateLinkDTO
+	if err := json.NewDecoder(r.Body).Decode(&dto); err != nil && !errors.Is(err, io.EOF) {
+		apperror.HandleError(w, apperror.BadRequestError("invalid request body"))
+		return
+	}
+	link, token, err := h.shares.Create(r.Context(), noteUUID, fileID, userID(r.Context()), dto)
+	if err != nil {
+		apperror.HandleError(w, err)
+		return
+	}
+	auditShare(r.Context(), link.ID)
+	writeJSON(w, http.StatusCreated, createShareLinkResponse{Link: link, Token: token})
+}
+
+func (h *handler) listShareLinks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	noteUUID, fileID, ok := h.sharedFile(w, r)
+	if !ok {
+		return
+	}
+	links, err := h.shares.List(r.Context(), noteUUID, fileID)
+	if err != nil {
+		apperror.HandleError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, links)
+}
+
+func (h *handler) revokeShareLink(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	noteUUID, fileID, ok := h.sharedFile(w, r)
+	if !ok {
+		return
+	}
+	err := h.shares.Revoke(r.Context(), noteUUID, fileID, chi.URLParam(r, "shareID"))
+	if err != nil {
+		apperror.HandleError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sharedFile returns the note and the file of a request on the share links of a file, answering
+// the request if it fails. Links hand the file out to anyone, so only its owner and admins manage them.
+func (h *handler) sharedFile(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	noteUUID, fileID := r.URL.Query().Get("note_uuid"), chi.URLParam(r, "id")
+	if noteUUID == "" {
+		apperror.HandleError(w, apperror.BadRequestError("note_uuid query parameter is required"))
+		return "", "", false
+	}
+	if err := checkNoteAccess(r.Context(), noteUUID); err != nil {
+		apperror.HandleError(w, err)
+		return "", "", false
+	}
+	f, err := h.service.StatFile(r.Context(), noteUUID, fileID)
+	if err == nil {
+		err = auth.CheckOwner(r.Context(), f.Owner)
+	}
+	if err != nil {
+		apperror.HandleError(w, err)
+		return "", "", false
+	}
+	return noteUUID, fileID, true
+}
+
+// downloadSharedFile streams the file of a share link to anyone with the token. The password of a link
+// is sent in the X-Share-Password header or, for HTML forms, as the password field of a POST.
+func (h *handler) downloadSharedFile(w http.ResponseWriter, r *http.Request) {
+	token := chi.URLParam(r, "token")
+	// only the id part of the token is recorded, the secret stays out of the audit log
+	if id, _, ok := strings.Cut(token, "."); ok {
+		auditShare(r.Context(), id)
+	}
+	password := r.Header.Get("X-Share-Password")
+	if password == "" && r.Method == http.MethodPost {
+		password = r.PostFormValue("password")
+	}
+	link, err := h.shares.Resolve(r.Context(), token, password)
+	switch {
+	case errors.Is(err, share.ErrPasswordRequired):
+		writeErrResponse(w, "share link password required", http.StatusUnauthorized)
+		return
+	case errors.Is(err, share.ErrWrongPassword):
+		writeErrResponse(w, "wrong share link password", http.StatusUnauthorized)
+		return
+	case errors.Is(err, share.ErrTooManyAttempts):
+		writeErrResponse(w, "too many wrong share link passwords, try again later", http.StatusTooManyRequests)
+		return
+	case err != nil:
+		apperror.HandleError(w, err)
+		return
+	}
+	auditNote(r.Context(), link.NoteUUID, "")
+	reader, f, err := h.service.OpenFile(r.Context(), link.NoteUUID, link.FileID)
+	if err != nil {
+		auditFile(r.Context(), link.FileID, err.Error())
+		apperror.HandleError(w, err)
+		return
+	}
+	defer reader.Close()
+	// only downloads that can be served use up the link
+	if err = h.shares.CountDownload(r.Context(), link.ID); err != nil {
+		auditFile(r.Context(), link.FileID, err.Error())
+		apperror.HandleError(w, err)
+		return
+	}
+	auditFile(r.Context(), link.FileID, "")
+	if sum, err := hex.DecodeString(f.Checksum); err == nil && len(sum) == sha256.Size {
+		w.Header().Set("ETag", `"`+f.Checksum+`"`)
+		w.Header().Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(sum))
+	}
+	// the file is served from the origin of the API, so browsers must neither render nor sniff it.
+	// Types they'd run scripts of go out as plain bytes in case the disposition is ignored
+	contentType := f.ContentType
+	if activeContent(contentType) {
+		contentType = "application/octet-stream"
+	}
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": f.Name})
+	if disposition == "" {
+		disposition = "attachment"
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Disposition", disposition)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if _, err = io.Copy(w, reader); err != nil {
+		h.log.Warnf("failed to stream shared file %s of note %s. err: %v", link.FileID, link.NoteUUID, err)
+	}
+}
+
+// activeContent tells if browsers render a content type as a document that can run scripts.
+func activeContent(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return true
+	}
+	switch mediaType {
+	case "text/html", "application/xhtml+xml", "image/svg+xml", "text/xml", "application/xml",
+		"text/javascript", "application/javascript", "application/pdf":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,211 @@
+package rest_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gerladeno/media-storage-service/internal/apikey"
+	"github.com/gerladeno/media-storage-service/internal/audit"
+	"github.com/gerladeno/media-storage-service/internal/broker"
+	"github.com/gerladeno/media-storage-service/internal/fulltext"
+	"github.com/gerladeno/media-storage-service/internal/rest"
+	"github.com/gerladeno/media-storage-service/internal/share"
+	"github.com/gerladeno/media-storage-service/internal/storage"
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/bbolt"
+)
+
+const noteUUID = "5f0c4d3e-8a1b-4c2d-9e3f-1a2b3c4d5e6f"
+
+type shareServer struct {
+	*httptest.Server
+	service *storage.Service
+	shares  *share.Store
+	// keys holds the API key of every caller: the owner of the files, another user,
+	// a key without an owner and an admin
+	keys map[string]string
+}
+
+func newShareServer(t *testing.T) *shareServer {
+	t.Helper()
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	dir := t.TempDir()
+	db, err := bbolt.Open(filepath.Join(dir, "storage.db"), 0o600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	fileStorage, err := storage.NewFilesystem(log, filepath.Join(dir, "files"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := storage.NewIndex(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	textIndex, err := fulltext.NewIndex(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service, err := storage.NewService(log, fileStorage, index, textIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := apikey.NewStore(log, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shares, err := share.NewStore(log, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &shareServer{service: service, shares: shares, keys: map[string]string{}}
+	write := []string{apikey.ScopeFilesRead, apikey.ScopeFilesWrite}
+	for caller, dto := range map[string]apikey.CreateKeyDTO{
+		"owner":   {Name: "owner", Scopes: write, Owner: "alice"},
+		"other":   {Name: "other", Scopes: write, Owner: "bob"},
+		"service": {Name: "service", Scopes: write},
+		"admin":   {Name: "admin", Scopes: []string{apikey.ScopeAdmin}},
+	} {
+		if _, s.keys[caller], err = keys.Create(context.Background(), dto); err != nil {
+			t.Fatal(err)
+		}
+	}
+	router := rest.NewRouter(log, service, keys, nil, broker.New(10), nil, nil, audit.NewLog(log), shares, nil, "test", "test")
+	s.Server = httptest.NewServer(router)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *shareServer) createFile(t *testing.T, name, contents string) *storage.File {
+	t.Helper()
+	f, err := s.service.Create(context.Background(), noteUUID, storage.CreateFileDTO{
+		Name:   name,
+		Owner:  "alice",
+		Reader: strings.NewReader(contents),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func (s *shareServer) do(t *testing.T, method, path, caller string, body []byte) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, s.URL+path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caller != "" {
+		req.Header.Set("X-API-Key", s.keys[caller])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	return resp
+}
+
+func TestShareLinksNeedTheOwner(t *testing.T) {
+	tests := []struct {
+		caller  string
+		allowed bool
+	}{
+		{caller: "owner", allowed: true},
+		{caller: "admin", allowed: true},
+		{caller: "other"},
+		{caller: "service"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.caller, func(t *testing.T) {
+			s := newShareServer(t)
+			f := s.createFile(t, "report.txt", "contents")
+			link, _, err := s.shares.Create(context.Background(), noteUUID, f.ID, "alice", share.CreateLinkDTO{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := "/public/v1/api/files/" + f.ID + "/shares"
+			query := "?note_uuid=" + noteUUID
+			requests := []struct {
+				method, path string
+				status       int
+			}{
+				{method: http.MethodPost, path: path + query, status: http.StatusCreated},
+				{method: http.MethodGet, path: path + query, status: http.StatusOK},
+				{method: http.MethodDelete, path: path + "/" + link.ID + query, status: http.StatusNoContent},
+			}
+			for _, r := range requests {
+				want := http.StatusForbidden
+				if tt.allowed {
+					want = r.status
+				}
+				if resp := s.do(t, r.method, r.path, tt.caller, nil); resp.StatusCode != want {
+					t.Errorf("%s %s: got %d, want %d", r.method, r.path, resp.StatusCode, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSharedFileHeaders(t *testing.T) {
+	const octetStream = "application/octet-stream"
+	tests := []struct {
+		name        string
+		fileName    string
+		contents    string
+		contentType string
+	}{
+		{name: "image", fileName: "photo.png", contents: "\x89PNG\r\n\x1a\n", contentType: "image/png"},
+		{name: "text", fileName: "notes.txt", contents: "plain", contentType: "text/plain; charset=utf-8"},
+		{name: "html", fileName: "page.html", contents: "<script>alert(1)</script>", contentType: octetStream},
+		{name: "svg", fileName: "image.svg", contents: "<svg></svg>", contentType: octetStream},
+		{name: "sniffed html", fileName: "my page", contents: "<html><script>alert(1)</script>", contentType: octetStream},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newShareServer(t)
+			f := s.createFile(t, tt.fileName, tt.contents)
+			body, _ := json.Marshal(share.CreateLinkDTO{MaxDownloads: 1})
+			resp := s.do(t, http.MethodPost, "/public/v1/api/files/"+f.ID+"/shares?note_uuid="+noteUUID, "owner", body)
+			var created struct {
+				Token string `json:"token"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&created); err != nil || created.Token == "" {
+				t.Fatalf("got %d, err: %v, want a share link", resp.StatusCode, err)
+			}
+
+			resp = s.do(t, http.MethodGet, "/share/"+created.Token, "", nil)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("got %d, want the shared file", resp.StatusCode)
+			}
+			if got := resp.Header.Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type %q, want %q", got, tt.contentType)
+			}
+			if got := resp.Header.Get("X-Content-Type-Options"); got != "nosniff" {
+				t.Errorf("X-Content-Type-Options %q, want nosniff", got)
+			}
+			disposition, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+			if err != nil || disposition != "attachment" || params["filename"] != tt.fileName {
+				t.Errorf("Content-Disposition %q, want an attachment named %s", resp.Header.Get("Content-Disposition"), tt.fileName)
+			}
+			contents, _ := io.ReadAll(resp.Body)
+			if string(contents) != tt.contents {
+				t.Errorf("got %q, want the file contents", contents)
+			}
+			// the link allows a single download
+			if resp = s.do(t, http.MethodGet, "/share/"+created.Token, "", nil); resp.StatusCode != http.StatusGone {
+				t.Errorf("got %d for a used up link, want %d", resp.StatusCode, http.StatusGone)
+			}
+		})
+	}
+}
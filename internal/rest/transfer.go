@@ -0,0 +1,97 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+	"github.com/go-chi/chi/v5"
+)
+
+type transferRequest struct {
+	NoteUUID       string   `json:"note_uuid"`
+	TargetNoteUUID string   `json:"target_note_uuid"`
+	FileIDs        []string `json:"file_ids"`
+}
+
+func (h *handler) copyFile(w http.ResponseWriter, r *http.Request) {
+	h.transferFile(w, r, false)
+}
+
+func (h *handler) moveFile(w http.ResponseWriter, r *http.Request) {
+	h.transferFile(w, r, true)
+}
+
+func (h *handler) transferFile(w http.ResponseWriter, r *http.Request, move bool) {
+	w.Header().Set("Content-Type", "application/json")
+	noteUUID := r.URL.Query().Get("note_uuid")
+	targetNoteUUID := r.URL.Query().Get("target_note_uuid")
+	if noteUUID == "" || targetNoteUUID == "" {
+		apperror.HandleError(w, apperror.BadRequestError("note_uuid and target_note_uuid query parameters are required"))
+		return
+	}
+	if err := checkTransferAccess(r.Context(), noteUUID, targetNoteUUID); err != nil {
+		apperror.HandleError(w, err)
+		return
+	}
+	transfer, status := h.service.Copy, http.StatusCreated
+	if move {
+		transfer, status = h.service.Move, http.StatusOK
+	}
+	f, err := transfer(r.Context(), noteUUID, chi.URLParam(r, "id"), targetNoteUUID)
+	if err != nil {
+		apperror.HandleError(w, err)
+		return
+	}
+	writeJSON(w, status, f)
+}
+
+func (h *handler) copyFiles(w http.ResponseWriter, r *http.Request) {
+	h.transferFiles(w, r, false)
+}
+
+func (h *handler) moveFiles(w http.ResponseWriter, r *http.Request) {
+	h.transferFiles(w, r, true)
+}
+
+func (h *handler) transferFiles(w http.ResponseWriter, r *http.Request, move bool) {
+	w.Header().Set("Content-Type", "application/json")
+	var req transferRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apperror.HandleError(w, apperror.BadRequestError("invalid request body"))
+		return
+	}
+	auditNote(r.Context(), req.NoteUUID, req.TargetNoteUUID)
+	if req.NoteUUID == "" || req.TargetNoteUUID == "" || len(req.FileIDs) == 0 {
+		apperror.HandleError(w, apperror.BadRequestError("note_uuid, target_note_uuid and file_ids are required"))
+		return
+	}
+	if req.NoteUUID == req.TargetNoteUUID {
+		apperror.HandleError(w, apperror.BadRequestError("source and target notes must differ"))
+		return
+	}
+	if err := checkTransferAccess(r.Context(), req.NoteUUID, req.TargetNoteUUID); err != nil {
+		apperror.HandleError(w, err)
+		return
+	}
+	results := h.service.Transfer(r.Context(), req.NoteUUID, req.TargetNoteUUID, req.FileIDs, move)
+	status := http.StatusCreated
+	if move {
+		status = http.StatusOK
+	}
+	for _, result := range results {
+		auditFile(r.Context(), result.ID, result.Error)
+		if result.Error != "" {
+			status = http.StatusMultiStatus
+		}
+	}
+	writeJSON(w, status, results)
+}
+
+func checkTransferAccess(ctx context.Context, noteUUID, targetNoteUUID string) error {
+	if err := checkNoteAccess(ctx, noteUUID); err != nil {
+		return err
+	}
+	return checkNoteAccess(ctx, targetNoteUUID)
+}
@@ -0,0 +1,69 @@
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+	"github.com/gerladeno/media-storage-service/internal/webhook"
+	"github.com/go-chi/chi/v5"
+)
+
+func (h *handler) createWebhook(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var dto webhook.CreateSubscriptionDTO
+	if err := json.NewDecoder(r.Body).Decode(&dto); err != nil {
+		apperror.HandleError(w, apperror.BadRequestError("invalid request body"))
+		return
+	}
+	sub, err := h.webhooks.Create(r.Context(), dto)
+	if err != nil {
+		apperror.HandleError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, sub)
+}
+
+func (h *handler) listWebhooks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	subs, err := h.webhooks.List(r.Context())
+	if err != nil {
+		apperror.HandleError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, subs)
+}
+
+func (h *handler) deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := h.webhooks.Delete(r.Context(), chi.URLParam(r, "id")); err != nil {
+		apperror.HandleError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) listDeadLetters(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	letters, err := h.webhooks.DeadLetters(r.Context())
+	if err != nil {
+		apperror.HandleError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, letters)
+}
+
+func (h *handler) redeliverDeadLetter(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		apperror.HandleError(w, apperror.BadRequestError("invalid dead letter id"))
+		return
+	}
+	if err = h.webhooks.Redeliver(r.Context(), id); err != nil {
+		apperror.HandleError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
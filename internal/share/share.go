@@ -0,0 +1,319 @@
+// Package share keeps the links that let anyone with the token download a single file.
+package share
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/bbolt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var linksBucket = []byte("share_links")
+
+// passwordCost is the bcrypt cost of the link passwords.
+var passwordCost = bcrypt.DefaultCost
+
+const (
+	// maxPasswordAttempts wrong passwords in a row lock a link's password out for passwordLockout.
+	maxPasswordAttempts = 5
+	passwordLockout     = 15 * time.Minute
+)
+
+var (
+	// ErrPasswordRequired means the link has a password and none was given.
+	ErrPasswordRequired = errors.New("err share link password required")
+	// ErrWrongPassword means the password given doesn't match the one of the link.
+	ErrWrongPassword = errors.New("err wrong share link password")
+	// ErrTooManyAttempts means the password of the link was locked out after too many wrong ones.
+	ErrTooManyAttempts = errors.New("err too many share link password attempts")
+)
+
+type Link struct {
+	ID           string     `json:"id"`
+	NoteUUID     string     `json:"note_uuid"`
+	FileID       string     `json:"file_id"`
+	CreatedBy    string     `json:"created_by,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	MaxDownloads int        `json:"max_downloads,omitempty"`
+	Downloads    int        `json:"downloads"`
+	HasPassword  bool       `json:"has_password"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+}
+
+type CreateLinkDTO struct {
+	ExpiresAt    *time.Time `json:"expires_at"`
+	MaxDownloads int        `json:"max_downloads"`
+	Password     string     `json:"password"`
+}
+
+// active reports whether the link can still be used, a link past its expiry, download limit
+// or revoked is gone for good.
+func (l *Link) active(now time.Time) bool {
+	if l.RevokedAt != nil {
+		return false
+	}
+	if l.ExpiresAt != nil && !now.Before(*l.ExpiresAt) {
+		return false
+	}
+	return l.MaxDownloads == 0 || l.Downloads < l.MaxDownloads
+}
+
+// storedLink is the persisted form of a link, neither the token nor the password is stored.
+type storedLink struct {
+	Link
+	Hash           string     `json:"hash"`
+	PasswordHash   string     `json:"password_hash,omitempty"`
+	FailedAttempts int        `json:"failed_attempts,omitempty"`
+	LockedUntil    *time.Time `json:"locked_until,omitempty"`
+}
+
+type Store struct {
+	log *logrus.Entry
+	db  *bbolt.DB
+}
+
+func NewStore(log *logrus.Logger, db *bbolt.DB) (*Store, error) {
+	err := db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(linksBucket)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to init share links bucket. err: %w", err)
+	}
+	return &Store{
+		log: log.WithField("module", "share"),
+		db:  db,
+	}, nil
+}
+
+// Create stores a new link to a file and returns it together with the token, which is shown only once.
+func (s *Store) Create(_ context.Context, noteUUID, fileID, createdBy string, dto CreateLinkDTO) (*Link, string, error) {
+	now := time.Now().UTC()
+	if dto.ExpiresAt != nil && !dto.ExpiresAt.After(now) {
+		return nil, "", apperror.BadRequestError("expires_at must be in the future")
+	}
+	if dto.MaxDownloads < 0 {
+		return nil, "", apperror.BadRequestError("max_downloads must not be negative")
+	}
+	id, err := randomString(8, hex.EncodeToString)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := randomString(32, base64.RawURLEncoding.EncodeToString)
+	if err != nil {
+		return nil, "", err
+	}
+	stored := storedLink{
+		Link: Link{
+			ID:           id,
+			NoteUUID:     noteUUID,
+			FileID:       fileID,
+			CreatedBy:    createdBy,
+			CreatedAt:    now,
+			ExpiresAt:    dto.ExpiresAt,
+			MaxDownloads: dto.MaxDownloads,
+			HasPassword:  dto.Password != "",
+		},
+		Hash: hashSecret(secret),
+	}
+	if dto.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(dto.Password), passwordCost)
+		if err != nil {
+			return nil, "", apperror.BadRequestError("invalid password")
+		}
+		stored.PasswordHash = string(hash)
+	}
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		return put(tx, &stored)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	s.log.Infof("share link %s to file %s of note %s created", id, fileID, noteUUID)
+	return &stored.Link, id + "." + secret, nil
+}
+
+// List returns the links to a file, the revoked and used up ones too.
+func (s *Store) List(_ context.Context, noteUUID, fileID string) ([]*Link, error) {
+	links := make([]*Link, 0)
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(linksBucket).ForEach(func(_, v []byte) error {
+			var stored storedLink
+			if err := json.Unmarshal(v, &stored); err != nil {
+				return err
+			}
+			if stored.NoteUUID == noteUUID && stored.FileID == fileID {
+				links = append(links, &stored.Link)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list share links. err: %w", err)
+	}
+	return links, nil
+}
+
+// Revoke disables a link to a file right away.
+func (s *Store) Revoke(_ context.Context, noteUUID, fileID, id string) error {
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		stored, err := get(tx, id)
+		if err != nil {
+			return err
+		}
+		if stored.NoteUUID != noteUUID || stored.FileID != fileID {
+			return apperror.ErrNotFound
+		}
+		if stored.RevokedAt != nil {
+			return nil
+		}
+		now := time.Now().UTC()
+		stored.RevokedAt = &now
+		return put(tx, stored)
+	})
+	if err != nil {
+		return err
+	}
+	s.log.Infof("share link %s revoked", id)
+	return nil
+}
+
+// Resolve returns the link of a token if it can be used with the password, without counting
+// a download, see CountDownload. It fails with apperror.ErrNotFound for unknown tokens, with
+// apperror.ErrGone for links that were revoked, expired or used up, with ErrPasswordRequired
+// or ErrWrongPassword when the password doesn't match and with ErrTooManyAttempts after
+// maxPasswordAttempts wrong passwords in a row, until passwordLockout passed.
+func (s *Store) Resolve(_ context.Context, token, password string) (*Link, error) {
+	id, secret, ok := strings.Cut(token, ".")
+	if !ok || id == "" || secret == "" {
+		return nil, apperror.ErrNotFound
+	}
+	var stored *storedLink
+	err := s.db.View(func(tx *bbolt.Tx) (err error) {
+		stored, err = get(tx, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(stored.Hash), []byte(hashSecret(secret))) != 1 {
+		return nil, apperror.ErrNotFound
+	}
+	now := time.Now()
+	if !stored.active(now) {
+		return nil, apperror.ErrGone
+	}
+	if stored.PasswordHash == "" {
+		return &stored.Link, nil
+	}
+	if stored.LockedUntil != nil && now.Before(*stored.LockedUntil) {
+		return nil, ErrTooManyAttempts
+	}
+	if password == "" {
+		return nil, ErrPasswordRequired
+	}
+	// bcrypt is slow on purpose, so it runs outside of the write transactions of the shared database
+	if bcrypt.CompareHashAndPassword([]byte(stored.PasswordHash), []byte(password)) != nil {
+		if err = s.passwordAttempt(id, false); err != nil {
+			return nil, err
+		}
+		return nil, ErrWrongPassword
+	}
+	if stored.FailedAttempts > 0 {
+		if err = s.passwordAttempt(id, true); err != nil {
+			return nil, err
+		}
+	}
+	return &stored.Link, nil
+}
+
+// passwordAttempt counts a wrong password, locking the password out after too many,
+// or resets the count after a right one.
+func (s *Store) passwordAttempt(id string, ok bool) error {
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		stored, err := get(tx, id)
+		if err != nil {
+			return err
+		}
+		if ok {
+			stored.FailedAttempts, stored.LockedUntil = 0, nil
+			return put(tx, stored)
+		}
+		stored.FailedAttempts++
+		if stored.FailedAttempts >= maxPasswordAttempts {
+			lockedUntil := time.Now().UTC().Add(passwordLockout)
+			stored.FailedAttempts, stored.LockedUntil = 0, &lockedUntil
+			s.log.Warnf("password of share link %s locked out after %d wrong attempts", id, maxPasswordAttempts)
+		}
+		return put(tx, stored)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record share link password attempt. err: %w", err)
+	}
+	return nil
+}
+
+// CountDownload counts a download of a resolved link. It fails with apperror.ErrGone if the link
+// was revoked, expired or used up in the meantime.
+func (s *Store) CountDownload(_ context.Context, id string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		stored, err := get(tx, id)
+		if err != nil {
+			return err
+		}
+		if !stored.active(time.Now()) {
+			return apperror.ErrGone
+		}
+		stored.Downloads++
+		return put(tx, stored)
+	})
+}
+
+func get(tx *bbolt.Tx, id string) (*storedLink, error) {
+	v := tx.Bucket(linksBucket).Get([]byte(id))
+	if v == nil {
+		return nil, apperror.ErrNotFound
+	}
+	stored := &storedLink{}
+	if err := json.Unmarshal(v, stored); err != nil {
+		return nil, fmt.Errorf("failed to get share link %s. err: %w", id, err)
+	}
+	return stored, nil
+}
+
+func put(tx *bbolt.Tx, stored *storedLink) error {
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return fmt.Errorf("failed to marshal share link. err: %w", err)
+	}
+	if err = tx.Bucket(linksBucket).Put([]byte(stored.ID), data); err != nil {
+		return fmt.Errorf("failed to save share link %s. err: %w", stored.ID, err)
+	}
+	return nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomString(n int, encode func([]byte) string) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate random bytes. err: %w", err)
+	}
+	return encode(b), nil
+}
@@ -0,0 +1,205 @@
+package share
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/bbolt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	passwordCost = bcrypt.MinCost
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	db, err := bbolt.Open(filepath.Join(t.TempDir(), "storage.db"), 0o600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	store, err := NewStore(log, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// update changes a stored link, as time passing would.
+func update(t *testing.T, store *Store, id string, change func(stored *storedLink)) {
+	t.Helper()
+	err := store.db.Update(func(tx *bbolt.Tx) error {
+		stored, err := get(tx, id)
+		if err != nil {
+			return err
+		}
+		change(stored)
+		return put(tx, stored)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	for name, dto := range map[string]CreateLinkDTO{
+		"expired":            {ExpiresAt: &past},
+		"negative downloads": {MaxDownloads: -1},
+	} {
+		var appErr *apperror.AppError
+		if _, _, err := newTestStore(t).Create(context.Background(), "n1", "f1", "u1", dto); !errors.As(err, &appErr) {
+			t.Errorf("%s: got %v, want a bad request", name, err)
+		}
+	}
+}
+
+func TestPasswordLockout(t *testing.T) {
+	type attempt struct {
+		password string
+		err      error
+	}
+	wrong := attempt{password: "wrong", err: ErrWrongPassword}
+	right := attempt{password: "secret"}
+	tests := []struct {
+		name     string
+		attempts []attempt
+		// lifted ends the lockout before the last attempt
+		lifted bool
+	}{
+		{name: "right password", attempts: []attempt{right, right}},
+		{name: "no password", attempts: []attempt{{err: ErrPasswordRequired}, right}},
+		{name: "right password resets the count", attempts: []attempt{wrong, wrong, wrong, wrong, right, wrong, wrong, right}},
+		{
+			name:     "locked out",
+			attempts: []attempt{wrong, wrong, wrong, wrong, wrong, {password: "secret", err: ErrTooManyAttempts}},
+		},
+		{name: "lockout lifted", attempts: []attempt{wrong, wrong, wrong, wrong, wrong, right}, lifted: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore(t)
+			ctx := context.Background()
+			link, token, err := store.Create(ctx, "n1", "f1", "u1", CreateLinkDTO{Password: "secret"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, a := range tt.attempts {
+				if tt.lifted && i == len(tt.attempts)-1 {
+					update(t, store, link.ID, func(stored *storedLink) {
+						lockedUntil := time.Now().Add(-time.Second)
+						stored.LockedUntil = &lockedUntil
+					})
+				}
+				resolved, err := store.Resolve(ctx, token, a.password)
+				if !errors.Is(err, a.err) {
+					t.Fatalf("attempt %d: got %v, want %v", i, err, a.err)
+				}
+				if err == nil && resolved.ID != link.ID {
+					t.Fatalf("attempt %d: resolved link %s, want %s", i, resolved.ID, link.ID)
+				}
+			}
+		})
+	}
+}
+
+func TestDownloadLimits(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxDownloads int
+		// prepare changes the link after it's created
+		prepare   func(t *testing.T, store *Store, link *Link)
+		downloads int
+		token     func(token string) string
+		err       error
+	}{
+		{name: "unlimited", downloads: 5},
+		{name: "within the limit", maxDownloads: 3, downloads: 3},
+		{name: "used up", maxDownloads: 2, downloads: 3, err: apperror.ErrGone},
+		{
+			name: "revoked",
+			prepare: func(t *testing.T, store *Store, link *Link) {
+				if err := store.Revoke(context.Background(), link.NoteUUID, link.FileID, link.ID); err != nil {
+					t.Fatal(err)
+				}
+			},
+			downloads: 1,
+			err:       apperror.ErrGone,
+		},
+		{
+			name: "expired",
+			prepare: func(t *testing.T, store *Store, link *Link) {
+				update(t, store, link.ID, func(stored *storedLink) {
+					expired := time.Now().Add(-time.Second)
+					stored.ExpiresAt = &expired
+				})
+			},
+			downloads: 1,
+			err:       apperror.ErrGone,
+		},
+		{name: "wrong secret", token: func(token string) string { return token + "x" }, downloads: 1, err: apperror.ErrNotFound},
+		{name: "malformed token", token: func(token string) string { return strings.Split(token, ".")[0] }, downloads: 1,
+			err: apperror.ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore(t)
+			ctx := context.Background()
+			link, token, err := store.Create(ctx, "n1", "f1", "u1", CreateLinkDTO{MaxDownloads: tt.maxDownloads})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.prepare != nil {
+				tt.prepare(t, store, link)
+			}
+			if tt.token != nil {
+				token = tt.token(token)
+			}
+			for i := 0; i < tt.downloads; i++ {
+				resolved, err := store.Resolve(ctx, token, "")
+				if err == nil {
+					err = store.CountDownload(ctx, resolved.ID)
+				}
+				last := i == tt.downloads-1
+				if last && !errors.Is(err, tt.err) || !last && err != nil {
+					t.Fatalf("download %d: got %v, want %v", i+1, err, tt.err)
+				}
+			}
+		})
+	}
+}
+
+func TestConcurrentLastDownload(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	link, token, err := store.Create(ctx, "n1", "f1", "u1", CreateLinkDTO{MaxDownloads: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// both requests resolve the link before either counts its download, only one gets the file
+	for i := 0; i < 2; i++ {
+		if _, err = store.Resolve(ctx, token, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = store.CountDownload(ctx, link.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.CountDownload(ctx, link.ID); !errors.Is(err, apperror.ErrGone) {
+		t.Fatalf("got %v, want the second download refused", err)
+	}
+	links, err := store.List(ctx, "n1", "f1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 1 || links[0].Downloads != 1 {
+		t.Fatalf("got %+v, want one link downloaded once", links)
+	}
+}
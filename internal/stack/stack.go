@@ -0,0 +1,202 @@
+// Package stack builds the file storage and the service on top of it from the environment,
+// so that the service and storagectl -direct write to the same replicas, caches and tiers.
+package stack
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gerladeno/media-storage-service/internal/fulltext"
+	"github.com/gerladeno/media-storage-service/internal/storage"
+	"github.com/gerladeno/media-storage-service/pkg/metrics"
+	"github.com/gerladeno/media-storage-service/pkg/minio"
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/bbolt"
+)
+
+// Stack is the storage the files are kept in and the service over it. Tiered and Replicated are
+// set when the cold tier and the replicas are configured, their Run is left to the caller.
+type Stack struct {
+	Storage    storage.Storage
+	Tiered     *storage.TieredStorage
+	Replicated *storage.ReplicatedStorage
+	Service    *storage.Service
+}
+
+// FromEnv builds the stack the MINIO_*, CACHE_*, TIER_* and REPLICATION_* variables describe.
+// Without background the caller doesn't run the replication queue, so the replicas are written
+// synchronously whatever REPLICATION_MODE says.
+func FromEnv(log *logrus.Logger, db *bbolt.DB, host string, background bool) (*Stack, error) {
+	collector := metrics.NewBackend(host).AutoRegister()
+	fileStorage, err := storage.New(log, os.Getenv("MINIO_ENDPOINT"), os.Getenv("MINIO_ACCESS_KEY"),
+		os.Getenv("MINIO_SECRET_KEY"), minioOptions(collector)...)
+	if err != nil {
+		return nil, err
+	}
+	if os.Getenv("CACHE_MEMORY_BYTES") != "" || os.Getenv("CACHE_DIR") != "" {
+		if fileStorage, err = cachedFromEnv(log, fileStorage, host); err != nil {
+			return nil, err
+		}
+	}
+	s := &Stack{}
+	if os.Getenv("TIER_COLD_DIR") != "" || os.Getenv("TIER_COLD_ENDPOINT") != "" {
+		if s.Tiered, err = tieredFromEnv(log, fileStorage, db, collector, host); err != nil {
+			return nil, err
+		}
+		fileStorage = s.Tiered
+	}
+	if endpoints := os.Getenv("MINIO_REPLICA_ENDPOINTS"); endpoints != "" {
+		if s.Replicated, err = replicatedFromEnv(log, fileStorage, endpoints, collector, host, background); err != nil {
+			return nil, err
+		}
+		fileStorage = s.Replicated
+	}
+	s.Storage = fileStorage
+	fileIndex, err := storage.NewIndex(db)
+	if err != nil {
+		return nil, err
+	}
+	textIndex, err := fulltext.NewIndex(db)
+	if err != nil {
+		return nil, err
+	}
+	if s.Service, err = storage.NewService(log, fileStorage, fileIndex, textIndex); err != nil {
+		return nil, err
+	}
+	locks, err := storage.NewLockStore(db)
+	if err != nil {
+		return nil, err
+	}
+	s.Service.SetLocks(locks)
+	if s.Tiered != nil {
+		s.Tiered.SetLocks(locks)
+	}
+	return s, nil
+}
+
+// cachedFromEnv caches the files read from the storage, the small ones in up to CACHE_MEMORY_BYTES
+// of memory and the larger ones in up to CACHE_DISK_BYTES in the directory CACHE_DIR.
+func cachedFromEnv(log *logrus.Logger, s storage.Storage, host string) (storage.Storage, error) {
+	opts := storage.DefaultCacheOptions()
+	opts.Dir = os.Getenv("CACHE_DIR")
+	for key, size := range map[string]*int64{"CACHE_MEMORY_BYTES": &opts.MemoryBytes, "CACHE_DISK_BYTES": &opts.DiskBytes} {
+		value := os.Getenv(key)
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 0 {
+			return nil, fmt.Errorf("invalid %s %q", key, value)
+		}
+		*size = parsed
+	}
+	return storage.NewCached(log, s, opts, metrics.NewCache(host).AutoRegister())
+}
+
+// tieredFromEnv moves the files not read for TIER_COLD_AFTER_DAYS from the primary storage
+// to the directory TIER_COLD_DIR or, if it's not set, to the MinIO at TIER_COLD_ENDPOINT using
+// TIER_COLD_ACCESS_KEY and TIER_COLD_SECRET_KEY. TIER_INTERVAL sets how often they are looked for
+// and TIER_PROMOTE=true moves the files read from the cold tier back.
+func tieredFromEnv(log *logrus.Logger, hot storage.Storage, db *bbolt.DB, collector *metrics.Backend, host string,
+) (*storage.TieredStorage, error) {
+	opts := storage.DefaultTieringOptions()
+	if value := os.Getenv("TIER_COLD_AFTER_DAYS"); value != "" {
+		days, err := strconv.Atoi(value)
+		if err != nil || days <= 0 {
+			return nil, fmt.Errorf("invalid TIER_COLD_AFTER_DAYS %q", value)
+		}
+		opts.ColdAfter = time.Duration(days) * 24 * time.Hour
+	}
+	if value := os.Getenv("TIER_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid TIER_INTERVAL %q", value)
+		}
+		opts.Interval = interval
+	}
+	opts.Promote = os.Getenv("TIER_PROMOTE") == "true"
+	var (
+		cold storage.Storage
+		err  error
+	)
+	if dir := os.Getenv("TIER_COLD_DIR"); dir != "" {
+		cold, err = storage.NewFilesystem(log, dir)
+	} else {
+		cold, err = storage.New(log, os.Getenv("TIER_COLD_ENDPOINT"), os.Getenv("TIER_COLD_ACCESS_KEY"),
+			os.Getenv("TIER_COLD_SECRET_KEY"), minio.WithMetrics(collector))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cold storage. err: %w", err)
+	}
+	return storage.NewTiered(log, hot, cold, db, opts, metrics.NewTiering(host).AutoRegister())
+}
+
+// replicatedFromEnv puts the replicas on the endpoints in front of the primary storage. They use
+// MINIO_REPLICA_ACCESS_KEY and MINIO_REPLICA_SECRET_KEY, falling back to the keys of the primary.
+// REPLICATION_MODE (sync or async), REPLICATION_QUEUE_SIZE, REPLICATION_REPAIR_INTERVAL
+// (a duration, 0 repairs only on demand) and REPLICATION_REPAIR_REMOVE_EXTRA (true to let
+// the scheduled repairs remove replica objects the primary doesn't have) override the defaults.
+func replicatedFromEnv(log *logrus.Logger, primary storage.Storage, endpoints string, collector *metrics.Backend,
+	host string, background bool,
+) (*storage.ReplicatedStorage, error) {
+	opts := storage.DefaultReplicationOptions()
+	if mode := os.Getenv("REPLICATION_MODE"); mode != "" {
+		if mode != storage.ReplicationSync && mode != storage.ReplicationAsync {
+			return nil, fmt.Errorf("invalid REPLICATION_MODE %q", mode)
+		}
+		opts.Mode = mode
+	}
+	if !background {
+		opts.Mode = storage.ReplicationSync
+	}
+	if value := os.Getenv("REPLICATION_QUEUE_SIZE"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid REPLICATION_QUEUE_SIZE %q", value)
+		}
+		opts.QueueSize = size
+	}
+	if value := os.Getenv("REPLICATION_REPAIR_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval < 0 {
+			return nil, fmt.Errorf("invalid REPLICATION_REPAIR_INTERVAL %q", value)
+		}
+		opts.RepairInterval = interval
+	}
+	if value := os.Getenv("REPLICATION_REPAIR_REMOVE_EXTRA"); value != "" {
+		removeExtra, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid REPLICATION_REPAIR_REMOVE_EXTRA %q", value)
+		}
+		opts.RemoveExtra = removeExtra
+	}
+	accessKey, secretKey := os.Getenv("MINIO_REPLICA_ACCESS_KEY"), os.Getenv("MINIO_REPLICA_SECRET_KEY")
+	if accessKey == "" {
+		accessKey, secretKey = os.Getenv("MINIO_ACCESS_KEY"), os.Getenv("MINIO_SECRET_KEY")
+	}
+	var replicas []storage.Replica
+	for _, endpoint := range strings.Split(endpoints, ",") {
+		if endpoint = strings.TrimSpace(endpoint); endpoint == "" {
+			continue
+		}
+		replica, err := storage.New(log, endpoint, accessKey, secretKey, minioOptions(collector)...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create replica %s. err: %w", endpoint, err)
+		}
+		replicas = append(replicas, storage.Replica{Name: endpoint, Storage: replica})
+	}
+	return storage.NewReplicated(log, primary, replicas, opts, metrics.NewReplication(host).AutoRegister()), nil
+}
+
+// minioOptions sets up the clients of the primary storage and its replicas. MINIO_OBJECT_LOCKING
+// creates new buckets with object locking, so the storage enforces the retention of files too.
+func minioOptions(collector *metrics.Backend) []minio.Option {
+	opts := []minio.Option{minio.WithMetrics(collector)}
+	if os.Getenv("MINIO_OBJECT_LOCKING") == "true" {
+		opts = append(opts, minio.WithObjectLocking())
+	}
+	return opts
+}
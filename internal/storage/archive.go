@@ -0,0 +1,274 @@
+package storage
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+)
+
+const (
+	ArchiveZip   = "zip"
+	ArchiveTarGz = "tar.gz"
+
+	manifestName = "manifest.json"
+)
+
+type ArchiveOptions struct {
+	Format   string
+	FileIDs  []string
+	Manifest bool
+}
+
+// Archive is a prepared export of a note. Nothing is read from the storage until WriteTo is called.
+type Archive struct {
+	// open reads the files verifying their checksums, so a corrupted one fails the archive
+	open     func(ctx context.Context, noteUUID, fileID string) (io.ReadCloser, *File, error)
+	noteUUID string
+	format   string
+	manifest bool
+	entries  []archiveEntry
+}
+
+type archiveEntry struct {
+	Name string `json:"name"`
+	File *File  `json:"-"`
+}
+
+type manifestEntry struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Path       string    `json:"path"`
+	Size       int64     `json:"size"`
+	ModifiedAt time.Time `json:"modified_at"`
+}
+
+type archiveManifest struct {
+	NoteUUID  string          `json:"note_uuid"`
+	CreatedAt time.Time       `json:"created_at"`
+	Files     []manifestEntry `json:"files"`
+}
+
+func (s *Service) NewArchive(ctx context.Context, noteUUID string, opts ArchiveOptions) (*Archive, error) {
+	if opts.Format != ArchiveZip && opts.Format != ArchiveTarGz {
+		return nil, apperror.BadRequestError(fmt.Sprintf("unsupported archive format %q", opts.Format))
+	}
+	listed, err := s.storage.ListFiles(ctx, noteUUID)
+	if err != nil {
+		return nil, err
+	}
+	files := listed[:0]
+	for _, f := range listed {
+		if checkExpired(f) == nil {
+			files = append(files, f)
+		}
+	}
+	if len(opts.FileIDs) > 0 {
+		files, err = selectFiles(files, opts.FileIDs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(files) == 0 {
+		return nil, apperror.ErrNotFound
+	}
+	a := &Archive{
+		open:     s.openVerified,
+		noteUUID: noteUUID,
+		format:   opts.Format,
+		manifest: opts.Manifest,
+	}
+	used := make(map[string]struct{}, len(files)+1)
+	if opts.Manifest {
+		used[manifestName] = struct{}{}
+	}
+	for _, f := range files {
+		a.entries = append(a.entries, archiveEntry{Name: uniqueEntryName(f, used), File: f})
+	}
+	return a, nil
+}
+
+func (a *Archive) Format() string {
+	return a.format
+}
+
+func (a *Archive) ContentType() string {
+	if a.format == ArchiveZip {
+		return "application/zip"
+	}
+	return "application/gzip"
+}
+
+func (a *Archive) FileName() string {
+	return a.noteUUID + "." + a.format
+}
+
+// WriteTo streams every entry into w, one file at a time.
+func (a *Archive) WriteTo(ctx context.Context, w io.Writer) error {
+	if a.format == ArchiveZip {
+		return a.writeZip(ctx, w)
+	}
+	return a.writeTarGz(ctx, w)
+}
+
+func (a *Archive) writeZip(ctx context.Context, w io.Writer) error {
+	zw := zip.NewWriter(w)
+	for _, e := range a.entries {
+		entry, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     e.Name,
+			Method:   zip.Deflate,
+			Modified: e.File.ModifiedAt,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create zip entry %s. err: %w", e.Name, err)
+		}
+		if err = a.copyFile(ctx, entry, e.File.ID); err != nil {
+			return err
+		}
+	}
+	if a.manifest {
+		entry, err := zw.Create(manifestName)
+		if err != nil {
+			return fmt.Errorf("failed to create zip entry %s. err: %w", manifestName, err)
+		}
+		if err = a.writeManifest(entry); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func (a *Archive) writeTarGz(ctx context.Context, w io.Writer) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	for _, e := range a.entries {
+		err := tw.WriteHeader(&tar.Header{
+			Name:    e.Name,
+			Mode:    0o644,
+			Size:    e.File.Size,
+			ModTime: e.File.ModifiedAt,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to write tar header %s. err: %w", e.Name, err)
+		}
+		if err = a.copyFile(ctx, tw, e.File.ID); err != nil {
+			return err
+		}
+	}
+	if a.manifest {
+		manifest, err := json.Marshal(a.buildManifest())
+		if err != nil {
+			return fmt.Errorf("failed to marshal manifest. err: %w", err)
+		}
+		err = tw.WriteHeader(&tar.Header{
+			Name:    manifestName,
+			Mode:    0o644,
+			Size:    int64(len(manifest)),
+			ModTime: time.Now(),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to write tar header %s. err: %w", manifestName, err)
+		}
+		if _, err = tw.Write(manifest); err != nil {
+			return fmt.Errorf("failed to write manifest. err: %w", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+func (a *Archive) copyFile(ctx context.Context, w io.Writer, fileID string) error {
+	reader, _, err := a.open(ctx, a.noteUUID, fileID)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	if _, err = io.Copy(w, reader); err != nil {
+		return fmt.Errorf("failed to copy file %s to archive. err: %w", fileID, err)
+	}
+	return nil
+}
+
+func (a *Archive) writeManifest(w io.Writer) error {
+	if err := json.NewEncoder(w).Encode(a.buildManifest()); err != nil {
+		return fmt.Errorf("failed to write manifest. err: %w", err)
+	}
+	return nil
+}
+
+func (a *Archive) buildManifest() archiveManifest {
+	m := archiveManifest{
+		NoteUUID:  a.noteUUID,
+		CreatedAt: time.Now().UTC(),
+		Files:     make([]manifestEntry, 0, len(a.entries)),
+	}
+	for _, e := range a.entries {
+		m.Files = append(m.Files, manifestEntry{
+			ID:         e.File.ID,
+			Name:       e.File.Name,
+			Path:       e.Name,
+			Size:       e.File.Size,
+			ModifiedAt: e.File.ModifiedAt,
+		})
+	}
+	return m
+}
+
+func selectFiles(files []*File, ids []string) ([]*File, error) {
+	byID := make(map[string]*File, len(files))
+	for _, f := range files {
+		byID[f.ID] = f
+	}
+	selected := make([]*File, 0, len(ids))
+	seen := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		f, ok := byID[id]
+		if !ok {
+			return nil, fmt.Errorf("file %s: %w", id, apperror.ErrNotFound)
+		}
+		selected = append(selected, f)
+	}
+	return selected, nil
+}
+
+// uniqueEntryName turns the original file name into a safe flat entry name,
+// adding a " (n)" suffix when the name is already taken.
+func uniqueEntryName(f *File, used map[string]struct{}) string {
+	name := sanitizeEntryName(f.Name)
+	if name == "" {
+		name = f.ID
+	}
+	candidate := name
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		if _, ok := used[candidate]; !ok {
+			break
+		}
+		candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+	used[candidate] = struct{}{}
+	return candidate
+}
+
+func sanitizeEntryName(name string) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == "/" || name == ".." {
+		return ""
+	}
+	return name
+}
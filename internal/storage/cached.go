@@ -0,0 +1,413 @@
+package storage
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gerladeno/media-storage-service/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	cacheMemory = "memory"
+	cacheDisk   = "disk"
+
+	cacheFilePrefix = "cached-"
+)
+
+type CacheOptions struct {
+	// MemoryBytes is the size of the in-memory cache, 0 disables it.
+	// It keeps the objects up to MemoryObjectBytes.
+	MemoryBytes       int64
+	MemoryObjectBytes int64
+	// Dir is where the larger objects up to DiskObjectBytes are cached, empty disables the disk cache.
+	Dir             string
+	DiskBytes       int64
+	DiskObjectBytes int64
+}
+
+func DefaultCacheOptions() CacheOptions {
+	return CacheOptions{
+		MemoryBytes:       64 << 20,
+		MemoryObjectBytes: 1 << 20,
+		DiskBytes:         1 << 30,
+		DiskObjectBytes:   64 << 20,
+	}
+}
+
+// CachedStorage keeps the contents of recently read files in memory or on the local disk.
+// Every read checks the ETag of the file with the storage, so a file overwritten elsewhere is
+// never served stale, and writes through the cache invalidate it right away.
+// Reads of maintenance jobs bypass the cache so they check what's actually stored.
+type CachedStorage struct {
+	Storage
+	log       *logrus.Entry
+	opts      CacheOptions
+	collector *metrics.Cache
+
+	mu     sync.Mutex
+	memory *lru
+	disk   *lru
+}
+
+func NewCached(log *logrus.Logger, s Storage, opts CacheOptions, collector *metrics.Cache) (*CachedStorage, error) {
+	c := &CachedStorage{
+		Storage:   s,
+		log:       log.WithField("module", "cache"),
+		opts:      opts,
+		collector: collector,
+		memory:    newLRU(opts.MemoryBytes),
+	}
+	if opts.Dir != "" {
+		if err := os.MkdirAll(opts.Dir, 0o750); err != nil {
+			return nil, fmt.Errorf("failed to create cache directory. err: %w", err)
+		}
+		// the index of the disk cache is kept in memory, so what's left from a previous run is unknown
+		leftovers, _ := filepath.Glob(filepath.Join(opts.Dir, cacheFilePrefix+"*"))
+		for _, path := range leftovers {
+			if err := os.Remove(path); err != nil {
+				return nil, fmt.Errorf("failed to clear cache directory. err: %w", err)
+			}
+		}
+		c.disk = newLRU(opts.DiskBytes)
+	}
+	return c, nil
+}
+
+func (c *CachedStorage) GetFile(ctx context.Context, noteUUID, fileID string) (*File, error) {
+	reader, f, err := c.OpenFile(ctx, noteUUID, fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	f.Bytes, err = ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file. err: %w", err)
+	}
+	return f, nil
+}
+
+func (c *CachedStorage) OpenFile(ctx context.Context, noteUUID, fileID string) (io.ReadCloser, *File, error) {
+	if isMaintenance(ctx) {
+		return c.Storage.OpenFile(ctx, noteUUID, fileID)
+	}
+	key := cacheKey(noteUUID, fileID)
+	f, err := c.Storage.StatFile(ctx, noteUUID, fileID)
+	if err != nil {
+		c.invalidate(key)
+		return nil, nil, err
+	}
+	if reader, layer := c.get(key, fileETag(f)); reader != nil {
+		c.observe(layer, true)
+		return reader, f, nil
+	}
+	c.observe("", false)
+	reader, f, err := c.Storage.OpenFile(ctx, noteUUID, fileID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.fill(reader, key, f), f, nil
+}
+
+func (c *CachedStorage) CreateFile(ctx context.Context, noteUUID string, file *File) error {
+	c.invalidate(cacheKey(noteUUID, file.ID))
+	return c.Storage.CreateFile(ctx, noteUUID, file)
+}
+
+func (c *CachedStorage) DeleteFile(ctx context.Context, noteUUID, fileID string) error {
+	c.invalidate(cacheKey(noteUUID, fileID))
+	return c.Storage.DeleteFile(ctx, noteUUID, fileID)
+}
+
+func (c *CachedStorage) CopyFile(ctx context.Context, srcNoteUUID, fileID, dstNoteUUID string) error {
+	c.invalidate(cacheKey(dstNoteUUID, fileID))
+	return c.Storage.CopyFile(ctx, srcNoteUUID, fileID, dstNoteUUID)
+}
+
+// LockFile forwards the lock to the cached storage if it enforces locks.
+func (c *CachedStorage) LockFile(ctx context.Context, noteUUID, fileID string, retainUntil *time.Time, legalHold bool) error {
+	if locker, ok := c.Storage.(Locker); ok {
+		return locker.LockFile(ctx, noteUUID, fileID, retainUntil, legalHold)
+	}
+	return nil
+}
+
+// Health forwards the health of the cached storage.
+func (c *CachedStorage) Health() error {
+	if checker, ok := c.Storage.(HealthChecker); ok {
+		return checker.Health()
+	}
+	return nil
+}
+
+// get returns a reader of the cached contents if their ETag is still current.
+func (c *CachedStorage) get(key, etag string) (io.ReadCloser, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, layer := range []*lru{c.memory, c.disk} {
+		if layer == nil {
+			continue
+		}
+		entry, ok := layer.get(key)
+		if !ok {
+			continue
+		}
+		if entry.etag != etag {
+			c.removeLocked(key)
+			return nil, ""
+		}
+		if entry.path == "" {
+			return ioutil.NopCloser(bytes.NewReader(entry.data)), cacheMemory
+		}
+		// an open file stays readable after it's evicted and removed
+		file, err := os.Open(entry.path)
+		if err != nil {
+			c.log.Warnf("failed to open cached file %s. err: %v", entry.path, err)
+			c.removeLocked(key)
+			return nil, ""
+		}
+		return file, cacheDisk
+	}
+	return nil, ""
+}
+
+// fill wraps a reader of the storage to cache the contents once they are read completely.
+func (c *CachedStorage) fill(reader io.ReadCloser, key string, f *File) io.ReadCloser {
+	switch {
+	case f.Size <= c.opts.MemoryObjectBytes && f.Size <= c.opts.MemoryBytes:
+		return &cachingReader{ReadCloser: reader, cache: c, key: key, file: f, hash: sha256.New(), buf: &bytes.Buffer{}}
+	case c.disk != nil && f.Size <= c.opts.DiskObjectBytes && f.Size <= c.opts.DiskBytes:
+		tmp, err := ioutil.TempFile(c.opts.Dir, cacheFilePrefix)
+		if err != nil {
+			c.log.Warnf("failed to create cache file. err: %v", err)
+			return reader
+		}
+		return &cachingReader{ReadCloser: reader, cache: c, key: key, file: f, hash: sha256.New(), tmp: tmp}
+	}
+	return reader
+}
+
+func (c *CachedStorage) add(entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(entry.key)
+	layer, name := c.memory, cacheMemory
+	if entry.path != "" {
+		layer, name = c.disk, cacheDisk
+	}
+	for _, evicted := range layer.add(entry) {
+		c.drop(evicted)
+		if c.collector != nil {
+			c.collector.EvictionsTotal.WithLabelValues(name).Inc()
+		}
+	}
+	c.observeSize()
+}
+
+func (c *CachedStorage) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(key)
+	c.observeSize()
+}
+
+func (c *CachedStorage) removeLocked(key string) {
+	for _, layer := range []*lru{c.memory, c.disk} {
+		if layer == nil {
+			continue
+		}
+		if entry, ok := layer.remove(key); ok {
+			c.drop(entry)
+		}
+	}
+}
+
+func (c *CachedStorage) drop(entry *cacheEntry) {
+	if entry.path == "" {
+		return
+	}
+	if err := os.Remove(entry.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		c.log.Warnf("failed to remove cached file %s. err: %v", entry.path, err)
+	}
+}
+
+func (c *CachedStorage) observe(layer string, hit bool) {
+	if c.collector == nil {
+		return
+	}
+	if hit {
+		c.collector.HitsTotal.WithLabelValues(layer).Inc()
+		return
+	}
+	c.collector.MissesTotal.Inc()
+}
+
+func (c *CachedStorage) observeSize() {
+	if c.collector == nil {
+		return
+	}
+	c.collector.Bytes.WithLabelValues(cacheMemory).Set(float64(c.memory.size))
+	if c.disk != nil {
+		c.collector.Bytes.WithLabelValues(cacheDisk).Set(float64(c.disk.size))
+	}
+}
+
+// cachingReader copies the contents into memory or a file of the disk cache as they are read and adds
+// them to the cache at the end if they are complete and match the checksum of the file.
+type cachingReader struct {
+	io.ReadCloser
+	cache *CachedStorage
+	key   string
+	file  *File
+	hash  hash.Hash
+	buf   *bytes.Buffer
+	tmp   *os.File
+	read  int64
+	done  bool
+}
+
+func (r *cachingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if !r.done && n > 0 {
+		r.read += int64(n)
+		r.hash.Write(p[:n])
+		var writeErr error
+		if r.tmp != nil {
+			_, writeErr = r.tmp.Write(p[:n])
+		} else {
+			r.buf.Write(p[:n])
+		}
+		if writeErr != nil || r.read > r.file.Size {
+			r.abandon()
+		}
+	}
+	if err == io.EOF && !r.done { //nolint:errorlint
+		r.commit()
+	}
+	return n, err
+}
+
+func (r *cachingReader) Close() error {
+	r.abandon()
+	return r.ReadCloser.Close()
+}
+
+func (r *cachingReader) commit() {
+	r.done = true
+	if r.read != r.file.Size {
+		r.cleanup()
+		return
+	}
+	if r.file.Checksum != "" && hex.EncodeToString(r.hash.Sum(nil)) != r.file.Checksum {
+		r.cleanup()
+		return
+	}
+	entry := &cacheEntry{key: r.key, etag: fileETag(r.file), size: r.read}
+	if r.tmp == nil {
+		entry.data = r.buf.Bytes()
+		r.cache.add(entry)
+		return
+	}
+	// every fill gets a file of its own, so replacing an entry never removes the file of its successor
+	entry.path = r.tmp.Name()
+	if err := r.tmp.Close(); err != nil {
+		r.cleanup()
+		return
+	}
+	r.cache.add(entry)
+}
+
+func (r *cachingReader) abandon() {
+	if !r.done {
+		r.done = true
+		r.cleanup()
+	}
+}
+
+func (r *cachingReader) cleanup() {
+	r.buf = nil
+	if r.tmp != nil {
+		_ = r.tmp.Close()
+		_ = os.Remove(r.tmp.Name())
+	}
+}
+
+// fileETag identifies the contents of a file, by the checksum if it's known.
+func fileETag(f *File) string {
+	if f.Checksum != "" {
+		return f.Checksum
+	}
+	return strconv.FormatInt(f.Size, 10) + "-" + strconv.FormatInt(f.ModifiedAt.UnixNano(), 10)
+}
+
+func cacheKey(noteUUID, fileID string) string {
+	return noteUUID + "\x00" + fileID
+}
+
+type cacheEntry struct {
+	key  string
+	etag string
+	size int64
+	// data holds the contents of an entry of the memory cache, path the file of one of the disk cache.
+	data []byte
+	path string
+}
+
+// lru holds entries up to a total size and evicts the least recently used ones first.
+type lru struct {
+	capacity int64
+	size     int64
+	order    *list.List
+	items    map[string]*list.Element
+}
+
+func newLRU(capacity int64) *lru {
+	return &lru{capacity: capacity, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (l *lru) get(key string) (*cacheEntry, bool) {
+	elem, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	l.order.MoveToFront(elem)
+	return elem.Value.(*cacheEntry), true
+}
+
+// add inserts an entry and returns the entries evicted to make room for it.
+func (l *lru) add(entry *cacheEntry) []*cacheEntry {
+	var evicted []*cacheEntry
+	for l.size+entry.size > l.capacity && l.order.Len() > 0 {
+		oldest := l.order.Back().Value.(*cacheEntry)
+		l.remove(oldest.key)
+		evicted = append(evicted, oldest)
+	}
+	l.items[entry.key] = l.order.PushFront(entry)
+	l.size += entry.size
+	return evicted
+}
+
+func (l *lru) remove(key string) (*cacheEntry, bool) {
+	elem, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	l.order.Remove(elem)
+	delete(l.items, key)
+	entry := elem.Value.(*cacheEntry)
+	l.size -= entry.size
+	return entry, true
+}
@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+	"go.etcd.io/bbolt"
+)
+
+const (
+	ChangeCreated = "created"
+	ChangeUpdated = "updated"
+	ChangeDeleted = "deleted"
+)
+
+var (
+	changesBucket       = []byte("changes")
+	latestChangesBucket = []byte("changes_latest")
+)
+
+// Change is an entry of the change log. The log keeps only the latest change of every file,
+// so a client behind the cursor may see a file as updated without having seen it created,
+// or as deleted without knowing it at all. Deleted files stay in the log as tombstones.
+type Change struct {
+	Seq       uint64      `json:"-"`
+	Type      string      `json:"type"`
+	NoteUUID  string      `json:"note_uuid"`
+	FileID    string      `json:"file_id"`
+	Owner     string      `json:"owner,omitempty"`
+	File      *IndexEntry `json:"file,omitempty"`
+	ChangedAt time.Time   `json:"changed_at"`
+}
+
+type ChangesQuery struct {
+	// Cursor is the one returned by the previous call, empty starts from the beginning of the log.
+	Cursor    string
+	NoteUUIDs []string
+	Owner     string
+	Limit     int
+}
+
+type ChangeSet struct {
+	Changes []*Change `json:"changes"`
+	Cursor  string    `json:"cursor"`
+	HasMore bool      `json:"has_more"`
+}
+
+func (q ChangesQuery) matches(c *Change) bool {
+	if len(q.NoteUUIDs) > 0 {
+		for _, noteUUID := range q.NoteUUIDs {
+			if noteUUID == c.NoteUUID {
+				return true
+			}
+		}
+		return false
+	}
+	return q.Owner == "" || q.Owner == c.Owner
+}
+
+// Changes returns the changes of the files in scope made after the cursor, oldest first.
+func (s *Service) Changes(ctx context.Context, q ChangesQuery) (*ChangeSet, error) {
+	return s.index.Changes(ctx, q)
+}
+
+func (i *boltIndex) Changes(_ context.Context, q ChangesQuery) (*ChangeSet, error) {
+	since, err := decodeCursor(q.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	set := &ChangeSet{Changes: []*Change{}}
+	err = i.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(changesBucket)
+		last := since
+		c := bucket.Cursor()
+		for k, v := c.Seek(seqKey(since + 1)); k != nil; k, v = c.Next() {
+			if q.Limit > 0 && len(set.Changes) == q.Limit {
+				set.HasMore = true
+				break
+			}
+			var change Change
+			if err := json.Unmarshal(v, &change); err != nil {
+				return err
+			}
+			change.Seq = binary.BigEndian.Uint64(k)
+			last = change.Seq
+			if q.matches(&change) {
+				set.Changes = append(set.Changes, &change)
+			}
+		}
+		if !set.HasMore && bucket.Sequence() > last {
+			last = bucket.Sequence()
+		}
+		set.Cursor = encodeCursor(last)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read change log. err: %w", err)
+	}
+	return set, nil
+}
+
+// appendChange logs the change and drops the previous change of the same file.
+func appendChange(tx *bbolt.Tx, change *Change) error {
+	changes, latest := tx.Bucket(changesBucket), tx.Bucket(latestChangesBucket)
+	key := indexKey(change.NoteUUID, change.FileID)
+	if prev := latest.Get(key); prev != nil {
+		if err := changes.Delete(prev); err != nil {
+			return err
+		}
+	}
+	seq, err := changes.NextSequence()
+	if err != nil {
+		return err
+	}
+	change.Seq = seq
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	if err = changes.Put(seqKey(seq), data); err != nil {
+		return err
+	}
+	return latest.Put(key, seqKey(seq))
+}
+
+func encodeCursor(seq uint64) string {
+	return base64.RawURLEncoding.EncodeToString(seqKey(seq))
+}
+
+func decodeCursor(cursor string) (uint64, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(b) != 8 {
+		return 0, apperror.BadRequestError("invalid cursor")
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5" //nolint:gosec
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+	"github.com/gerladeno/media-storage-service/pkg/metrics"
+)
+
+// Checksums are the digests a client sent along with the contents, nil ones aren't checked.
+type Checksums struct {
+	MD5    []byte
+	SHA256 []byte
+}
+
+func (c Checksums) verify(content []byte) error {
+	if c.MD5 != nil {
+		sum := md5.Sum(content) //nolint:gosec
+		if !bytes.Equal(sum[:], c.MD5) {
+			return fmt.Errorf("md5 of the contents is %s: %w", hex.EncodeToString(sum[:]), apperror.ErrChecksumMismatch)
+		}
+	}
+	if c.SHA256 != nil {
+		sum := sha256.Sum256(content)
+		if !bytes.Equal(sum[:], c.SHA256) {
+			return fmt.Errorf("sha256 of the contents is %s: %w", hex.EncodeToString(sum[:]), apperror.ErrChecksumMismatch)
+		}
+	}
+	return nil
+}
+
+// SetIntegrityMetrics makes the service count the files found not to match their checksum.
+func (s *Service) SetIntegrityMetrics(collector *metrics.Integrity) {
+	s.integrity = collector
+}
+
+// reportCorruption logs and counts a file whose contents don't match its checksum.
+func (s *Service) reportCorruption(operation, noteUUID, fileID, expected, actual string) {
+	s.log.Errorf("file %s of note %s is corrupted, checksum %s, expected %s", fileID, noteUUID, actual, expected)
+	if s.integrity != nil {
+		s.integrity.ChecksumMismatchTotal.WithLabelValues(operation).Inc()
+	}
+}
+
+// verifyingReader hashes the contents as they are read. If they don't match the expected
+// checksum the final read fails with apperror.ErrChecksumMismatch instead of io.EOF,
+// so a consumer never takes corrupted contents for a complete file.
+type verifyingReader struct {
+	io.ReadCloser
+	hash       hash.Hash
+	expected   string
+	onMismatch func(actual string)
+	done       bool
+}
+
+func newVerifyingReader(r io.ReadCloser, expected string, onMismatch func(actual string)) *verifyingReader {
+	return &verifyingReader{ReadCloser: r, hash: sha256.New(), expected: expected, onMismatch: onMismatch}
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF && !r.done { //nolint:errorlint
+		r.done = true
+		if actual := hex.EncodeToString(r.hash.Sum(nil)); actual != r.expected {
+			r.onMismatch(actual)
+			return n, fmt.Errorf("checksum of the contents is %s, expected %s: %w", actual, r.expected, apperror.ErrChecksumMismatch)
+		}
+	}
+	return n, err
+}
+
+// openVerified opens a file for reading and verifies its contents against the stored checksum,
+// or the indexed one for files stored before checksums were kept with the contents.
+func (s *Service) openVerified(ctx context.Context, noteUUID, fileID string) (io.ReadCloser, *File, error) {
+	reader, f, err := s.storage.OpenFile(ctx, noteUUID, fileID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if f.Checksum == "" {
+		if entry, err := s.index.Get(ctx, noteUUID, fileID); err == nil {
+			f.Checksum = entry.Checksum
+		}
+	}
+	if f.Checksum == "" {
+		return reader, f, nil
+	}
+	expected := f.Checksum
+	return newVerifyingReader(reader, expected, func(actual string) {
+		s.reportCorruption("download", noteUUID, fileID, expected, actual)
+	}), f, nil
+}
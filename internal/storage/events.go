@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+const (
+	EventFileCreated = "file.created"
+	EventFileDeleted = "file.deleted"
+	EventFileUpdated = "file.updated"
+	// EventFileRenamed is opt-in: renames are recorded as EventFileUpdated with PreviousName set,
+	// which the consumers that know the type turn into EventFileRenamed, see Event.AsRenamed.
+	EventFileRenamed = "file.renamed"
+	EventNoteEmptied = "note.emptied"
+)
+
+var EventTypes = []string{EventFileCreated, EventFileDeleted, EventFileUpdated, EventFileRenamed, EventNoteEmptied}
+
+type Event struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	NoteUUID string `json:"note_uuid"`
+	FileID   string `json:"file_id,omitempty"`
+	FileName string `json:"file_name,omitempty"`
+	// PreviousName is the name a renamed file had before.
+	PreviousName string    `json:"previous_name,omitempty"`
+	Size         int64     `json:"size,omitempty"`
+	OccurredAt   time.Time `json:"occurred_at"`
+}
+
+// Publisher receives the events of file lifecycle changes in process, right after they happen.
+// Publish must not block for long. Durable delivery goes through the outbox sinks instead.
+type Publisher interface {
+	Publish(ctx context.Context, e Event)
+}
+
+// AsRenamed returns a rename as EventFileRenamed and any other event as it is.
+func (e Event) AsRenamed() Event {
+	if e.Type == EventFileUpdated && e.PreviousName != "" {
+		e.Type = EventFileRenamed
+	}
+	return e
+}
+
+func (s *Service) AddPublisher(p Publisher) {
+	s.publishers = append(s.publishers, p)
+}
+
+func newEvent(eventType, noteUUID string, f *File) Event {
+	e := Event{
+		ID:         newEventID(),
+		Type:       eventType,
+		NoteUUID:   noteUUID,
+		OccurredAt: time.Now().UTC(),
+	}
+	if f != nil {
+		e.FileID, e.FileName, e.Size = f.ID, f.Name, f.Size
+	}
+	return e
+}
+
+func (s *Service) publish(ctx context.Context, events []Event) {
+	for _, e := range events {
+		for _, p := range s.publishers {
+			p.Publish(ctx, e)
+		}
+	}
+}
+
+func newEventID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
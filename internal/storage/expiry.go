@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+	"github.com/sirupsen/logrus"
+)
+
+// resolveExpiry returns when a file expires given either the time or a TTL, nil if neither is set.
+func resolveExpiry(expiresAt *time.Time, ttl string, now time.Time) (*time.Time, error) {
+	if expiresAt != nil && ttl != "" {
+		return nil, apperror.BadRequestError("expires_at and ttl are mutually exclusive")
+	}
+	if ttl != "" {
+		d, err := ParseTTL(ttl)
+		if err != nil {
+			return nil, err
+		}
+		at := now.Add(d)
+		expiresAt = &at
+	}
+	if expiresAt == nil {
+		return nil, nil
+	}
+	if !expiresAt.After(now) {
+		return nil, apperror.BadRequestError("expires_at must be in the future")
+	}
+	at := expiresAt.UTC().Truncate(time.Second)
+	return &at, nil
+}
+
+// ParseTTL parses a duration such as "90m" or "12h", or a number of days such as "7d".
+func ParseTTL(ttl string) (time.Duration, error) {
+	var (
+		d   time.Duration
+		err error
+	)
+	if days := strings.TrimSuffix(ttl, "d"); days != ttl {
+		var n int
+		n, err = strconv.Atoi(days)
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(ttl)
+	}
+	if err != nil || d <= 0 {
+		return 0, apperror.BadRequestError("invalid ttl " + strconv.Quote(ttl))
+	}
+	return d, nil
+}
+
+func (f *File) expired(now time.Time) bool {
+	return f.ExpiresAt != nil && !f.ExpiresAt.After(now)
+}
+
+func (e *IndexEntry) expired(now time.Time) bool {
+	return e.ExpiresAt != nil && !e.ExpiresAt.After(now)
+}
+
+// checkExpired fails with apperror.ErrGone for a file that expired but wasn't reaped yet.
+func checkExpired(f *File) error {
+	if f.expired(time.Now()) {
+		return apperror.ErrGone
+	}
+	return nil
+}
+
+// Reaper removes the expired files.
+type Reaper struct {
+	log      *logrus.Entry
+	service  *Service
+	interval time.Duration
+}
+
+func NewReaper(log *logrus.Logger, service *Service, interval time.Duration) *Reaper {
+	return &Reaper{
+		log:      log.WithField("module", "reaper"),
+		service:  service,
+		interval: interval,
+	}
+}
+
+// Run removes the expired files every interval until ctx is done.
+func (r *Reaper) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		reaped, err := r.service.ReapExpired(ctx)
+		if err != nil {
+			r.log.Errorf("failed to reap expired files. err: %v", err)
+		}
+		if reaped > 0 {
+			r.log.Infof("reaped %d expired files", reaped)
+		}
+	}
+}
+
+// ReapExpired deletes the files that have expired and returns how many were deleted.
+func (s *Service) ReapExpired(ctx context.Context) (int, error) {
+	expired, err := s.index.Expired(ctx, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	reaped := 0
+	for _, e := range expired {
+		err = s.Delete(ctx, e.NoteUUID, e.ID)
+		if errors.Is(err, apperror.ErrNotFound) {
+			// removed by a lifecycle rule of the storage already
+			err = s.indexDelete(ctx, e.NoteUUID, e.ID)
+		}
+		if errors.Is(err, apperror.ErrLocked) {
+			// reaped once the lock is lifted
+			continue
+		}
+		if err != nil {
+			s.log.Warnf("failed to reap expired file %s of note %s. err: %v", e.ID, e.NoteUUID, err)
+			continue
+		}
+		reaped++
+	}
+	return reaped, ctx.Err()
+}
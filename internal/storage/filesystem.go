@@ -0,0 +1,347 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+	"github.com/sirupsen/logrus"
+)
+
+// fsMetaExt is the extension of the file next to the contents of an object that keeps its metadata.
+const fsMetaExt = ".meta"
+
+type fsMetadata struct {
+	Name        string            `json:"name"`
+	ContentType string            `json:"content_type,omitempty"`
+	Checksum    string            `json:"checksum,omitempty"`
+	Owner       string            `json:"owner,omitempty"`
+	ExpiresAt   *time.Time        `json:"expires_at,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	ObjectTags  map[string]string `json:"object_tags,omitempty"`
+}
+
+// fsStorage keeps every note in a directory under root, the contents of a file in a file named
+// by its id and the metadata in a JSON file next to it.
+type fsStorage struct {
+	log  *logrus.Entry
+	root string
+}
+
+func NewFilesystem(log *logrus.Logger, root string) (Storage, error) {
+	if err := os.MkdirAll(root, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory. err: %w", err)
+	}
+	return &fsStorage{
+		log:  log.WithField("module", "fs-storage"),
+		root: root,
+	}, nil
+}
+
+func (s *fsStorage) GetFile(ctx context.Context, noteUUID, fileID string) (*File, error) {
+	reader, f, err := s.OpenFile(ctx, noteUUID, fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	f.Bytes, err = ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file. err: %w", err)
+	}
+	return f, nil
+}
+
+func (s *fsStorage) GetFilesByNoteUUID(ctx context.Context, noteUUID string) ([]*File, error) {
+	listed, err := s.ListFiles(ctx, noteUUID)
+	if err != nil {
+		return nil, err
+	}
+	if len(listed) == 0 {
+		return nil, apperror.ErrNotFound
+	}
+	files := make([]*File, 0, len(listed))
+	for _, f := range listed {
+		file, err := s.GetFile(ctx, noteUUID, f.ID)
+		if err != nil {
+			s.log.Warnf("failed to get objects. err: %v", err)
+			continue
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+func (s *fsStorage) CreateFile(_ context.Context, noteUUID string, file *File) error {
+	contentPath, err := s.path(noteUUID, file.ID)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(contentPath), 0o750); err != nil {
+		return fmt.Errorf("failed to create note directory. err: %w", err)
+	}
+	if err = writeFileAtomic(contentPath, file.Bytes); err != nil {
+		return err
+	}
+	return s.writeMetadata(contentPath, fsMetadata{
+		Name:        file.Name,
+		ContentType: file.ContentType,
+		Checksum:    file.Checksum,
+		Owner:       file.Owner,
+		ExpiresAt:   file.ExpiresAt,
+		Description: file.Description,
+		Tags:        file.Tags,
+	})
+}
+
+func (s *fsStorage) DeleteFile(_ context.Context, noteUUID, fileID string) error {
+	contentPath, err := s.path(noteUUID, fileID)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(contentPath); err != nil {
+		return fmt.Errorf("failed to delete file. err: %w", mapFSErr(err))
+	}
+	if err = os.Remove(contentPath + fsMetaExt); err != nil && !errors.Is(err, os.ErrNotExist) {
+		s.log.Warnf("failed to delete metadata of file %s of note %s. err: %v", fileID, noteUUID, err)
+	}
+	return nil
+}
+
+func (s *fsStorage) ListFiles(_ context.Context, noteUUID string) ([]*File, error) {
+	dir, err := s.path(noteUUID, "")
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files. err: %w", mapFSErr(err))
+	}
+	files := make([]*File, 0, len(entries))
+	for _, info := range entries {
+		if info.IsDir() || strings.HasSuffix(info.Name(), fsMetaExt) || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		f, err := s.stat(filepath.Join(dir, info.Name()), info)
+		if err != nil {
+			s.log.Warnf("failed to stat file %s of note %s. err: %v", info.Name(), noteUUID, err)
+			continue
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+func (s *fsStorage) OpenFile(_ context.Context, noteUUID, fileID string) (io.ReadCloser, *File, error) {
+	contentPath, err := s.path(noteUUID, fileID)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader, err := os.Open(contentPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get file. err: %w", mapFSErr(err))
+	}
+	info, err := reader.Stat()
+	if err != nil {
+		_ = reader.Close()
+		return nil, nil, fmt.Errorf("failed to get file. err: %w", err)
+	}
+	f, err := s.stat(contentPath, info)
+	if err != nil {
+		_ = reader.Close()
+		return nil, nil, err
+	}
+	return reader, f, nil
+}
+
+func (s *fsStorage) StatFile(_ context.Context, noteUUID, fileID string) (*File, error) {
+	contentPath, err := s.path(noteUUID, fileID)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(contentPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat file. err: %w", mapFSErr(err))
+	}
+	return s.stat(contentPath, info)
+}
+
+func (s *fsStorage) CopyFile(ctx context.Context, srcNoteUUID, fileID, dstNoteUUID string) error {
+	f, err := s.GetFile(ctx, srcNoteUUID, fileID)
+	if err != nil {
+		return fmt.Errorf("failed to copy file. err: %w", err)
+	}
+	if err = s.CreateFile(ctx, dstNoteUUID, f); err != nil {
+		return fmt.Errorf("failed to copy file. err: %w", err)
+	}
+	if len(f.ObjectTags) == 0 {
+		return nil
+	}
+	return s.SetObjectTags(ctx, dstNoteUUID, fileID, f.ObjectTags)
+}
+
+func (s *fsStorage) UpdateFile(_ context.Context, noteUUID string, file *File) error {
+	contentPath, err := s.path(noteUUID, file.ID)
+	if err != nil {
+		return err
+	}
+	metadata, err := s.readMetadata(contentPath)
+	if err != nil {
+		return fmt.Errorf("failed to update file. err: %w", err)
+	}
+	metadata.Name, metadata.Owner, metadata.Description, metadata.Tags = file.Name, file.Owner, file.Description, file.Tags
+	metadata.ExpiresAt = file.ExpiresAt
+	if file.ContentType != "" {
+		metadata.ContentType = file.ContentType
+	}
+	if file.Checksum != "" {
+		metadata.Checksum = file.Checksum
+	}
+	return s.writeMetadata(contentPath, metadata)
+}
+
+func (s *fsStorage) GetObjectTags(_ context.Context, noteUUID, fileID string) (map[string]string, error) {
+	contentPath, err := s.path(noteUUID, fileID)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := s.readMetadata(contentPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object tags. err: %w", err)
+	}
+	if metadata.ObjectTags == nil {
+		return map[string]string{}, nil
+	}
+	return metadata.ObjectTags, nil
+}
+
+func (s *fsStorage) SetObjectTags(_ context.Context, noteUUID, fileID string, tags map[string]string) error {
+	contentPath, err := s.path(noteUUID, fileID)
+	if err != nil {
+		return err
+	}
+	metadata, err := s.readMetadata(contentPath)
+	if err != nil {
+		return fmt.Errorf("failed to set object tags. err: %w", err)
+	}
+	metadata.ObjectTags = tags
+	return s.writeMetadata(contentPath, metadata)
+}
+
+func (s *fsStorage) ListNotes(_ context.Context) ([]string, error) {
+	entries, err := ioutil.ReadDir(s.root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list notes. err: %w", err)
+	}
+	notes := make([]string, 0, len(entries))
+	for _, info := range entries {
+		if info.IsDir() && !strings.HasPrefix(info.Name(), ".") {
+			notes = append(notes, info.Name())
+		}
+	}
+	return notes, nil
+}
+
+func (s *fsStorage) DeleteNote(_ context.Context, noteUUID string) error {
+	dir, err := s.path(noteUUID, "")
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(dir); err != nil {
+		return fmt.Errorf("failed to delete note. err: %w", mapFSErr(err))
+	}
+	return nil
+}
+
+// path returns the path of the contents of a file, or of the note directory for an empty fileID.
+// Names that could escape the root are rejected.
+func (s *fsStorage) path(noteUUID, fileID string) (string, error) {
+	if !validFSName(noteUUID) || (fileID != "" && !validFSName(fileID)) {
+		return "", apperror.BadRequestError("invalid note uuid or file id")
+	}
+	return filepath.Join(s.root, noteUUID, fileID), nil
+}
+
+func validFSName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, `/\`) &&
+		!strings.HasSuffix(name, fsMetaExt)
+}
+
+func (s *fsStorage) stat(contentPath string, info os.FileInfo) (*File, error) {
+	metadata, err := s.readMetadata(contentPath)
+	if err != nil {
+		return nil, err
+	}
+	return &File{
+		ID:          filepath.Base(contentPath),
+		Name:        metadata.Name,
+		Size:        info.Size(),
+		ModifiedAt:  info.ModTime().UTC(),
+		ExpiresAt:   metadata.ExpiresAt,
+		Checksum:    metadata.Checksum,
+		ContentType: metadata.ContentType,
+		Owner:       metadata.Owner,
+		Description: metadata.Description,
+		Tags:        metadata.Tags,
+		ObjectTags:  metadata.ObjectTags,
+	}, nil
+}
+
+func (s *fsStorage) readMetadata(contentPath string) (fsMetadata, error) {
+	var metadata fsMetadata
+	data, err := ioutil.ReadFile(contentPath + fsMetaExt)
+	if err != nil {
+		return metadata, mapFSErr(err)
+	}
+	if err = json.Unmarshal(data, &metadata); err != nil {
+		return metadata, fmt.Errorf("failed to decode metadata of %s. err: %w", contentPath, err)
+	}
+	return metadata, nil
+}
+
+func (s *fsStorage) writeMetadata(contentPath string, metadata fsMetadata) error {
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata. err: %w", err)
+	}
+	return writeFileAtomic(contentPath+fsMetaExt, data)
+}
+
+// writeFileAtomic writes to a temporary file first so readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return fmt.Errorf("failed to create file. err: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write file. err: %w", err)
+	}
+	if err = tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write file. err: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write file. err: %w", err)
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write file. err: %w", err)
+	}
+	return nil
+}
+
+func mapFSErr(err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return apperror.ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+)
+
+const ratioCheckMinSize = 1 << 20
+
+type ImportLimits struct {
+	MaxEntries          int
+	MaxEntrySize        int64
+	MaxTotalSize        int64
+	MaxCompressionRatio uint64
+	// AllowedTypes holds MIME type prefixes an entry must match, empty means any type.
+	AllowedTypes      []string
+	BlockedExtensions []string
+}
+
+func DefaultImportLimits() ImportLimits {
+	return ImportLimits{
+		MaxEntries:          1000,
+		MaxEntrySize:        32 << 20,
+		MaxTotalSize:        512 << 20,
+		MaxCompressionRatio: 100,
+		BlockedExtensions:   []string{".exe", ".dll", ".msi", ".bat", ".cmd", ".com", ".scr"},
+	}
+}
+
+type ImportResult struct {
+	Entry string `json:"entry"`
+	ID    string `json:"id,omitempty"`
+	Name  string `json:"name,omitempty"`
+	Size  int64  `json:"size,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+var (
+	errEntryTooLarge  = errors.New("entry exceeds size limit")
+	errTotalTooLarge  = errors.New("archive exceeds total size limit")
+	errSuspiciousPath = errors.New("entry path is not allowed")
+)
+
+// ImportZip creates a file in the note for every regular entry of the archive.
+// Entry failures are reported per entry, an error is returned only if the archive itself is unusable.
+func (s *Service) ImportZip(ctx context.Context, noteUUID, owner string, r io.ReaderAt, size int64) ([]ImportResult, error) {
+	limits := s.importLimits
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, apperror.BadRequestError("invalid zip archive")
+	}
+	if len(zr.File) > limits.MaxEntries {
+		return nil, apperror.BadRequestError(fmt.Sprintf("archive has more than %d entries", limits.MaxEntries))
+	}
+	results := make([]ImportResult, 0, len(zr.File))
+	var total int64
+	for _, entry := range zr.File {
+		if entry.FileInfo().IsDir() {
+			continue
+		}
+		result := ImportResult{Entry: entry.Name}
+		f, n, err := s.importEntry(ctx, noteUUID, owner, entry, limits, limits.MaxTotalSize-total)
+		total += n
+		if err != nil {
+			result.Error = err.Error()
+			results = append(results, result)
+			if errors.Is(err, errTotalTooLarge) {
+				break
+			}
+			continue
+		}
+		result.ID, result.Name, result.Size = f.ID, f.Name, f.Size
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (s *Service) importEntry(ctx context.Context, noteUUID, owner string, entry *zip.File, limits ImportLimits, remaining int64,
+) (*File, int64, error) {
+	name, err := importEntryName(entry.Name)
+	if err != nil {
+		return nil, 0, err
+	}
+	if entry.UncompressedSize64 > uint64(limits.MaxEntrySize) {
+		return nil, 0, errEntryTooLarge
+	}
+	// small entries legitimately compress well, so only large ones are checked for the ratio
+	if entry.UncompressedSize64 > ratioCheckMinSize && entry.CompressedSize64 > 0 &&
+		entry.UncompressedSize64/entry.CompressedSize64 > limits.MaxCompressionRatio {
+		return nil, 0, fmt.Errorf("entry compression ratio exceeds %d", limits.MaxCompressionRatio)
+	}
+	for _, ext := range limits.BlockedExtensions {
+		if strings.EqualFold(path.Ext(name), ext) {
+			return nil, 0, fmt.Errorf("file type %s is not allowed", ext)
+		}
+	}
+	rc, err := entry.Open()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open entry: %w", err)
+	}
+	defer rc.Close()
+	// declared sizes can't be trusted, so the actual amount read is limited as well
+	limit := limits.MaxEntrySize
+	if remaining < limit {
+		limit = remaining
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(rc, limit+1))
+	n := int64(len(content))
+	if err != nil {
+		return nil, n, fmt.Errorf("failed to read entry: %w", err)
+	}
+	if n > limit {
+		if n > limits.MaxEntrySize {
+			return nil, n, errEntryTooLarge
+		}
+		return nil, n, errTotalTooLarge
+	}
+	if !typeAllowed(http.DetectContentType(content), limits.AllowedTypes) {
+		return nil, n, fmt.Errorf("content type %s is not allowed", http.DetectContentType(content))
+	}
+	f, err := s.Create(ctx, noteUUID, CreateFileDTO{
+		Name:   name,
+		Size:   n,
+		Owner:  owner,
+		Reader: bytes.NewReader(content),
+	})
+	if err != nil {
+		return nil, n, err
+	}
+	return f, n, nil
+}
+
+// importEntryName rejects absolute and parent-relative entry paths and flattens the rest to a base name.
+func importEntryName(name string) (string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if name == "" || strings.HasPrefix(name, "/") || len(name) > 1 && name[1] == ':' {
+		return "", errSuspiciousPath
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", errSuspiciousPath
+		}
+	}
+	base := path.Base(path.Clean(name))
+	if base == "." || base == "/" {
+		return "", errSuspiciousPath
+	}
+	return base, nil
+}
+
+func typeAllowed(contentType string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, prefix := range allowed {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
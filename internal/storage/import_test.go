@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"context"
+	"errors"
+	"hash/crc32"
+	"testing"
+
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+)
+
+type zipEntry struct {
+	name     string
+	contents []byte
+	// declaredSize, if set, is written as the uncompressed size instead of the real one
+	declaredSize uint64
+}
+
+func buildZip(t *testing.T, entries ...zipEntry) *bytes.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		if e.declaredSize == 0 {
+			w, err := zw.Create(e.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = w.Write(e.contents); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		var compressed bytes.Buffer
+		fw, _ := flate.NewWriter(&compressed, flate.BestCompression)
+		_, _ = fw.Write(e.contents)
+		_ = fw.Close()
+		w, err := zw.CreateRaw(&zip.FileHeader{
+			Name:               e.name,
+			Method:             zip.Deflate,
+			CRC32:              crc32.ChecksumIEEE(e.contents),
+			CompressedSize64:   uint64(compressed.Len()),
+			UncompressedSize64: e.declaredSize,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = w.Write(compressed.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(buf.Bytes())
+}
+
+func TestImportZip(t *testing.T) {
+	text := []byte("plain text")
+	zeros := make([]byte, 4<<20)
+	tests := []struct {
+		name    string
+		limits  func(l *ImportLimits)
+		entries []zipEntry
+		// want holds the imported name or the error of every result
+		want []string
+	}{
+		{
+			name:    "nested entries are flattened",
+			entries: []zipEntry{{name: "docs/a.txt", contents: text}, {name: "b.txt", contents: []byte("other")}},
+			want:    []string{"a.txt", "b.txt"},
+		},
+		{
+			name: "path traversal",
+			entries: []zipEntry{
+				{name: "../evil.txt", contents: text},
+				{name: "docs/../../evil.txt", contents: text},
+				{name: "/etc/passwd", contents: text},
+				{name: `C:\evil.txt`, contents: text},
+				{name: `..\evil.txt`, contents: text},
+			},
+			want: []string{errSuspiciousPath.Error(), errSuspiciousPath.Error(), errSuspiciousPath.Error(),
+				errSuspiciousPath.Error(), errSuspiciousPath.Error()},
+		},
+		{
+			name:    "blocked extension",
+			entries: []zipEntry{{name: "setup.EXE", contents: text}},
+			want:    []string{"file type .exe is not allowed"},
+		},
+		{
+			name:    "content type",
+			limits:  func(l *ImportLimits) { l.AllowedTypes = []string{"image/"} },
+			entries: []zipEntry{{name: "a.txt", contents: text}},
+			want:    []string{"content type text/plain; charset=utf-8 is not allowed"},
+		},
+		{
+			name:    "zip bomb",
+			entries: []zipEntry{{name: "zeros.bin", contents: zeros}},
+			want:    []string{"entry compression ratio exceeds 100"},
+		},
+		{
+			name:    "entry larger than declared",
+			limits:  func(l *ImportLimits) { l.MaxEntrySize = 1 << 10 },
+			entries: []zipEntry{{name: "zeros.bin", contents: zeros, declaredSize: 10}},
+			want:    []string{"failed to read entry: zip: not a valid zip file"},
+		},
+		{
+			name:    "entry too large",
+			limits:  func(l *ImportLimits) { l.MaxEntrySize = 4 },
+			entries: []zipEntry{{name: "a.txt", contents: text}},
+			want:    []string{errEntryTooLarge.Error()},
+		},
+		{
+			name:   "total too large stops the import",
+			limits: func(l *ImportLimits) { l.MaxTotalSize = 15 },
+			entries: []zipEntry{
+				{name: "a.txt", contents: text},
+				{name: "b.txt", contents: text},
+				{name: "c.txt", contents: text},
+			},
+			want: []string{"a.txt", errTotalTooLarge.Error()},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, _ := newTestService(t, nil)
+			if tt.limits != nil {
+				tt.limits(&service.importLimits)
+			}
+			archive := buildZip(t, tt.entries...)
+			results, err := service.ImportZip(context.Background(), testNote, "u1", archive, archive.Size())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) != len(tt.want) {
+				t.Fatalf("got %d results %+v, want %d", len(results), results, len(tt.want))
+			}
+			imported := 0
+			for i, r := range results {
+				got := r.Name
+				if r.Error != "" {
+					got = r.Error
+				} else {
+					imported++
+				}
+				if got != tt.want[i] {
+					t.Errorf("entry %s: got %q, want %q", r.Entry, got, tt.want[i])
+				}
+			}
+			files, err := service.GetFilesByNoteUUID(context.Background(), testNote)
+			if err != nil && !errors.Is(err, apperror.ErrNotFound) {
+				t.Fatal(err)
+			}
+			if len(files) != imported {
+				t.Fatalf("stored %d files, want only the %d imported ones", len(files), imported)
+			}
+			for _, f := range files {
+				if f.Owner != "u1" {
+					t.Errorf("file %s owned by %q, want the importer", f.Name, f.Owner)
+				}
+			}
+		})
+	}
+}
+
+func TestImportZipRejectsArchive(t *testing.T) {
+	tests := []struct {
+		name    string
+		archive *bytes.Reader
+	}{
+		{name: "not a zip", archive: bytes.NewReader([]byte("not a zip archive"))},
+		{name: "too many entries", archive: buildZip(t, zipEntry{name: "a.txt"}, zipEntry{name: "b.txt"}, zipEntry{name: "c.txt"})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, _ := newTestService(t, nil)
+			service.importLimits.MaxEntries = 2
+			var appErr *apperror.AppError
+			if _, err := service.ImportZip(context.Background(), testNote, "", tt.archive, tt.archive.Size()); !errors.As(err, &appErr) {
+				t.Fatalf("got %v, want a bad request", err)
+			}
+		})
+	}
+}
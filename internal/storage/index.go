@@ -0,0 +1,455 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+	"go.etcd.io/bbolt"
+)
+
+var (
+	filesBucket         = []byte("files")
+	filesByOwnerBucket  = []byte("files_by_owner")
+	pendingWritesBucket = []byte("pending_writes")
+)
+
+// Index keeps file metadata searchable without listing storage buckets.
+// Put and Delete record the resulting events in the outbox and the change log in the same
+// transaction as the metadata change and return the events.
+type Index interface {
+	Put(ctx context.Context, noteUUID string, f *File) ([]Event, error)
+	Delete(ctx context.Context, noteUUID, fileID string) ([]Event, error)
+	Get(ctx context.Context, noteUUID, fileID string) (*IndexEntry, error)
+	// Expired returns the entries of the files that expired before the given time.
+	Expired(ctx context.Context, before time.Time) ([]*IndexEntry, error)
+	Search(ctx context.Context, q SearchQuery) (*SearchResult, error)
+	Changes(ctx context.Context, q ChangesQuery) (*ChangeSet, error)
+	// BeginWrite records that a file is about to be written to the storage, until Put or EndWrite
+	// clear it, so a write interrupted before its index change can be found with PendingWrites.
+	BeginWrite(ctx context.Context, noteUUID, fileID string) error
+	// BeginDelete records that a file is about to be deleted from the storage, until Delete or
+	// EndWrite clear it.
+	BeginDelete(ctx context.Context, noteUUID, fileID string) error
+	EndWrite(ctx context.Context, noteUUID, fileID string) error
+	PendingWrites(ctx context.Context) ([]*PendingWrite, error)
+}
+
+// PendingWrite is a file written to or deleted from the storage without its index change yet.
+type PendingWrite struct {
+	NoteUUID  string    `json:"note_uuid"`
+	FileID    string    `json:"file_id"`
+	Delete    bool      `json:"delete,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+type IndexEntry struct {
+	NoteUUID    string            `json:"note_uuid"`
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	Size        int64             `json:"size"`
+	ContentType string            `json:"content_type,omitempty"`
+	Checksum    string            `json:"checksum,omitempty"`
+	Owner       string            `json:"owner,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	CreatedAt   time.Time         `json:"created_at"`
+	ModifiedAt  time.Time         `json:"modified_at"`
+	ExpiresAt   *time.Time        `json:"expires_at,omitempty"`
+	Score       float64           `json:"score,omitempty"`
+	Snippets    []string          `json:"snippets,omitempty"`
+}
+
+type SearchQuery struct {
+	// Text is matched against the contents of text, Markdown, HTML and PDF files.
+	Text string
+	// NoteUUIDs and Owner restrict the scope of the search, both empty means all files.
+	NoteUUIDs []string
+	Owner     string
+	// Name is a case-insensitive substring, or a glob pattern if it contains any of *?[.
+	Name string
+	// ContentType matches as a prefix, so "image/" finds every image.
+	ContentType string
+	// Tags must all be present on the file, an empty value matches any value of the tag.
+	Tags          map[string]string
+	MinSize       int64
+	MaxSize       int64
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	Limit         int
+	Offset        int
+	// hideExpired leaves out the files that expired but weren't reaped yet.
+	hideExpired bool
+}
+
+type SearchResult struct {
+	Total int           `json:"total"`
+	Files []*IndexEntry `json:"files"`
+}
+
+type boltIndex struct {
+	db *bbolt.DB
+}
+
+func NewIndex(db *bbolt.DB) (Index, error) {
+	err := db.Update(func(tx *bbolt.Tx) error {
+		buckets := [][]byte{filesBucket, filesByOwnerBucket, outboxBucket, changesBucket, latestChangesBucket, pendingWritesBucket}
+		for _, name := range buckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to init index buckets. err: %w", err)
+	}
+	return &boltIndex{db: db}, nil
+}
+
+// Put records file.created for a new entry and file.updated for any other change,
+// with the previous name of an entry that got a new one. It ends a pending write of the file.
+func (i *boltIndex) Put(_ context.Context, noteUUID string, f *File) ([]Event, error) {
+	var events []Event
+	err := i.db.Update(func(tx *bbolt.Tx) error {
+		e := newEvent(EventFileCreated, noteUUID, f)
+		changeType := ChangeCreated
+		if prev := getIndexEntry(tx, noteUUID, f.ID); prev != nil {
+			e.Type, changeType = EventFileUpdated, ChangeUpdated
+			if prev.Name != f.Name {
+				e.PreviousName = prev.Name
+			}
+		}
+		entry, err := putIndexEntry(tx, noteUUID, f)
+		if err != nil {
+			return err
+		}
+		err = appendChange(tx, &Change{
+			Type:      changeType,
+			NoteUUID:  noteUUID,
+			FileID:    f.ID,
+			Owner:     entry.Owner,
+			File:      entry,
+			ChangedAt: entry.ModifiedAt,
+		})
+		if err != nil {
+			return err
+		}
+		if err = tx.Bucket(pendingWritesBucket).Delete(indexKey(noteUUID, f.ID)); err != nil {
+			return err
+		}
+		events = []Event{e}
+		return appendOutbox(tx, events...)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to index file %s. err: %w", f.ID, err)
+	}
+	return events, nil
+}
+
+func (i *boltIndex) BeginWrite(_ context.Context, noteUUID, fileID string) error {
+	return i.begin(PendingWrite{NoteUUID: noteUUID, FileID: fileID, StartedAt: time.Now().UTC()})
+}
+
+func (i *boltIndex) BeginDelete(_ context.Context, noteUUID, fileID string) error {
+	return i.begin(PendingWrite{NoteUUID: noteUUID, FileID: fileID, Delete: true, StartedAt: time.Now().UTC()})
+}
+
+func (i *boltIndex) begin(w PendingWrite) error {
+	data, err := json.Marshal(w)
+	if err != nil {
+		return fmt.Errorf("failed to marshal pending write. err: %w", err)
+	}
+	err = i.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(pendingWritesBucket).Put(indexKey(w.NoteUUID, w.FileID), data)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record pending write of file %s. err: %w", w.FileID, err)
+	}
+	return nil
+}
+
+func (i *boltIndex) EndWrite(_ context.Context, noteUUID, fileID string) error {
+	err := i.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(pendingWritesBucket).Delete(indexKey(noteUUID, fileID))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to end pending write of file %s. err: %w", fileID, err)
+	}
+	return nil
+}
+
+func (i *boltIndex) PendingWrites(_ context.Context) ([]*PendingWrite, error) {
+	var writes []*PendingWrite
+	err := i.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(pendingWritesBucket).ForEach(func(_, v []byte) error {
+			var w PendingWrite
+			if err := json.Unmarshal(v, &w); err != nil {
+				return err
+			}
+			writes = append(writes, &w)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pending writes. err: %w", err)
+	}
+	return writes, nil
+}
+
+// Delete records file.deleted and, if it was the last file of the note, note.emptied.
+func (i *boltIndex) Delete(_ context.Context, noteUUID, fileID string) ([]Event, error) {
+	var events []Event
+	err := i.db.Update(func(tx *bbolt.Tx) error {
+		f := &File{ID: fileID}
+		if prev := getIndexEntry(tx, noteUUID, fileID); prev != nil {
+			f.Name, f.Size, f.Owner = prev.Name, prev.Size, prev.Owner
+		}
+		if err := deleteIndexEntry(tx, noteUUID, fileID); err != nil {
+			return err
+		}
+		if err := tx.Bucket(pendingWritesBucket).Delete(indexKey(noteUUID, fileID)); err != nil {
+			return err
+		}
+		err := appendChange(tx, &Change{
+			Type:      ChangeDeleted,
+			NoteUUID:  noteUUID,
+			FileID:    fileID,
+			Owner:     f.Owner,
+			ChangedAt: time.Now().UTC(),
+		})
+		if err != nil {
+			return err
+		}
+		events = []Event{newEvent(EventFileDeleted, noteUUID, f)}
+		prefix := indexKey(noteUUID, "")
+		if k, _ := tx.Bucket(filesBucket).Cursor().Seek(prefix); k == nil || !bytes.HasPrefix(k, prefix) {
+			events = append(events, newEvent(EventNoteEmptied, noteUUID, nil))
+		}
+		return appendOutbox(tx, events...)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to remove file %s from index. err: %w", fileID, err)
+	}
+	return events, nil
+}
+
+func (i *boltIndex) Get(_ context.Context, noteUUID, fileID string) (*IndexEntry, error) {
+	var entry *IndexEntry
+	_ = i.db.View(func(tx *bbolt.Tx) error {
+		entry = getIndexEntry(tx, noteUUID, fileID)
+		return nil
+	})
+	if entry == nil {
+		return nil, apperror.ErrNotFound
+	}
+	return entry, nil
+}
+
+func (i *boltIndex) Expired(_ context.Context, before time.Time) ([]*IndexEntry, error) {
+	var expired []*IndexEntry
+	err := i.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(filesBucket).ForEach(func(_, v []byte) error {
+			var entry IndexEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			if entry.expired(before) {
+				expired = append(expired, &entry)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan index for expired files. err: %w", err)
+	}
+	return expired, nil
+}
+
+func (i *boltIndex) Search(_ context.Context, q SearchQuery) (*SearchResult, error) {
+	var matched []*IndexEntry
+	err := i.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		matched, err = scanIndex(tx, q)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to search index. err: %w", err)
+	}
+	sort.Slice(matched, func(a, b int) bool {
+		return matched[a].CreatedAt.After(matched[b].CreatedAt)
+	})
+	result := &SearchResult{Total: len(matched), Files: []*IndexEntry{}}
+	if q.Offset < len(matched) {
+		matched = matched[q.Offset:]
+		if q.Limit > 0 && q.Limit < len(matched) {
+			matched = matched[:q.Limit]
+		}
+		result.Files = matched
+	}
+	return result, nil
+}
+
+func putIndexEntry(tx *bbolt.Tx, noteUUID string, f *File) (*IndexEntry, error) {
+	files := tx.Bucket(filesBucket)
+	key := indexKey(noteUUID, f.ID)
+	entry := IndexEntry{
+		NoteUUID:    noteUUID,
+		ID:          f.ID,
+		Name:        f.Name,
+		Size:        f.Size,
+		ContentType: f.ContentType,
+		Checksum:    f.Checksum,
+		Owner:       f.Owner,
+		Description: f.Description,
+		Tags:        f.Tags,
+		ExpiresAt:   f.ExpiresAt,
+		CreatedAt:   time.Now().UTC(),
+		ModifiedAt:  time.Now().UTC(),
+	}
+	if prev := getIndexEntry(tx, noteUUID, f.ID); prev != nil {
+		entry.CreatedAt = prev.CreatedAt
+		if entry.Checksum == "" {
+			entry.Checksum = prev.Checksum
+		}
+		if prev.Owner != entry.Owner {
+			if err := tx.Bucket(filesByOwnerBucket).Delete(ownerKey(prev.Owner, noteUUID, f.ID)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	if err = files.Put(key, data); err != nil {
+		return nil, err
+	}
+	if entry.Owner != "" {
+		if err = tx.Bucket(filesByOwnerBucket).Put(ownerKey(entry.Owner, noteUUID, f.ID), nil); err != nil {
+			return nil, err
+		}
+	}
+	return &entry, nil
+}
+
+func deleteIndexEntry(tx *bbolt.Tx, noteUUID, fileID string) error {
+	prev := getIndexEntry(tx, noteUUID, fileID)
+	if prev == nil {
+		return nil
+	}
+	if prev.Owner != "" {
+		if err := tx.Bucket(filesByOwnerBucket).Delete(ownerKey(prev.Owner, noteUUID, fileID)); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(filesBucket).Delete(indexKey(noteUUID, fileID))
+}
+
+func getIndexEntry(tx *bbolt.Tx, noteUUID, fileID string) *IndexEntry {
+	data := tx.Bucket(filesBucket).Get(indexKey(noteUUID, fileID))
+	if data == nil {
+		return nil
+	}
+	var entry IndexEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil
+	}
+	return &entry
+}
+
+func scanIndex(tx *bbolt.Tx, q SearchQuery) ([]*IndexEntry, error) {
+	var matched []*IndexEntry
+	collect := func(data []byte) error {
+		var entry IndexEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return err
+		}
+		if q.matches(&entry) {
+			matched = append(matched, &entry)
+		}
+		return nil
+	}
+	files := tx.Bucket(filesBucket)
+	switch {
+	case len(q.NoteUUIDs) > 0:
+		for _, noteUUID := range q.NoteUUIDs {
+			prefix := indexKey(noteUUID, "")
+			c := files.Cursor()
+			for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+				if err := collect(v); err != nil {
+					return nil, err
+				}
+			}
+		}
+	case q.Owner != "":
+		prefix := []byte(q.Owner + "\x00")
+		c := tx.Bucket(filesByOwnerBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			if v := files.Get(bytes.TrimPrefix(k, prefix)); v != nil {
+				if err := collect(v); err != nil {
+					return nil, err
+				}
+			}
+		}
+	default:
+		if err := files.ForEach(func(_, v []byte) error { return collect(v) }); err != nil {
+			return nil, err
+		}
+	}
+	return matched, nil
+}
+
+func (q SearchQuery) matches(e *IndexEntry) bool {
+	if q.hideExpired && e.expired(time.Now()) {
+		return false
+	}
+	if q.Owner != "" && e.Owner != q.Owner {
+		return false
+	}
+	if q.Name != "" && !matchName(q.Name, e.Name) {
+		return false
+	}
+	if q.ContentType != "" && !strings.HasPrefix(e.ContentType, q.ContentType) {
+		return false
+	}
+	if q.MinSize > 0 && e.Size < q.MinSize || q.MaxSize > 0 && e.Size > q.MaxSize {
+		return false
+	}
+	if !q.CreatedAfter.IsZero() && e.CreatedAt.Before(q.CreatedAfter) {
+		return false
+	}
+	if !q.CreatedBefore.IsZero() && e.CreatedAt.After(q.CreatedBefore) {
+		return false
+	}
+	for k, v := range q.Tags {
+		tag, ok := e.Tags[k]
+		if !ok || v != "" && tag != v {
+			return false
+		}
+	}
+	return true
+}
+
+func matchName(pattern, name string) bool {
+	pattern, name = strings.ToLower(pattern), strings.ToLower(name)
+	if strings.ContainsAny(pattern, "*?[") {
+		ok, err := path.Match(pattern, name)
+		return err == nil && ok
+	}
+	return strings.Contains(name, pattern)
+}
+
+func indexKey(noteUUID, fileID string) []byte {
+	return []byte(noteUUID + "\x00" + fileID)
+}
+
+func ownerKey(owner, noteUUID, fileID string) []byte {
+	return []byte(owner + "\x00" + noteUUID + "\x00" + fileID)
+}
@@ -0,0 +1,341 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+)
+
+const (
+	VerifyOK = "ok"
+	// VerifyMismatch means the stored contents don't hash to the checksum of the file.
+	VerifyMismatch = "mismatch"
+	// VerifyUnchecked means there is no checksum to compare the contents with.
+	VerifyUnchecked = "unchecked"
+	VerifyFailed    = "failed"
+
+	ReconcileIndexed   = "indexed"
+	ReconcileUnindexed = "unindexed"
+	ReconcileRefreshed = "refreshed"
+)
+
+type VerifyResult struct {
+	NoteUUID string `json:"note_uuid"`
+	FileID   string `json:"file_id"`
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type ReconcileResult struct {
+	NoteUUID string `json:"note_uuid"`
+	FileID   string `json:"file_id"`
+	Name     string `json:"name"`
+	Action   string `json:"action"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Verify reads every file of the notes, or of all notes if none are given, and compares
+// its contents with the checksum stored with it or recorded in the index.
+func (s *Service) Verify(ctx context.Context, noteUUIDs []string) ([]VerifyResult, error) {
+	ctx = maintenance(ctx)
+	notes, err := s.notes(ctx, noteUUIDs)
+	if err != nil {
+		return nil, err
+	}
+	var results []VerifyResult
+	for _, noteUUID := range notes {
+		files, err := s.storage.ListFiles(ctx, noteUUID)
+		if err != nil && !errors.Is(err, apperror.ErrNotFound) {
+			return nil, err
+		}
+		for _, f := range files {
+			results = append(results, s.verifyFile(ctx, noteUUID, f))
+		}
+	}
+	return results, nil
+}
+
+func (s *Service) verifyFile(ctx context.Context, noteUUID string, f *File) VerifyResult {
+	result := VerifyResult{NoteUUID: noteUUID, FileID: f.ID, Name: f.Name, Status: VerifyUnchecked, Expected: f.Checksum}
+	if result.Expected == "" {
+		if entry, err := s.index.Get(ctx, noteUUID, f.ID); err == nil {
+			result.Expected = entry.Checksum
+		}
+	}
+	actual, err := s.checksum(ctx, noteUUID, f.ID)
+	if err != nil {
+		result.Status, result.Error = VerifyFailed, err.Error()
+		return result
+	}
+	result.Actual = actual
+	switch {
+	case result.Expected == "":
+	case result.Expected == actual:
+		result.Status = VerifyOK
+	default:
+		result.Status = VerifyMismatch
+		s.reportCorruption("verify", noteUUID, f.ID, result.Expected, actual)
+	}
+	return result
+}
+
+func (s *Service) checksum(ctx context.Context, noteUUID, fileID string) (string, error) {
+	reader, _, err := s.storage.OpenFile(ctx, noteUUID, fileID)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(hash, reader); err != nil {
+		return "", fmt.Errorf("failed to read file %s of note %s. err: %w", fileID, noteUUID, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Reconcile brings the index in line with the storage, which is the source of truth:
+// stored files missing from the index are indexed, entries without a stored file are removed
+// and entries whose name or size differ are refreshed. With dryRun nothing is changed.
+func (s *Service) Reconcile(ctx context.Context, noteUUIDs []string, dryRun bool) ([]ReconcileResult, error) {
+	ctx = maintenance(ctx)
+	notes, err := s.notes(ctx, noteUUIDs)
+	if err != nil {
+		return nil, err
+	}
+	var results []ReconcileResult
+	for _, noteUUID := range notes {
+		noteResults, err := s.reconcileNote(ctx, noteUUID, dryRun)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, noteResults...)
+	}
+	return results, nil
+}
+
+func (s *Service) reconcileNote(ctx context.Context, noteUUID string, dryRun bool) ([]ReconcileResult, error) {
+	files, err := s.storage.ListFiles(ctx, noteUUID)
+	if err != nil && !errors.Is(err, apperror.ErrNotFound) {
+		return nil, err
+	}
+	indexed, err := s.index.Search(ctx, SearchQuery{NoteUUIDs: []string{noteUUID}})
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]*IndexEntry, len(indexed.Files))
+	for _, e := range indexed.Files {
+		entries[e.ID] = e
+	}
+	var results []ReconcileResult
+	for _, f := range files {
+		e, ok := entries[f.ID]
+		delete(entries, f.ID)
+		action := ReconcileIndexed
+		if ok {
+			if e.Name == f.Name && e.Size == f.Size {
+				continue
+			}
+			action = ReconcileRefreshed
+			if f.Checksum == "" {
+				f.Checksum = e.Checksum
+			}
+		}
+		result := ReconcileResult{NoteUUID: noteUUID, FileID: f.ID, Name: f.Name, Action: action}
+		if !dryRun {
+			if err = s.reindex(ctx, noteUUID, f); err != nil {
+				result.Error = err.Error()
+			}
+		}
+		results = append(results, result)
+	}
+	for _, e := range entries {
+		result := ReconcileResult{NoteUUID: noteUUID, FileID: e.ID, Name: e.Name, Action: ReconcileUnindexed}
+		if !dryRun {
+			if err = s.indexDelete(ctx, noteUUID, e.ID); err != nil {
+				result.Error = err.Error()
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// RecoverWrites finishes the writes a crash left between the storage and the index:
+// a file that was stored is indexed, which records its event, one that wasn't is forgotten,
+// and a delete is finished. It must run before the service takes requests and returns how many
+// files were indexed or deleted.
+func (s *Service) RecoverWrites(ctx context.Context) (int, error) {
+	ctx = maintenance(ctx)
+	writes, err := s.index.PendingWrites(ctx)
+	if err != nil {
+		return 0, err
+	}
+	recovered := 0
+	for _, w := range writes {
+		if w.Delete {
+			if err = s.recoverDelete(ctx, w); err != nil {
+				return recovered, err
+			}
+			recovered++
+			continue
+		}
+		f, err := s.storage.StatFile(ctx, w.NoteUUID, w.FileID)
+		if errors.Is(err, apperror.ErrNotFound) {
+			if err = s.index.EndWrite(ctx, w.NoteUUID, w.FileID); err != nil {
+				return recovered, err
+			}
+			continue
+		}
+		if err == nil {
+			err = s.reindex(ctx, w.NoteUUID, f)
+		}
+		if err != nil {
+			return recovered, fmt.Errorf("failed to recover write of file %s of note %s. err: %w", w.FileID, w.NoteUUID, err)
+		}
+		recovered++
+	}
+	return recovered, nil
+}
+
+// recoverDelete finishes an interrupted delete, removing the object if it's still there
+// and the index entry with its events.
+func (s *Service) recoverDelete(ctx context.Context, w *PendingWrite) error {
+	err := s.storage.DeleteFile(ctx, w.NoteUUID, w.FileID)
+	if err != nil && !errors.Is(err, apperror.ErrNotFound) {
+		return fmt.Errorf("failed to recover delete of file %s of note %s. err: %w", w.FileID, w.NoteUUID, err)
+	}
+	if err = s.indexDelete(ctx, w.NoteUUID, w.FileID); err != nil {
+		return fmt.Errorf("failed to recover delete of file %s of note %s. err: %w", w.FileID, w.NoteUUID, err)
+	}
+	return nil
+}
+
+// BackfillIndex indexes every stored file when the index is empty, as it is the first time
+// the service starts on an existing storage. It returns how many files were indexed.
+func (s *Service) BackfillIndex(ctx context.Context) (int, error) {
+	ctx = maintenance(ctx)
+	indexed, err := s.index.Search(ctx, SearchQuery{Limit: 1})
+	if err != nil {
+		return 0, err
+	}
+	if indexed.Total > 0 {
+		return 0, nil
+	}
+	notes, err := s.storage.ListNotes(ctx)
+	if err != nil {
+		return 0, err
+	}
+	backfilled := 0
+	for _, noteUUID := range notes {
+		if noteUUID == QuarantineNote {
+			continue
+		}
+		files, err := s.storage.ListFiles(ctx, noteUUID)
+		if err != nil && !errors.Is(err, apperror.ErrNotFound) {
+			return backfilled, err
+		}
+		for _, listed := range files {
+			f, err := s.storage.GetFile(ctx, noteUUID, listed.ID)
+			if err != nil {
+				return backfilled, fmt.Errorf("failed to backfill file %s of note %s. err: %w", listed.ID, noteUUID, err)
+			}
+			if f.Checksum == "" {
+				sum := sha256.Sum256(f.Bytes)
+				f.Checksum = hex.EncodeToString(sum[:])
+			}
+			if err = s.indexPut(ctx, noteUUID, f); err != nil {
+				return backfilled, fmt.Errorf("failed to backfill file %s of note %s. err: %w", listed.ID, noteUUID, err)
+			}
+			s.indexText(ctx, noteUUID, f)
+			backfilled++
+		}
+	}
+	return backfilled, nil
+}
+
+func (s *Service) reindex(ctx context.Context, noteUUID string, f *File) error {
+	if f.Checksum == "" {
+		checksum, err := s.checksum(ctx, noteUUID, f.ID)
+		if err != nil {
+			return err
+		}
+		f.Checksum = checksum
+	}
+	return s.indexPut(ctx, noteUUID, f)
+}
+
+// GC releases the storage of notes that have no files left and returns their uuids.
+// With dryRun the notes are only reported.
+func (s *Service) GC(ctx context.Context, dryRun bool) ([]string, error) {
+	notes, err := s.storage.ListNotes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	removed := []string{}
+	for _, noteUUID := range notes {
+		if noteUUID == QuarantineNote {
+			continue
+		}
+		files, err := s.storage.ListFiles(ctx, noteUUID)
+		if err != nil && !errors.Is(err, apperror.ErrNotFound) {
+			return removed, err
+		}
+		if len(files) > 0 {
+			continue
+		}
+		indexed, err := s.index.Search(ctx, SearchQuery{NoteUUIDs: []string{noteUUID}, Limit: 1})
+		if err != nil {
+			return removed, err
+		}
+		if indexed.Total > 0 {
+			continue
+		}
+		if !dryRun {
+			if err = s.storage.DeleteNote(ctx, noteUUID); err != nil {
+				s.log.Warnf("failed to remove empty note %s. err: %v", noteUUID, err)
+				continue
+			}
+		}
+		removed = append(removed, noteUUID)
+	}
+	return removed, nil
+}
+
+// notes returns the given notes or, if none are given, every note known to the storage or the index
+// except the quarantine.
+func (s *Service) notes(ctx context.Context, noteUUIDs []string) ([]string, error) {
+	if len(noteUUIDs) > 0 {
+		return noteUUIDs, nil
+	}
+	stored, err := s.storage.ListNotes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	indexed, err := s.index.Search(ctx, SearchQuery{})
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[string]struct{}, len(stored))
+	for _, noteUUID := range stored {
+		if noteUUID != QuarantineNote {
+			set[noteUUID] = struct{}{}
+		}
+	}
+	for _, e := range indexed.Files {
+		set[e.NoteUUID] = struct{}{}
+	}
+	notes := make([]string, 0, len(set))
+	for noteUUID := range set {
+		notes = append(notes, noteUUID)
+	}
+	sort.Strings(notes)
+	return notes, nil
+}
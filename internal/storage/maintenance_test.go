@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+)
+
+func TestRecoverWrites(t *testing.T) {
+	tests := []struct {
+		name string
+		// interrupt leaves the file as a crash would
+		interrupt func(t *testing.T, service *Service, f *File)
+		// indexed tells if the file is in the index after the recovery
+		indexed bool
+		// stored tells if the file is in the storage after the recovery
+		stored    bool
+		recovered int
+		events    []string
+	}{
+		{
+			name: "write stored but not indexed",
+			interrupt: func(t *testing.T, service *Service, f *File) {
+				must(t, service.index.BeginWrite(context.Background(), testNote, f.ID))
+				must(t, service.storage.CreateFile(context.Background(), testNote, f))
+			},
+			indexed:   true,
+			stored:    true,
+			recovered: 1,
+			events:    []string{EventFileCreated},
+		},
+		{
+			name: "write not stored",
+			interrupt: func(t *testing.T, service *Service, f *File) {
+				must(t, service.index.BeginWrite(context.Background(), testNote, f.ID))
+			},
+		},
+		{
+			name: "delete not started",
+			interrupt: func(t *testing.T, service *Service, f *File) {
+				createTestFile(t, service, f.Name, string(f.Bytes))
+				must(t, service.index.BeginDelete(context.Background(), testNote, f.ID))
+			},
+			recovered: 1,
+			events:    []string{EventFileDeleted, EventNoteEmptied},
+		},
+		{
+			name: "delete removed from the storage only",
+			interrupt: func(t *testing.T, service *Service, f *File) {
+				createTestFile(t, service, f.Name, string(f.Bytes))
+				must(t, service.index.BeginDelete(context.Background(), testNote, f.ID))
+				must(t, service.storage.DeleteFile(context.Background(), testNote, f.ID))
+			},
+			recovered: 1,
+			events:    []string{EventFileDeleted, EventNoteEmptied},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, db := newTestService(t, nil)
+			ctx := context.Background()
+			f, err := NewFile(CreateFileDTO{Name: "a.txt", Size: 1, Reader: bytes.NewReader([]byte("a"))})
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.interrupt(t, service, f)
+			outbox := newTestOutbox(t, db)
+			before, err := outbox.pending("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recovered, err := service.RecoverWrites(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if recovered != tt.recovered {
+				t.Fatalf("recovered %d, want %d", recovered, tt.recovered)
+			}
+			if pending, _ := service.index.PendingWrites(ctx); len(pending) != 0 {
+				t.Fatalf("got %d pending writes left", len(pending))
+			}
+			_, err = service.index.Get(ctx, testNote, f.ID)
+			if indexed := err == nil; indexed != tt.indexed || err != nil && !errors.Is(err, apperror.ErrNotFound) {
+				t.Fatalf("index: got %v, want indexed %v", err, tt.indexed)
+			}
+			_, err = service.storage.StatFile(ctx, testNote, f.ID)
+			if stored := err == nil; stored != tt.stored || err != nil && !errors.Is(err, apperror.ErrNotFound) {
+				t.Fatalf("storage: got %v, want stored %v", err, tt.stored)
+			}
+			after, err := outbox.pending("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			events := after[len(before):]
+			if len(events) != len(tt.events) {
+				t.Fatalf("got events %+v, want %v", events, tt.events)
+			}
+			for i, entry := range events {
+				if entry.Event.Type != tt.events[i] {
+					t.Errorf("event %d: got %s, want %s", i, entry.Event.Type, tt.events[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBackfillIndex(t *testing.T) {
+	tests := []struct {
+		name string
+		// indexed files are created through the service, the others only stored
+		indexed    []string
+		stored     []string
+		backfilled int
+		// found are the names a text search for "backfill" finds afterwards
+		found []string
+	}{
+		{name: "nothing stored"},
+		{name: "empty index", stored: []string{"a.txt", "b.txt"}, backfilled: 2, found: []string{"a.txt", "b.txt"}},
+		{name: "index in use", indexed: []string{"a.txt"}, stored: []string{"b.txt"}, found: []string{"a.txt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, _ := newTestService(t, nil)
+			ctx := context.Background()
+			for _, name := range tt.indexed {
+				createTestFile(t, service, name, "backfill "+name)
+			}
+			for _, name := range tt.stored {
+				contents := []byte("backfill " + name)
+				f, err := NewFile(CreateFileDTO{Name: name, Size: int64(len(contents)), Reader: bytes.NewReader(contents)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				must(t, service.storage.CreateFile(ctx, testNote, f))
+			}
+
+			backfilled, err := service.BackfillIndex(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if backfilled != tt.backfilled {
+				t.Fatalf("backfilled %d, want %d", backfilled, tt.backfilled)
+			}
+			result, err := service.Search(ctx, SearchQuery{Text: "backfill"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			found := map[string]bool{}
+			for _, e := range result.Files {
+				found[e.Name] = e.Checksum != ""
+			}
+			if len(found) != len(tt.found) {
+				t.Fatalf("found %v, want %v", found, tt.found)
+			}
+			for _, name := range tt.found {
+				if !found[name] {
+					t.Errorf("%s not found with its checksum, got %v", name, found)
+				}
+			}
+		})
+	}
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/bbolt"
+)
+
+const (
+	outboxPollInterval = 500 * time.Millisecond
+	outboxBatchSize    = 100
+	outboxMaxBackoff   = time.Minute
+)
+
+var (
+	outboxBucket        = []byte("outbox")
+	outboxCursorsBucket = []byte("outbox_cursors")
+)
+
+// Sink receives the events drained from the outbox. Delivery is at least once,
+// so a sink may see the same event again and should use Event.ID as the idempotency key.
+type Sink interface {
+	Name() string
+	Send(ctx context.Context, e Event) error
+}
+
+type outboxEntry struct {
+	Seq   uint64 `json:"seq"`
+	Event Event  `json:"event"`
+}
+
+// Outbox drains the events recorded together with the index changes to the sinks.
+// Every sink keeps its own cursor, so a failing sink neither blocks nor duplicates the others.
+type Outbox struct {
+	log   *logrus.Entry
+	db    *bbolt.DB
+	mu    sync.Mutex
+	sinks []Sink
+}
+
+func NewOutbox(log *logrus.Logger, db *bbolt.DB) (*Outbox, error) {
+	err := db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{outboxBucket, outboxCursorsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to init outbox buckets. err: %w", err)
+	}
+	return &Outbox{
+		log: log.WithField("module", "outbox"),
+		db:  db,
+	}, nil
+}
+
+func (o *Outbox) AddSink(s Sink) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.sinks = append(o.sinks, s)
+}
+
+// Run dispatches the outbox to every sink until ctx is done.
+func (o *Outbox) Run(ctx context.Context) {
+	o.mu.Lock()
+	sinks := append([]Sink(nil), o.sinks...)
+	o.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, sink := range sinks {
+		wg.Add(1)
+		go func(sink Sink) {
+			defer wg.Done()
+			o.drain(ctx, sink)
+		}(sink)
+	}
+	go o.prune(ctx, sinks)
+	wg.Wait()
+}
+
+func (o *Outbox) drain(ctx context.Context, sink Sink) {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+	for {
+		entries, err := o.pending(sink.Name())
+		if err != nil {
+			o.log.Errorf("failed to read outbox for sink %s. err: %v", sink.Name(), err)
+		}
+		for _, entry := range entries {
+			if !o.send(ctx, sink, entry) {
+				return
+			}
+		}
+		if len(entries) == outboxBatchSize {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// send retries the delivery with exponential backoff until it succeeds or ctx is done.
+func (o *Outbox) send(ctx context.Context, sink Sink, entry outboxEntry) bool {
+	delay := outboxPollInterval
+	for {
+		err := sink.Send(ctx, entry.Event)
+		if err == nil {
+			if err = o.advance(sink.Name(), entry.Seq); err != nil {
+				o.log.Errorf("failed to save outbox cursor for sink %s. err: %v", sink.Name(), err)
+			}
+			return true
+		}
+		o.log.Warnf("failed to send event %s to sink %s, retrying in %s. err: %v", entry.Event.ID, sink.Name(), delay, err)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > outboxMaxBackoff {
+			delay = outboxMaxBackoff
+		}
+	}
+}
+
+func (o *Outbox) pending(sinkName string) ([]outboxEntry, error) {
+	var entries []outboxEntry
+	err := o.db.View(func(tx *bbolt.Tx) error {
+		cursor := readCursor(tx, sinkName)
+		c := tx.Bucket(outboxBucket).Cursor()
+		for k, v := c.Seek(seqKey(cursor + 1)); k != nil && len(entries) < outboxBatchSize; k, v = c.Next() {
+			var entry outboxEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+func (o *Outbox) advance(sinkName string, seq uint64) error {
+	return o.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(outboxCursorsBucket).Put([]byte(sinkName), seqKey(seq))
+	})
+}
+
+// prune periodically removes the entries every sink has already received.
+func (o *Outbox) prune(ctx context.Context, sinks []Sink) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := o.pruneDelivered(sinks); err != nil {
+			o.log.Warnf("failed to prune outbox. err: %v", err)
+		}
+	}
+}
+
+// pruneDelivered removes the entries up to the lowest cursor of the sinks.
+func (o *Outbox) pruneDelivered(sinks []Sink) error {
+	return o.db.Update(func(tx *bbolt.Tx) error {
+		var low uint64
+		for i, sink := range sinks {
+			if cursor := readCursor(tx, sink.Name()); i == 0 || cursor < low {
+				low = cursor
+			}
+		}
+		bucket := tx.Bucket(outboxBucket)
+		var delivered [][]byte
+		c := bucket.Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, seqKey(low)) <= 0; k, _ = c.Next() {
+			delivered = append(delivered, append([]byte(nil), k...))
+		}
+		for _, k := range delivered {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// appendOutbox records events in the transaction of the change they describe.
+func appendOutbox(tx *bbolt.Tx, events ...Event) error {
+	bucket := tx.Bucket(outboxBucket)
+	for _, e := range events {
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(outboxEntry{Seq: seq, Event: e})
+		if err != nil {
+			return err
+		}
+		if err = bucket.Put(seqKey(seq), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readCursor(tx *bbolt.Tx, sinkName string) uint64 {
+	v := tx.Bucket(outboxCursorsBucket).Get([]byte(sinkName))
+	if v == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+func seqKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
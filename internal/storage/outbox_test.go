@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/bbolt"
+)
+
+// recordingSink keeps the events it receives, failing the first failures sends.
+type recordingSink struct {
+	name     string
+	mu       sync.Mutex
+	failures int
+	events   []Event
+}
+
+func (s *recordingSink) Name() string {
+	return s.name
+}
+
+func (s *recordingSink) Send(_ context.Context, e Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("sink unavailable")
+	}
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *recordingSink) received() []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Event(nil), s.events...)
+}
+
+func newTestOutbox(t *testing.T, db *bbolt.DB, sinks ...Sink) *Outbox {
+	t.Helper()
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	outbox, err := NewOutbox(log, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sink := range sinks {
+		outbox.AddSink(sink)
+	}
+	return outbox
+}
+
+// runOutbox runs the outbox until every sink received n events and returns once it stopped.
+func runOutbox(t *testing.T, outbox *Outbox, n int, sinks ...*recordingSink) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		outbox.Run(ctx)
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for _, sink := range sinks {
+		for len(sink.received()) < n && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	// one more poll, so events sent twice would show up
+	time.Sleep(outboxPollInterval + 100*time.Millisecond)
+	cancel()
+	<-done
+}
+
+func TestOutboxDrain(t *testing.T) {
+	service, db := newTestService(t, nil)
+	for i := 0; i < 3; i++ {
+		createTestFile(t, service, fmt.Sprintf("%d.txt", i), "contents")
+	}
+	healthy, flaky := &recordingSink{name: "healthy"}, &recordingSink{name: "flaky", failures: 2}
+	runOutbox(t, newTestOutbox(t, db, healthy, flaky), 3, healthy, flaky)
+	for _, sink := range []*recordingSink{healthy, flaky} {
+		events := sink.received()
+		if len(events) != 3 {
+			t.Fatalf("sink %s got %d events, want 3", sink.name, len(events))
+		}
+		for i, e := range events {
+			if e.Type != EventFileCreated || e.FileName != fmt.Sprintf("%d.txt", i) {
+				t.Errorf("sink %s event %d: got %+v, want the creation of %d.txt", sink.name, i, e, i)
+			}
+		}
+	}
+
+	// the cursors survive a restart, so only the new events are sent
+	createTestFile(t, service, "3.txt", "contents")
+	healthy, flaky = &recordingSink{name: "healthy"}, &recordingSink{name: "flaky"}
+	added := &recordingSink{name: "added"}
+	runOutbox(t, newTestOutbox(t, db, healthy, flaky, added), 1, healthy, flaky, added)
+	for _, sink := range []*recordingSink{healthy, flaky} {
+		if events := sink.received(); len(events) != 1 || events[0].FileName != "3.txt" {
+			t.Errorf("sink %s got %+v after the restart, want only the creation of 3.txt", sink.name, events)
+		}
+	}
+	if events := added.received(); len(events) != 4 {
+		t.Errorf("added sink got %d events, want all 4", len(events))
+	}
+}
+
+func TestOutboxPrune(t *testing.T) {
+	tests := []struct {
+		name    string
+		cursors map[string]uint64
+		// want is the sequence numbers left in the outbox
+		want []uint64
+	}{
+		{name: "no sinks", want: []uint64{1, 2, 3, 4, 5}},
+		{name: "sink without a cursor", cursors: map[string]uint64{"a": 0, "b": 5}, want: []uint64{1, 2, 3, 4, 5}},
+		{name: "lowest cursor", cursors: map[string]uint64{"a": 3, "b": 5}, want: []uint64{4, 5}},
+		{name: "all delivered", cursors: map[string]uint64{"a": 5, "b": 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, db := newTestService(t, nil)
+			outbox := newTestOutbox(t, db)
+			err := db.Update(func(tx *bbolt.Tx) error {
+				for i := 0; i < 5; i++ {
+					if err := appendOutbox(tx, Event{ID: fmt.Sprint(i), Type: EventFileCreated}); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var sinks []Sink
+			for name, cursor := range tt.cursors {
+				sinks = append(sinks, &recordingSink{name: name})
+				if cursor > 0 {
+					if err = outbox.advance(name, cursor); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if err = outbox.pruneDelivered(sinks); err != nil {
+				t.Fatal(err)
+			}
+			left, err := outbox.pending("new sink")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(left) != len(tt.want) {
+				t.Fatalf("got %d entries left, want %v", len(left), tt.want)
+			}
+			for i, entry := range left {
+				if entry.Seq != tt.want[i] {
+					t.Errorf("entry %d: got seq %d, want %d", i, entry.Seq, tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,576 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+	"github.com/gerladeno/media-storage-service/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ReplicationSync applies every write to the replicas before it returns.
+	ReplicationSync = "sync"
+	// ReplicationAsync returns once the primary is written and replicates in the background.
+	ReplicationAsync = "async"
+
+	RepairCopied  = "copied"
+	RepairRemoved = "removed"
+	RepairFailed  = "failed"
+	// RepairDivergent marks replica objects the primary doesn't have and that were left in place.
+	RepairDivergent = "divergent"
+)
+
+type Replica struct {
+	Name    string
+	Storage Storage
+}
+
+type ReplicationOptions struct {
+	Mode string
+	// QueueSize bounds the asynchronous writes waiting for the replicas. Writes over it are
+	// dropped and left to the repair job.
+	QueueSize int
+	// RepairInterval is how often the replicas are compared with the primary, 0 means only on demand.
+	RepairInterval time.Duration
+	// RemoveExtra makes the scheduled repairs remove the replica objects the primary doesn't have.
+	// They are only reported by default, a primary that lost a bucket would wipe the replicas otherwise.
+	RemoveExtra bool
+}
+
+func DefaultReplicationOptions() ReplicationOptions {
+	return ReplicationOptions{
+		Mode:           ReplicationSync,
+		QueueSize:      1024,
+		RepairInterval: 6 * time.Hour,
+	}
+}
+
+type RepairAction struct {
+	Replica  string `json:"replica"`
+	NoteUUID string `json:"note_uuid"`
+	FileID   string `json:"file_id"`
+	Action   string `json:"action"`
+	Error    string `json:"error,omitempty"`
+}
+
+type RepairReport struct {
+	StartedAt  time.Time      `json:"started_at"`
+	FinishedAt time.Time      `json:"finished_at"`
+	Notes      int            `json:"notes"`
+	Files      int            `json:"files"`
+	Actions    []RepairAction `json:"actions"`
+	Error      string         `json:"error,omitempty"`
+}
+
+// ReplicatedStorage keeps copies of the primary storage on one or more replicas. Reads are served
+// by the primary and fall back to the replicas when it fails. The repair job copies over what
+// the replicas missed, e.g. while they were down or when the asynchronous queue overflowed.
+type ReplicatedStorage struct {
+	log       *logrus.Entry
+	primary   Storage
+	replicas  []Replica
+	opts      ReplicationOptions
+	collector *metrics.Replication
+	queue     chan replicationTask
+	trigger   chan bool
+
+	mu        sync.Mutex
+	repairing bool
+	report    *RepairReport
+}
+
+type replicationTask struct {
+	operation string
+	apply     func(ctx context.Context, s Storage) error
+	// noteUUID and fileID name the object the write leaves behind. If the replica misses
+	// the object the write builds on, the object is copied over from the primary instead.
+	noteUUID string
+	fileID   string
+}
+
+func NewReplicated(log *logrus.Logger, primary Storage, replicas []Replica, opts ReplicationOptions,
+	collector *metrics.Replication,
+) *ReplicatedStorage {
+	return &ReplicatedStorage{
+		log:       log.WithField("module", "replication"),
+		primary:   primary,
+		replicas:  replicas,
+		opts:      opts,
+		collector: collector,
+		queue:     make(chan replicationTask, opts.QueueSize),
+		trigger:   make(chan bool, 1),
+	}
+}
+
+// Run applies the asynchronous writes to the replicas and repairs them every interval,
+// or earlier when triggered, until ctx is done.
+func (r *ReplicatedStorage) Run(ctx context.Context) {
+	ctx = maintenance(ctx)
+	go r.runRepairs(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case task := <-r.queue:
+			if r.collector != nil {
+				r.collector.QueueLength.Set(float64(len(r.queue)))
+			}
+			for _, replica := range r.replicas {
+				if err := r.apply(ctx, replica, task); err != nil {
+					r.log.Errorf("failed to replicate %s of note %s to %s, left to repair. err: %v",
+						task.operation, task.noteUUID, replica.Name, err)
+				}
+			}
+		}
+	}
+}
+
+func (r *ReplicatedStorage) GetFile(ctx context.Context, noteUUID, fileID string) (f *File, err error) {
+	err = r.read(ctx, func(s Storage) (err error) {
+		f, err = s.GetFile(ctx, noteUUID, fileID)
+		return err
+	})
+	return f, err
+}
+
+func (r *ReplicatedStorage) GetFilesByNoteUUID(ctx context.Context, noteUUID string) (files []*File, err error) {
+	err = r.read(ctx, func(s Storage) (err error) {
+		files, err = s.GetFilesByNoteUUID(ctx, noteUUID)
+		return err
+	})
+	return files, err
+}
+
+func (r *ReplicatedStorage) CreateFile(ctx context.Context, noteUUID string, file *File) error {
+	if err := r.primary.CreateFile(ctx, noteUUID, file); err != nil {
+		return err
+	}
+	return r.replicate(ctx, replicationTask{
+		operation: "create",
+		apply: func(ctx context.Context, s Storage) error {
+			return s.CreateFile(ctx, noteUUID, file)
+		},
+	})
+}
+
+func (r *ReplicatedStorage) DeleteFile(ctx context.Context, noteUUID, fileID string) error {
+	if err := r.primary.DeleteFile(ctx, noteUUID, fileID); err != nil {
+		return err
+	}
+	return r.replicate(ctx, replicationTask{
+		operation: "delete",
+		apply: func(ctx context.Context, s Storage) error {
+			return ignoreNotFound(s.DeleteFile(ctx, noteUUID, fileID))
+		},
+	})
+}
+
+func (r *ReplicatedStorage) ListFiles(ctx context.Context, noteUUID string) (files []*File, err error) {
+	err = r.read(ctx, func(s Storage) (err error) {
+		files, err = s.ListFiles(ctx, noteUUID)
+		return err
+	})
+	return files, err
+}
+
+func (r *ReplicatedStorage) OpenFile(ctx context.Context, noteUUID, fileID string) (reader io.ReadCloser, f *File, err error) {
+	err = r.read(ctx, func(s Storage) (err error) {
+		reader, f, err = s.OpenFile(ctx, noteUUID, fileID)
+		return err
+	})
+	return reader, f, err
+}
+
+func (r *ReplicatedStorage) StatFile(ctx context.Context, noteUUID, fileID string) (f *File, err error) {
+	err = r.read(ctx, func(s Storage) (err error) {
+		f, err = s.StatFile(ctx, noteUUID, fileID)
+		return err
+	})
+	return f, err
+}
+
+func (r *ReplicatedStorage) CopyFile(ctx context.Context, srcNoteUUID, fileID, dstNoteUUID string) error {
+	if err := r.primary.CopyFile(ctx, srcNoteUUID, fileID, dstNoteUUID); err != nil {
+		return err
+	}
+	return r.replicate(ctx, replicationTask{
+		operation: "copy",
+		apply: func(ctx context.Context, s Storage) error {
+			return s.CopyFile(ctx, srcNoteUUID, fileID, dstNoteUUID)
+		},
+		noteUUID: dstNoteUUID,
+		fileID:   fileID,
+	})
+}
+
+func (r *ReplicatedStorage) UpdateFile(ctx context.Context, noteUUID string, file *File) error {
+	if err := r.primary.UpdateFile(ctx, noteUUID, file); err != nil {
+		return err
+	}
+	return r.replicate(ctx, replicationTask{
+		operation: "update",
+		apply: func(ctx context.Context, s Storage) error {
+			return s.UpdateFile(ctx, noteUUID, file)
+		},
+		noteUUID: noteUUID,
+		fileID:   file.ID,
+	})
+}
+
+func (r *ReplicatedStorage) GetObjectTags(ctx context.Context, noteUUID, fileID string) (tags map[string]string, err error) {
+	err = r.read(ctx, func(s Storage) (err error) {
+		tags, err = s.GetObjectTags(ctx, noteUUID, fileID)
+		return err
+	})
+	return tags, err
+}
+
+func (r *ReplicatedStorage) SetObjectTags(ctx context.Context, noteUUID, fileID string, tags map[string]string) error {
+	if err := r.primary.SetObjectTags(ctx, noteUUID, fileID, tags); err != nil {
+		return err
+	}
+	return r.replicate(ctx, replicationTask{
+		operation: "tag",
+		apply: func(ctx context.Context, s Storage) error {
+			return s.SetObjectTags(ctx, noteUUID, fileID, tags)
+		},
+		noteUUID: noteUUID,
+		fileID:   fileID,
+	})
+}
+
+// LockFile locks the file in the primary and the replicas that enforce locks.
+func (r *ReplicatedStorage) LockFile(ctx context.Context, noteUUID, fileID string, retainUntil *time.Time, legalHold bool) error {
+	lock := func(ctx context.Context, s Storage) error {
+		if locker, ok := s.(Locker); ok {
+			return locker.LockFile(ctx, noteUUID, fileID, retainUntil, legalHold)
+		}
+		return nil
+	}
+	if err := lock(ctx, r.primary); err != nil {
+		return err
+	}
+	return r.replicate(ctx, replicationTask{
+		operation: "lock",
+		apply:     lock,
+		noteUUID:  noteUUID,
+		fileID:    fileID,
+	})
+}
+
+func (r *ReplicatedStorage) ListNotes(ctx context.Context) (notes []string, err error) {
+	err = r.read(ctx, func(s Storage) (err error) {
+		notes, err = s.ListNotes(ctx)
+		return err
+	})
+	return notes, err
+}
+
+func (r *ReplicatedStorage) DeleteNote(ctx context.Context, noteUUID string) error {
+	if err := r.primary.DeleteNote(ctx, noteUUID); err != nil {
+		return err
+	}
+	return r.replicate(ctx, replicationTask{
+		operation: "delete_note",
+		apply: func(ctx context.Context, s Storage) error {
+			return ignoreNotFound(s.DeleteNote(ctx, noteUUID))
+		},
+	})
+}
+
+// Health reports the primary, and in the synchronous mode the replicas too since writes need them.
+func (r *ReplicatedStorage) Health() error {
+	storages := []Storage{r.primary}
+	if r.opts.Mode == ReplicationSync {
+		for _, replica := range r.replicas {
+			storages = append(storages, replica.Storage)
+		}
+	}
+	for _, s := range storages {
+		if checker, ok := s.(HealthChecker); ok {
+			if err := checker.Health(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// read runs op against the primary and, if the primary fails rather than rejects the request,
+// against the replicas until one succeeds. The replicas may lag behind in the asynchronous mode.
+func (r *ReplicatedStorage) read(ctx context.Context, op func(s Storage) error) error {
+	err := op(r.primary)
+	if err == nil || !isBackendFailure(err) {
+		return err
+	}
+	for _, replica := range r.replicas {
+		if ctx.Err() != nil {
+			break
+		}
+		if replicaErr := op(replica.Storage); replicaErr == nil {
+			r.log.Warnf("read served by replica %s, primary failed. err: %v", replica.Name, err)
+			if r.collector != nil {
+				r.collector.FallbackReadsTotal.WithLabelValues(replica.Name).Inc()
+			}
+			return nil
+		}
+	}
+	return err
+}
+
+// replicate applies a write already done on the primary to the replicas, or queues it
+// in the asynchronous mode. A full queue drops the write instead of blocking the request.
+func (r *ReplicatedStorage) replicate(ctx context.Context, task replicationTask) error {
+	if r.opts.Mode == ReplicationAsync {
+		select {
+		case r.queue <- task:
+			if r.collector != nil {
+				r.collector.QueueLength.Set(float64(len(r.queue)))
+			}
+		default:
+			r.log.Warnf("replication queue is full, %s of note %s left to repair", task.operation, task.noteUUID)
+			if r.collector != nil {
+				r.collector.DroppedTotal.Inc()
+			}
+		}
+		return nil
+	}
+	var failed error
+	for _, replica := range r.replicas {
+		if err := r.apply(maintenance(ctx), replica, task); err != nil && failed == nil {
+			failed = fmt.Errorf("failed to replicate %s to %s. err: %w", task.operation, replica.Name, err)
+		}
+	}
+	return failed
+}
+
+func (r *ReplicatedStorage) apply(ctx context.Context, replica Replica, task replicationTask) error {
+	err := task.apply(ctx, replica.Storage)
+	if errors.Is(err, apperror.ErrNotFound) && task.fileID != "" {
+		err = r.syncObject(ctx, replica.Storage, task.noteUUID, task.fileID)
+	}
+	if r.collector != nil {
+		result := "ok"
+		if err != nil {
+			result = "failed"
+		}
+		r.collector.WritesTotal.WithLabelValues(replica.Name, task.operation, result).Inc()
+	}
+	return err
+}
+
+// syncObject copies an object with its metadata and object tags from the primary to a replica.
+func (r *ReplicatedStorage) syncObject(ctx context.Context, replica Storage, noteUUID, fileID string) error {
+	return copyObject(ctx, r.primary, replica, noteUUID, fileID)
+}
+
+// copyObject copies an object with its metadata and object tags from one storage to another.
+func copyObject(ctx context.Context, src, dst Storage, noteUUID, fileID string) error {
+	reader, f, err := src.OpenFile(ctx, noteUUID, fileID)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	if f.Bytes, err = ioutil.ReadAll(reader); err != nil {
+		return fmt.Errorf("failed to read file %s of note %s. err: %w", fileID, noteUUID, err)
+	}
+	if err = dst.CreateFile(ctx, noteUUID, f); err != nil {
+		return err
+	}
+	tags, err := src.GetObjectTags(ctx, noteUUID, fileID)
+	if err != nil || len(tags) == 0 {
+		return ignoreNotFound(err)
+	}
+	return dst.SetObjectTags(ctx, noteUUID, fileID, tags)
+}
+
+// TriggerRepair starts a repair without waiting for the interval, which removes the replica objects
+// the primary doesn't have if removeExtra is set. It returns false if a repair is already in progress.
+func (r *ReplicatedStorage) TriggerRepair(removeExtra bool) bool {
+	r.mu.Lock()
+	repairing := r.repairing
+	r.mu.Unlock()
+	if repairing {
+		return false
+	}
+	select {
+	case r.trigger <- removeExtra:
+	default:
+	}
+	return true
+}
+
+// RepairReport returns the report of the last finished repair, nil if there was none yet.
+func (r *ReplicatedStorage) RepairReport() *RepairReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.report
+}
+
+func (r *ReplicatedStorage) runRepairs(ctx context.Context) {
+	for {
+		var interval <-chan time.Time
+		if r.opts.RepairInterval > 0 {
+			interval = time.After(r.opts.RepairInterval)
+		}
+		removeExtra := r.opts.RemoveExtra
+		select {
+		case <-ctx.Done():
+			return
+		case <-interval:
+		case removeExtra = <-r.trigger:
+		}
+		r.Repair(ctx, removeExtra)
+	}
+}
+
+// Repair makes the replicas match the primary: objects that are missing or differ are copied over.
+// Objects the primary doesn't have are reported as divergent and only removed if removeExtra is set.
+func (r *ReplicatedStorage) Repair(ctx context.Context, removeExtra bool) *RepairReport {
+	ctx = maintenance(ctx)
+	r.mu.Lock()
+	r.repairing = true
+	r.mu.Unlock()
+	report := &RepairReport{StartedAt: time.Now().UTC(), Actions: []RepairAction{}}
+	r.log.Info("replica repair started")
+	if err := r.repairAll(ctx, report, removeExtra); err != nil {
+		r.log.Errorf("replica repair failed. err: %v", err)
+		report.Error = err.Error()
+	}
+	report.FinishedAt = time.Now().UTC()
+	r.log.Infof("replica repair finished, %d files, %d actions", report.Files, len(report.Actions))
+	if r.collector != nil {
+		for _, action := range report.Actions {
+			r.collector.RepairedTotal.WithLabelValues(action.Replica, action.Action).Inc()
+		}
+		r.collector.RepairLastRun.Set(float64(report.FinishedAt.Unix()))
+	}
+	r.mu.Lock()
+	r.repairing, r.report = false, report
+	r.mu.Unlock()
+	return report
+}
+
+func (r *ReplicatedStorage) repairAll(ctx context.Context, report *RepairReport, removeExtra bool) error {
+	primaryNotes, err := r.primary.ListNotes(ctx)
+	if err != nil {
+		return err
+	}
+	for _, replica := range r.replicas {
+		replicaNotes, err := replica.Storage.ListNotes(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list notes of %s. err: %w", replica.Name, err)
+		}
+		for _, noteUUID := range unionNotes(primaryNotes, replicaNotes) {
+			if err = r.repairNote(ctx, replica, noteUUID, report, removeExtra); err != nil {
+				return err
+			}
+			report.Notes++
+		}
+	}
+	return nil
+}
+
+func (r *ReplicatedStorage) repairNote(ctx context.Context, replica Replica, noteUUID string, report *RepairReport,
+	removeExtra bool,
+) error {
+	files, err := r.primary.ListFiles(ctx, noteUUID)
+	if err != nil && !errors.Is(err, apperror.ErrNotFound) {
+		return err
+	}
+	replicaFiles, err := replica.Storage.ListFiles(ctx, noteUUID)
+	if err != nil && !errors.Is(err, apperror.ErrNotFound) {
+		return fmt.Errorf("failed to list files of %s. err: %w", replica.Name, err)
+	}
+	copies := make(map[string]*File, len(replicaFiles))
+	for _, f := range replicaFiles {
+		copies[f.ID] = f
+	}
+	for _, f := range files {
+		report.Files++
+		c, ok := copies[f.ID]
+		delete(copies, f.ID)
+		if ok && sameObject(f, c) {
+			continue
+		}
+		action := RepairAction{Replica: replica.Name, NoteUUID: noteUUID, FileID: f.ID, Action: RepairCopied}
+		if err = r.syncObject(ctx, replica.Storage, noteUUID, f.ID); err != nil {
+			action.Action, action.Error = RepairFailed, err.Error()
+		}
+		report.Actions = append(report.Actions, action)
+	}
+	for id := range copies {
+		action := RepairAction{Replica: replica.Name, NoteUUID: noteUUID, FileID: id, Action: RepairDivergent}
+		if !removeExtra {
+			report.Actions = append(report.Actions, action)
+			continue
+		}
+		action.Action = RepairRemoved
+		if err = ignoreNotFound(replica.Storage.DeleteFile(ctx, noteUUID, id)); err != nil {
+			action.Action, action.Error = RepairFailed, err.Error()
+		}
+		report.Actions = append(report.Actions, action)
+	}
+	return ctx.Err()
+}
+
+// sameObject compares what's listed of two objects, the contents by their checksums.
+func sameObject(a, b *File) bool {
+	if a.Checksum != "" && b.Checksum != "" && a.Checksum != b.Checksum {
+		return false
+	}
+	return a.Name == b.Name && a.Size == b.Size && a.Owner == b.Owner && a.Description == b.Description &&
+		a.ContentType == b.ContentType && sameTags(a.Tags, b.Tags)
+}
+
+func sameTags(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+func unionNotes(a, b []string) []string {
+	set := make(map[string]struct{}, len(a)+len(b))
+	for _, noteUUID := range a {
+		set[noteUUID] = struct{}{}
+	}
+	for _, noteUUID := range b {
+		set[noteUUID] = struct{}{}
+	}
+	notes := make([]string, 0, len(set))
+	for noteUUID := range set {
+		notes = append(notes, noteUUID)
+	}
+	sort.Strings(notes)
+	return notes
+}
+
+// isBackendFailure tells a failure of the storage from a rejection of the request, e.g. a missing file.
+func isBackendFailure(err error) bool {
+	if errors.Is(err, apperror.ErrUnavailable) {
+		return true
+	}
+	var appErr *apperror.AppError
+	return !errors.As(err, &appErr)
+}
+
+func ignoreNotFound(err error) error {
+	if errors.Is(err, apperror.ErrNotFound) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+	"go.etcd.io/bbolt"
+)
+
+var locksBucket = []byte("locks")
+
+// Lock keeps the files of a note, or a single file when FileID is set, from being deleted or overwritten
+// until RetainUntil or while the legal hold is placed.
+type Lock struct {
+	NoteUUID    string     `json:"note_uuid"`
+	FileID      string     `json:"file_id,omitempty"`
+	RetainUntil *time.Time `json:"retain_until,omitempty"`
+	LegalHold   bool       `json:"legal_hold"`
+	UpdatedAt   time.Time  `json:"updated_at,omitempty"`
+}
+
+// LockDTO changes a lock, the fields left nil stay as they are. The retention can only be extended.
+type LockDTO struct {
+	RetainUntil *time.Time `json:"retain_until"`
+	LegalHold   *bool      `json:"legal_hold"`
+}
+
+func (l *Lock) active(now time.Time) bool {
+	return l != nil && (l.LegalHold || (l.RetainUntil != nil && l.RetainUntil.After(now)))
+}
+
+// merge returns the lock that holds while either lock does.
+func (l *Lock) merge(other *Lock) *Lock {
+	if other == nil {
+		return l
+	}
+	merged := *l
+	merged.LegalHold = l.LegalHold || other.LegalHold
+	if other.RetainUntil != nil && (merged.RetainUntil == nil || other.RetainUntil.After(*merged.RetainUntil)) {
+		merged.RetainUntil = other.RetainUntil
+	}
+	return &merged
+}
+
+// Locker is implemented by storages that can enforce a lock themselves, such as MinIO with object locking.
+// They keep the locked contents from being lost, whereas the service keeps the files from being deleted
+// or overwritten, since a versioned bucket accepts both.
+type Locker interface {
+	LockFile(ctx context.Context, noteUUID, fileID string, retainUntil *time.Time, legalHold bool) error
+}
+
+// LockStore keeps the locks of notes and files.
+type LockStore struct {
+	db *bbolt.DB
+}
+
+func NewLockStore(db *bbolt.DB) (*LockStore, error) {
+	err := db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(locksBucket)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to init locks bucket. err: %w", err)
+	}
+	return &LockStore{db: db}, nil
+}
+
+// Get returns the lock of a note for an empty fileID or of a file, nil if there is none.
+func (s *LockStore) Get(_ context.Context, noteUUID, fileID string) (*Lock, error) {
+	var lock *Lock
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(locksBucket).Get(indexKey(noteUUID, fileID))
+		if data == nil {
+			return nil
+		}
+		lock = &Lock{}
+		return json.Unmarshal(data, lock)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get lock. err: %w", err)
+	}
+	return lock, nil
+}
+
+// merged merges the locks of a file and of its note, nil if neither was ever set.
+func (s *LockStore) merged(ctx context.Context, noteUUID, fileID string) (*Lock, error) {
+	noteLock, err := s.Get(ctx, noteUUID, "")
+	if err != nil {
+		return nil, err
+	}
+	fileLock, err := s.Get(ctx, noteUUID, fileID)
+	if err != nil {
+		return nil, err
+	}
+	if noteLock == nil && fileLock == nil {
+		return nil, nil
+	}
+	lock := &Lock{NoteUUID: noteUUID, FileID: fileID}
+	return lock.merge(noteLock).merge(fileLock), nil
+}
+
+func (s *LockStore) put(lock *Lock) error {
+	data, err := json.Marshal(lock)
+	if err != nil {
+		return fmt.Errorf("failed to marshal lock. err: %w", err)
+	}
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(locksBucket).Put(indexKey(lock.NoteUUID, lock.FileID), data)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save lock. err: %w", err)
+	}
+	return nil
+}
+
+// SetLocks makes the service enforce the locks of the store.
+func (s *Service) SetLocks(locks *LockStore) {
+	s.locks = locks
+}
+
+// Lock returns the lock of a note for an empty fileID or of a file, with no retention and hold if there is none.
+func (s *Service) Lock(ctx context.Context, noteUUID, fileID string) (*Lock, error) {
+	if s.locks == nil {
+		return nil, apperror.ErrNotFound
+	}
+	lock, err := s.locks.Get(ctx, noteUUID, fileID)
+	if err != nil || lock != nil {
+		return lock, err
+	}
+	return &Lock{NoteUUID: noteUUID, FileID: fileID}, nil
+}
+
+// SetLock changes the lock of a note for an empty fileID or of a file and passes it on to the storage.
+// A note lock covers the files added to the note later too.
+func (s *Service) SetLock(ctx context.Context, noteUUID, fileID string, dto LockDTO) (*Lock, error) {
+	if s.locks == nil {
+		return nil, apperror.ErrNotFound
+	}
+	if dto.RetainUntil == nil && dto.LegalHold == nil {
+		return nil, apperror.BadRequestError("nothing to update")
+	}
+	if fileID != "" {
+		if _, err := s.storage.StatFile(ctx, noteUUID, fileID); err != nil {
+			return nil, err
+		}
+	}
+	lock, err := s.Lock(ctx, noteUUID, fileID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if dto.RetainUntil != nil {
+		if !dto.RetainUntil.After(now) {
+			return nil, apperror.BadRequestError("retain_until must be in the future")
+		}
+		if lock.RetainUntil != nil && dto.RetainUntil.Before(*lock.RetainUntil) {
+			return nil, apperror.BadRequestError("retention can only be extended")
+		}
+		retainUntil := dto.RetainUntil.UTC().Truncate(time.Second)
+		lock.RetainUntil = &retainUntil
+	}
+	if dto.LegalHold != nil {
+		lock.LegalHold = *dto.LegalHold
+	}
+	lock.UpdatedAt = now.UTC()
+	if err = s.locks.put(lock); err != nil {
+		return nil, err
+	}
+	if fileID != "" {
+		s.applyLock(ctx, noteUUID, fileID)
+		return lock, nil
+	}
+	files, err := s.storage.ListFiles(ctx, noteUUID)
+	if err != nil && !errors.Is(err, apperror.ErrNotFound) {
+		s.log.Warnf("failed to list files of note %s to lock. err: %v", noteUUID, err)
+	}
+	for _, f := range files {
+		s.applyLock(ctx, noteUUID, f.ID)
+	}
+	return lock, nil
+}
+
+// mergedLock merges the locks of a file and of its note, nil if neither was ever set.
+func (s *Service) mergedLock(ctx context.Context, noteUUID, fileID string) (*Lock, error) {
+	if s.locks == nil {
+		return nil, nil
+	}
+	return s.locks.merged(ctx, noteUUID, fileID)
+}
+
+// checkLocked fails with apperror.ErrLocked if a file can't be deleted or overwritten.
+func (s *Service) checkLocked(ctx context.Context, noteUUID, fileID string) error {
+	lock, err := s.mergedLock(ctx, noteUUID, fileID)
+	if err != nil {
+		return err
+	}
+	if lock.active(time.Now()) {
+		return apperror.ErrLocked
+	}
+	return nil
+}
+
+// applyLock passes the lock of a file on to storages that enforce locks themselves. The service enforces
+// the lock for its own writes either way, so failures, e.g. of buckets without object locking, are only
+// logged. MinIO storages also drop the expiry tag of locked files, so the bucket lifecycle rules don't
+// remove them, and the tiered storage keeps locked files on the hot tier.
+func (s *Service) applyLock(ctx context.Context, noteUUID, fileID string) {
+	locker, ok := s.storage.(Locker)
+	if !ok {
+		return
+	}
+	lock, err := s.mergedLock(ctx, noteUUID, fileID)
+	if err != nil || lock == nil {
+		return
+	}
+	retainUntil := lock.RetainUntil
+	if retainUntil != nil && !retainUntil.After(time.Now()) {
+		retainUntil = nil
+	}
+	if err = locker.LockFile(ctx, noteUUID, fileID, retainUntil, lock.LegalHold); err != nil {
+		s.log.Warnf("failed to lock file %s of note %s in the storage. err: %v", fileID, noteUUID, err)
+	}
+}
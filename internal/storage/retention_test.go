@@ -0,0 +1,252 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+	"github.com/gerladeno/media-storage-service/internal/fulltext"
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/bbolt"
+)
+
+const testNote = "5f0c4d3e-8a1b-4c2d-9e3f-1a2b3c4d5e6f"
+
+// versionedStorage stands for a bucket with object locking: it takes the locks, but deleting
+// and overwriting the locked files still succeed, as they only add versions.
+type versionedStorage struct {
+	Storage
+	locked map[string]bool
+}
+
+func (v *versionedStorage) LockFile(_ context.Context, _, fileID string, retainUntil *time.Time, legalHold bool) error {
+	v.locked[fileID] = retainUntil != nil || legalHold
+	return nil
+}
+
+func newTestService(t *testing.T, fileStorage func(Storage) Storage) (*Service, *bbolt.DB) {
+	t.Helper()
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	dir := t.TempDir()
+	db, err := bbolt.Open(filepath.Join(dir, "storage.db"), 0o600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	fs, err := NewFilesystem(log, filepath.Join(dir, "files"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileStorage != nil {
+		fs = fileStorage(fs)
+	}
+	index, err := NewIndex(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	textIndex, err := fulltext.NewIndex(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service, err := NewService(log, fs, index, textIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locks, err := NewLockStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.SetLocks(locks)
+	return service, db
+}
+
+func createTestFile(t *testing.T, service *Service, name, contents string) *File {
+	t.Helper()
+	f, err := service.Create(context.Background(), testNote, CreateFileDTO{
+		Name:   name,
+		Size:   int64(len(contents)),
+		Reader: bytes.NewReader([]byte(contents)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestLockedFiles(t *testing.T) {
+	hold, release := true, false
+	retainUntil := time.Now().Add(time.Hour)
+	tests := []struct {
+		name string
+		// note locks the note instead of the file
+		note   bool
+		dto    LockDTO
+		locked bool
+	}{
+		{name: "file retention", dto: LockDTO{RetainUntil: &retainUntil}, locked: true},
+		{name: "file legal hold", dto: LockDTO{LegalHold: &hold}, locked: true},
+		{name: "note retention", note: true, dto: LockDTO{RetainUntil: &retainUntil}, locked: true},
+		{name: "note legal hold", note: true, dto: LockDTO{LegalHold: &hold}, locked: true},
+		{name: "released legal hold", dto: LockDTO{LegalHold: &release}, locked: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			versioned := &versionedStorage{locked: map[string]bool{}}
+			service, _ := newTestService(t, func(s Storage) Storage {
+				versioned.Storage = s
+				return versioned
+			})
+			ctx := context.Background()
+			f := createTestFile(t, service, "report.txt", "v1")
+			fileID := f.ID
+			if tt.note {
+				fileID = ""
+			}
+			if _, err := service.SetLock(ctx, testNote, fileID, tt.dto); err != nil {
+				t.Fatal(err)
+			}
+			if versioned.locked[f.ID] != tt.locked {
+				t.Fatalf("storage lock %v, want %v", versioned.locked[f.ID], tt.locked)
+			}
+			// the id is derived from the name and the contents, so uploading them again overwrites the file
+			_, err := service.Create(ctx, testNote, CreateFileDTO{Name: "report.txt", Size: 2, Reader: bytes.NewReader([]byte("v1"))})
+			if tt.locked != errors.Is(err, apperror.ErrLocked) {
+				t.Fatalf("overwrite: got %v, locked %v", err, tt.locked)
+			}
+			err = service.Delete(ctx, testNote, f.ID)
+			if tt.locked != errors.Is(err, apperror.ErrLocked) {
+				t.Fatalf("delete: got %v, locked %v", err, tt.locked)
+			}
+			reader, _, err := service.OpenFile(ctx, testNote, f.ID)
+			if !tt.locked {
+				if !errors.Is(err, apperror.ErrNotFound) {
+					t.Fatalf("got %v, want the unlocked file deleted", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+			contents, _ := io.ReadAll(reader)
+			if string(contents) != "v1" {
+				t.Fatalf("read %q, want the locked contents", contents)
+			}
+		})
+	}
+}
+
+func TestLockCanOnlyBeExtended(t *testing.T) {
+	service, _ := newTestService(t, nil)
+	ctx := context.Background()
+	f := createTestFile(t, service, "a.txt", "a")
+	later, earlier, past := time.Now().Add(2*time.Hour), time.Now().Add(time.Hour), time.Now().Add(-time.Hour)
+	if _, err := service.SetLock(ctx, testNote, f.ID, LockDTO{RetainUntil: &later}); err != nil {
+		t.Fatal(err)
+	}
+	for name, until := range map[string]*time.Time{"shortened": &earlier, "past": &past} {
+		var appErr *apperror.AppError
+		if _, err := service.SetLock(ctx, testNote, f.ID, LockDTO{RetainUntil: until}); !errors.As(err, &appErr) {
+			t.Errorf("%s retention: got %v, want a bad request", name, err)
+		}
+	}
+}
+
+func TestLockedFileOperations(t *testing.T) {
+	const otherNote = "6a1d5e4f-9b2c-4d3e-8f4a-2b3c4d5e6f7a"
+	name := "renamed.txt"
+	tests := []struct {
+		name string
+		op   func(ctx context.Context, service *Service, f *File) error
+		err  error
+	}{
+		{
+			name: "rename",
+			op: func(ctx context.Context, service *Service, f *File) error {
+				_, err := service.Update(ctx, testNote, f.ID, UpdateFileDTO{Name: &name})
+				return err
+			},
+			err: apperror.ErrLocked,
+		},
+		{
+			name: "object tags",
+			op: func(ctx context.Context, service *Service, f *File) error {
+				_, err := service.Update(ctx, testNote, f.ID, UpdateFileDTO{ObjectTags: map[string]string{"class": "report"}})
+				return err
+			},
+		},
+		{
+			name: "move",
+			op: func(ctx context.Context, service *Service, f *File) error {
+				_, err := service.Move(ctx, testNote, f.ID, otherNote)
+				return err
+			},
+			err: apperror.ErrLocked,
+		},
+		{
+			name: "copy",
+			op: func(ctx context.Context, service *Service, f *File) error {
+				_, err := service.Copy(ctx, testNote, f.ID, otherNote)
+				return err
+			},
+		},
+	}
+	hold := true
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, _ := newTestService(t, nil)
+			ctx := context.Background()
+			f := createTestFile(t, service, "report.txt", "v1")
+			if _, err := service.SetLock(ctx, testNote, f.ID, LockDTO{LegalHold: &hold}); err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.op(ctx, service, f); !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			stat, err := service.StatFile(ctx, testNote, f.ID)
+			if err != nil {
+				t.Fatalf("got %v, want the locked file kept", err)
+			}
+			if stat.Name != "report.txt" {
+				t.Fatalf("locked file renamed to %s", stat.Name)
+			}
+		})
+	}
+}
+
+func TestReapSkipsLockedFiles(t *testing.T) {
+	service, _ := newTestService(t, nil)
+	ctx := context.Background()
+	locked, unlocked := createTestFile(t, service, "locked.txt", "a"), createTestFile(t, service, "unlocked.txt", "b")
+	retainUntil := time.Now().Add(time.Hour)
+	if _, err := service.SetLock(ctx, testNote, locked.ID, LockDTO{RetainUntil: &retainUntil}); err != nil {
+		t.Fatal(err)
+	}
+	// files can't be created expired, so the expiry is moved into the past in the index
+	expired := time.Now().Add(-time.Minute)
+	for _, f := range []*File{locked, unlocked} {
+		f.ExpiresAt = &expired
+		if _, err := service.index.Put(ctx, testNote, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reaped, err := service.ReapExpired(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reaped != 1 {
+		t.Fatalf("reaped %d files, want only the unlocked one", reaped)
+	}
+	if _, err = service.StatFile(ctx, testNote, locked.ID); err != nil {
+		t.Fatalf("got %v, want the locked file kept", err)
+	}
+	if _, err = service.StatFile(ctx, testNote, unlocked.ID); !errors.Is(err, apperror.ErrNotFound) {
+		t.Fatalf("got %v, want the unlocked file reaped", err)
+	}
+}
@@ -0,0 +1,303 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+	"github.com/gerladeno/media-storage-service/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// QuarantineNote holds the corrupted objects taken out of their notes by the scrubber.
+	QuarantineNote = "quarantine"
+
+	ScrubCorrupted = "corrupted"
+	// ScrubOrphaned is a stored object without an index entry.
+	ScrubOrphaned = "orphaned"
+	// ScrubDangling is an index entry without a stored object.
+	ScrubDangling = "dangling"
+	ScrubFailed   = "failed"
+)
+
+type ScrubOptions struct {
+	Interval time.Duration
+	// Rate limits how many bytes per second are read, 0 means no limit.
+	Rate int64
+	// Quarantine moves corrupted objects out of their notes into QuarantineNote.
+	Quarantine bool
+}
+
+func DefaultScrubOptions() ScrubOptions {
+	return ScrubOptions{
+		Interval: 24 * time.Hour,
+		Rate:     8 << 20,
+	}
+}
+
+type ScrubFinding struct {
+	Kind        string `json:"kind"`
+	NoteUUID    string `json:"note_uuid"`
+	FileID      string `json:"file_id"`
+	Name        string `json:"name,omitempty"`
+	Expected    string `json:"expected,omitempty"`
+	Actual      string `json:"actual,omitempty"`
+	Quarantined bool   `json:"quarantined,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+type ScrubReport struct {
+	StartedAt  time.Time      `json:"started_at"`
+	FinishedAt time.Time      `json:"finished_at"`
+	Notes      int            `json:"notes"`
+	Files      int            `json:"files"`
+	Bytes      int64          `json:"bytes"`
+	Findings   []ScrubFinding `json:"findings"`
+	Error      string         `json:"error,omitempty"`
+}
+
+// Scrubber periodically reads every stored file to find corrupted contents and
+// disagreements between the storage and the index.
+type Scrubber struct {
+	log       *logrus.Entry
+	service   *Service
+	opts      ScrubOptions
+	collector *metrics.Integrity
+	trigger   chan struct{}
+
+	mu      sync.Mutex
+	running bool
+	report  *ScrubReport
+}
+
+func NewScrubber(log *logrus.Logger, service *Service, opts ScrubOptions, collector *metrics.Integrity) *Scrubber {
+	return &Scrubber{
+		log:       log.WithField("module", "scrubber"),
+		service:   service,
+		opts:      opts,
+		collector: collector,
+		trigger:   make(chan struct{}, 1),
+	}
+}
+
+// Run scrubs the storage every interval, or earlier when triggered, until ctx is done.
+func (s *Scrubber) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.opts.Interval):
+		case <-s.trigger:
+		}
+		s.scrub(ctx)
+	}
+}
+
+// Trigger starts a run without waiting for the interval. It returns false if a run is already in progress.
+func (s *Scrubber) Trigger() bool {
+	s.mu.Lock()
+	running := s.running
+	s.mu.Unlock()
+	if running {
+		return false
+	}
+	select {
+	case s.trigger <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Report returns the report of the last finished run, nil if there was none yet.
+func (s *Scrubber) Report() *ScrubReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.report
+}
+
+func (s *Scrubber) scrub(ctx context.Context) {
+	ctx = maintenance(ctx)
+	s.mu.Lock()
+	s.running = true
+	s.mu.Unlock()
+	report := &ScrubReport{StartedAt: time.Now().UTC(), Findings: []ScrubFinding{}}
+	s.log.Info("scrubbing started")
+	if err := s.scrubAll(ctx, report); err != nil {
+		s.log.Errorf("scrubbing failed. err: %v", err)
+		report.Error = err.Error()
+	}
+	report.FinishedAt = time.Now().UTC()
+	s.log.Infof("scrubbing finished, %d files, %d findings", report.Files, len(report.Findings))
+	s.observe(report)
+	s.mu.Lock()
+	s.running, s.report = false, report
+	s.mu.Unlock()
+}
+
+func (s *Scrubber) scrubAll(ctx context.Context, report *ScrubReport) error {
+	notes, err := s.service.notes(ctx, nil)
+	if err != nil {
+		return err
+	}
+	limiter := newThrottle(s.opts.Rate)
+	for _, noteUUID := range notes {
+		if err = s.scrubNote(ctx, noteUUID, limiter, report); err != nil {
+			return err
+		}
+		report.Notes++
+	}
+	return nil
+}
+
+func (s *Scrubber) scrubNote(ctx context.Context, noteUUID string, limiter *throttle, report *ScrubReport) error {
+	files, err := s.service.storage.ListFiles(ctx, noteUUID)
+	if err != nil && !errors.Is(err, apperror.ErrNotFound) {
+		return err
+	}
+	indexed, err := s.service.index.Search(ctx, SearchQuery{NoteUUIDs: []string{noteUUID}})
+	if err != nil {
+		return err
+	}
+	entries := make(map[string]*IndexEntry, len(indexed.Files))
+	for _, e := range indexed.Files {
+		entries[e.ID] = e
+	}
+	for _, f := range files {
+		e, ok := entries[f.ID]
+		delete(entries, f.ID)
+		if !ok {
+			report.Findings = append(report.Findings, ScrubFinding{Kind: ScrubOrphaned, NoteUUID: noteUUID, FileID: f.ID, Name: f.Name})
+			continue
+		}
+		expected := f.Checksum
+		if expected == "" {
+			expected = e.Checksum
+		}
+		actual, n, err := s.checksum(ctx, noteUUID, f.ID, limiter)
+		report.Files++
+		report.Bytes += n
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			report.Findings = append(report.Findings, ScrubFinding{
+				Kind: ScrubFailed, NoteUUID: noteUUID, FileID: f.ID, Name: f.Name, Error: err.Error(),
+			})
+			continue
+		}
+		if expected == "" || expected == actual {
+			continue
+		}
+		s.service.reportCorruption("scrub", noteUUID, f.ID, expected, actual)
+		finding := ScrubFinding{
+			Kind: ScrubCorrupted, NoteUUID: noteUUID, FileID: f.ID, Name: f.Name, Expected: expected, Actual: actual,
+		}
+		if s.opts.Quarantine {
+			if err = s.service.quarantine(ctx, noteUUID, f.ID); err != nil {
+				finding.Error = err.Error()
+			} else {
+				finding.Quarantined = true
+			}
+		}
+		report.Findings = append(report.Findings, finding)
+	}
+	for _, e := range entries {
+		report.Findings = append(report.Findings, ScrubFinding{Kind: ScrubDangling, NoteUUID: noteUUID, FileID: e.ID, Name: e.Name})
+	}
+	return nil
+}
+
+func (s *Scrubber) checksum(ctx context.Context, noteUUID, fileID string, limiter *throttle) (string, int64, error) {
+	reader, _, err := s.service.storage.OpenFile(ctx, noteUUID, fileID)
+	if err != nil {
+		return "", 0, err
+	}
+	defer reader.Close()
+	hash := sha256.New()
+	buf := make([]byte, 64<<10)
+	var total int64
+	for {
+		n, err := reader.Read(buf)
+		hash.Write(buf[:n])
+		total += int64(n)
+		if waitErr := limiter.wait(ctx, n); waitErr != nil {
+			return "", total, waitErr
+		}
+		if errors.Is(err, io.EOF) {
+			return hex.EncodeToString(hash.Sum(nil)), total, nil
+		}
+		if err != nil {
+			return "", total, fmt.Errorf("failed to read file %s of note %s. err: %w", fileID, noteUUID, err)
+		}
+	}
+}
+
+func (s *Scrubber) observe(report *ScrubReport) {
+	if s.collector == nil {
+		return
+	}
+	counts := map[string]int{ScrubCorrupted: 0, ScrubOrphaned: 0, ScrubDangling: 0, ScrubFailed: 0}
+	for _, finding := range report.Findings {
+		counts[finding.Kind]++
+	}
+	for kind, count := range counts {
+		s.collector.ScrubFindings.WithLabelValues(kind).Set(float64(count))
+	}
+	s.collector.ScrubFilesTotal.Add(float64(report.Files))
+	s.collector.ScrubBytesTotal.Add(float64(report.Bytes))
+	s.collector.ScrubDuration.Set(report.FinishedAt.Sub(report.StartedAt).Seconds())
+	s.collector.ScrubLastRun.Set(float64(report.FinishedAt.Unix()))
+}
+
+// quarantine moves a corrupted object out of its note so it's no longer served,
+// keeping it for inspection. Locked objects stay where they are.
+func (s *Service) quarantine(ctx context.Context, noteUUID, fileID string) error {
+	if err := s.checkLocked(ctx, noteUUID, fileID); err != nil {
+		return err
+	}
+	if err := s.storage.CopyFile(ctx, noteUUID, fileID, QuarantineNote); err != nil {
+		return err
+	}
+	if err := s.storage.DeleteFile(ctx, noteUUID, fileID); err != nil {
+		return err
+	}
+	return s.indexDelete(ctx, noteUUID, fileID)
+}
+
+// throttle keeps the read rate under a number of bytes per second.
+type throttle struct {
+	rate  int64
+	start time.Time
+	bytes int64
+}
+
+func newThrottle(rate int64) *throttle {
+	return &throttle{rate: rate, start: time.Now()}
+}
+
+func (t *throttle) wait(ctx context.Context, n int) error {
+	if t.rate <= 0 {
+		return ctx.Err()
+	}
+	t.bytes += int64(n)
+	due := t.start.Add(time.Duration(float64(t.bytes) / float64(t.rate) * float64(time.Second)))
+	delay := time.Until(due)
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -2,27 +2,67 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"io"
+	"time"
 
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+	"github.com/gerladeno/media-storage-service/internal/fulltext"
+	"github.com/gerladeno/media-storage-service/pkg/metrics"
 	"github.com/sirupsen/logrus"
 )
 
+// TextIndex is a full-text index of the extracted file contents.
+type TextIndex interface {
+	Put(ctx context.Context, noteUUID, fileID, text string) error
+	Delete(ctx context.Context, noteUUID, fileID string) error
+	Copy(ctx context.Context, srcNoteUUID, fileID, dstNoteUUID string) error
+	Search(ctx context.Context, query string) ([]fulltext.Hit, error)
+	Snippets(ctx context.Context, noteUUID, fileID, query string) ([]string, error)
+}
+
+// HealthChecker is implemented by storages that know whether their backend is available.
+type HealthChecker interface {
+	Health() error
+}
+
 type Service struct {
-	log     *logrus.Entry
-	storage Storage
+	log          *logrus.Entry
+	storage      Storage
+	index        Index
+	textIndex    TextIndex
+	publishers   []Publisher
+	importLimits ImportLimits
+	integrity    *metrics.Integrity
+	locks        *LockStore
 }
 
-func NewService(log *logrus.Logger, noteStorage Storage) (*Service, error) {
+func NewService(log *logrus.Logger, noteStorage Storage, index Index, textIndex TextIndex) (*Service, error) {
 	return &Service{
-		storage: noteStorage,
-		log:     log.WithField("module", "service"),
+		storage:      noteStorage,
+		index:        index,
+		textIndex:    textIndex,
+		log:          log.WithField("module", "service"),
+		importLimits: DefaultImportLimits(),
 	}, nil
 }
 
+// Ready returns an error while the storage can't serve requests.
+func (s *Service) Ready(_ context.Context) error {
+	if checker, ok := s.storage.(HealthChecker); ok {
+		return checker.Health()
+	}
+	return nil
+}
+
 func (s *Service) GetFile(ctx context.Context, noteUUID, fileID string) (f *File, err error) {
 	f, err = s.storage.GetFile(ctx, noteUUID, fileID)
 	if err != nil {
 		return f, err
 	}
+	if err = checkExpired(f); err != nil {
+		return nil, err
+	}
 	return f, nil
 }
 
@@ -31,25 +71,306 @@ func (s *Service) GetFilesByNoteUUID(ctx context.Context, noteUUID string) ([]*F
 	if err != nil {
 		return nil, err
 	}
-	return files, nil
+	current := files[:0]
+	for _, f := range files {
+		if checkExpired(f) == nil {
+			current = append(current, f)
+		}
+	}
+	return current, nil
 }
 
-func (s *Service) Create(ctx context.Context, noteUUID string, dto CreateFileDTO) error {
+// OpenFile streams the contents of a file instead of loading them into memory.
+// The contents are verified against the checksum of the file as they are read.
+func (s *Service) OpenFile(ctx context.Context, noteUUID, fileID string) (io.ReadCloser, *File, error) {
+	reader, f, err := s.openVerified(ctx, noteUUID, fileID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = checkExpired(f); err != nil {
+		_ = reader.Close()
+		return nil, nil, err
+	}
+	return reader, f, nil
+}
+
+func (s *Service) StatFile(ctx context.Context, noteUUID, fileID string) (*File, error) {
+	f, err := s.storage.StatFile(ctx, noteUUID, fileID)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkExpired(f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Create stores the file and records it in the index. If the index can't be updated
+// the stored object is removed again. The write is recorded as pending before the object
+// is stored, so one interrupted by a crash is indexed with its event by RecoverWrites.
+// Overwriting a file fails with apperror.ErrLocked while the file or its note is locked.
+func (s *Service) Create(ctx context.Context, noteUUID string, dto CreateFileDTO) (*File, error) {
 	file, err := NewFile(dto)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	// new files may be added to a locked note, only overwrites are checked. An object that
+	// was there before isn't removed when the index update fails either, unless the storage
+	// said for sure it wasn't there
+	_, err = s.storage.StatFile(ctx, noteUUID, file.ID)
+	existed := !errors.Is(err, apperror.ErrNotFound)
+	if existed {
+		if err = s.checkLocked(ctx, noteUUID, file.ID); err != nil {
+			return nil, err
+		}
+	}
+	if err = s.index.BeginWrite(ctx, noteUUID, file.ID); err != nil {
+		return nil, err
 	}
 	err = s.storage.CreateFile(ctx, noteUUID, file)
 	if err != nil {
-		return err
+		s.endWrite(ctx, noteUUID, file.ID)
+		return nil, err
 	}
-	return nil
+	if err = s.indexPut(ctx, noteUUID, file); err != nil {
+		if !existed {
+			s.discard(ctx, noteUUID, file.ID)
+		}
+		s.endWrite(ctx, noteUUID, file.ID)
+		return nil, err
+	}
+	s.indexText(ctx, noteUUID, file)
+	s.applyLock(ctx, noteUUID, file.ID)
+	return file, nil
 }
 
+// Delete removes a file. It fails with apperror.ErrLocked while the file or its note is locked.
+// The delete is recorded as pending before the object is removed, see RecoverWrites.
 func (s *Service) Delete(ctx context.Context, noteUUID, fileName string) error {
+	if err := s.checkLocked(ctx, noteUUID, fileName); err != nil {
+		return err
+	}
+	if err := s.checkExists(ctx, noteUUID, fileName); err != nil {
+		return err
+	}
+	// like writes, the delete is pending until the index is updated, so RecoverWrites finishes
+	// one interrupted after the object is gone
+	if err := s.index.BeginDelete(ctx, noteUUID, fileName); err != nil {
+		return err
+	}
 	err := s.storage.DeleteFile(ctx, noteUUID, fileName)
 	if err != nil {
+		s.endWrite(ctx, noteUUID, fileName)
+		return err
+	}
+	return s.indexDelete(ctx, noteUUID, fileName)
+}
+
+// checkExists fails with apperror.ErrNotFound for a file that is neither indexed nor stored,
+// so that deleting it records no change and emits no events. Files stored before the index
+// existed are found by their object.
+func (s *Service) checkExists(ctx context.Context, noteUUID, fileID string) error {
+	_, err := s.index.Get(ctx, noteUUID, fileID)
+	if !errors.Is(err, apperror.ErrNotFound) {
 		return err
 	}
+	_, err = s.storage.StatFile(ctx, noteUUID, fileID)
+	return err
+}
+
+func (s *Service) Search(ctx context.Context, q SearchQuery) (*SearchResult, error) {
+	q.hideExpired = true
+	if q.Text == "" {
+		return s.index.Search(ctx, q)
+	}
+	hits, err := s.textIndex.Search(ctx, q.Text)
+	if err != nil {
+		return nil, err
+	}
+	limit, offset := q.Limit, q.Offset
+	q.Limit, q.Offset = 0, 0
+	scoped, err := s.index.Search(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]*IndexEntry, len(scoped.Files))
+	for _, e := range scoped.Files {
+		entries[string(indexKey(e.NoteUUID, e.ID))] = e
+	}
+	ranked := make([]*IndexEntry, 0, len(hits))
+	for _, hit := range hits {
+		if e, ok := entries[string(indexKey(hit.NoteUUID, hit.FileID))]; ok {
+			e.Score = hit.Score
+			ranked = append(ranked, e)
+		}
+	}
+	result := &SearchResult{Total: len(ranked), Files: []*IndexEntry{}}
+	if offset < len(ranked) {
+		ranked = ranked[offset:]
+		if limit > 0 && limit < len(ranked) {
+			ranked = ranked[:limit]
+		}
+		result.Files = ranked
+	}
+	for _, e := range result.Files {
+		if e.Snippets, err = s.textIndex.Snippets(ctx, e.NoteUUID, e.ID, q.Text); err != nil {
+			s.log.Warnf("failed to build snippets for file %s. err: %v", e.ID, err)
+		}
+	}
+	return result, nil
+}
+
+// indexPut and indexDelete record the metadata change together with its events,
+// which are then published to the in-process subscribers.
+func (s *Service) indexPut(ctx context.Context, noteUUID string, f *File) error {
+	events, err := s.index.Put(ctx, noteUUID, f)
+	if err != nil {
+		return err
+	}
+	s.publish(ctx, events)
+	return nil
+}
+
+func (s *Service) indexDelete(ctx context.Context, noteUUID, fileID string) error {
+	if err := s.textIndex.Delete(ctx, noteUUID, fileID); err != nil {
+		s.log.Warnf("failed to remove text of file %s of note %s from index. err: %v", fileID, noteUUID, err)
+	}
+	events, err := s.index.Delete(ctx, noteUUID, fileID)
+	if err != nil {
+		return err
+	}
+	s.publish(ctx, events)
+	return nil
+}
+
+// endWrite forgets a pending write that failed, one that can't be forgotten is left to RecoverWrites.
+func (s *Service) endWrite(ctx context.Context, noteUUID, fileID string) {
+	if err := s.index.EndWrite(ctx, noteUUID, fileID); err != nil {
+		s.log.Warnf("failed to end pending write of file %s of note %s. err: %v", fileID, noteUUID, err)
+	}
+}
+
+// discard removes an object whose index entry couldn't be written.
+func (s *Service) discard(ctx context.Context, noteUUID, fileID string) {
+	if err := s.storage.DeleteFile(ctx, noteUUID, fileID); err != nil {
+		s.log.Errorf("failed to remove unindexed file %s of note %s. err: %v", fileID, noteUUID, err)
+	}
+}
+
+func (s *Service) indexText(ctx context.Context, noteUUID string, f *File) {
+	text, err := fulltext.Extract(f.Name, f.ContentType, f.Bytes)
+	if errors.Is(err, fulltext.ErrUnsupported) {
+		return
+	}
+	if err != nil {
+		s.log.Warnf("failed to extract text of file %s. err: %v", f.ID, err)
+		return
+	}
+	if err = s.textIndex.Put(ctx, noteUUID, f.ID, text); err != nil {
+		s.log.Warnf("failed to index text of file %s of note %s. err: %v", f.ID, noteUUID, err)
+	}
+}
+
+type UpdateFileDTO struct {
+	Name             *string           `json:"name"`
+	Description      *string           `json:"description"`
+	Tags             map[string]string `json:"tags"`
+	RemoveTags       []string          `json:"remove_tags"`
+	ObjectTags       map[string]string `json:"object_tags"`
+	RemoveObjectTags []string          `json:"remove_object_tags"`
+	// ExpiresAt or TTL set when the file expires, RemoveExpiry keeps it forever.
+	ExpiresAt    *time.Time `json:"expires_at"`
+	TTL          string     `json:"ttl"`
+	RemoveExpiry bool       `json:"remove_expiry"`
+}
+
+func (dto UpdateFileDTO) changesMetadata() bool {
+	return dto.Name != nil || dto.Description != nil || len(dto.Tags) > 0 || len(dto.RemoveTags) > 0 ||
+		dto.changesExpiry()
+}
+
+func (dto UpdateFileDTO) changesExpiry() bool {
+	return dto.ExpiresAt != nil || dto.TTL != "" || dto.RemoveExpiry
+}
+
+func (dto UpdateFileDTO) changesObjectTags() bool {
+	return len(dto.ObjectTags) > 0 || len(dto.RemoveObjectTags) > 0
+}
+
+// Update changes the name, description, tags and expiry of a file. The file id and contents stay the same.
+func (s *Service) Update(ctx context.Context, noteUUID, fileID string, dto UpdateFileDTO) (*File, error) {
+	if !dto.changesMetadata() && !dto.changesObjectTags() {
+		return nil, apperror.BadRequestError("nothing to update")
+	}
+	f, err := s.StatFile(ctx, noteUUID, fileID)
+	if err != nil {
+		return nil, err
+	}
+	if dto.changesMetadata() {
+		if err = s.checkLocked(ctx, noteUUID, fileID); err != nil {
+			return nil, err
+		}
+		if err = s.applyMetadata(ctx, noteUUID, f, dto); err != nil {
+			return nil, err
+		}
+		if err = s.storage.UpdateFile(ctx, noteUUID, f); err != nil {
+			return nil, err
+		}
+	}
+	if f.ObjectTags, err = s.storage.GetObjectTags(ctx, noteUUID, fileID); err != nil {
+		return nil, err
+	}
+	if dto.changesObjectTags() {
+		f.ObjectTags = mergeTags(f.ObjectTags, dto.ObjectTags, dto.RemoveObjectTags)
+		if err = s.storage.SetObjectTags(ctx, noteUUID, fileID, f.ObjectTags); err != nil {
+			return nil, err
+		}
+	}
+	if err = s.indexPut(ctx, noteUUID, f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *Service) applyMetadata(ctx context.Context, noteUUID string, f *File, dto UpdateFileDTO) error {
+	if dto.Name != nil && *dto.Name != f.Name {
+		if *dto.Name == "" {
+			return apperror.BadRequestError("name must not be empty")
+		}
+		if err := s.checkNameConflict(ctx, noteUUID, *dto.Name); err != nil {
+			return err
+		}
+		f.Name = *dto.Name
+	}
+	if dto.Description != nil {
+		f.Description = *dto.Description
+	}
+	f.Tags = mergeTags(f.Tags, dto.Tags, dto.RemoveTags)
+	switch {
+	case dto.RemoveExpiry && (dto.ExpiresAt != nil || dto.TTL != ""):
+		return apperror.BadRequestError("remove_expiry excludes expires_at and ttl")
+	case dto.RemoveExpiry:
+		f.ExpiresAt = nil
+	case dto.changesExpiry():
+		expiresAt, err := resolveExpiry(dto.ExpiresAt, dto.TTL, time.Now())
+		if err != nil {
+			return err
+		}
+		f.ExpiresAt = expiresAt
+	}
 	return nil
 }
+
+func mergeTags(current, set map[string]string, remove []string) map[string]string {
+	merged := make(map[string]string, len(current)+len(set))
+	for k, v := range current {
+		merged[k] = v
+	}
+	for _, k := range remove {
+		delete(merged, k)
+	}
+	for k, v := range set {
+		merged[k] = v
+	}
+	return merged
+}
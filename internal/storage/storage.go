@@ -5,9 +5,17 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
 
 	"github.com/gerladeno/media-storage-service/internal/apperror"
 	"github.com/gerladeno/media-storage-service/pkg/minio"
@@ -19,19 +27,60 @@ type Storage interface {
 	GetFilesByNoteUUID(ctx context.Context, uuid string) ([]*File, error)
 	CreateFile(ctx context.Context, noteUUID string, file *File) error
 	DeleteFile(ctx context.Context, noteUUID, fileName string) error
+	// ListFiles returns the files of a note without their contents.
+	ListFiles(ctx context.Context, noteUUID string) ([]*File, error)
+	// OpenFile returns a streaming reader of the file contents. File.Bytes is left empty.
+	OpenFile(ctx context.Context, noteUUID, fileID string) (io.ReadCloser, *File, error)
+	StatFile(ctx context.Context, noteUUID, fileID string) (*File, error)
+	// CopyFile copies a file with its metadata to another note keeping the file id.
+	CopyFile(ctx context.Context, srcNoteUUID, fileID, dstNoteUUID string) error
+	// UpdateFile stores the name, description and tags of the file without touching its contents.
+	UpdateFile(ctx context.Context, noteUUID string, file *File) error
+	GetObjectTags(ctx context.Context, noteUUID, fileID string) (map[string]string, error)
+	SetObjectTags(ctx context.Context, noteUUID, fileID string, tags map[string]string) error
+	// ListNotes returns the uuids of all notes that have storage allocated.
+	ListNotes(ctx context.Context) ([]string, error)
+	// DeleteNote releases the storage of an empty note.
+	DeleteNote(ctx context.Context, noteUUID string) error
 }
 
 type File struct {
-	ID    string `json:"id"`
-	Name  string `json:"name"`
-	Size  int64  `json:"size"`
-	Bytes []byte `json:"bytes"`
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	Size        int64             `json:"size"`
+	ModifiedAt  time.Time         `json:"modified_at"`
+	ExpiresAt   *time.Time        `json:"expires_at,omitempty"`
+	Checksum    string            `json:"checksum,omitempty"`
+	ContentType string            `json:"content_type,omitempty"`
+	Owner       string            `json:"owner,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	ObjectTags  map[string]string `json:"object_tags,omitempty"`
+	Bytes       []byte            `json:"bytes"`
 }
 
+const (
+	metaName        = "Name"
+	metaOwner       = "Owner"
+	metaDescription = "Description"
+	metaTags        = "Tags"
+	metaChecksum    = "Checksum"
+	metaExpiresAt   = "Expires-At"
+)
+
+// expiryTagKey is the object tag the bucket lifecycle rules expire objects by, it's hidden from the object tags.
+const expiryTagKey = "storage-expiry-days"
+
 type CreateFileDTO struct {
 	Name   string `json:"name"`
 	Size   int64  `json:"size"`
+	Owner  string `json:"owner"`
 	Reader io.Reader
+	// Checksums sent by the client, the file is rejected if the contents don't match them.
+	Checksums Checksums `json:"-"`
+	// ExpiresAt or TTL, e.g. "12h" or "7d", make the file expire, see Reaper.
+	ExpiresAt *time.Time
+	TTL       string
 }
 
 func NewFile(dto CreateFileDTO) (*File, error) {
@@ -39,27 +88,51 @@ func NewFile(dto CreateFileDTO) (*File, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to create file model. err: %w", err)
 	}
+	if err = dto.Checksums.verify(bytes); err != nil {
+		return nil, err
+	}
+	expiresAt, err := resolveExpiry(dto.ExpiresAt, dto.TTL, time.Now())
+	if err != nil {
+		return nil, err
+	}
 	sum := sha256.Sum256(append([]byte(dto.Name), bytes...))
 	name := base64.URLEncoding.EncodeToString(sum[:])
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate file id. err: %w", err)
 	}
 
+	checksum := sha256.Sum256(bytes)
+	size := dto.Size
+	if size <= 0 {
+		size = int64(len(bytes))
+	}
+
 	return &File{
-		ID:    name,
-		Name:  dto.Name,
-		Size:  dto.Size,
-		Bytes: bytes,
+		ID:          name,
+		Name:        dto.Name,
+		Size:        size,
+		Checksum:    hex.EncodeToString(checksum[:]),
+		ContentType: detectContentType(dto.Name, bytes),
+		Owner:       dto.Owner,
+		ExpiresAt:   expiresAt,
+		Bytes:       bytes,
 	}, nil
 }
 
+func detectContentType(name string, content []byte) string {
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		return contentType
+	}
+	return http.DetectContentType(content)
+}
+
 type minioStorage struct {
 	log    *logrus.Entry
 	client *minio.Client
 }
 
-func New(log *logrus.Logger, endpoint, accessKey, secretKey string) (Storage, error) {
-	client, err := minio.NewClient(log, endpoint, accessKey, secretKey)
+func New(log *logrus.Logger, endpoint, accessKey, secretKey string, opts ...minio.Option) (Storage, error) {
+	client, err := minio.NewClient(log, endpoint, accessKey, secretKey, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create minio client. err: %w", err)
 	}
@@ -70,33 +143,22 @@ func New(log *logrus.Logger, endpoint, accessKey, secretKey string) (Storage, er
 }
 
 func (m *minioStorage) GetFile(ctx context.Context, bucketName, fileID string) (*File, error) {
-	obj, err := m.client.GetFile(ctx, bucketName, fileID)
+	reader, f, err := m.OpenFile(ctx, bucketName, fileID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get file. err: %w", err)
+		return nil, err
 	}
-	defer obj.Close()
-	objectInfo, err := obj.Stat()
+	defer reader.Close()
+	f.Bytes, err = ioutil.ReadAll(reader)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get file. err: %w", err)
 	}
-	buffer := make([]byte, objectInfo.Size)
-	_, err = obj.Read(buffer)
-	if err != nil && err != io.EOF {
-		return nil, fmt.Errorf("failed to get objects. err: %w", err)
-	}
-	f := File{
-		ID:    objectInfo.Key,
-		Name:  objectInfo.UserMetadata["Name"],
-		Size:  objectInfo.Size,
-		Bytes: buffer,
-	}
-	return &f, nil
+	return f, nil
 }
 
 func (m *minioStorage) GetFilesByNoteUUID(ctx context.Context, noteUUID string) ([]*File, error) {
 	objects, err := m.client.GetBucketFiles(ctx, noteUUID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get objects. err: %w", err)
+		return nil, fmt.Errorf("failed to get objects. err: %w", mapErr(err))
 	}
 	if len(objects) == 0 {
 		return nil, apperror.ErrNotFound
@@ -129,17 +191,256 @@ func (m *minioStorage) GetFilesByNoteUUID(ctx context.Context, noteUUID string)
 }
 
 func (m *minioStorage) CreateFile(ctx context.Context, noteUUID string, file *File) error {
-	err := m.client.UploadFile(ctx, file.ID, file.Name, noteUUID, file.Size, bytes.NewBuffer(file.Bytes))
+	err := m.client.UploadFile(ctx, file.ID, noteUUID, file.ContentType, fileMetadata(file), file.Size, bytes.NewReader(file.Bytes))
 	if err != nil {
-		return err
+		return mapErr(err)
 	}
+	m.syncExpiryTag(ctx, noteUUID, file)
 	return nil
 }
 
 func (m *minioStorage) DeleteFile(ctx context.Context, noteUUID, fileID string) error {
 	err := m.client.DeleteFile(ctx, noteUUID, fileID)
+	if err != nil {
+		return mapErr(err)
+	}
+	return nil
+}
+
+func (m *minioStorage) ListFiles(ctx context.Context, noteUUID string) ([]*File, error) {
+	objects, err := m.client.ListFiles(ctx, noteUUID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files. err: %w", mapErr(err))
+	}
+	files := make([]*File, 0, len(objects))
+	for _, obj := range objects {
+		files = append(files, fileFromObject(obj))
+	}
+	return files, nil
+}
+
+func (m *minioStorage) OpenFile(ctx context.Context, noteUUID, fileID string) (io.ReadCloser, *File, error) {
+	reader, obj, err := m.client.OpenFile(ctx, noteUUID, fileID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get file. err: %w", mapErr(err))
+	}
+	return reader, fileFromObject(obj), nil
+}
+
+func (m *minioStorage) StatFile(ctx context.Context, noteUUID, fileID string) (*File, error) {
+	obj, err := m.client.StatFile(ctx, noteUUID, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat file. err: %w", mapErr(err))
+	}
+	return fileFromObject(obj), nil
+}
+
+func (m *minioStorage) CopyFile(ctx context.Context, srcNoteUUID, fileID, dstNoteUUID string) error {
+	err := m.client.CopyFile(ctx, srcNoteUUID, fileID, dstNoteUUID)
+	if err != nil {
+		return fmt.Errorf("failed to copy file. err: %w", mapErr(err))
+	}
+	// the copy is a new object, so the lifecycle counts its days from now
+	if f, err := m.StatFile(ctx, dstNoteUUID, fileID); err == nil {
+		m.syncExpiryTag(ctx, dstNoteUUID, f)
+	}
+	return nil
+}
+
+func (m *minioStorage) UpdateFile(ctx context.Context, noteUUID string, file *File) error {
+	err := m.client.UpdateMetadata(ctx, noteUUID, file.ID, file.ContentType, fileMetadata(file))
+	if err != nil {
+		return fmt.Errorf("failed to update file. err: %w", mapErr(err))
+	}
+	m.syncExpiryTag(ctx, noteUUID, file)
+	return nil
+}
+
+func (m *minioStorage) GetObjectTags(ctx context.Context, noteUUID, fileID string) (map[string]string, error) {
+	tags, err := m.client.GetTags(ctx, noteUUID, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object tags. err: %w", mapErr(err))
+	}
+	delete(tags, expiryTagKey)
+	return tags, nil
+}
+
+// SetObjectTags replaces the object tags but keeps the tag the bucket lifecycle expires the object by.
+func (m *minioStorage) SetObjectTags(ctx context.Context, noteUUID, fileID string, tags map[string]string) error {
+	current, err := m.client.GetTags(ctx, noteUUID, fileID)
+	if err != nil {
+		return fmt.Errorf("failed to set object tags. err: %w", mapErr(err))
+	}
+	if days, ok := current[expiryTagKey]; ok {
+		withExpiry := make(map[string]string, len(tags)+1)
+		for k, v := range tags {
+			withExpiry[k] = v
+		}
+		withExpiry[expiryTagKey] = days
+		tags = withExpiry
+	}
+	err = m.client.PutTags(ctx, noteUUID, fileID, tags)
+	if err != nil {
+		return fmt.Errorf("failed to set object tags. err: %w", mapErr(err))
+	}
+	return nil
+}
+
+// LockFile sets the retention and legal hold of an object, which needs a bucket with object locking.
+// MinIO then keeps the locked version from being removed, but not the object from being deleted
+// or overwritten with a new version, see minio.WithObjectLocking, that's what checkLocked is for.
+// A locked object loses its expiry tag first, so the bucket lifecycle rules don't remove it on buckets
+// without object locking either, and gets it back once it's released.
+func (m *minioStorage) LockFile(ctx context.Context, noteUUID, fileID string, retainUntil *time.Time, legalHold bool) error {
+	f, err := m.StatFile(ctx, noteUUID, fileID)
 	if err != nil {
 		return err
 	}
+	if retainUntil != nil || legalHold {
+		f.ExpiresAt = nil
+	}
+	m.syncExpiryTag(ctx, noteUUID, f)
+	if retainUntil != nil {
+		if err := m.client.SetRetention(ctx, noteUUID, fileID, *retainUntil); err != nil {
+			return fmt.Errorf("failed to lock file. err: %w", mapErr(err))
+		}
+	}
+	if err := m.client.SetLegalHold(ctx, noteUUID, fileID, legalHold); err != nil {
+		return fmt.Errorf("failed to lock file. err: %w", mapErr(err))
+	}
+	return nil
+}
+
+// Health reports the storage as unavailable while its circuit breaker is open.
+func (m *minioStorage) Health() error {
+	return mapErr(m.client.Health())
+}
+
+func (m *minioStorage) ListNotes(ctx context.Context) ([]string, error) {
+	notes, err := m.client.ListBuckets(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list notes. err: %w", mapErr(err))
+	}
+	return notes, nil
+}
+
+func (m *minioStorage) DeleteNote(ctx context.Context, noteUUID string) error {
+	err := m.client.RemoveBucket(ctx, noteUUID)
+	if err != nil {
+		return fmt.Errorf("failed to delete note. err: %w", mapErr(err))
+	}
 	return nil
 }
+
+// syncExpiryTag tags an expiring object so a bucket lifecycle rule removes it even if the Reaper doesn't.
+// The rule is only a backstop, so failures are logged and don't fail the write.
+func (m *minioStorage) syncExpiryTag(ctx context.Context, noteUUID string, file *File) {
+	tags, err := m.client.GetTags(ctx, noteUUID, file.ID)
+	if err != nil {
+		m.log.Warnf("failed to get tags of file %s of note %s. err: %v", file.ID, noteUUID, err)
+		return
+	}
+	want := ""
+	if file.ExpiresAt != nil {
+		days := lifecycleDays(time.Until(*file.ExpiresAt))
+		want = strconv.Itoa(days)
+		if err = m.client.EnsureExpiryRule(ctx, noteUUID, expiryTagKey, want, days); err != nil {
+			m.log.Warnf("failed to add expiry rule to note %s. err: %v", noteUUID, err)
+			return
+		}
+	}
+	if tags[expiryTagKey] == want {
+		return
+	}
+	if want == "" {
+		delete(tags, expiryTagKey)
+	} else {
+		tags[expiryTagKey] = want
+	}
+	if err = m.client.PutTags(ctx, noteUUID, file.ID, tags); err != nil {
+		m.log.Warnf("failed to tag file %s of note %s for expiry. err: %v", file.ID, noteUUID, err)
+	}
+}
+
+// lifecycleDays rounds the time left up to whole days, and longer periods up to a few steps,
+// so a bucket needs only a handful of lifecycle rules.
+func lifecycleDays(left time.Duration) int {
+	days := int((left + 24*time.Hour - 1) / (24 * time.Hour))
+	if days < 1 {
+		return 1
+	}
+	if days <= 7 {
+		return days
+	}
+	for _, step := range []int{14, 30, 60, 90, 180, 365} {
+		if days <= step {
+			return step
+		}
+	}
+	return (days + 364) / 365 * 365
+}
+
+// fileMetadata encodes the editable attributes of a file as object user metadata.
+// Free-form values are url-encoded since metadata travels in HTTP headers.
+func fileMetadata(file *File) map[string]string {
+	metadata := map[string]string{metaName: file.Name}
+	if file.Checksum != "" {
+		metadata[metaChecksum] = file.Checksum
+	}
+	if file.Owner != "" {
+		metadata[metaOwner] = file.Owner
+	}
+	if file.ExpiresAt != nil {
+		metadata[metaExpiresAt] = file.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	if file.Description != "" {
+		metadata[metaDescription] = url.QueryEscape(file.Description)
+	}
+	if len(file.Tags) > 0 {
+		values := make(url.Values, len(file.Tags))
+		for k, v := range file.Tags {
+			values.Set(k, v)
+		}
+		metadata[metaTags] = values.Encode()
+	}
+	return metadata
+}
+
+func fileFromObject(obj *minio.Object) *File {
+	f := &File{
+		ID:          obj.ID,
+		Name:        obj.Metadata[metaName],
+		Size:        obj.Size,
+		ModifiedAt:  obj.LastModified,
+		ContentType: obj.ContentType,
+		Owner:       obj.Metadata[metaOwner],
+		Checksum:    obj.Metadata[metaChecksum],
+	}
+	if expiresAt, err := time.Parse(time.RFC3339, obj.Metadata[metaExpiresAt]); err == nil {
+		f.ExpiresAt = &expiresAt
+	}
+	if description, err := url.QueryUnescape(obj.Metadata[metaDescription]); err == nil {
+		f.Description = description
+	}
+	if values, err := url.ParseQuery(obj.Metadata[metaTags]); err == nil && len(values) > 0 {
+		f.Tags = make(map[string]string, len(values))
+		for k := range values {
+			f.Tags[k] = values.Get(k)
+		}
+	}
+	return f
+}
+
+func mapErr(err error) error {
+	var unavailable *minio.UnavailableError
+	if errors.As(err, &unavailable) {
+		return &apperror.UnavailableError{RetryAfter: unavailable.RetryAfter, Err: err}
+	}
+	if errors.Is(err, minio.ErrNotFound) {
+		return apperror.ErrNotFound
+	}
+	if errors.Is(err, minio.ErrInvalidTags) {
+		return apperror.BadRequestError(err.Error())
+	}
+	return err
+}
@@ -0,0 +1,493 @@
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+	"github.com/gerladeno/media-storage-service/pkg/metrics"
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/bbolt"
+)
+
+const (
+	TierHot  = "hot"
+	TierCold = "cold"
+
+	tierDemoted  = "demoted"
+	tierPromoted = "promoted"
+)
+
+var accessBucket = []byte("file_access")
+
+type TieringOptions struct {
+	// ColdAfter is how long a file stays on the hot tier after it was last accessed.
+	ColdAfter time.Duration
+	// Interval is how often the hot tier is checked for files to move.
+	Interval time.Duration
+	// Promote moves files read from the cold tier back to the hot one.
+	Promote bool
+}
+
+func DefaultTieringOptions() TieringOptions {
+	return TieringOptions{
+		ColdAfter: 30 * 24 * time.Hour,
+		Interval:  24 * time.Hour,
+	}
+}
+
+type TierMove struct {
+	NoteUUID   string    `json:"note_uuid"`
+	FileID     string    `json:"file_id"`
+	Name       string    `json:"name"`
+	Size       int64     `json:"size"`
+	LastAccess time.Time `json:"last_access"`
+	Error      string    `json:"error,omitempty"`
+}
+
+type TieringReport struct {
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt time.Time  `json:"finished_at"`
+	Files      int        `json:"files"`
+	Moves      []TierMove `json:"moves"`
+	Error      string     `json:"error,omitempty"`
+}
+
+type fileRef struct {
+	noteUUID string
+	fileID   string
+}
+
+// TieredStorage keeps new and recently read files on a fast hot storage and moves the files
+// that weren't read for a while to a cheaper cold one. Reads look in the hot tier first and
+// then in the cold one, so callers don't need to know where a file is.
+type TieredStorage struct {
+	log        *logrus.Entry
+	hot        Storage
+	cold       Storage
+	db         *bbolt.DB
+	opts       TieringOptions
+	collector  *metrics.Tiering
+	promotions chan fileRef
+	locks      *LockStore
+}
+
+func NewTiered(log *logrus.Logger, hot, cold Storage, db *bbolt.DB, opts TieringOptions, collector *metrics.Tiering,
+) (*TieredStorage, error) {
+	err := db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(accessBucket)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to init access bucket. err: %w", err)
+	}
+	return &TieredStorage{
+		log:        log.WithField("module", "tiering"),
+		hot:        hot,
+		cold:       cold,
+		db:         db,
+		opts:       opts,
+		collector:  collector,
+		promotions: make(chan fileRef, 64),
+	}, nil
+}
+
+// SetLocks keeps locked files on the hot tier, the cold tier may not enforce locks.
+func (t *TieredStorage) SetLocks(locks *LockStore) {
+	t.locks = locks
+}
+
+// Run moves cold files off the hot tier every interval and promotes the files read from
+// the cold tier until ctx is done.
+func (t *TieredStorage) Run(ctx context.Context) {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ref := <-t.promotions:
+				t.promote(ctx, ref)
+			}
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(t.opts.Interval):
+		}
+		t.Demote(ctx)
+	}
+}
+
+func (t *TieredStorage) GetFile(ctx context.Context, noteUUID, fileID string) (*File, error) {
+	f, err := t.hot.GetFile(ctx, noteUUID, fileID)
+	if err == nil {
+		t.accessed(ctx, TierHot, noteUUID, fileID)
+		return f, nil
+	}
+	if !errors.Is(err, apperror.ErrNotFound) {
+		return nil, err
+	}
+	if f, err = t.cold.GetFile(ctx, noteUUID, fileID); err != nil {
+		return nil, err
+	}
+	t.accessed(ctx, TierCold, noteUUID, fileID)
+	return f, nil
+}
+
+func (t *TieredStorage) GetFilesByNoteUUID(ctx context.Context, noteUUID string) ([]*File, error) {
+	hot, err := t.hot.GetFilesByNoteUUID(ctx, noteUUID)
+	if err != nil && !errors.Is(err, apperror.ErrNotFound) {
+		return nil, err
+	}
+	cold, err := t.cold.GetFilesByNoteUUID(ctx, noteUUID)
+	if err != nil && !errors.Is(err, apperror.ErrNotFound) {
+		return nil, err
+	}
+	files := mergeTiers(hot, cold)
+	if len(files) == 0 {
+		return nil, apperror.ErrNotFound
+	}
+	return files, nil
+}
+
+// CreateFile writes to the hot tier and drops an older copy from the cold one.
+func (t *TieredStorage) CreateFile(ctx context.Context, noteUUID string, file *File) error {
+	if err := t.hot.CreateFile(ctx, noteUUID, file); err != nil {
+		return err
+	}
+	t.touch(noteUUID, file.ID)
+	if err := ignoreNotFound(t.cold.DeleteFile(ctx, noteUUID, file.ID)); err != nil {
+		t.log.Warnf("failed to delete the cold copy of file %s of note %s. err: %v", file.ID, noteUUID, err)
+	}
+	return nil
+}
+
+func (t *TieredStorage) DeleteFile(ctx context.Context, noteUUID, fileID string) error {
+	hotErr := t.hot.DeleteFile(ctx, noteUUID, fileID)
+	if hotErr != nil && !errors.Is(hotErr, apperror.ErrNotFound) {
+		return hotErr
+	}
+	coldErr := t.cold.DeleteFile(ctx, noteUUID, fileID)
+	if coldErr != nil && !errors.Is(coldErr, apperror.ErrNotFound) {
+		return coldErr
+	}
+	if hotErr != nil && coldErr != nil {
+		return hotErr
+	}
+	t.forget(noteUUID, fileID)
+	return nil
+}
+
+func (t *TieredStorage) ListFiles(ctx context.Context, noteUUID string) ([]*File, error) {
+	hot, hotErr := t.hot.ListFiles(ctx, noteUUID)
+	if hotErr != nil && !errors.Is(hotErr, apperror.ErrNotFound) {
+		return nil, hotErr
+	}
+	cold, coldErr := t.cold.ListFiles(ctx, noteUUID)
+	if coldErr != nil && !errors.Is(coldErr, apperror.ErrNotFound) {
+		return nil, coldErr
+	}
+	if hotErr != nil && coldErr != nil {
+		return nil, hotErr
+	}
+	return mergeTiers(hot, cold), nil
+}
+
+func (t *TieredStorage) OpenFile(ctx context.Context, noteUUID, fileID string) (io.ReadCloser, *File, error) {
+	reader, f, err := t.hot.OpenFile(ctx, noteUUID, fileID)
+	if err == nil {
+		t.accessed(ctx, TierHot, noteUUID, fileID)
+		return reader, f, nil
+	}
+	if !errors.Is(err, apperror.ErrNotFound) {
+		return nil, nil, err
+	}
+	if reader, f, err = t.cold.OpenFile(ctx, noteUUID, fileID); err != nil {
+		return nil, nil, err
+	}
+	t.accessed(ctx, TierCold, noteUUID, fileID)
+	return reader, f, nil
+}
+
+func (t *TieredStorage) StatFile(ctx context.Context, noteUUID, fileID string) (f *File, err error) {
+	err = t.either(func(s Storage) (err error) {
+		f, err = s.StatFile(ctx, noteUUID, fileID)
+		return err
+	})
+	return f, err
+}
+
+// CopyFile copies a file within the tier that holds it.
+func (t *TieredStorage) CopyFile(ctx context.Context, srcNoteUUID, fileID, dstNoteUUID string) error {
+	return t.either(func(s Storage) error {
+		return s.CopyFile(ctx, srcNoteUUID, fileID, dstNoteUUID)
+	})
+}
+
+func (t *TieredStorage) UpdateFile(ctx context.Context, noteUUID string, file *File) error {
+	return t.either(func(s Storage) error {
+		return s.UpdateFile(ctx, noteUUID, file)
+	})
+}
+
+func (t *TieredStorage) GetObjectTags(ctx context.Context, noteUUID, fileID string) (tags map[string]string, err error) {
+	err = t.either(func(s Storage) (err error) {
+		tags, err = s.GetObjectTags(ctx, noteUUID, fileID)
+		return err
+	})
+	return tags, err
+}
+
+func (t *TieredStorage) SetObjectTags(ctx context.Context, noteUUID, fileID string, tags map[string]string) error {
+	return t.either(func(s Storage) error {
+		return s.SetObjectTags(ctx, noteUUID, fileID, tags)
+	})
+}
+
+func (t *TieredStorage) ListNotes(ctx context.Context) ([]string, error) {
+	hot, err := t.hot.ListNotes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cold, err := t.cold.ListNotes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return unionNotes(hot, cold), nil
+}
+
+func (t *TieredStorage) DeleteNote(ctx context.Context, noteUUID string) error {
+	hotErr := t.hot.DeleteNote(ctx, noteUUID)
+	if hotErr != nil && !errors.Is(hotErr, apperror.ErrNotFound) {
+		return hotErr
+	}
+	coldErr := t.cold.DeleteNote(ctx, noteUUID)
+	if coldErr != nil && !errors.Is(coldErr, apperror.ErrNotFound) {
+		return coldErr
+	}
+	if hotErr != nil && coldErr != nil {
+		return hotErr
+	}
+	return nil
+}
+
+// LockFile locks the file in the tier that has it, if the tier enforces locks.
+func (t *TieredStorage) LockFile(ctx context.Context, noteUUID, fileID string, retainUntil *time.Time, legalHold bool) error {
+	return t.either(func(s Storage) error {
+		if locker, ok := s.(Locker); ok {
+			return locker.LockFile(ctx, noteUUID, fileID, retainUntil, legalHold)
+		}
+		return nil
+	})
+}
+
+// Health reports the hot tier, which every write goes to.
+func (t *TieredStorage) Health() error {
+	if checker, ok := t.hot.(HealthChecker); ok {
+		return checker.Health()
+	}
+	return nil
+}
+
+// either runs op against the hot tier and, if the file isn't there, against the cold one.
+func (t *TieredStorage) either(op func(s Storage) error) error {
+	err := op(t.hot)
+	if errors.Is(err, apperror.ErrNotFound) {
+		return op(t.cold)
+	}
+	return err
+}
+
+// accessed records a read of a file and queues files read from the cold tier for promotion.
+// Reads of maintenance jobs don't count.
+func (t *TieredStorage) accessed(ctx context.Context, tier, noteUUID, fileID string) {
+	if isMaintenance(ctx) {
+		return
+	}
+	if t.collector != nil {
+		t.collector.ReadsTotal.WithLabelValues(tier).Inc()
+	}
+	t.touch(noteUUID, fileID)
+	if tier != TierCold || !t.opts.Promote {
+		return
+	}
+	select {
+	case t.promotions <- fileRef{noteUUID: noteUUID, fileID: fileID}:
+	default:
+		// promoted on a later read
+	}
+}
+
+func (t *TieredStorage) promote(ctx context.Context, ref fileRef) {
+	f, err := t.cold.StatFile(ctx, ref.noteUUID, ref.fileID)
+	if err != nil {
+		if !errors.Is(err, apperror.ErrNotFound) {
+			t.log.Warnf("failed to promote file %s of note %s. err: %v", ref.fileID, ref.noteUUID, err)
+		}
+		return
+	}
+	err = t.move(ctx, t.cold, t.hot, ref.noteUUID, ref.fileID)
+	t.observeMove(tierPromoted, f.Size, err)
+	if err != nil {
+		t.log.Warnf("failed to promote file %s of note %s. err: %v", ref.fileID, ref.noteUUID, err)
+	}
+}
+
+// Demote moves the files of the hot tier that weren't read for ColdAfter to the cold tier.
+// Files read before the access was tracked count as read when they were last modified.
+func (t *TieredStorage) Demote(ctx context.Context) *TieringReport {
+	ctx = maintenance(ctx)
+	report := &TieringReport{StartedAt: time.Now().UTC(), Moves: []TierMove{}}
+	t.log.Info("tiering started")
+	if err := t.demoteAll(ctx, report); err != nil {
+		t.log.Errorf("tiering failed. err: %v", err)
+		report.Error = err.Error()
+	}
+	report.FinishedAt = time.Now().UTC()
+	t.log.Infof("tiering finished, %d files, %d moved", report.Files, len(report.Moves))
+	if t.collector != nil {
+		t.collector.LastRun.Set(float64(report.FinishedAt.Unix()))
+	}
+	return report
+}
+
+func (t *TieredStorage) demoteAll(ctx context.Context, report *TieringReport) error {
+	notes, err := t.hot.ListNotes(ctx)
+	if err != nil {
+		return err
+	}
+	threshold := time.Now().Add(-t.opts.ColdAfter)
+	for _, noteUUID := range notes {
+		if noteUUID == QuarantineNote {
+			continue
+		}
+		files, err := t.hot.ListFiles(ctx, noteUUID)
+		if err != nil && !errors.Is(err, apperror.ErrNotFound) {
+			return err
+		}
+		for _, f := range files {
+			report.Files++
+			lastAccess, ok := t.lastAccess(noteUUID, f.ID)
+			if !ok {
+				lastAccess = f.ModifiedAt
+			}
+			if lastAccess.After(threshold) || t.locked(ctx, noteUUID, f.ID) {
+				continue
+			}
+			move := TierMove{NoteUUID: noteUUID, FileID: f.ID, Name: f.Name, Size: f.Size, LastAccess: lastAccess}
+			err = t.move(ctx, t.hot, t.cold, noteUUID, f.ID)
+			t.observeMove(tierDemoted, f.Size, err)
+			if err != nil {
+				move.Error = err.Error()
+			}
+			report.Moves = append(report.Moves, move)
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// move copies a file to another tier and then removes it from the original one,
+// so it can always be read from one of them.
+func (t *TieredStorage) move(ctx context.Context, src, dst Storage, noteUUID, fileID string) error {
+	if err := copyObject(ctx, src, dst, noteUUID, fileID); err != nil {
+		return err
+	}
+	return ignoreNotFound(src.DeleteFile(ctx, noteUUID, fileID))
+}
+
+// locked reports whether a file is locked, in doubt it is.
+func (t *TieredStorage) locked(ctx context.Context, noteUUID, fileID string) bool {
+	if t.locks == nil {
+		return false
+	}
+	lock, err := t.locks.merged(ctx, noteUUID, fileID)
+	if err != nil {
+		t.log.Warnf("failed to get lock of file %s of note %s. err: %v", fileID, noteUUID, err)
+		return true
+	}
+	return lock.active(time.Now())
+}
+
+func (t *TieredStorage) observeMove(direction string, size int64, err error) {
+	if t.collector == nil {
+		return
+	}
+	result := "ok"
+	if err != nil {
+		result = "failed"
+	}
+	t.collector.MovesTotal.WithLabelValues(direction, result).Inc()
+	if err == nil {
+		t.collector.MovedBytesTotal.WithLabelValues(direction).Add(float64(size))
+	}
+}
+
+func (t *TieredStorage) touch(noteUUID, fileID string) {
+	at := make([]byte, 8)
+	binary.BigEndian.PutUint64(at, uint64(time.Now().Unix()))
+	err := t.db.Batch(func(tx *bbolt.Tx) error {
+		return tx.Bucket(accessBucket).Put(indexKey(noteUUID, fileID), at)
+	})
+	if err != nil {
+		t.log.Warnf("failed to record access of file %s of note %s. err: %v", fileID, noteUUID, err)
+	}
+}
+
+func (t *TieredStorage) forget(noteUUID, fileID string) {
+	err := t.db.Batch(func(tx *bbolt.Tx) error {
+		return tx.Bucket(accessBucket).Delete(indexKey(noteUUID, fileID))
+	})
+	if err != nil {
+		t.log.Warnf("failed to forget access of file %s of note %s. err: %v", fileID, noteUUID, err)
+	}
+}
+
+func (t *TieredStorage) lastAccess(noteUUID, fileID string) (time.Time, bool) {
+	var at time.Time
+	_ = t.db.View(func(tx *bbolt.Tx) error {
+		if v := tx.Bucket(accessBucket).Get(indexKey(noteUUID, fileID)); len(v) == 8 {
+			at = time.Unix(int64(binary.BigEndian.Uint64(v)), 0)
+		}
+		return nil
+	})
+	return at, !at.IsZero()
+}
+
+// mergeTiers lists the files of both tiers once, preferring the hot copy while a file is being moved.
+func mergeTiers(hot, cold []*File) []*File {
+	files := make([]*File, 0, len(hot)+len(cold))
+	seen := make(map[string]struct{}, len(hot))
+	for _, f := range hot {
+		seen[f.ID] = struct{}{}
+		files = append(files, f)
+	}
+	for _, f := range cold {
+		if _, ok := seen[f.ID]; !ok {
+			files = append(files, f)
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool { return files[i].ID < files[j].ID })
+	return files
+}
+
+type maintenanceKey struct{}
+
+// maintenance marks the reads of background jobs, they don't count as accesses of the files.
+func maintenance(ctx context.Context) context.Context {
+	return context.WithValue(ctx, maintenanceKey{}, true)
+}
+
+func isMaintenance(ctx context.Context) bool {
+	marked, _ := ctx.Value(maintenanceKey{}).(bool)
+	return marked
+}
@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+)
+
+type TransferResult struct {
+	ID    string `json:"id"`
+	Name  string `json:"name,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Copy copies a file to another note. It fails with apperror.ErrAlreadyExist
+// if the target note already has a file with the same name, and with apperror.ErrLocked
+// if it would overwrite a locked file.
+func (s *Service) Copy(ctx context.Context, srcNoteUUID, fileID, dstNoteUUID string) (*File, error) {
+	if srcNoteUUID == dstNoteUUID {
+		return nil, apperror.BadRequestError("source and target notes must differ")
+	}
+	f, err := s.StatFile(ctx, srcNoteUUID, fileID)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.checkNameConflict(ctx, dstNoteUUID, f.Name); err != nil {
+		return nil, err
+	}
+	if _, err = s.storage.StatFile(ctx, dstNoteUUID, fileID); err == nil {
+		if err = s.checkLocked(ctx, dstNoteUUID, fileID); err != nil {
+			return nil, err
+		}
+	}
+	if err = s.storage.CopyFile(ctx, srcNoteUUID, fileID, dstNoteUUID); err != nil {
+		return nil, err
+	}
+	if err = s.indexPut(ctx, dstNoteUUID, f); err != nil {
+		s.discard(ctx, dstNoteUUID, fileID)
+		return nil, err
+	}
+	if err = s.textIndex.Copy(ctx, srcNoteUUID, fileID, dstNoteUUID); err != nil {
+		s.log.Warnf("failed to copy text of file %s to note %s in index. err: %v", fileID, dstNoteUUID, err)
+	}
+	s.applyLock(ctx, dstNoteUUID, fileID)
+	return f, nil
+}
+
+// Move copies a file to another note and removes it from the source one.
+// A locked file can be copied but not moved.
+func (s *Service) Move(ctx context.Context, srcNoteUUID, fileID, dstNoteUUID string) (*File, error) {
+	if err := s.checkLocked(ctx, srcNoteUUID, fileID); err != nil {
+		return nil, err
+	}
+	f, err := s.Copy(ctx, srcNoteUUID, fileID, dstNoteUUID)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.storage.DeleteFile(ctx, srcNoteUUID, fileID); err != nil {
+		if rbErr := s.Delete(ctx, dstNoteUUID, fileID); rbErr != nil {
+			s.log.Errorf("failed to roll back copy of %s to note %s. err: %v", fileID, dstNoteUUID, rbErr)
+		}
+		return nil, err
+	}
+	if err = s.indexDelete(ctx, srcNoteUUID, fileID); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Transfer copies or moves several files, reporting the outcome for each of them.
+func (s *Service) Transfer(ctx context.Context, srcNoteUUID, dstNoteUUID string, fileIDs []string, move bool) []TransferResult {
+	transfer := s.Copy
+	if move {
+		transfer = s.Move
+	}
+	results := make([]TransferResult, 0, len(fileIDs))
+	for _, id := range fileIDs {
+		f, err := transfer(ctx, srcNoteUUID, id, dstNoteUUID)
+		if err != nil {
+			results = append(results, TransferResult{ID: id, Error: err.Error()})
+			continue
+		}
+		results = append(results, TransferResult{ID: f.ID, Name: f.Name})
+	}
+	return results
+}
+
+func (s *Service) checkNameConflict(ctx context.Context, noteUUID, name string) error {
+	files, err := s.storage.ListFiles(ctx, noteUUID)
+	if err != nil && !errors.Is(err, apperror.ErrNotFound) {
+		return err
+	}
+	for _, f := range files {
+		if f.Name == name && checkExpired(f) == nil {
+			return fmt.Errorf("file %s in note %s: %w", name, noteUUID, apperror.ErrAlreadyExist)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+	"github.com/gerladeno/media-storage-service/internal/storage"
+	"github.com/gerladeno/media-storage-service/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	workers           = 4
+	pollInterval      = time.Second
+	maxAttempts       = 8
+	baseBackoff       = time.Second
+	maxBackoff        = 5 * time.Minute
+	requestTimeout    = 10 * time.Second
+	deliveryRetention = 24 * time.Hour
+	pruneInterval     = time.Hour
+	maxAckBody        = 64 << 10
+)
+
+// Dispatcher is the outbox sink for webhooks. It stores a delivery per subscription
+// and sends them in the background, retrying failed deliveries with exponential backoff
+// before giving up to the dead-letter log.
+type Dispatcher struct {
+	*Store
+	log       *logrus.Entry
+	collector *metrics.HTTPOut
+	client    *http.Client
+}
+
+func NewDispatcher(log *logrus.Logger, store *Store, collector *metrics.HTTPOut) *Dispatcher {
+	return &Dispatcher{
+		Store:     store,
+		log:       log.WithField("module", "webhook"),
+		collector: collector,
+		// a redirect would resend the event without its body to wherever the receiver points,
+		// so it's answered like any other non-2xx and retried
+		client: &http.Client{
+			Timeout: requestTimeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+func (d *Dispatcher) Name() string {
+	return "webhook"
+}
+
+// Send stores the deliveries of an event to the subscriptions that want it.
+// Deliveries already stored for the event are left as they are, so a repeated event isn't sent twice.
+func (d *Dispatcher) Send(ctx context.Context, e storage.Event) error {
+	subs, err := d.Store.subscriptions(ctx)
+	if err != nil {
+		return err
+	}
+	var deliveries []*delivery
+	for _, sub := range subs {
+		if event, ok := sub.event(e); ok {
+			deliveries = append(deliveries, &delivery{SubscriptionID: sub.ID, Event: event, NextAttemptAt: time.Now().UTC()})
+		}
+	}
+	if err = d.Store.addDeliveries(deliveries); err != nil {
+		return fmt.Errorf("failed to save deliveries of event %s. err: %w", e.ID, err)
+	}
+	return nil
+}
+
+// Run sends the due deliveries until ctx is done and prunes the closed ones every pruneInterval.
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	pruneTicker := time.NewTicker(pruneInterval)
+	defer pruneTicker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-pruneTicker.C:
+			if err := d.Store.pruneDeliveries(time.Now().Add(-deliveryRetention)); err != nil {
+				d.log.Warnf("failed to prune deliveries. err: %v", err)
+			}
+			continue
+		case <-ticker.C:
+		}
+		due, err := d.Store.dueDeliveries(time.Now().UTC(), workers*16)
+		if err != nil {
+			d.log.Errorf("failed to load pending deliveries. err: %v", err)
+			continue
+		}
+		sem := make(chan struct{}, workers)
+		var wg sync.WaitGroup
+		for _, dl := range due {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(dl *delivery) {
+				defer func() { <-sem; wg.Done() }()
+				d.deliver(ctx, dl)
+			}(dl)
+		}
+		wg.Wait()
+	}
+}
+
+// Redeliver takes a dead letter out of the log and schedules it again.
+func (d *Dispatcher) Redeliver(ctx context.Context, deadLetterID uint64) error {
+	return d.Store.TakeDeadLetter(ctx, deadLetterID, time.Now().UTC())
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, dl *delivery) {
+	sub, err := d.Store.subscription(ctx, dl.SubscriptionID)
+	if errors.Is(err, apperror.ErrNotFound) {
+		d.close(dl)
+		return
+	}
+	if err == nil {
+		dl.Attempts++
+		err = d.send(ctx, sub, dl.Event)
+	}
+	switch {
+	case err == nil:
+		d.close(dl)
+		return
+	case ctx.Err() != nil:
+		return
+	case dl.Attempts >= maxAttempts:
+		d.bury(dl, err)
+		return
+	}
+	delay := backoff(dl.Attempts)
+	d.log.Debugf("delivery of event %s to webhook %s failed, retrying in %s. err: %v", dl.Event.ID, dl.SubscriptionID, delay, err)
+	dl.NextAttemptAt = time.Now().UTC().Add(delay)
+	if err = d.Store.saveDelivery(dl); err != nil {
+		d.log.Errorf("failed to reschedule delivery of event %s. err: %v", dl.Event.ID, err)
+	}
+}
+
+func (d *Dispatcher) close(dl *delivery) {
+	now := time.Now().UTC()
+	dl.ClosedAt = &now
+	if err := d.Store.saveDelivery(dl); err != nil {
+		d.log.Errorf("failed to close delivery of event %s. err: %v", dl.Event.ID, err)
+	}
+}
+
+func (d *Dispatcher) send(ctx context.Context, sub *Subscription, e storage.Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event. err: %w", err)
+	}
+	reqCtx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodPost, sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to build request. err: %w", err)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-ID", e.ID)
+	req.Header.Set("X-Webhook-Event", e.Type)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "sha256="+Sign(sub.Secret, timestamp, body))
+	resp, err := d.collector.Do(d.client, req)
+	if err != nil {
+		return err
+	}
+	// any 2xx acknowledges the delivery, whatever the receiver answers with is of no use,
+	// it's only drained so the connection can be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxAckBody))
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("err unexpected response, code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (d *Dispatcher) bury(dl *delivery, cause error) {
+	d.log.Warnf("giving up delivery of event %s to webhook %s after %d attempts. err: %v", dl.Event.ID, dl.SubscriptionID, dl.Attempts, cause)
+	err := d.Store.addDeadLetter(&DeadLetter{
+		SubscriptionID: dl.SubscriptionID,
+		Event:          dl.Event,
+		Attempts:       dl.Attempts,
+		LastError:      cause.Error(),
+		FailedAt:       time.Now().UTC(),
+	})
+	if err != nil {
+		d.log.Errorf("failed to save dead letter for event %s. err: %v", dl.Event.ID, err)
+		return
+	}
+	d.close(dl)
+}
+
+// Sign returns the hex HMAC-SHA256 of "<timestamp>.<body>" receivers use to verify a delivery.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func backoff(attempt int) time.Duration {
+	delay := baseBackoff << (attempt - 1)
+	if delay > maxBackoff || delay <= 0 {
+		delay = maxBackoff
+	}
+	jitter := time.Duration(rand.Int63n(int64(delay) / 5))
+	return delay - delay/10 + jitter
+}
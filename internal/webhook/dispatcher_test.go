@@ -0,0 +1,296 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+	"github.com/gerladeno/media-storage-service/internal/storage"
+	"github.com/gerladeno/media-storage-service/pkg/metrics"
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/bbolt"
+)
+
+func newTestDispatcher(t *testing.T) *Dispatcher {
+	t.Helper()
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	db, err := bbolt.Open(filepath.Join(t.TempDir(), "storage.db"), 0o600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	store, err := NewStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewDispatcher(log, store, metrics.NewHTTPOut("test"))
+}
+
+func testEvent(id, eventType, noteUUID string) storage.Event {
+	return storage.Event{ID: id, Type: eventType, NoteUUID: noteUUID, FileID: "f1", OccurredAt: time.Now().UTC()}
+}
+
+func TestSign(t *testing.T) {
+	body := []byte(`{"id":"e1"}`)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("1700000000." + string(body)))
+	want := hex.EncodeToString(mac.Sum(nil))
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp string
+		body      []byte
+		valid     bool
+	}{
+		{name: "same delivery", secret: "secret", timestamp: "1700000000", body: body, valid: true},
+		{name: "other secret", secret: "other", timestamp: "1700000000", body: body},
+		{name: "replayed later", secret: "secret", timestamp: "1700000001", body: body},
+		{name: "tampered body", secret: "secret", timestamp: "1700000000", body: []byte(`{"id":"e2"}`)},
+	}
+	for _, tt := range tests {
+		if got := Sign(tt.secret, tt.timestamp, tt.body) == want; got != tt.valid {
+			t.Errorf("%s: signature matches %v, want %v", tt.name, got, tt.valid)
+		}
+	}
+}
+
+func TestSend(t *testing.T) {
+	tests := []struct {
+		name string
+		dto  CreateSubscriptionDTO
+		// want holds the types of the events stored for the subscription
+		want []string
+	}{
+		{name: "all events", dto: CreateSubscriptionDTO{}, want: []string{"file.created", "file.updated", "file.updated"}},
+		{
+			name: "listed events",
+			dto:  CreateSubscriptionDTO{Events: []string{"file.updated"}},
+			want: []string{"file.updated", "file.updated"},
+		},
+		{name: "renames", dto: CreateSubscriptionDTO{Events: []string{"file.renamed"}}, want: []string{"file.renamed"}},
+		{name: "note", dto: CreateSubscriptionDTO{NoteUUID: "n2"}, want: []string{"file.updated"}},
+	}
+	renamed := testEvent("e3", storage.EventFileUpdated, "n1")
+	renamed.PreviousName = "old.txt"
+	events := []storage.Event{
+		testEvent("e1", storage.EventFileCreated, "n1"),
+		testEvent("e2", storage.EventFileUpdated, "n2"),
+		renamed,
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newTestDispatcher(t)
+			ctx := context.Background()
+			tt.dto.URL = "https://example.com/hook"
+			if _, err := d.Create(ctx, tt.dto); err != nil {
+				t.Fatal(err)
+			}
+			// the outbox sends events again after a failure, they must not be delivered twice
+			for i := 0; i < 2; i++ {
+				for _, e := range events {
+					if err := d.Send(ctx, e); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			due, err := d.dueDeliveries(time.Now().UTC(), 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(due) != len(tt.want) {
+				t.Fatalf("got %d deliveries, want %d", len(due), len(tt.want))
+			}
+			for i, dl := range due {
+				if dl.Event.Type != tt.want[i] {
+					t.Errorf("delivery %d: got %s, want %s", i, dl.Event.Type, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCreateValidation(t *testing.T) {
+	for _, dto := range []CreateSubscriptionDTO{
+		{URL: "ftp://example.com/hook"},
+		{URL: "/hook"},
+		{URL: "https://example.com/hook", Events: []string{"file.touched"}},
+	} {
+		var appErr *apperror.AppError
+		if _, err := newTestDispatcher(t).Create(context.Background(), dto); !errors.As(err, &appErr) {
+			t.Errorf("%+v: got %v, want a bad request", dto, err)
+		}
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		attempts int
+		// deleted removes the subscription before the delivery
+		deleted bool
+		// want is the state of the delivery afterwards: closed, retried or dead
+		want string
+	}{
+		{name: "acknowledged", status: http.StatusNoContent, want: "closed"},
+		{name: "failed", status: http.StatusInternalServerError, want: "retried"},
+		{name: "redirected", status: http.StatusFound, want: "retried"},
+		{name: "failed for the last time", status: http.StatusBadGateway, attempts: maxAttempts - 1, want: "dead"},
+		{name: "subscription deleted", status: http.StatusOK, deleted: true, want: "closed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				requests int
+				sub      *Subscription
+			)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				body, _ := io.ReadAll(r.Body)
+				signature := "sha256=" + Sign(sub.Secret, r.Header.Get("X-Webhook-Timestamp"), body)
+				if r.Header.Get("X-Webhook-Signature") != signature || r.Header.Get("X-Webhook-ID") != "e1" {
+					t.Errorf("got headers %v, want the signed event", r.Header)
+				}
+				if tt.status == http.StatusFound {
+					w.Header().Set("Location", "/elsewhere")
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+			d := newTestDispatcher(t)
+			ctx := context.Background()
+			var err error
+			if sub, err = d.Create(ctx, CreateSubscriptionDTO{URL: server.URL + "/hook"}); err != nil {
+				t.Fatal(err)
+			}
+			if err = d.Send(ctx, testEvent("e1", storage.EventFileCreated, "n1")); err != nil {
+				t.Fatal(err)
+			}
+			if tt.deleted {
+				if err = d.Delete(ctx, sub.ID); err != nil {
+					t.Fatal(err)
+				}
+			}
+			due, err := d.dueDeliveries(time.Now().UTC(), 10)
+			if err != nil || len(due) != 1 {
+				t.Fatalf("got %d due deliveries, err: %v", len(due), err)
+			}
+			due[0].Attempts = tt.attempts
+			d.deliver(ctx, due[0])
+
+			if tt.deleted && requests != 0 {
+				t.Fatalf("sent %d requests to a deleted subscription", requests)
+			}
+			stillDue, err := d.dueDeliveries(time.Now().UTC().Add(maxBackoff*2), 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			letters, err := d.DeadLetters(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch tt.want {
+			case "closed", "dead":
+				if len(stillDue) != 0 {
+					t.Fatalf("delivery still open after %s", tt.want)
+				}
+			case "retried":
+				if len(stillDue) != 1 || stillDue[0].Attempts != 1 || !stillDue[0].NextAttemptAt.After(time.Now()) {
+					t.Fatalf("got %+v, want the delivery rescheduled", stillDue)
+				}
+			}
+			if dead := len(letters) == 1 && letters[0].Attempts == maxAttempts; dead != (tt.want == "dead") {
+				t.Fatalf("got dead letters %+v, want %s", letters, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedeliver(t *testing.T) {
+	tests := []struct {
+		name string
+		// deleted removes the subscription of the letter first
+		deleted bool
+		letter  uint64
+		err     error
+	}{
+		{name: "dead letter", letter: 1},
+		{name: "unknown letter", letter: 2, err: apperror.ErrNotFound},
+		{name: "subscription deleted", letter: 1, deleted: true, err: apperror.ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newTestDispatcher(t)
+			ctx := context.Background()
+			sub, err := d.Create(ctx, CreateSubscriptionDTO{URL: "https://example.com/hook"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			d.bury(&delivery{SubscriptionID: sub.ID, Event: testEvent("e1", storage.EventFileCreated, "n1"), Attempts: maxAttempts},
+				errors.New("unreachable"))
+			if tt.deleted {
+				if err = d.Delete(ctx, sub.ID); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = d.Redeliver(ctx, tt.letter)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			letters, _ := d.DeadLetters(ctx)
+			due, _ := d.dueDeliveries(time.Now().UTC(), 10)
+			if tt.err != nil {
+				if len(letters) != 1 || len(due) != 0 {
+					t.Fatalf("got %d letters and %d deliveries, want the letter kept", len(letters), len(due))
+				}
+				return
+			}
+			if len(letters) != 0 || len(due) != 1 || due[0].Attempts != 0 {
+				t.Fatalf("got %d letters and deliveries %+v, want a fresh delivery", len(letters), due)
+			}
+		})
+	}
+}
+
+func TestPruneDeliveries(t *testing.T) {
+	d := newTestDispatcher(t)
+	now := time.Now().UTC()
+	old, recent := now.Add(-2*deliveryRetention), now.Add(-time.Minute)
+	deliveries := []*delivery{
+		{SubscriptionID: "s1", Event: testEvent("old", storage.EventFileCreated, "n1"), ClosedAt: &old},
+		{SubscriptionID: "s1", Event: testEvent("recent", storage.EventFileCreated, "n1"), ClosedAt: &recent},
+		{SubscriptionID: "s1", Event: testEvent("open", storage.EventFileCreated, "n1"), NextAttemptAt: now},
+	}
+	for _, dl := range deliveries {
+		if err := d.saveDelivery(dl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.pruneDeliveries(now.Add(-deliveryRetention)); err != nil {
+		t.Fatal(err)
+	}
+	// a pruned delivery is stored again as new, the kept ones are skipped
+	for _, dl := range deliveries {
+		dl.ClosedAt, dl.NextAttemptAt = nil, now
+	}
+	if err := d.addDeliveries(deliveries); err != nil {
+		t.Fatal(err)
+	}
+	due, err := d.dueDeliveries(now, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(due) != 2 || due[0].Event.ID == "recent" || due[1].Event.ID == "recent" {
+		t.Fatalf("got %+v, want the open and the pruned delivery due", due)
+	}
+}
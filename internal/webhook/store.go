@@ -0,0 +1,399 @@
+package webhook
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+	"github.com/gerladeno/media-storage-service/internal/storage"
+	"go.etcd.io/bbolt"
+)
+
+var (
+	subscriptionsBucket = []byte("webhooks")
+	deadLettersBucket   = []byte("webhook_dead_letters")
+	deliveriesBucket    = []byte("webhook_deliveries")
+	// dueBucket indexes the open deliveries by their next attempt, keyed by dueKey.
+	dueBucket = []byte("webhook_due")
+)
+
+type Subscription struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	Events    []string  `json:"events"`
+	NoteUUID  string    `json:"note_uuid,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type CreateSubscriptionDTO struct {
+	URL      string   `json:"url"`
+	Events   []string `json:"events"`
+	NoteUUID string   `json:"note_uuid"`
+}
+
+// DeadLetter is a delivery that failed after all retries.
+type DeadLetter struct {
+	ID             uint64        `json:"id"`
+	SubscriptionID string        `json:"subscription_id"`
+	Event          storage.Event `json:"event"`
+	Attempts       int           `json:"attempts"`
+	LastError      string        `json:"last_error"`
+	FailedAt       time.Time     `json:"failed_at"`
+}
+
+// delivery is an event pending for a subscription. Closed deliveries are kept for a while
+// so that an event sent again by the outbox isn't delivered twice.
+type delivery struct {
+	SubscriptionID string        `json:"subscription_id"`
+	Event          storage.Event `json:"event"`
+	Attempts       int           `json:"attempts"`
+	NextAttemptAt  time.Time     `json:"next_attempt_at"`
+	ClosedAt       *time.Time    `json:"closed_at,omitempty"`
+}
+
+func (dl *delivery) key() []byte {
+	return []byte(dl.Event.ID + "/" + dl.SubscriptionID)
+}
+
+// dueKey is the next attempt in unix nanoseconds followed by the key of the delivery,
+// so the due deliveries come first in the index.
+func (dl *delivery) dueKey() []byte {
+	key := make([]byte, 8, 8+len(dl.Event.ID)+1+len(dl.SubscriptionID))
+	binary.BigEndian.PutUint64(key, uint64(dl.NextAttemptAt.UnixNano()))
+	return append(key, dl.key()...)
+}
+
+// event returns the event as the subscription gets it, if it wants it. Renames are sent as
+// file.renamed only to subscriptions that list it, the others get file.updated as they always did.
+func (s *Subscription) event(e storage.Event) (storage.Event, bool) {
+	if s.lists(storage.EventFileRenamed) {
+		e = e.AsRenamed()
+	}
+	if s.NoteUUID != "" && s.NoteUUID != e.NoteUUID {
+		return e, false
+	}
+	return e, len(s.Events) == 0 || s.lists(e.Type)
+}
+
+func (s *Subscription) lists(eventType string) bool {
+	for _, t := range s.Events {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+type Store struct {
+	db *bbolt.DB
+}
+
+func NewStore(db *bbolt.DB) (*Store, error) {
+	err := db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{subscriptionsBucket, deadLettersBucket, deliveriesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		if tx.Bucket(dueBucket) != nil {
+			return nil
+		}
+		// the index came after the deliveries, so it's built from the ones stored before it
+		due, err := tx.CreateBucket(dueBucket)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(deliveriesBucket).ForEach(func(_, v []byte) error {
+			var dl delivery
+			if err := json.Unmarshal(v, &dl); err != nil {
+				return err
+			}
+			if dl.ClosedAt != nil {
+				return nil
+			}
+			return due.Put(dl.dueKey(), nil)
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to init webhook buckets. err: %w", err)
+	}
+	return &Store{db: db}, nil
+}
+
+// Create stores a subscription with a generated signing secret, which is returned only here.
+func (s *Store) Create(_ context.Context, dto CreateSubscriptionDTO) (*Subscription, error) {
+	u, err := url.Parse(dto.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, apperror.BadRequestError("url must be an absolute http(s) url")
+	}
+	for _, t := range dto.Events {
+		if !knownEvent(t) {
+			return nil, apperror.BadRequestError(fmt.Sprintf("unknown event %q", t))
+		}
+	}
+	sub := &Subscription{
+		ID:        randomHex(8),
+		URL:       dto.URL,
+		Secret:    randomHex(32),
+		Events:    dto.Events,
+		NoteUUID:  dto.NoteUUID,
+		CreatedAt: time.Now().UTC(),
+	}
+	data, err := json.Marshal(sub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal webhook. err: %w", err)
+	}
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(subscriptionsBucket).Put([]byte(sub.ID), data)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to save webhook. err: %w", err)
+	}
+	return sub, nil
+}
+
+// List returns the subscriptions without their secrets.
+func (s *Store) List(ctx context.Context) ([]*Subscription, error) {
+	subs, err := s.subscriptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, sub := range subs {
+		sub.Secret = ""
+	}
+	return subs, nil
+}
+
+func (s *Store) Delete(_ context.Context, id string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(subscriptionsBucket)
+		if bucket.Get([]byte(id)) == nil {
+			return apperror.ErrNotFound
+		}
+		return bucket.Delete([]byte(id))
+	})
+}
+
+func (s *Store) DeadLetters(_ context.Context) ([]*DeadLetter, error) {
+	letters := make([]*DeadLetter, 0)
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(deadLettersBucket).ForEach(func(_, v []byte) error {
+			var letter DeadLetter
+			if err := json.Unmarshal(v, &letter); err != nil {
+				return err
+			}
+			letters = append(letters, &letter)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list dead letters. err: %w", err)
+	}
+	return letters, nil
+}
+
+// TakeDeadLetter replaces a dead letter with a delivery due at, in one transaction so that
+// the letter is kept when its subscription is gone.
+func (s *Store) TakeDeadLetter(_ context.Context, id uint64, at time.Time) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(deadLettersBucket)
+		key := seqKey(id)
+		data := bucket.Get(key)
+		if data == nil {
+			return apperror.ErrNotFound
+		}
+		var letter DeadLetter
+		if err := json.Unmarshal(data, &letter); err != nil {
+			return err
+		}
+		if tx.Bucket(subscriptionsBucket).Get([]byte(letter.SubscriptionID)) == nil {
+			return apperror.ErrNotFound
+		}
+		if err := bucket.Delete(key); err != nil {
+			return err
+		}
+		return putDelivery(tx, &delivery{
+			SubscriptionID: letter.SubscriptionID,
+			Event:          letter.Event,
+			NextAttemptAt:  at,
+		})
+	})
+}
+
+func (s *Store) subscriptions(_ context.Context) ([]*Subscription, error) {
+	subs := make([]*Subscription, 0)
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(subscriptionsBucket).ForEach(func(_, v []byte) error {
+			var sub Subscription
+			if err := json.Unmarshal(v, &sub); err != nil {
+				return err
+			}
+			subs = append(subs, &sub)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webhooks. err: %w", err)
+	}
+	return subs, nil
+}
+
+func (s *Store) subscription(_ context.Context, id string) (*Subscription, error) {
+	var sub *Subscription
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(subscriptionsBucket).Get([]byte(id))
+		if data == nil {
+			return apperror.ErrNotFound
+		}
+		sub = &Subscription{}
+		return json.Unmarshal(data, sub)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+func (s *Store) addDeadLetter(letter *DeadLetter) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(deadLettersBucket)
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		letter.ID = id
+		data, err := json.Marshal(letter)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(seqKey(id), data)
+	})
+}
+
+// addDeliveries stores the deliveries unless they are already known.
+func (s *Store) addDeliveries(deliveries []*delivery) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		for _, dl := range deliveries {
+			if tx.Bucket(deliveriesBucket).Get(dl.key()) != nil {
+				continue
+			}
+			if err := putDelivery(tx, dl); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Store) saveDelivery(dl *delivery) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return putDelivery(tx, dl)
+	})
+}
+
+// putDelivery stores a delivery and moves it in the due index.
+func putDelivery(tx *bbolt.Tx, dl *delivery) error {
+	bucket, due := tx.Bucket(deliveriesBucket), tx.Bucket(dueBucket)
+	if data := bucket.Get(dl.key()); data != nil {
+		var prev delivery
+		if err := json.Unmarshal(data, &prev); err != nil {
+			return err
+		}
+		if err := due.Delete(prev.dueKey()); err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	if err = bucket.Put(dl.key(), data); err != nil {
+		return err
+	}
+	if dl.ClosedAt != nil {
+		return nil
+	}
+	return due.Put(dl.dueKey(), nil)
+}
+
+// dueDeliveries returns up to limit open deliveries whose next attempt is due,
+// reading the due index only as far as now.
+func (s *Store) dueDeliveries(now time.Time, limit int) ([]*delivery, error) {
+	var due []*delivery
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(deliveriesBucket)
+		end := uint64(now.UnixNano())
+		c := tx.Bucket(dueBucket).Cursor()
+		for k, _ := c.First(); k != nil && len(due) < limit; k, _ = c.Next() {
+			if binary.BigEndian.Uint64(k[:8]) > end {
+				break
+			}
+			data := bucket.Get(k[8:])
+			if data == nil {
+				continue
+			}
+			var dl delivery
+			if err := json.Unmarshal(data, &dl); err != nil {
+				return err
+			}
+			due = append(due, &dl)
+		}
+		return nil
+	})
+	return due, err
+}
+
+// pruneDeliveries removes the deliveries closed before the given time.
+func (s *Store) pruneDeliveries(before time.Time) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(deliveriesBucket)
+		var expired [][]byte
+		err := bucket.ForEach(func(k, v []byte) error {
+			var dl delivery
+			if err := json.Unmarshal(v, &dl); err != nil {
+				return err
+			}
+			if dl.ClosedAt != nil && dl.ClosedAt.Before(before) {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err = bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func knownEvent(t string) bool {
+	for _, known := range storage.EventTypes {
+		if t == known {
+			return true
+		}
+	}
+	return false
+}
+
+func seqKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
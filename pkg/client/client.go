@@ -0,0 +1,308 @@
+// Package client is a Go client of the public storage API.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRetries = 3
+	defaultBackoff = 200 * time.Millisecond
+	maxBackoff     = 5 * time.Second
+)
+
+// TokenSource returns the access token for a request, so expiring tokens can be refreshed.
+type TokenSource func(ctx context.Context) (string, error)
+
+type Client struct {
+	baseURL    *url.URL
+	httpClient *http.Client
+	token      TokenSource
+	apiKey     string
+	retries    int
+	backoff    time.Duration
+}
+
+type Option func(*Client)
+
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithToken authenticates the requests with a fixed user access token.
+func WithToken(token string) Option {
+	return WithTokenSource(func(context.Context) (string, error) {
+		return token, nil
+	})
+}
+
+func WithTokenSource(source TokenSource) Option {
+	return func(c *Client) {
+		c.token = source
+	}
+}
+
+// WithAPIKey authenticates the requests with an API key instead of a user token.
+func WithAPIKey(key string) Option {
+	return func(c *Client) {
+		c.apiKey = key
+	}
+}
+
+// WithRetries sets how many times idempotent calls are retried and the initial backoff between them.
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.retries, c.backoff = retries, backoff
+	}
+}
+
+// New returns a client of the service at baseURL, e.g. http://localhost:3000.
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid base url %q", baseURL)
+	}
+	c := &Client{
+		baseURL:    u,
+		httpClient: http.DefaultClient,
+		retries:    defaultRetries,
+		backoff:    defaultBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// request describes a call. Only calls with a replayable body and idempotent are retried.
+type request struct {
+	method     string
+	path       string
+	query      url.Values
+	body       func() (io.Reader, string, error)
+	idempotent bool
+}
+
+// do sends the request and returns the response of a successful call. Error responses are
+// turned into an *Error.
+func (c *Client) do(ctx context.Context, r request) (*http.Response, error) {
+	attempts := 1
+	if r.idempotent {
+		attempts += c.retries
+	}
+	delay := c.backoff
+	var lastErr error
+	for attempt := 1; ; attempt++ {
+		resp, err := c.send(ctx, r)
+		if err == nil && resp.StatusCode < http.StatusBadRequest {
+			return resp, nil
+		}
+		retryAfter := time.Duration(0)
+		if err == nil {
+			retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+			err = responseError(resp)
+			_ = resp.Body.Close()
+		}
+		lastErr = err
+		if attempt == attempts || !retryable(err) {
+			return nil, lastErr
+		}
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay)))
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+		select {
+		case <-ctx.Done():
+			return nil, lastErr
+		case <-time.After(wait):
+		}
+		if delay *= 2; delay > maxBackoff {
+			delay = maxBackoff
+		}
+	}
+}
+
+func (c *Client) send(ctx context.Context, r request) (*http.Response, error) {
+	u := *c.baseURL
+	u.Path += r.path
+	u.RawQuery = r.query.Encode()
+	var (
+		body        io.Reader
+		contentType string
+	)
+	if r.body != nil {
+		var err error
+		if body, contentType, err = r.body(); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, r.method, u.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build request. err: %w", err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	switch {
+	case c.apiKey != "":
+		req.Header.Set("X-API-Key", c.apiKey)
+	case c.token != nil:
+		token, err := c.token(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get access token. err: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return c.httpClient.Do(req)
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, query url.Values, v interface{}) error {
+	resp, err := c.do(ctx, request{method: http.MethodGet, path: path, query: query, idempotent: true})
+	if err != nil {
+		return err
+	}
+	return decode(resp, v)
+}
+
+func jsonBody(v interface{}) func() (io.Reader, string, error) {
+	return func() (io.Reader, string, error) {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to marshal request. err: %w", err)
+		}
+		return strings.NewReader(string(data)), "application/json", nil
+	}
+}
+
+func decode(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode response. err: %w", err)
+	}
+	return nil
+}
+
+// The codes of the errors the service answers with.
+const (
+	CodeNotFound         = "FS-000010"
+	CodeAlreadyExist     = "FS-000011"
+	CodeForbidden        = "FS-000012"
+	CodeChecksumMismatch = "FS-000013"
+	CodeUnavailable      = "FS-000014"
+	CodeGone             = "FS-000015"
+	CodeLocked           = "FS-000016"
+)
+
+// The errors an *Error matches with errors.Is, by its code or, for responses without one, its status.
+var (
+	ErrNotFound         = errors.New("not found")
+	ErrAlreadyExist     = errors.New("already exists")
+	ErrForbidden        = errors.New("forbidden")
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	ErrUnavailable      = errors.New("storage unavailable")
+	ErrGone             = errors.New("gone")
+	ErrLocked           = errors.New("locked")
+	ErrUnauthorized     = errors.New("unauthorized")
+)
+
+var sentinels = map[string]error{
+	CodeNotFound:         ErrNotFound,
+	CodeAlreadyExist:     ErrAlreadyExist,
+	CodeForbidden:        ErrForbidden,
+	CodeChecksumMismatch: ErrChecksumMismatch,
+	CodeUnavailable:      ErrUnavailable,
+	CodeGone:             ErrGone,
+	CodeLocked:           ErrLocked,
+}
+
+// Error is an error response of the service, errors.Is(err, client.ErrNotFound) and the like work on it.
+type Error struct {
+	StatusCode       int
+	Code             string
+	Message          string
+	DeveloperMessage string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("storage api responded %d: %s", e.StatusCode, e.Message)
+}
+
+func (e *Error) Is(target error) bool {
+	if sentinel, ok := sentinels[e.Code]; ok {
+		return sentinel == target
+	}
+	switch e.StatusCode {
+	case http.StatusUnauthorized:
+		return target == ErrUnauthorized
+	case http.StatusForbidden:
+		return target == ErrForbidden
+	case http.StatusNotFound:
+		return target == ErrNotFound
+	}
+	return false
+}
+
+func responseError(resp *http.Response) error {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	apiErr := &Error{StatusCode: resp.StatusCode}
+	var body struct {
+		Message          string `json:"message"`
+		DeveloperMessage string `json:"developer_message"`
+		Code             string `json:"code"`
+	}
+	if err := json.Unmarshal(data, &body); err == nil && body.Code != "" {
+		apiErr.Code, apiErr.Message, apiErr.DeveloperMessage = body.Code, body.Message, body.DeveloperMessage
+		return apiErr
+	}
+	// auth failures come as {"error": "...", "code": <status>}
+	var generic struct {
+		Error string `json:"error"`
+	}
+	apiErr.Message = http.StatusText(resp.StatusCode)
+	if err := json.Unmarshal(data, &generic); err == nil && generic.Error != "" {
+		apiErr.Message = generic.Error
+	} else {
+		apiErr.DeveloperMessage = strings.TrimSpace(string(data))
+	}
+	return apiErr
+}
+
+func retryable(err error) bool {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		switch apiErr.StatusCode {
+		case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
+
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return time.Until(at)
+	}
+	return 0
+}
@@ -0,0 +1,231 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gerladeno/media-storage-service/internal/apikey"
+	"github.com/gerladeno/media-storage-service/internal/apperror"
+	"github.com/gerladeno/media-storage-service/internal/audit"
+	"github.com/gerladeno/media-storage-service/internal/broker"
+	"github.com/gerladeno/media-storage-service/internal/fulltext"
+	"github.com/gerladeno/media-storage-service/internal/rest"
+	"github.com/gerladeno/media-storage-service/internal/storage"
+	"github.com/gerladeno/media-storage-service/pkg/client"
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/bbolt"
+)
+
+const noteUUID = "5f0c4d3e-8a1b-4c2d-9e3f-1a2b3c4d5e6f"
+
+type testServer struct {
+	*httptest.Server
+	readKey  string
+	writeKey string
+	// failures is how many requests are answered with 503 before they reach the router.
+	failures int32
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	dir := t.TempDir()
+	db, err := bbolt.Open(filepath.Join(dir, "storage.db"), 0o600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	fileStorage, err := storage.NewFilesystem(log, filepath.Join(dir, "files"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := storage.NewIndex(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	textIndex, err := fulltext.NewIndex(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service, err := storage.NewService(log, fileStorage, index, textIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := apikey.NewStore(log, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := &testServer{}
+	ctx := context.Background()
+	readScopes := []string{apikey.ScopeFilesRead}
+	if _, ts.readKey, err = keys.Create(ctx, apikey.CreateKeyDTO{Name: "read", Scopes: readScopes}); err != nil {
+		t.Fatal(err)
+	}
+	writeScopes := []string{apikey.ScopeFilesRead, apikey.ScopeFilesWrite}
+	if _, ts.writeKey, err = keys.Create(ctx, apikey.CreateKeyDTO{Name: "write", Scopes: writeScopes}); err != nil {
+		t.Fatal(err)
+	}
+	router := rest.NewRouter(log, service, keys, nil, broker.New(10), nil, nil, audit.NewLog(log), nil, nil, "test", "test")
+	ts.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&ts.failures, -1) >= 0 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte(`{"message":"storage unavailable","code":"FS-000014"}`))
+			return
+		}
+		router.ServeHTTP(w, r)
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func (ts *testServer) client(t *testing.T, key string) *client.Client {
+	t.Helper()
+	c, err := client.New(ts.URL, client.WithAPIKey(key), client.WithRetries(2, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestUploadDownload(t *testing.T) {
+	ts := newTestServer(t)
+	c := ts.client(t, ts.writeKey)
+	ctx := context.Background()
+	contents := []byte("hello, storage")
+	uploaded, err := c.Upload(ctx, noteUUID, "hello.txt", bytes.NewReader(contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uploaded.Name != "hello.txt" || uploaded.Size != int64(len(contents)) || uploaded.Checksum == "" {
+		t.Fatalf("unexpected upload result %+v", uploaded)
+	}
+	body, err := c.Download(ctx, noteUUID, uploaded.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	downloaded, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(downloaded, contents) {
+		t.Fatalf("downloaded %q, want %q", downloaded, contents)
+	}
+}
+
+func TestListPages(t *testing.T) {
+	ts := newTestServer(t)
+	c := ts.client(t, ts.writeKey)
+	ctx := context.Background()
+	const files = 5
+	for i := 0; i < files; i++ {
+		if _, err := c.Upload(ctx, noteUUID, fmt.Sprintf("file-%d.txt", i), bytes.NewReader([]byte{byte(i)})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q := client.Query{NoteUUIDs: []string{noteUUID}}
+	page, err := c.List(ctx, q, 2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != files || len(page.Files) != 1 {
+		t.Fatalf("got %d files of %d, want 1 of %d", len(page.Files), page.Total, files)
+	}
+	seen := map[string]bool{}
+	err = c.ListAll(ctx, q, func(f *client.File) error {
+		seen[f.ID] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != files {
+		t.Fatalf("listed %d files, want %d", len(seen), files)
+	}
+}
+
+func TestRetryUnavailable(t *testing.T) {
+	ts := newTestServer(t)
+	c := ts.client(t, ts.readKey)
+	ctx := context.Background()
+	atomic.StoreInt32(&ts.failures, 2)
+	started := time.Now()
+	if _, err := c.List(ctx, client.Query{NoteUUIDs: []string{noteUUID}}, 10, 0); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(started); elapsed < 2*time.Second {
+		t.Fatalf("retried after %s, want Retry-After to be honored", elapsed)
+	}
+	atomic.StoreInt32(&ts.failures, 3)
+	_, err := c.List(ctx, client.Query{NoteUUIDs: []string{noteUUID}}, 10, 0)
+	if !errors.Is(err, client.ErrUnavailable) {
+		t.Fatalf("got %v, want ErrUnavailable once the retries are used up", err)
+	}
+}
+
+func TestUploadIsNotRetried(t *testing.T) {
+	ts := newTestServer(t)
+	c := ts.client(t, ts.writeKey)
+	atomic.StoreInt32(&ts.failures, 1)
+	_, err := c.Upload(context.Background(), noteUUID, "a.txt", bytes.NewReader([]byte("a")))
+	if !errors.Is(err, client.ErrUnavailable) {
+		t.Fatalf("got %v, want ErrUnavailable", err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	_, err := ts.client(t, ts.readKey).Download(ctx, noteUUID, "missing")
+	var apiErr *client.Error
+	if !errors.Is(err, client.ErrNotFound) || !errors.As(err, &apiErr) {
+		t.Fatalf("got %v, want ErrNotFound", err)
+	}
+	if apiErr.StatusCode != http.StatusNotFound || apiErr.Code != client.CodeNotFound {
+		t.Fatalf("got status %d and code %q", apiErr.StatusCode, apiErr.Code)
+	}
+	_, err = ts.client(t, ts.readKey).Upload(ctx, noteUUID, "a.txt", bytes.NewReader([]byte("a")))
+	if !errors.Is(err, client.ErrForbidden) {
+		t.Fatalf("got %v, want ErrForbidden for a read key", err)
+	}
+	past := client.WithExpiresAt(time.Now().Add(-time.Hour))
+	_, err = ts.client(t, ts.writeKey).Upload(ctx, noteUUID, "a.txt", bytes.NewReader([]byte("a")), past)
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest || apiErr.Message == "" {
+		t.Fatalf("got %v, want the error of the upload", err)
+	}
+	_, err = ts.client(t, "unknown").List(ctx, client.Query{}, 10, 0)
+	if !errors.Is(err, client.ErrUnauthorized) {
+		t.Fatalf("got %v, want ErrUnauthorized", err)
+	}
+	if errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("%v matches ErrNotFound", err)
+	}
+}
+
+func TestCodesMatchService(t *testing.T) {
+	codes := map[string]*apperror.AppError{
+		client.CodeNotFound:         apperror.ErrNotFound,
+		client.CodeAlreadyExist:     apperror.ErrAlreadyExist,
+		client.CodeForbidden:        apperror.ErrForbidden,
+		client.CodeChecksumMismatch: apperror.ErrChecksumMismatch,
+		client.CodeUnavailable:      apperror.ErrUnavailable,
+		client.CodeGone:             apperror.ErrGone,
+		client.CodeLocked:           apperror.ErrLocked,
+	}
+	for code, appErr := range codes {
+		if code != appErr.Code {
+			t.Errorf("client code %s, service code %s for %q", code, appErr.Code, appErr.Message)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	filesPath   = "/public/v1/api/files"
+	changesPath = "/public/v1/api/changes"
+	pageSize    = 100
+)
+
+type File struct {
+	NoteUUID    string            `json:"note_uuid"`
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	Size        int64             `json:"size"`
+	ContentType string            `json:"content_type,omitempty"`
+	Checksum    string            `json:"checksum,omitempty"`
+	Owner       string            `json:"owner,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	CreatedAt   time.Time         `json:"created_at"`
+	ModifiedAt  time.Time         `json:"modified_at"`
+	ExpiresAt   *time.Time        `json:"expires_at,omitempty"`
+	Score       float64           `json:"score,omitempty"`
+	Snippets    []string          `json:"snippets,omitempty"`
+}
+
+type UploadResult struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"`
+}
+
+// Query filters the listed files, see GET /public/v1/api/files/search.
+type Query struct {
+	NoteUUIDs   []string
+	Text        string
+	Name        string
+	ContentType string
+	Tags        map[string]string
+	MinSize     int64
+	MaxSize     int64
+	From        time.Time
+	To          time.Time
+}
+
+type Page struct {
+	Files []*File
+	Total int
+}
+
+type UpdateRequest struct {
+	Name             *string           `json:"name,omitempty"`
+	Description      *string           `json:"description,omitempty"`
+	Tags             map[string]string `json:"tags,omitempty"`
+	RemoveTags       []string          `json:"remove_tags,omitempty"`
+	ObjectTags       map[string]string `json:"object_tags,omitempty"`
+	RemoveObjectTags []string          `json:"remove_object_tags,omitempty"`
+	ExpiresAt        *time.Time        `json:"expires_at,omitempty"`
+	TTL              string            `json:"ttl,omitempty"`
+	RemoveExpiry     bool              `json:"remove_expiry,omitempty"`
+}
+
+type UploadOption func(url.Values)
+
+// WithExpiresAt makes the uploaded file expire at t.
+func WithExpiresAt(t time.Time) UploadOption {
+	return func(fields url.Values) {
+		fields.Set("expires_at", t.UTC().Format(time.RFC3339))
+	}
+}
+
+// WithTTL makes the uploaded file expire after ttl.
+func WithTTL(ttl time.Duration) UploadOption {
+	return func(fields url.Values) {
+		fields.Set("ttl", ttl.String())
+	}
+}
+
+type Change struct {
+	Type      string    `json:"type"`
+	NoteUUID  string    `json:"note_uuid"`
+	FileID    string    `json:"file_id"`
+	Owner     string    `json:"owner,omitempty"`
+	File      *File     `json:"file,omitempty"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+type ChangeSet struct {
+	Changes []*Change `json:"changes"`
+	Cursor  string    `json:"cursor"`
+	HasMore bool      `json:"has_more"`
+}
+
+// Upload streams the contents of r to the note as a file named name, opts set e.g. its expiry.
+// It isn't retried, since the reader can't be replayed.
+func (c *Client) Upload(ctx context.Context, noteUUID, name string, r io.Reader, opts ...UploadOption) (*UploadResult, error) {
+	fields := url.Values{}
+	for _, opt := range opts {
+		opt(fields)
+	}
+	body := func() (io.Reader, string, error) {
+		pr, pw := io.Pipe()
+		mw := multipart.NewWriter(pw)
+		go func() {
+			err := mw.WriteField("note_uuid", noteUUID)
+			for key := range fields {
+				if err == nil {
+					err = mw.WriteField(key, fields.Get(key))
+				}
+			}
+			if err == nil {
+				var part io.Writer
+				if part, err = mw.CreateFormFile("file", name); err == nil {
+					_, err = io.Copy(part, r)
+				}
+			}
+			if err == nil {
+				err = mw.Close()
+			}
+			_ = pw.CloseWithError(err)
+		}()
+		return pr, mw.FormDataContentType(), nil
+	}
+	resp, err := c.do(ctx, request{method: http.MethodPost, path: filesPath, body: body})
+	if err != nil {
+		return nil, err
+	}
+	var results []*UploadResult
+	if err = decode(resp, &results); err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, fmt.Errorf("empty upload response")
+	}
+	return results[0], nil
+}
+
+// Download returns the contents of a file, the caller must close the reader.
+func (c *Client) Download(ctx context.Context, noteUUID, fileID string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, request{
+		method:     http.MethodGet,
+		path:       filesPath + "/" + url.PathEscape(fileID),
+		query:      url.Values{"note_uuid": {noteUUID}},
+		idempotent: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// List returns a page of the files matching q, limited to the caller's scope.
+func (c *Client) List(ctx context.Context, q Query, limit, offset int) (*Page, error) {
+	query := q.values()
+	query.Set("limit", strconv.Itoa(limit))
+	query.Set("offset", strconv.Itoa(offset))
+	var resp struct {
+		Data []*File `json:"data"`
+		Meta struct {
+			Count int `json:"count"`
+		} `json:"meta"`
+	}
+	if err := c.getJSON(ctx, filesPath+"/search", query, &resp); err != nil {
+		return nil, err
+	}
+	return &Page{Files: resp.Data, Total: resp.Meta.Count}, nil
+}
+
+// ListAll calls fn for every file matching q, fetching the pages as it goes.
+func (c *Client) ListAll(ctx context.Context, q Query, fn func(*File) error) error {
+	for offset := 0; ; {
+		page, err := c.List(ctx, q, pageSize, offset)
+		if err != nil {
+			return err
+		}
+		for _, f := range page.Files {
+			if err = fn(f); err != nil {
+				return err
+			}
+		}
+		offset += len(page.Files)
+		if len(page.Files) == 0 || offset >= page.Total {
+			return nil
+		}
+	}
+}
+
+func (c *Client) Update(ctx context.Context, noteUUID, fileID string, update UpdateRequest) (*File, error) {
+	resp, err := c.do(ctx, request{
+		method: http.MethodPatch,
+		path:   filesPath + "/" + url.PathEscape(fileID),
+		query:  url.Values{"note_uuid": {noteUUID}},
+		body:   jsonBody(update),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var f File
+	if err = decode(resp, &f); err != nil {
+		return nil, err
+	}
+	f.NoteUUID = noteUUID
+	return &f, nil
+}
+
+func (c *Client) Delete(ctx context.Context, noteUUID, fileID string) error {
+	resp, err := c.do(ctx, request{
+		method:     http.MethodDelete,
+		path:       filesPath + "/" + url.PathEscape(fileID),
+		query:      url.Values{"note_uuid": {noteUUID}},
+		idempotent: true,
+	})
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (c *Client) Copy(ctx context.Context, noteUUID, fileID, targetNoteUUID string) (*File, error) {
+	return c.transfer(ctx, "copy", noteUUID, fileID, targetNoteUUID)
+}
+
+func (c *Client) Move(ctx context.Context, noteUUID, fileID, targetNoteUUID string) (*File, error) {
+	return c.transfer(ctx, "move", noteUUID, fileID, targetNoteUUID)
+}
+
+func (c *Client) transfer(ctx context.Context, action, noteUUID, fileID, targetNoteUUID string) (*File, error) {
+	resp, err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   filesPath + "/" + url.PathEscape(fileID) + "/" + action,
+		query:  url.Values{"note_uuid": {noteUUID}, "target_note_uuid": {targetNoteUUID}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var f File
+	if err = decode(resp, &f); err != nil {
+		return nil, err
+	}
+	f.NoteUUID = targetNoteUUID
+	return &f, nil
+}
+
+// Changes returns the changes after cursor, an empty cursor starts from the beginning.
+func (c *Client) Changes(ctx context.Context, cursor string, limit int) (*ChangeSet, error) {
+	query := url.Values{}
+	if cursor != "" {
+		query.Set("since", cursor)
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	var resp struct {
+		Data *ChangeSet `json:"data"`
+	}
+	if err := c.getJSON(ctx, changesPath, query, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+func (q Query) values() url.Values {
+	query := url.Values{}
+	for _, noteUUID := range q.NoteUUIDs {
+		query.Add("note_uuid", noteUUID)
+	}
+	set := func(key, value string) {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	set("q", q.Text)
+	set("name", q.Name)
+	set("type", q.ContentType)
+	for k, v := range q.Tags {
+		query.Add("tag", k+":"+v)
+	}
+	if q.MinSize > 0 {
+		query.Set("min_size", strconv.FormatInt(q.MinSize, 10))
+	}
+	if q.MaxSize > 0 {
+		query.Set("max_size", strconv.FormatInt(q.MaxSize, 10))
+	}
+	if !q.From.IsZero() {
+		query.Set("from", q.From.Format(time.RFC3339))
+	}
+	if !q.To.IsZero() {
+		query.Set("to", q.To.Format(time.RFC3339))
+	}
+	return query
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"context"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+)
+
+const notesPath = "/public/v1/api/notes"
+
+type ImportResult struct {
+	Entry string `json:"entry"`
+	ID    string `json:"id,omitempty"`
+	Name  string `json:"name,omitempty"`
+	Size  int64  `json:"size,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Export returns an archive of the files of a note, format is "zip" or "tar.gz".
+// The caller must close the reader.
+func (c *Client) Export(ctx context.Context, noteUUID, format string) (io.ReadCloser, error) {
+	query := url.Values{"manifest": {"true"}}
+	if format != "" {
+		query.Set("format", format)
+	}
+	resp, err := c.do(ctx, request{
+		method:     http.MethodGet,
+		path:       notesPath + "/" + url.PathEscape(noteUUID) + "/archive",
+		query:      query,
+		idempotent: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Import creates a file in the note for every entry of a zip archive. Entry failures are
+// reported in the results.
+func (c *Client) Import(ctx context.Context, noteUUID string, archive io.Reader) ([]ImportResult, error) {
+	body := func() (io.Reader, string, error) {
+		pr, pw := io.Pipe()
+		mw := multipart.NewWriter(pw)
+		go func() {
+			part, err := mw.CreateFormFile("archive", noteUUID+".zip")
+			if err == nil {
+				_, err = io.Copy(part, archive)
+			}
+			if err == nil {
+				err = mw.Close()
+			}
+			_ = pw.CloseWithError(err)
+		}()
+		return pr, mw.FormDataContentType(), nil
+	}
+	resp, err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   notesPath + "/" + url.PathEscape(noteUUID) + "/import",
+		body:   body,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var results []ImportResult
+	if err = decode(resp, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
@@ -0,0 +1,74 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type ShareLink struct {
+	ID           string     `json:"id"`
+	NoteUUID     string     `json:"note_uuid"`
+	FileID       string     `json:"file_id"`
+	CreatedBy    string     `json:"created_by,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	MaxDownloads int        `json:"max_downloads,omitempty"`
+	Downloads    int        `json:"downloads"`
+	HasPassword  bool       `json:"has_password"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+	// Token is only returned when the link is created, the file is shared at /share/{token}.
+	Token string `json:"token,omitempty"`
+}
+
+// ShareOptions limits a share link, the zero values don't limit it.
+type ShareOptions struct {
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	MaxDownloads int        `json:"max_downloads,omitempty"`
+	Password     string     `json:"password,omitempty"`
+}
+
+// CreateShareLink creates a link that lets anyone with its token download the file without authenticating.
+func (c *Client) CreateShareLink(ctx context.Context, noteUUID, fileID string, opts ShareOptions) (*ShareLink, error) {
+	resp, err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   sharesPath(fileID),
+		query:  url.Values{"note_uuid": {noteUUID}},
+		body:   jsonBody(opts),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var link ShareLink
+	if err = decode(resp, &link); err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+// ShareLinks returns the links to a file, the revoked and used up ones too.
+func (c *Client) ShareLinks(ctx context.Context, noteUUID, fileID string) ([]*ShareLink, error) {
+	var links []*ShareLink
+	if err := c.getJSON(ctx, sharesPath(fileID), url.Values{"note_uuid": {noteUUID}}, &links); err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+func (c *Client) RevokeShareLink(ctx context.Context, noteUUID, fileID, shareID string) error {
+	resp, err := c.do(ctx, request{
+		method:     http.MethodDelete,
+		path:       sharesPath(fileID) + "/" + url.PathEscape(shareID),
+		query:      url.Values{"note_uuid": {noteUUID}},
+		idempotent: true,
+	})
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func sharesPath(fileID string) string {
+	return filesPath + "/" + url.PathEscape(fileID) + "/shares"
+}
@@ -0,0 +1,4 @@
+// Package filestoragepb is the Go code generated from filestorage.proto.
+package filestoragepb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative filestorage.proto
@@ -0,0 +1,315 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             (unknown)
+// source: filestorage.proto
+
+package filestoragepb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// FileStorageClient is the client API for FileStorage service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type FileStorageClient interface {
+	// Upload takes the header first and the file contents in the following chunks.
+	Upload(ctx context.Context, opts ...grpc.CallOption) (FileStorage_UploadClient, error)
+	// Download sends the file info first and the file contents in the following chunks.
+	Download(ctx context.Context, in *DownloadRequest, opts ...grpc.CallOption) (FileStorage_DownloadClient, error)
+	List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error)
+	Stat(ctx context.Context, in *StatRequest, opts ...grpc.CallOption) (*FileInfo, error)
+	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error)
+}
+
+type fileStorageClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewFileStorageClient(cc grpc.ClientConnInterface) FileStorageClient {
+	return &fileStorageClient{cc}
+}
+
+func (c *fileStorageClient) Upload(ctx context.Context, opts ...grpc.CallOption) (FileStorage_UploadClient, error) {
+	stream, err := c.cc.NewStream(ctx, &FileStorage_ServiceDesc.Streams[0], "/mediastorage.filestorage.v1.FileStorage/Upload", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &fileStorageUploadClient{stream}
+	return x, nil
+}
+
+type FileStorage_UploadClient interface {
+	Send(*UploadRequest) error
+	CloseAndRecv() (*FileInfo, error)
+	grpc.ClientStream
+}
+
+type fileStorageUploadClient struct {
+	grpc.ClientStream
+}
+
+func (x *fileStorageUploadClient) Send(m *UploadRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *fileStorageUploadClient) CloseAndRecv() (*FileInfo, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(FileInfo)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *fileStorageClient) Download(ctx context.Context, in *DownloadRequest, opts ...grpc.CallOption) (FileStorage_DownloadClient, error) {
+	stream, err := c.cc.NewStream(ctx, &FileStorage_ServiceDesc.Streams[1], "/mediastorage.filestorage.v1.FileStorage/Download", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &fileStorageDownloadClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type FileStorage_DownloadClient interface {
+	Recv() (*DownloadResponse, error)
+	grpc.ClientStream
+}
+
+type fileStorageDownloadClient struct {
+	grpc.ClientStream
+}
+
+func (x *fileStorageDownloadClient) Recv() (*DownloadResponse, error) {
+	m := new(DownloadResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *fileStorageClient) List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error) {
+	out := new(ListResponse)
+	err := c.cc.Invoke(ctx, "/mediastorage.filestorage.v1.FileStorage/List", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fileStorageClient) Stat(ctx context.Context, in *StatRequest, opts ...grpc.CallOption) (*FileInfo, error) {
+	out := new(FileInfo)
+	err := c.cc.Invoke(ctx, "/mediastorage.filestorage.v1.FileStorage/Stat", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fileStorageClient) Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error) {
+	out := new(DeleteResponse)
+	err := c.cc.Invoke(ctx, "/mediastorage.filestorage.v1.FileStorage/Delete", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// FileStorageServer is the server API for FileStorage service.
+// All implementations must embed UnimplementedFileStorageServer
+// for forward compatibility
+type FileStorageServer interface {
+	// Upload takes the header first and the file contents in the following chunks.
+	Upload(FileStorage_UploadServer) error
+	// Download sends the file info first and the file contents in the following chunks.
+	Download(*DownloadRequest, FileStorage_DownloadServer) error
+	List(context.Context, *ListRequest) (*ListResponse, error)
+	Stat(context.Context, *StatRequest) (*FileInfo, error)
+	Delete(context.Context, *DeleteRequest) (*DeleteResponse, error)
+	mustEmbedUnimplementedFileStorageServer()
+}
+
+// UnimplementedFileStorageServer must be embedded to have forward compatible implementations.
+type UnimplementedFileStorageServer struct {
+}
+
+func (UnimplementedFileStorageServer) Upload(FileStorage_UploadServer) error {
+	return status.Errorf(codes.Unimplemented, "method Upload not implemented")
+}
+func (UnimplementedFileStorageServer) Download(*DownloadRequest, FileStorage_DownloadServer) error {
+	return status.Errorf(codes.Unimplemented, "method Download not implemented")
+}
+func (UnimplementedFileStorageServer) List(context.Context, *ListRequest) (*ListResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method List not implemented")
+}
+func (UnimplementedFileStorageServer) Stat(context.Context, *StatRequest) (*FileInfo, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Stat not implemented")
+}
+func (UnimplementedFileStorageServer) Delete(context.Context, *DeleteRequest) (*DeleteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Delete not implemented")
+}
+func (UnimplementedFileStorageServer) mustEmbedUnimplementedFileStorageServer() {}
+
+// UnsafeFileStorageServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to FileStorageServer will
+// result in compilation errors.
+type UnsafeFileStorageServer interface {
+	mustEmbedUnimplementedFileStorageServer()
+}
+
+func RegisterFileStorageServer(s grpc.ServiceRegistrar, srv FileStorageServer) {
+	s.RegisterService(&FileStorage_ServiceDesc, srv)
+}
+
+func _FileStorage_Upload_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(FileStorageServer).Upload(&fileStorageUploadServer{stream})
+}
+
+type FileStorage_UploadServer interface {
+	SendAndClose(*FileInfo) error
+	Recv() (*UploadRequest, error)
+	grpc.ServerStream
+}
+
+type fileStorageUploadServer struct {
+	grpc.ServerStream
+}
+
+func (x *fileStorageUploadServer) SendAndClose(m *FileInfo) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *fileStorageUploadServer) Recv() (*UploadRequest, error) {
+	m := new(UploadRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _FileStorage_Download_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(DownloadRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(FileStorageServer).Download(m, &fileStorageDownloadServer{stream})
+}
+
+type FileStorage_DownloadServer interface {
+	Send(*DownloadResponse) error
+	grpc.ServerStream
+}
+
+type fileStorageDownloadServer struct {
+	grpc.ServerStream
+}
+
+func (x *fileStorageDownloadServer) Send(m *DownloadResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _FileStorage_List_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FileStorageServer).List(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mediastorage.filestorage.v1.FileStorage/List",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FileStorageServer).List(ctx, req.(*ListRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FileStorage_Stat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FileStorageServer).Stat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mediastorage.filestorage.v1.FileStorage/Stat",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FileStorageServer).Stat(ctx, req.(*StatRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FileStorage_Delete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FileStorageServer).Delete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mediastorage.filestorage.v1.FileStorage/Delete",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FileStorageServer).Delete(ctx, req.(*DeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// FileStorage_ServiceDesc is the grpc.ServiceDesc for FileStorage service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var FileStorage_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "mediastorage.filestorage.v1.FileStorage",
+	HandlerType: (*FileStorageServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "List",
+			Handler:    _FileStorage_List_Handler,
+		},
+		{
+			MethodName: "Stat",
+			Handler:    _FileStorage_Stat_Handler,
+		},
+		{
+			MethodName: "Delete",
+			Handler:    _FileStorage_Delete_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Upload",
+			Handler:       _FileStorage_Upload_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Download",
+			Handler:       _FileStorage_Download_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "filestorage.proto",
+}
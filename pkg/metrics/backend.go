@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type Backend struct {
+	BreakerState  *prometheus.GaugeVec
+	RetriesTotal  *prometheus.CounterVec
+	RejectedTotal *prometheus.CounterVec
+}
+
+func NewBackend(host string) *Backend {
+	constLabels := prometheus.Labels{"host": host}
+	return &Backend{
+		BreakerState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        "storage_backend_breaker_state",
+			Help:        "State of the circuit breaker of a storage endpoint: 0 closed, 1 half-open, 2 open",
+			ConstLabels: constLabels,
+		}, []string{"endpoint"}),
+		RetriesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "storage_backend_retries_total",
+			Help:        "How many calls to a storage endpoint were retried",
+			ConstLabels: constLabels,
+		}, []string{"endpoint", "operation"}),
+		RejectedTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "storage_backend_rejected_total",
+			Help:        "How many calls failed fast because the circuit breaker was open",
+			ConstLabels: constLabels,
+		}, []string{"endpoint"}),
+	}
+}
+
+var backendOnce sync.Once
+
+func (b *Backend) AutoRegister() *Backend {
+	backendOnce.Do(func() {
+		b.mustRegister(prometheus.DefaultRegisterer)
+	})
+	return b
+}
+
+func (b *Backend) mustRegister(registerer prometheus.Registerer) {
+	registerer.MustRegister(b.BreakerState, b.RetriesTotal, b.RejectedTotal)
+}
@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type Cache struct {
+	HitsTotal      *prometheus.CounterVec
+	MissesTotal    prometheus.Counter
+	EvictionsTotal *prometheus.CounterVec
+	Bytes          *prometheus.GaugeVec
+}
+
+func NewCache(host string) *Cache {
+	constLabels := prometheus.Labels{"host": host}
+	return &Cache{
+		HitsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "storage_cache_hits_total",
+			Help:        "How many file reads were served from the memory or the disk cache",
+			ConstLabels: constLabels,
+		}, []string{"layer"}),
+		MissesTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "storage_cache_misses_total",
+			Help:        "How many file reads went to the storage",
+			ConstLabels: constLabels,
+		}),
+		EvictionsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "storage_cache_evictions_total",
+			Help:        "How many files were evicted to make room for others",
+			ConstLabels: constLabels,
+		}, []string{"layer"}),
+		Bytes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        "storage_cache_bytes",
+			Help:        "How many bytes are cached",
+			ConstLabels: constLabels,
+		}, []string{"layer"}),
+	}
+}
+
+var cacheOnce sync.Once
+
+func (c *Cache) AutoRegister() *Cache {
+	cacheOnce.Do(func() {
+		c.mustRegister(prometheus.DefaultRegisterer)
+	})
+	return c
+}
+
+func (c *Cache) mustRegister(registerer prometheus.Registerer) {
+	registerer.MustRegister(c.HitsTotal, c.MissesTotal, c.EvictionsTotal, c.Bytes)
+}
@@ -189,6 +189,28 @@ func (h *HTTPOut) mustRegister(registerer prometheus.Registerer) {
 	)
 }
 
+// Do sends the request with c and collects the metrics of it, leaving the status code
+// and the response body to the caller.
+func (h *HTTPOut) Do(c *http.Client, req *http.Request) (*http.Response, error) {
+	labelValues := []string{req.URL.Hostname(), req.URL.Port(), req.Method, replaceAccounts(replaceUUIDs(req.URL.Path))}
+	h.ReqTotal.WithLabelValues(labelValues...).Inc()
+	if req.ContentLength > 0 {
+		h.ReqBytesTotal.WithLabelValues(labelValues...).Add(float64(req.ContentLength))
+	}
+	started := time.Now()
+	resp, err := c.Do(req)
+	if err != nil {
+		h.ReqErrorsTotal.WithLabelValues(labelValues...).Inc()
+		h.RespTotal.WithLabelValues(append(labelValues, err.Error())...).Inc()
+		h.RespTimeTotal.WithLabelValues(append(labelValues, err.Error())...).Add(time.Since(started).Seconds())
+		return nil, err
+	}
+	labelValues = append(labelValues, strconv.Itoa(resp.StatusCode))
+	h.RespTotal.WithLabelValues(labelValues...).Inc()
+	h.RespTimeTotal.WithLabelValues(labelValues...).Add(time.Since(started).Seconds())
+	return resp, nil
+}
+
 func (h *HTTPOut) DoAndCollect(c *http.Client, req *http.Request, dest interface{}) (*http.Response, error) {
 	labelValues := []string{req.URL.Hostname(), req.URL.Port(), req.Method, replaceAccounts(replaceUUIDs(req.URL.Path))}
 	h.ReqTotal.WithLabelValues(labelValues...).Inc()
@@ -208,6 +230,7 @@ func (h *HTTPOut) DoAndCollect(c *http.Client, req *http.Request, dest interface
 		h.RespTotal.WithLabelValues(append(labelValues, resp.Status)...).Inc()
 		h.RespTimeTotal.WithLabelValues(append(labelValues, resp.Status)...).Add(time.Since(started).Seconds())
 		b, e := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
 		if e != nil {
 			return nil, fmt.Errorf("err reading response body: %w", e)
 		}
@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type Integrity struct {
+	ChecksumMismatchTotal *prometheus.CounterVec
+	ScrubFindings         *prometheus.GaugeVec
+	ScrubFilesTotal       prometheus.Counter
+	ScrubBytesTotal       prometheus.Counter
+	ScrubDuration         prometheus.Gauge
+	ScrubLastRun          prometheus.Gauge
+}
+
+func NewIntegrity(host string) *Integrity {
+	constLabels := prometheus.Labels{"host": host}
+	return &Integrity{
+		ChecksumMismatchTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "storage_checksum_mismatch_total",
+			Help:        "How many stored files didn't match their checksum when read",
+			ConstLabels: constLabels,
+		}, []string{"operation"}),
+		ScrubFindings: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        "storage_scrub_findings",
+			Help:        "Problems found by the last scrubber run by kind",
+			ConstLabels: constLabels,
+		}, []string{"kind"}),
+		ScrubFilesTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "storage_scrub_files_total",
+			Help:        "How many files the scrubber has read",
+			ConstLabels: constLabels,
+		}),
+		ScrubBytesTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "storage_scrub_bytes_total",
+			Help:        "How many bytes the scrubber has read",
+			ConstLabels: constLabels,
+		}),
+		ScrubDuration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "storage_scrub_duration_seconds",
+			Help:        "How long the last scrubber run took",
+			ConstLabels: constLabels,
+		}),
+		ScrubLastRun: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "storage_scrub_last_run_timestamp_seconds",
+			Help:        "When the last scrubber run finished",
+			ConstLabels: constLabels,
+		}),
+	}
+}
+
+var integrityOnce sync.Once
+
+func (i *Integrity) AutoRegister() *Integrity {
+	integrityOnce.Do(func() {
+		i.mustRegister(prometheus.DefaultRegisterer)
+	})
+	return i
+}
+
+func (i *Integrity) mustRegister(registerer prometheus.Registerer) {
+	registerer.MustRegister(i.ChecksumMismatchTotal, i.ScrubFindings, i.ScrubFilesTotal, i.ScrubBytesTotal,
+		i.ScrubDuration, i.ScrubLastRun)
+}
@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type Replication struct {
+	WritesTotal        *prometheus.CounterVec
+	QueueLength        prometheus.Gauge
+	DroppedTotal       prometheus.Counter
+	FallbackReadsTotal *prometheus.CounterVec
+	RepairedTotal      *prometheus.CounterVec
+	RepairLastRun      prometheus.Gauge
+}
+
+func NewReplication(host string) *Replication {
+	constLabels := prometheus.Labels{"host": host}
+	return &Replication{
+		WritesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "storage_replication_writes_total",
+			Help:        "How many writes were applied to a replica, by result",
+			ConstLabels: constLabels,
+		}, []string{"replica", "operation", "result"}),
+		QueueLength: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "storage_replication_queue_length",
+			Help:        "How many asynchronous writes wait to be applied to the replicas",
+			ConstLabels: constLabels,
+		}),
+		DroppedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "storage_replication_dropped_total",
+			Help:        "How many asynchronous writes were dropped because the queue was full",
+			ConstLabels: constLabels,
+		}),
+		FallbackReadsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "storage_replication_fallback_reads_total",
+			Help:        "How many reads were served by a replica because the primary failed",
+			ConstLabels: constLabels,
+		}, []string{"replica"}),
+		RepairedTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "storage_replication_repaired_total",
+			Help:        "How many objects the repair job wrote to or removed from a replica",
+			ConstLabels: constLabels,
+		}, []string{"replica", "action"}),
+		RepairLastRun: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "storage_replication_repair_last_run_timestamp_seconds",
+			Help:        "When the last repair run finished",
+			ConstLabels: constLabels,
+		}),
+	}
+}
+
+var replicationOnce sync.Once
+
+func (r *Replication) AutoRegister() *Replication {
+	replicationOnce.Do(func() {
+		r.mustRegister(prometheus.DefaultRegisterer)
+	})
+	return r
+}
+
+func (r *Replication) mustRegister(registerer prometheus.Registerer) {
+	registerer.MustRegister(r.WritesTotal, r.QueueLength, r.DroppedTotal, r.FallbackReadsTotal, r.RepairedTotal, r.RepairLastRun)
+}
@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type Tiering struct {
+	ReadsTotal      *prometheus.CounterVec
+	MovesTotal      *prometheus.CounterVec
+	MovedBytesTotal *prometheus.CounterVec
+	LastRun         prometheus.Gauge
+}
+
+func NewTiering(host string) *Tiering {
+	constLabels := prometheus.Labels{"host": host}
+	return &Tiering{
+		ReadsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "storage_tier_reads_total",
+			Help:        "How many files were read from each storage tier",
+			ConstLabels: constLabels,
+		}, []string{"tier"}),
+		MovesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "storage_tier_moves_total",
+			Help:        "How many files were demoted to the cold tier or promoted to the hot one, by result",
+			ConstLabels: constLabels,
+		}, []string{"direction", "result"}),
+		MovedBytesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "storage_tier_moved_bytes_total",
+			Help:        "How many bytes were moved between the storage tiers",
+			ConstLabels: constLabels,
+		}, []string{"direction"}),
+		LastRun: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "storage_tier_last_run_timestamp_seconds",
+			Help:        "When the last tiering run finished",
+			ConstLabels: constLabels,
+		}),
+	}
+}
+
+var tieringOnce sync.Once
+
+func (t *Tiering) AutoRegister() *Tiering {
+	tieringOnce.Do(func() {
+		t.mustRegister(prometheus.DefaultRegisterer)
+	})
+	return t
+}
+
+func (t *Tiering) mustRegister(registerer prometheus.Registerer) {
+	registerer.MustRegister(t.ReadsTotal, t.MovesTotal, t.MovedBytesTotal, t.LastRun)
+}
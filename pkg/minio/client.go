@@ -2,12 +2,16 @@ package minio
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"sync"
 	"time"
 
+	"github.com/gerladeno/media-storage-service/pkg/metrics"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/tags"
 	"github.com/sirupsen/logrus"
 )
 
@@ -17,18 +21,47 @@ const (
 	uploadTimeoutSeconds    = 10
 )
 
+var (
+	ErrNotFound    = errors.New("err object not found")
+	ErrInvalidTags = errors.New("err invalid object tags")
+)
+
 type Object struct {
-	ID   string
-	Size int64
-	Tags map[string]string
+	ID           string
+	Size         int64
+	Tags         map[string]string
+	Metadata     map[string]string
+	ETag         string
+	ContentType  string
+	LastModified time.Time
+}
+
+func newObject(info minio.ObjectInfo) *Object {
+	return &Object{
+		ID:           info.Key,
+		Size:         info.Size,
+		Tags:         info.UserTags,
+		Metadata:     info.UserMetadata,
+		ETag:         info.ETag,
+		ContentType:  info.ContentType,
+		LastModified: info.LastModified,
+	}
 }
 
 type Client struct {
 	log         *logrus.Entry
 	minioClient *minio.Client
+	endpoint    string
+	retries     int
+	backoff     time.Duration
+	breaker     *breaker
+	collector   *metrics.Backend
+	rulesMu     sync.Mutex
+	rules       map[string]struct{}
+	locking     bool
 }
 
-func NewClient(log *logrus.Logger, endpoint, accessKey, secretKey string) (*Client, error) {
+func NewClient(log *logrus.Logger, endpoint, accessKey, secretKey string, opts ...Option) (*Client, error) {
 	minioClient, err := minio.New(endpoint, &minio.Options{
 		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
 		Secure: false,
@@ -36,17 +69,41 @@ func NewClient(log *logrus.Logger, endpoint, accessKey, secretKey string) (*Clie
 	if err != nil {
 		return nil, fmt.Errorf("err creating minio client")
 	}
-	return &Client{
+	c := &Client{
 		log:         log.WithField("module", "minio"),
 		minioClient: minioClient,
-	}, nil
+		endpoint:    endpoint,
+		retries:     defaultRetries,
+		backoff:     defaultBackoff,
+		breaker:     newBreaker(endpoint),
+		rules:       make(map[string]struct{}),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.breaker.onChange = func(state string) {
+		c.log.Warnf("circuit breaker of %s is %s", endpoint, state)
+		c.observeBreaker(state)
+	}
+	c.observeBreaker(BreakerClosed)
+	return c, nil
 }
 
-func (c *Client) GetFile(ctx context.Context, bucketName, fileID string) (*minio.Object, error) {
-	reqCtx, cancel := context.WithTimeout(ctx, getTimeoutSeconds*time.Second)
-	defer cancel()
+func (c *Client) observeBreaker(state string) {
+	if c.collector == nil {
+		return
+	}
+	value := map[string]float64{BreakerClosed: 0, BreakerHalfOpen: 1, BreakerOpen: 2}[state]
+	c.collector.BreakerState.WithLabelValues(c.endpoint).Set(value)
+}
 
-	obj, err := c.minioClient.GetObject(reqCtx, bucketName, fileID, minio.GetObjectOptions{})
+func (c *Client) GetFile(ctx context.Context, bucketName, fileID string) (*minio.Object, error) {
+	var obj *minio.Object
+	err := c.do(ctx, "get", 0, true, func(ctx context.Context) error {
+		var err error
+		obj, err = c.minioClient.GetObject(ctx, bucketName, fileID, minio.GetObjectOptions{})
+		return err
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to get file with id: %s from minio bucket %s. err: %w", fileID, bucketName, err)
 	}
@@ -54,18 +111,29 @@ func (c *Client) GetFile(ctx context.Context, bucketName, fileID string) (*minio
 }
 
 func (c *Client) GetBucketFiles(ctx context.Context, bucketName string) ([]*minio.Object, error) {
-	reqCtx, cancel := context.WithTimeout(ctx, getBucketTimeoutSeconds*time.Second)
-	defer cancel()
-
-	var files []*minio.Object //nolint:prealloc
-	for lobj := range c.minioClient.ListObjects(reqCtx, bucketName, minio.ListObjectsOptions{WithMetadata: true}) {
-		if lobj.Err != nil {
-			c.log.Warnf("failed to list object from minio bucket %s. err: %v", bucketName, lobj.Err)
-			continue
+	var keys []string
+	err := c.do(ctx, "list", getBucketTimeoutSeconds*time.Second, true, func(ctx context.Context) error {
+		keys = keys[:0]
+		for lobj := range c.minioClient.ListObjects(ctx, bucketName, minio.ListObjectsOptions{WithMetadata: true}) {
+			if lobj.Err != nil {
+				if isTransient(lobj.Err) {
+					return lobj.Err
+				}
+				c.log.Warnf("failed to list object from minio bucket %s. err: %v", bucketName, lobj.Err)
+				continue
+			}
+			keys = append(keys, lobj.Key)
 		}
-		object, err := c.minioClient.GetObject(ctx, bucketName, lobj.Key, minio.GetObjectOptions{})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects from minio bucket %s. err: %w", bucketName, err)
+	}
+	files := make([]*minio.Object, 0, len(keys))
+	for _, key := range keys {
+		object, err := c.minioClient.GetObject(ctx, bucketName, key, minio.GetObjectOptions{})
 		if err != nil {
-			c.log.Warnf("failed to get object key=%s from minio bucket %s. err: %v", lobj.Key, bucketName, lobj.Err)
+			c.log.Warnf("failed to get object key=%s from minio bucket %s. err: %v", key, bucketName, err)
 			continue
 		}
 		files = append(files, object)
@@ -73,34 +141,239 @@ func (c *Client) GetBucketFiles(ctx context.Context, bucketName string) ([]*mini
 	return files, nil
 }
 
-func (c *Client) UploadFile(ctx context.Context, fileID, fileName, bucketName string, fileSize int64, reader io.Reader) error {
-	reqCtx, cancel := context.WithTimeout(ctx, uploadTimeoutSeconds*time.Second)
-	defer cancel()
+// UploadFile stores an object. The upload is retried only if the reader can be rewound.
+func (c *Client) UploadFile(ctx context.Context, fileID, bucketName, contentType string, metadata map[string]string,
+	fileSize int64, reader io.Reader,
+) error {
+	if err := c.ensureBucket(ctx, bucketName); err != nil {
+		return err
+	}
+	c.log.Debugf("put new object %s to bucket %s", fileID, bucketName)
+	seeker, rewindable := reader.(io.Seeker)
+	err := c.do(ctx, "put", uploadTimeoutSeconds*time.Second, rewindable, func(ctx context.Context) error {
+		if rewindable {
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		_, err := c.minioClient.PutObject(ctx, bucketName, fileID, reader, fileSize,
+			minio.PutObjectOptions{
+				UserMetadata: metadata,
+				ContentType:  contentType,
+			})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload file. err: %w", err)
+	}
+	return nil
+}
 
-	exists, errBucketExists := c.minioClient.BucketExists(ctx, bucketName)
-	if errBucketExists != nil || !exists {
-		c.log.Warnf("no bucket %s. creating new one...", bucketName)
-		err := c.minioClient.MakeBucket(ctx, bucketName, minio.MakeBucketOptions{})
+// CopyFile copies an object to another bucket under the same id, keeping its metadata.
+func (c *Client) CopyFile(ctx context.Context, srcBucket, fileID, dstBucket string) error {
+	if err := c.ensureBucket(ctx, dstBucket); err != nil {
+		return err
+	}
+	err := c.do(ctx, "copy", uploadTimeoutSeconds*time.Second, true, func(ctx context.Context) error {
+		_, err := c.minioClient.CopyObject(ctx,
+			minio.CopyDestOptions{Bucket: dstBucket, Object: fileID},
+			minio.CopySrcOptions{Bucket: srcBucket, Object: fileID},
+		)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to copy file %s from bucket %s to %s. err: %w", fileID, srcBucket, dstBucket, wrapErr(err))
+	}
+	return nil
+}
+
+// UpdateMetadata replaces the user metadata of an object in place without touching its contents.
+func (c *Client) UpdateMetadata(ctx context.Context, bucketName, fileID, contentType string, metadata map[string]string) error {
+	userMetadata := make(map[string]string, len(metadata)+1)
+	for k, v := range metadata {
+		userMetadata[k] = v
+	}
+	userMetadata["Content-Type"] = contentType
+	err := c.do(ctx, "update_metadata", uploadTimeoutSeconds*time.Second, true, func(ctx context.Context) error {
+		_, err := c.minioClient.CopyObject(ctx,
+			minio.CopyDestOptions{Bucket: bucketName, Object: fileID, UserMetadata: userMetadata, ReplaceMetadata: true},
+			minio.CopySrcOptions{Bucket: bucketName, Object: fileID},
+		)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update metadata of file %s in bucket %s. err: %w", fileID, bucketName, wrapErr(err))
+	}
+	return nil
+}
+
+func (c *Client) GetTags(ctx context.Context, bucketName, fileID string) (map[string]string, error) {
+	var objectTags *tags.Tags
+	err := c.do(ctx, "get_tags", getTimeoutSeconds*time.Second, true, func(ctx context.Context) error {
+		var err error
+		objectTags, err = c.minioClient.GetObjectTagging(ctx, bucketName, fileID, minio.GetObjectTaggingOptions{})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tags of file %s in bucket %s. err: %w", fileID, bucketName, wrapErr(err))
+	}
+	return objectTags.ToMap(), nil
+}
+
+// PutTags replaces all object tags, an empty map removes them.
+func (c *Client) PutTags(ctx context.Context, bucketName, fileID string, tagMap map[string]string) error {
+	if len(tagMap) == 0 {
+		err := c.do(ctx, "remove_tags", uploadTimeoutSeconds*time.Second, true, func(ctx context.Context) error {
+			return c.minioClient.RemoveObjectTagging(ctx, bucketName, fileID, minio.RemoveObjectTaggingOptions{})
+		})
 		if err != nil {
-			return fmt.Errorf("failed to create new bucket. err: %w", err)
+			return fmt.Errorf("failed to remove tags of file %s in bucket %s. err: %w", fileID, bucketName, wrapErr(err))
 		}
+		return nil
 	}
-	c.log.Debugf("put new object %s to bucket %s", fileName, bucketName)
-	_, err := c.minioClient.PutObject(reqCtx, bucketName, fileID, reader, fileSize,
-		minio.PutObjectOptions{
-			UserMetadata: map[string]string{"Name": fileName},
-			ContentType:  "application/octet-stream",
-		})
+	objectTags, err := tags.MapToObjectTags(tagMap)
 	if err != nil {
-		return fmt.Errorf("failed to upload file. err: %w", err)
+		return fmt.Errorf("%w: %v", ErrInvalidTags, err)
+	}
+	err = c.do(ctx, "put_tags", uploadTimeoutSeconds*time.Second, true, func(ctx context.Context) error {
+		return c.minioClient.PutObjectTagging(ctx, bucketName, fileID, objectTags, minio.PutObjectTaggingOptions{})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put tags of file %s in bucket %s. err: %w", fileID, bucketName, wrapErr(err))
+	}
+	return nil
+}
+
+func (c *Client) ensureBucket(ctx context.Context, bucketName string) error {
+	var exists bool
+	err := c.do(ctx, "bucket_exists", getTimeoutSeconds*time.Second, true, func(ctx context.Context) error {
+		var err error
+		exists, err = c.minioClient.BucketExists(ctx, bucketName)
+		return err
+	})
+	if err != nil && errors.Is(err, ErrUnavailable) {
+		return err
+	}
+	if err != nil || !exists {
+		c.log.Warnf("no bucket %s. creating new one...", bucketName)
+		err = c.do(ctx, "make_bucket", getTimeoutSeconds*time.Second, false, func(ctx context.Context) error {
+			return c.minioClient.MakeBucket(ctx, bucketName, minio.MakeBucketOptions{ObjectLocking: c.locking})
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create new bucket. err: %w", err)
+		}
 	}
 	return nil
 }
 
 func (c *Client) DeleteFile(ctx context.Context, noteUUID, fileName string) error {
-	err := c.minioClient.RemoveObject(ctx, noteUUID, fileName, minio.RemoveObjectOptions{})
+	err := c.do(ctx, "delete", uploadTimeoutSeconds*time.Second, true, func(ctx context.Context) error {
+		return c.minioClient.RemoveObject(ctx, noteUUID, fileName, minio.RemoveObjectOptions{})
+	})
 	if err != nil {
 		return fmt.Errorf("failed to delete file. err: %w", err)
 	}
 	return nil
 }
+
+// OpenFile returns a streaming reader for the object along with its info.
+// The reader is bound to ctx and must be closed by the caller. Only opening is retried,
+// a failure while streaming is returned by the reader.
+func (c *Client) OpenFile(ctx context.Context, bucketName, fileID string) (io.ReadCloser, *Object, error) {
+	var (
+		obj  *minio.Object
+		info minio.ObjectInfo
+	)
+	err := c.do(ctx, "open", 0, true, func(context.Context) error {
+		var err error
+		if obj, err = c.minioClient.GetObject(ctx, bucketName, fileID, minio.GetObjectOptions{}); err != nil {
+			return err
+		}
+		if info, err = obj.Stat(); err != nil {
+			_ = obj.Close()
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open file with id: %s from minio bucket %s. err: %w", fileID, bucketName, wrapErr(err))
+	}
+	return obj, newObject(info), nil
+}
+
+func (c *Client) StatFile(ctx context.Context, bucketName, fileID string) (*Object, error) {
+	var info minio.ObjectInfo
+	err := c.do(ctx, "stat", getTimeoutSeconds*time.Second, true, func(ctx context.Context) error {
+		var err error
+		info, err = c.minioClient.StatObject(ctx, bucketName, fileID, minio.StatObjectOptions{})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat file with id: %s from minio bucket %s. err: %w", fileID, bucketName, wrapErr(err))
+	}
+	return newObject(info), nil
+}
+
+// ListFiles returns info with user metadata for every object in the bucket without fetching the contents.
+func (c *Client) ListFiles(ctx context.Context, bucketName string) ([]*Object, error) {
+	var objects []*Object
+	err := c.do(ctx, "list", getBucketTimeoutSeconds*time.Second, true, func(ctx context.Context) error {
+		objects = objects[:0]
+		for lobj := range c.minioClient.ListObjects(ctx, bucketName, minio.ListObjectsOptions{}) {
+			if lobj.Err != nil {
+				return lobj.Err
+			}
+			info, err := c.minioClient.StatObject(ctx, bucketName, lobj.Key, minio.StatObjectOptions{})
+			if err != nil {
+				if isTransient(err) {
+					return err
+				}
+				c.log.Warnf("failed to stat object key=%s from minio bucket %s. err: %v", lobj.Key, bucketName, err)
+				continue
+			}
+			objects = append(objects, newObject(info))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects from minio bucket %s. err: %w", bucketName, wrapErr(err))
+	}
+	return objects, nil
+}
+
+// ListBuckets returns the names of all buckets.
+func (c *Client) ListBuckets(ctx context.Context) ([]string, error) {
+	var buckets []minio.BucketInfo
+	err := c.do(ctx, "list_buckets", getBucketTimeoutSeconds*time.Second, true, func(ctx context.Context) error {
+		var err error
+		buckets, err = c.minioClient.ListBuckets(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list minio buckets. err: %w", err)
+	}
+	names := make([]string, 0, len(buckets))
+	for _, bucket := range buckets {
+		names = append(names, bucket.Name)
+	}
+	return names, nil
+}
+
+// RemoveBucket removes a bucket, which fails unless the bucket is empty.
+func (c *Client) RemoveBucket(ctx context.Context, bucketName string) error {
+	err := c.do(ctx, "remove_bucket", getBucketTimeoutSeconds*time.Second, true, func(ctx context.Context) error {
+		return c.minioClient.RemoveBucket(ctx, bucketName)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to remove minio bucket %s. err: %w", bucketName, wrapErr(err))
+	}
+	return nil
+}
+
+func wrapErr(err error) error {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NoSuchBucket":
+		return fmt.Errorf("%v: %w", err, ErrNotFound)
+	}
+	return err
+}
@@ -0,0 +1,53 @@
+package minio
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/lifecycle"
+)
+
+// EnsureExpiryRule adds a lifecycle rule to the bucket that removes objects tagged with tagKey=tagValue
+// after the given number of days. Rules already known to exist are not fetched again.
+func (c *Client) EnsureExpiryRule(ctx context.Context, bucketName, tagKey, tagValue string, days int) error {
+	ruleID := fmt.Sprintf("%s-%s", tagKey, tagValue)
+	c.rulesMu.Lock()
+	defer c.rulesMu.Unlock()
+	if _, ok := c.rules[bucketName+"/"+ruleID]; ok {
+		return nil
+	}
+	var config *lifecycle.Configuration
+	err := c.do(ctx, "get_lifecycle", getTimeoutSeconds*time.Second, true, func(ctx context.Context) error {
+		var err error
+		config, err = c.minioClient.GetBucketLifecycle(ctx, bucketName)
+		if minio.ToErrorResponse(err).Code == "NoSuchLifecycleConfiguration" {
+			config, err = lifecycle.NewConfiguration(), nil
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get lifecycle of bucket %s. err: %w", bucketName, wrapErr(err))
+	}
+	for _, rule := range config.Rules {
+		if rule.ID == ruleID {
+			c.rules[bucketName+"/"+ruleID] = struct{}{}
+			return nil
+		}
+	}
+	config.Rules = append(config.Rules, lifecycle.Rule{
+		ID:         ruleID,
+		Status:     "Enabled",
+		RuleFilter: lifecycle.Filter{Tag: lifecycle.Tag{Key: tagKey, Value: tagValue}},
+		Expiration: lifecycle.Expiration{Days: lifecycle.ExpirationDays(days)},
+	})
+	err = c.do(ctx, "set_lifecycle", uploadTimeoutSeconds*time.Second, true, func(ctx context.Context) error {
+		return c.minioClient.SetBucketLifecycle(ctx, bucketName, config)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set lifecycle of bucket %s. err: %w", bucketName, wrapErr(err))
+	}
+	c.rules[bucketName+"/"+ruleID] = struct{}{}
+	return nil
+}
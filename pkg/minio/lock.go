@@ -0,0 +1,51 @@
+package minio
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// WithObjectLocking creates new buckets with object locking enabled, which the retention
+// and legal hold of objects need. Buckets created before keep deleting objects freely.
+//
+// Buckets with object locking are versioned, so the lock protects the locked version only:
+// removing the object adds a delete marker and putting it again adds a new version without
+// the lock, both of which readers see. The locked version stays in the bucket to be restored,
+// keeping the current one from changing is up to the service.
+func WithObjectLocking() Option {
+	return func(c *Client) {
+		c.locking = true
+	}
+}
+
+// SetRetention keeps an object from being deleted or overwritten until the given time in the compliance mode,
+// so the retention can be extended but not shortened.
+func (c *Client) SetRetention(ctx context.Context, bucketName, fileID string, until time.Time) error {
+	mode := minio.Compliance
+	err := c.do(ctx, "put_retention", uploadTimeoutSeconds*time.Second, true, func(ctx context.Context) error {
+		return c.minioClient.PutObjectRetention(ctx, bucketName, fileID,
+			minio.PutObjectRetentionOptions{Mode: &mode, RetainUntilDate: &until})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set retention of file %s in bucket %s. err: %w", fileID, bucketName, wrapErr(err))
+	}
+	return nil
+}
+
+// SetLegalHold places or releases a legal hold on an object.
+func (c *Client) SetLegalHold(ctx context.Context, bucketName, fileID string, hold bool) error {
+	status := minio.LegalHoldDisabled
+	if hold {
+		status = minio.LegalHoldEnabled
+	}
+	err := c.do(ctx, "put_legal_hold", uploadTimeoutSeconds*time.Second, true, func(ctx context.Context) error {
+		return c.minioClient.PutObjectLegalHold(ctx, bucketName, fileID, minio.PutObjectLegalHoldOptions{Status: &status})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set legal hold of file %s in bucket %s. err: %w", fileID, bucketName, wrapErr(err))
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+package minio
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gerladeno/media-storage-service/pkg/metrics"
+	"github.com/minio/minio-go/v7"
+)
+
+const (
+	defaultRetries          = 3
+	defaultBackoff          = 100 * time.Millisecond
+	maxBackoff              = 2 * time.Second
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+const (
+	BreakerClosed   = "closed"
+	BreakerHalfOpen = "half-open"
+	BreakerOpen     = "open"
+)
+
+func init() {
+	// calls are retried by Client.do, so the breaker sees every failure and backoffs don't compound
+	minio.MaxRetry = 1
+}
+
+// ErrUnavailable is returned without calling the backend while its circuit breaker is open.
+var ErrUnavailable = errors.New("err storage unavailable")
+
+type UnavailableError struct {
+	Endpoint   string
+	RetryAfter time.Duration
+}
+
+func (e *UnavailableError) Error() string {
+	return fmt.Sprintf("storage %s is unavailable, retry after %s", e.Endpoint, e.RetryAfter)
+}
+
+func (e *UnavailableError) Unwrap() error {
+	return ErrUnavailable
+}
+
+type Option func(*Client)
+
+// WithRetries sets how many times idempotent calls are retried and the initial backoff between them.
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.retries, c.backoff = retries, backoff
+	}
+}
+
+// WithBreaker opens the circuit after threshold consecutive transient failures
+// and lets a probe call through after cooldown.
+func WithBreaker(threshold int, cooldown time.Duration) Option {
+	return func(c *Client) {
+		c.breaker.threshold, c.breaker.cooldown = threshold, cooldown
+	}
+}
+
+func WithMetrics(collector *metrics.Backend) Option {
+	return func(c *Client) {
+		c.collector = collector
+	}
+}
+
+// do runs an operation through the circuit breaker, giving every attempt its own timeout.
+// Transient failures of idempotent operations are retried with jittered exponential backoff.
+func (c *Client) do(ctx context.Context, op string, timeout time.Duration, idempotent bool, fn func(ctx context.Context) error) error {
+	attempts := 1
+	if idempotent {
+		attempts += c.retries
+	}
+	delay := c.backoff
+	for attempt := 1; ; attempt++ {
+		if err := c.breaker.allow(); err != nil {
+			if c.collector != nil {
+				c.collector.RejectedTotal.WithLabelValues(c.endpoint).Inc()
+			}
+			return err
+		}
+		err := c.attempt(ctx, timeout, fn)
+		if ctx.Err() != nil {
+			// an abandoned call tells nothing about the backend
+			c.breaker.release()
+			return err
+		}
+		transient := err != nil && isTransient(err)
+		c.breaker.record(!transient)
+		if !transient || attempt == attempts {
+			return err
+		}
+		c.log.Debugf("retrying %s after a transient failure. err: %v", op, err)
+		if c.collector != nil {
+			c.collector.RetriesTotal.WithLabelValues(c.endpoint, op).Inc()
+		}
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay))) //nolint:gosec
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		if delay *= 2; delay > maxBackoff {
+			delay = maxBackoff
+		}
+	}
+}
+
+func (c *Client) attempt(ctx context.Context, timeout time.Duration, fn func(ctx context.Context) error) error {
+	if timeout <= 0 {
+		return fn(ctx)
+	}
+	reqCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return fn(reqCtx)
+}
+
+// BreakerState returns the state of the circuit breaker of the endpoint.
+func (c *Client) BreakerState() string {
+	return c.breaker.current()
+}
+
+// Health returns an UnavailableError while the circuit breaker is open.
+func (c *Client) Health() error {
+	return c.breaker.check()
+}
+
+// isTransient reports whether a failure is likely to go away on retry.
+func isTransient(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	resp := minio.ToErrorResponse(err)
+	switch {
+	case resp.StatusCode >= http.StatusInternalServerError, resp.StatusCode == http.StatusTooManyRequests:
+		return true
+	case resp.Code == "SlowDown", resp.Code == "RequestTimeout", resp.Code == "InternalError":
+		return true
+	}
+	return false
+}
+
+// breaker is a circuit breaker: after threshold consecutive failures it opens and rejects
+// calls for cooldown, then lets a single probe through whose outcome closes or reopens it.
+type breaker struct {
+	endpoint  string
+	threshold int
+	cooldown  time.Duration
+	onChange  func(state string)
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newBreaker(endpoint string) *breaker {
+	return &breaker{
+		endpoint:  endpoint,
+		threshold: defaultBreakerThreshold,
+		cooldown:  defaultBreakerCooldown,
+		state:     BreakerClosed,
+	}
+}
+
+func (b *breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if wait := b.cooldown - time.Since(b.openedAt); wait > 0 {
+			return &UnavailableError{Endpoint: b.endpoint, RetryAfter: wait}
+		}
+		b.setState(BreakerHalfOpen)
+		b.probing = true
+	case BreakerHalfOpen:
+		if b.probing {
+			return &UnavailableError{Endpoint: b.endpoint, RetryAfter: time.Second}
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+func (b *breaker) record(ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerClosed:
+		if ok {
+			b.failures = 0
+			return
+		}
+		if b.failures++; b.failures >= b.threshold {
+			b.open()
+		}
+	case BreakerHalfOpen:
+		b.probing = false
+		if ok {
+			b.failures = 0
+			b.setState(BreakerClosed)
+			return
+		}
+		b.open()
+	}
+}
+
+// release ends a probe without an outcome, so another call can probe.
+func (b *breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+func (b *breaker) open() {
+	b.openedAt = time.Now()
+	b.setState(BreakerOpen)
+}
+
+func (b *breaker) setState(state string) {
+	if b.state == state {
+		return
+	}
+	b.state = state
+	if b.onChange != nil {
+		b.onChange(state)
+	}
+}
+
+func (b *breaker) current() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *breaker) check() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != BreakerOpen {
+		return nil
+	}
+	wait := b.cooldown - time.Since(b.openedAt)
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return &UnavailableError{Endpoint: b.endpoint, RetryAfter: wait}
+}